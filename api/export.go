@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"gorepository/repository"
+)
+
+// ExportRecord is one line of a JSON-lines export: a user, and the cursor
+// to resume the export from after them.
+type ExportRecord struct {
+	Cursor string           `json:"cursor"`
+	User   *repository.User `json:"user"`
+}
+
+// exportWriter writes users in one export format.
+type exportWriter interface {
+	// header is called once, before any users.
+	header(fields []string) error
+	user(cursor string, user *repository.User) error
+	flush() error
+}
+
+// exportUsers streams every user as JSON lines, or as CSV with
+// ?format=csv, starting after ?cursor= if set. Users are written as they
+// are read, so the response starts straight away and a slow client holds
+// up the reads rather than the server buffering for it. Every record
+// carries the cursor to resume from after it.
+//
+// Errors before the first record get an error response. After that the
+// status has been sent, so the connection is dropped instead, and the
+// client sees a truncated stream.
+func (s *Server) exportUsers(w http.ResponseWriter, r *http.Request) {
+	opts := findOptions(r)
+	fields, err := repository.FieldNames(opts...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	var out exportWriter
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "jsonl":
+		w.Header().Set("Content-Type", "application/jsonl")
+		out = &jsonLinesWriter{enc: json.NewEncoder(w)}
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		out = &csvWriter{w: csv.NewWriter(w)}
+	default:
+		writeError(w, http.StatusBadRequest, "format must be jsonl or csv")
+		return
+	}
+
+	started := false
+	start := func() error {
+		started = true
+		w.WriteHeader(http.StatusOK)
+		return out.header(fields)
+	}
+	err = s.users(r).ExportUsers(r.URL.Query().Get("cursor"), func(user *repository.User) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		return out.user(repository.CursorAfter(user.ID), user)
+	}, opts...)
+	if err == nil && !started {
+		err = start()
+	}
+	if err == nil {
+		err = out.flush()
+	}
+
+	switch {
+	case err == nil:
+	case !started:
+		w.Header().Del("Content-Type")
+		writeServiceError(w, err)
+	default:
+		// net/http closes the connection for this panic
+		log.Printf("api: export stopped: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+type jsonLinesWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonLinesWriter) header(fields []string) error { return nil }
+
+func (j *jsonLinesWriter) user(cursor string, user *repository.User) error {
+	return j.enc.Encode(ExportRecord{Cursor: cursor, User: user})
+}
+
+func (j *jsonLinesWriter) flush() error { return nil }
+
+// csvWriter writes a column for each field, after one for the cursor.
+// Values are as they would be in JSON, with strings unquoted and null or
+// missing values left empty.
+type csvWriter struct {
+	w      *csv.Writer
+	fields []string
+}
+
+func (c *csvWriter) header(fields []string) error {
+	c.fields = fields
+	return c.w.Write(append([]string{"cursor"}, fields...))
+}
+
+func (c *csvWriter) user(cursor string, user *repository.User) error {
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &values); err != nil {
+		return err
+	}
+
+	record := make([]string, 0, len(c.fields)+1)
+	record = append(record, cursor)
+	for _, field := range c.fields {
+		record = append(record, csvValue(values[field]))
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvValue(raw json.RawMessage) string {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
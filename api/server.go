@@ -0,0 +1,768 @@
+// Package api serves UserService over HTTP as JSON.
+//
+// Routes:
+//
+//	GET  /users         a page of users, by ID; with ?status=suspended, only
+//	                    those with that status
+//	GET  /users/export  every user as JSON lines, or CSV with ?format=csv,
+//	                    streamed as they are read; each record has a cursor
+//	                    to resume from with ?cursor=
+//	GET  /users/{id}    the user, or 404; with ?as_of=<RFC 3339 time>, the
+//	                    user as they were then
+//	GET  /users/history/{id}
+//	                    the user's past versions, oldest first
+//	GET  /users/by-email/{email}
+//	                    the user with that email, or 404
+//	GET  /users/by-phone/{phone}
+//	                    the user with that phone number, or 404
+//	GET  /users/by-metadata?key=plan&value="pro"
+//	                    a page of the users whose metadata has that key set
+//	                    to that JSON value, by ID
+//	GET  /users/by-ids?ids=1,2,3
+//	                    the users that exist out of those
+//	GET  /users/search?prefix=jo
+//	                    users whose name starts with that, by name
+//	GET  /users/suggest?q=jhon
+//	                    users whose name is close to that, closest first
+//	POST /users         create one user; responds with it, ID set
+//	POST /users/batch   create many users; responds with them, IDs set
+//	PUT  /users/{id}    update the user; 204
+//	POST /users/{id}/rollback?to=<RFC 3339 time>
+//	                    undo the user's changes since then; responds with
+//	                    the restored user
+//	POST /users/{id}/logins
+//	                    record that the user has logged in; 204
+//	POST /users/{id}/anonymize
+//	                    irreversibly scrub the user's personal data; 204
+//	POST /users/{id}/deactivate
+//	                    close the user's account for good; 204, or 409 if
+//	                    it already is
+//	DELETE /users/{id}  delete the user; 204
+//	GET  /stats/users   signups per day, active users and users per email
+//	                    domain, as a stats.Report; only when the server
+//	                    has a Stats reporter
+//
+// Admin routes, which need the admin token:
+//
+//	POST   /admin/users/{id}/restore
+//	                    bring back a deleted user; responds with them, or
+//	                    409 if they haven't been deleted
+//	DELETE /admin/users/{id}
+//	                    purge the user and their history for good; 204
+//	POST   /admin/users/{id}/suspend
+//	POST   /admin/users/{id}/activate
+//	                    suspend or activate the user; 204, or 409 if their
+//	                    status doesn't allow it
+//	GET    /admin/read-only
+//	PUT    /admin/read-only
+//	                    read or switch read-only mode, as
+//	                    {"read_only": true}; only when the server has a
+//	                    ReadOnly switch
+//
+// While read-only, requests other than GET and HEAD are refused with 503
+// and a Retry-After header, as are writes that race with the switch.
+//
+// The GET routes take an optional ?fields=id,name to return only those
+// fields; the rest come back empty. The search routes also take ?limit=n,
+// up to MaxSearchLimit.
+//
+// Lists are returned in a repository.Page: {"items": [...], "total": n,
+// "page_size": n, "next": "...", "prev": "..."}. The paged routes take
+// ?limit=n, up to repository.MaxPageSize, and ?cursor= set to the next or
+// prev of a page to get the one after or before it. Those cursors are also
+// sent as a Link header. The other lists are a single page.
+//
+// Errors are returned as {"error": "..."}.
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorepository/repository"
+	"gorepository/service"
+	"gorepository/stats"
+)
+
+// MaxSearchLimit is the most users a search route returns at once.
+const MaxSearchLimit = 100
+
+// ReadOnlyRetryAfter is how long clients refused during read-only mode are
+// told to wait before retrying.
+const ReadOnlyRetryAfter = time.Minute
+
+// ReadOnlySwitch turns read-only mode on and off, as
+// repository.ReadOnlyUserRepository does.
+type ReadOnlySwitch interface {
+	ReadOnly() bool
+	SetReadOnly(readOnly bool)
+}
+
+// Server routes HTTP requests to a UserService.
+type Server struct {
+	Users *service.UserService
+	// Token, when set, must be sent by clients as "Authorization: Bearer <Token>".
+	Token string
+	// TokenFunc, when set, is used instead of Token and called for each
+	// request, so the token can be rotated while the server runs.
+	TokenFunc func() string
+	// AdminToken must be sent instead of Token for the admin routes, which
+	// are refused while it is unset. AdminTokenFunc overrides it as
+	// TokenFunc does Token.
+	AdminToken     string
+	AdminTokenFunc func() string
+	// ReadOnly, when set, is switched by the admin read-only route, and
+	// writes are refused while it is on.
+	ReadOnly ReadOnlySwitch
+	// Stats, when set, serves the user statistics route.
+	Stats *stats.Reporter
+}
+
+func NewServer(users *service.UserService, token string) *Server {
+	return &Server{Users: users, Token: token}
+}
+
+// Handler returns the server's routes, behind authentication when a Token
+// is set. The admin routes always need the admin token. Each request finds
+// users by ID through an identity map of its own.
+func (s *Server) Handler() http.Handler {
+	admin := http.NewServeMux()
+	admin.HandleFunc("POST /admin/users/{id}/restore", s.restoreUser)
+	admin.HandleFunc("DELETE /admin/users/{id}", s.purgeUser)
+	admin.HandleFunc("POST /admin/users/{id}/suspend", s.suspendUser)
+	admin.HandleFunc("POST /admin/users/{id}/activate", s.activateUser)
+	if s.ReadOnly != nil {
+		admin.HandleFunc("GET /admin/read-only", s.getReadOnly)
+		admin.HandleFunc("PUT /admin/read-only", s.setReadOnly)
+	}
+
+	adminRoutes := s.authenticate(s.refuseWritesWhileReadOnly(admin), s.adminToken)
+
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", adminRoutes)
+	mux.HandleFunc("GET /users", s.listUsers)
+	mux.HandleFunc("GET /users/export", s.exportUsers)
+	mux.HandleFunc("GET /users/{id}", s.getUser)
+	mux.HandleFunc("GET /users/by-email/{email}", s.getUserByEmail)
+	mux.HandleFunc("GET /users/history/{id}", s.getUserHistory)
+	mux.HandleFunc("GET /users/by-phone/{phone}", s.getUserByPhone)
+	mux.HandleFunc("GET /users/by-metadata", s.getUsersByMetadata)
+	mux.HandleFunc("GET /users/by-ids", s.getUsersByIDs)
+	mux.HandleFunc("GET /users/search", s.searchUsers)
+	mux.HandleFunc("GET /users/suggest", s.suggestUsers)
+	mux.HandleFunc("POST /users", s.createUser)
+	mux.HandleFunc("POST /users/batch", s.createUsers)
+	mux.HandleFunc("PUT /users/{id}", s.updateUser)
+	mux.HandleFunc("POST /users/{id}/rollback", s.rollbackUser)
+	mux.HandleFunc("POST /users/{id}/logins", s.recordLogin)
+	mux.HandleFunc("POST /users/{id}/anonymize", s.anonymizeUser)
+	mux.HandleFunc("POST /users/{id}/deactivate", s.deactivateUser)
+	mux.HandleFunc("DELETE /users/{id}", s.deleteUser)
+	if s.Stats != nil {
+		mux.HandleFunc("GET /stats/users", s.getUserStats)
+	}
+	users := s.refuseWritesWhileReadOnly(mux)
+
+	if s.Token == "" && s.TokenFunc == nil {
+		return withIdentityMap(users)
+	}
+
+	// Admin clients send only the admin token
+	root := http.NewServeMux()
+	root.Handle("/admin/", adminRoutes)
+	root.Handle("/", s.authenticate(users, s.token))
+	return withIdentityMap(root)
+}
+
+// refuseWritesWhileReadOnly answers requests that could write with 503
+// while the server is read-only, sparing them a trip to the repository.
+// Switching read-only mode itself is always let through.
+func (s *Server) refuseWritesWhileReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write := r.Method != http.MethodGet && r.Method != http.MethodHead
+		if write && s.ReadOnly != nil && s.ReadOnly.ReadOnly() && r.URL.Path != "/admin/read-only" {
+			writeServiceError(w, repository.ErrReadOnly)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withIdentityMap gives each request its own repository.IdentityMap, so a
+// handler finding the same user more than once reads them only once.
+func withIdentityMap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(repository.WithIdentityMap(r.Context())))
+	})
+}
+
+// users returns the service scoped to r; see service.UserService.WithContext.
+func (s *Server) users(r *http.Request) *service.UserService {
+	return s.Users.WithContext(r.Context())
+}
+
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	size, err := pageSize(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cursor := r.URL.Query().Get("cursor")
+
+	var page repository.Page[*repository.User]
+	if status := r.URL.Query().Get("status"); status != "" {
+		var parsed repository.Status
+		if parsed, err = repository.ParseStatus(status); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		page, err = s.users(r).GetUsersByStatus(parsed, cursor, size, findOptions(r)...)
+	} else {
+		page, err = s.users(r).ListUsers(cursor, size, findOptions(r)...)
+	}
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writePage(w, r, page)
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	var user *repository.User
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		at, err := time.Parse(time.RFC3339Nano, asOf)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid as_of time")
+			return
+		}
+		user, err = s.users(r).GetUserAsOf(id, at)
+	} else {
+		user, err = s.users(r).GetUser(id, findOptions(r)...)
+	}
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) getUserHistory(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	history, err := s.users(r).GetUserHistory(id)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, history)
+}
+
+func (s *Server) getUserByEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := s.users(r).GetUserByEmail(r.PathValue("email"), findOptions(r)...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) getUserByPhone(w http.ResponseWriter, r *http.Request) {
+	user, err := s.users(r).GetUserByPhone(r.PathValue("phone"), findOptions(r)...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) getUsersByMetadata(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" {
+		writeError(w, http.StatusBadRequest, "missing metadata key")
+		return
+	}
+	var value any
+	if err := json.Unmarshal([]byte(query.Get("value")), &value); err != nil {
+		writeError(w, http.StatusBadRequest, "metadata value must be JSON")
+		return
+	}
+
+	size, err := pageSize(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	page, err := s.users(r).GetUsersByMetadata(key, value, query.Get("cursor"), size, findOptions(r)...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writePage(w, r, page)
+}
+
+func (s *Server) getUsersByIDs(w http.ResponseWriter, r *http.Request) {
+	var ids []int
+	for _, field := range strings.Split(r.URL.Query().Get("ids"), ",") {
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid user id")
+			return
+		}
+		ids = append(ids, id)
+	}
+
+	found, err := s.users(r).GetUsers(ids, findOptions(r)...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+
+	// Respond in the order asked for, which a map can't keep
+	users := make([]*repository.User, 0, len(found))
+	for _, id := range ids {
+		if user, ok := found[id]; ok {
+			users = append(users, user)
+			delete(found, id)
+		}
+	}
+	writeJSON(w, http.StatusOK, repository.NewPage(users))
+}
+
+func (s *Server) searchUsers(w http.ResponseWriter, r *http.Request) {
+	opts, err := searchOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := s.users(r).SearchUsers(r.URL.Query().Get("prefix"), opts...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *Server) suggestUsers(w http.ResponseWriter, r *http.Request) {
+	opts, err := searchOptions(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	page, err := s.users(r).SuggestUsers(r.URL.Query().Get("q"), opts...)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// newUser is what a client may give for a user it creates. The rest, such
+// as the status, login activity and creation time, is left for the
+// repository to set.
+type newUser struct {
+	Name       string              `json:"name"`
+	Email      string              `json:"email"`
+	VerifiedAt *time.Time          `json:"verified_at,omitempty"`
+	Phone      *string             `json:"phone,omitempty"`
+	Metadata   repository.Metadata `json:"metadata,omitempty"`
+}
+
+func (u newUser) user() *repository.User {
+	return &repository.User{Name: u.Name, Email: u.Email, VerifiedAt: u.VerifiedAt, Phone: u.Phone, Metadata: u.Metadata}
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var body newUser
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user: "+err.Error())
+		return
+	}
+
+	user := body.user()
+	if err := s.users(r).CreateUser(user); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, user)
+}
+
+func (s *Server) createUsers(w http.ResponseWriter, r *http.Request) {
+	var body []newUser
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid users: "+err.Error())
+		return
+	}
+
+	users := make([]*repository.User, len(body))
+	for i, u := range body {
+		users[i] = u.user()
+	}
+	if err := s.users(r).CreateUsers(users); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, users)
+}
+
+// userUpdate is what a client may change about a user with PUT, replacing
+// what they had. The status and login activity change through their own
+// routes, and the ID and creation time not at all.
+type userUpdate struct {
+	Name       string              `json:"name"`
+	Email      string              `json:"email"`
+	VerifiedAt *time.Time          `json:"verified_at,omitempty"`
+	Phone      *string             `json:"phone,omitempty"`
+	Metadata   repository.Metadata `json:"metadata,omitempty"`
+}
+
+func (u userUpdate) user(id int) *repository.User {
+	return &repository.User{ID: id, Name: u.Name, Email: u.Email, VerifiedAt: u.VerifiedAt, Phone: u.Phone, Metadata: u.Metadata}
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	var body userUpdate
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user: "+err.Error())
+		return
+	}
+
+	if err := s.users(r).UpdateUser(body.user(id)); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) rollbackUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	to, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("to"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid rollback time")
+		return
+	}
+
+	user, err := s.users(r).RollbackUser(id, to)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) recordLogin(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).RecordLogin(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) suspendUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).SuspendUser(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) activateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).ActivateUser(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deactivateUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).DeactivateUser(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) anonymizeUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).AnonymizeUser(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).DeleteUser(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) restoreUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	user, err := s.users(r).RestoreUser(id)
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, user)
+}
+
+func (s *Server) purgeUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid user id")
+		return
+	}
+
+	if err := s.users(r).PurgeUser(id); err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// readOnlyMode is the body of the admin read-only route.
+type readOnlyMode struct {
+	ReadOnly *bool `json:"read_only"`
+}
+
+func (s *Server) getUserStats(w http.ResponseWriter, r *http.Request) {
+	report, err := s.Stats.Users()
+	if err != nil {
+		writeServiceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) getReadOnly(w http.ResponseWriter, r *http.Request) {
+	readOnly := s.ReadOnly.ReadOnly()
+	writeJSON(w, http.StatusOK, readOnlyMode{ReadOnly: &readOnly})
+}
+
+func (s *Server) setReadOnly(w http.ResponseWriter, r *http.Request) {
+	var mode readOnlyMode
+	if err := json.NewDecoder(r.Body).Decode(&mode); err != nil || mode.ReadOnly == nil {
+		writeError(w, http.StatusBadRequest, `body must be {"read_only": true} or false`)
+		return
+	}
+
+	s.ReadOnly.SetReadOnly(*mode.ReadOnly)
+	log.Printf("api: read-only mode set to %t", *mode.ReadOnly)
+	writeJSON(w, http.StatusOK, mode)
+}
+
+// authenticate lets through requests bearing the token returned by want.
+func (s *Server) authenticate(next http.Handler, want func() string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		want := want()
+		if !ok || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// token returns the token clients must send.
+func (s *Server) token() string {
+	if s.TokenFunc != nil {
+		return s.TokenFunc()
+	}
+	return s.Token
+}
+
+// adminToken returns the token the admin routes need.
+func (s *Server) adminToken() string {
+	if s.AdminTokenFunc != nil {
+		return s.AdminTokenFunc()
+	}
+	return s.AdminToken
+}
+
+// findOptions reads the find options a request asks for.
+func findOptions(r *http.Request) []repository.FindOption {
+	fields := r.URL.Query().Get("fields")
+	if fields == "" {
+		return nil
+	}
+	return []repository.FindOption{repository.Fields(strings.Split(fields, ",")...)}
+}
+
+// searchOptions adds the ?limit= of a search route to its find options.
+func searchOptions(r *http.Request) ([]repository.FindOption, error) {
+	opts := findOptions(r)
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > MaxSearchLimit {
+			return nil, fmt.Errorf("limit must be between 1 and %d", MaxSearchLimit)
+		}
+		opts = append(opts, repository.Limit(n))
+	}
+	return opts, nil
+}
+
+// pageSize reads the ?limit= of a paged route, or 0 for the default.
+func pageSize(r *http.Request) (int, error) {
+	limit := r.URL.Query().Get("limit")
+	if limit == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(limit)
+	if err != nil || n < 1 || n > repository.MaxPageSize {
+		return 0, fmt.Errorf("limit must be between 1 and %d", repository.MaxPageSize)
+	}
+	return n, nil
+}
+
+// writePage responds with page, linking to the pages either side of it.
+func writePage(w http.ResponseWriter, r *http.Request, page repository.Page[*repository.User]) {
+	var links []string
+	for _, link := range []struct{ rel, cursor string }{{"next", page.Next}, {"prev", page.Prev}} {
+		if link.cursor == "" {
+			continue
+		}
+		u := *r.URL
+		query := u.Query()
+		query.Set("cursor", link.cursor)
+		u.RawQuery = query.Encode()
+		links = append(links, fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), link.rel))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// writeServiceError maps errors from the service onto status codes. Anything
+// unexpected is logged and reported without detail.
+func writeServiceError(w http.ResponseWriter, err error) {
+	var violation *service.PolicyViolation
+	var remoteErr *repository.RemoteError
+	switch {
+	case errors.As(err, &violation):
+		writePolicyViolation(w, violation)
+	case errors.As(err, &remoteErr) && remoteErr.Rule != "":
+		// Refused by a remote instance's policies; pass its answer on
+		writeJSON(w, remoteErr.StatusCode, map[string]string{"error": remoteErr.Message, "rule": remoteErr.Rule})
+	case errors.Is(err, repository.ErrUserNotFound):
+		writeError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, repository.ErrUserExists), errors.Is(err, repository.ErrStatusChanged),
+		errors.Is(err, service.ErrInvalidTransition):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, repository.ErrUnknownField), errors.Is(err, repository.ErrInvalidMetadata),
+		errors.Is(err, repository.ErrInvalidCursor), errors.Is(err, service.ErrInvalidPhone):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, repository.ErrQueryTimeout):
+		log.Printf("api: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "query timed out")
+	case errors.Is(err, repository.ErrUnavailable):
+		log.Printf("api: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "database unavailable")
+	case errors.Is(err, repository.ErrWriteBehindFull):
+		log.Printf("api: %v", err)
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	case errors.Is(err, repository.ErrReadOnly):
+		w.Header().Set("Retry-After", strconv.Itoa(int(ReadOnlyRetryAfter.Seconds())))
+		writeError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		log.Printf("api: %v", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// writePolicyViolation reports a user refused by a policy, naming the rule
+// so clients can tell them apart: 403 for what the caller may not do, a
+// tenant over its quota or a reserved domain, and 422 for an email address
+// that won't be accepted from anyone.
+func writePolicyViolation(w http.ResponseWriter, violation *service.PolicyViolation) {
+	status := http.StatusUnprocessableEntity
+	if violation.Rule == service.RuleTenantQuota || violation.Rule == service.RuleReservedDomain {
+		status = http.StatusForbidden
+	}
+	writeJSON(w, status, map[string]string{"error": violation.Error(), "rule": string(violation.Rule)})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
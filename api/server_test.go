@@ -0,0 +1,444 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorepository/repository"
+	"gorepository/repository/mocks"
+	"gorepository/service"
+	"gorepository/stats"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(repo repository.UserRepository, token string) http.Handler {
+	return NewServer(&service.UserService{Repo: repo}, token).Handler()
+}
+
+func TestGetUser(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	mockRepo := mocks.NewUserRepo().
+		WithUser(&repository.User{ID: 1, Name: "John Doe", Email: "john.doe@example.com", CreatedAt: createdAt}).
+		Build()
+	handler := newTestServer(mockRepo, "")
+
+	// Test getting an existing user
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"id": 1, "name": "John Doe", "email": "john.doe@example.com", "created_at": "2024-05-01T12:00:00Z"}`, rec.Body.String())
+
+	// Test getting a non-existing user
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/2", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// Test a malformed id
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/abc", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestCreateUser(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().Build()
+	handler := newTestServer(mockRepo, "")
+
+	body := strings.NewReader(`{"name": "Jane Doe", "email": "jane.doe@example.com"}`)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", body))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var user repository.User
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &user))
+	assert.Equal(t, 1, user.ID)
+	assert.Equal(t, "Jane Doe", user.Name)
+	assert.False(t, user.CreatedAt.IsZero())
+}
+
+func TestCreateUserIgnoresServerFields(t *testing.T) {
+	handler := newTestServer(mocks.NewUserRepo().Build(), "")
+	post := func(path, body string, v any) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+
+	// Clients can't create users with a status or login history of their
+	// choosing, nor backdate them
+	forged := `{"name": "Jane Doe", "status": "suspended", "login_count": 7, "last_login_at": "2020-01-01T00:00:00Z", "created_at": "2020-01-01T00:00:00Z"}`
+	var user repository.User
+	var batch []repository.User
+	post("/users", forged, &user)
+	post("/users/batch", "["+forged+"]", &batch)
+
+	for _, user := range append(batch, user) {
+		assert.Equal(t, "Jane Doe", user.Name)
+		assert.Equal(t, repository.StatusActive, user.Status)
+		assert.Zero(t, user.LoginCount)
+		assert.Nil(t, user.LastLoginAt)
+		assert.True(t, user.CreatedAt.After(time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)))
+	}
+}
+
+func TestUpdateUserIgnoresServerFields(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUsers(&repository.User{ID: 1, Name: "Jane Doe", Email: "jane@example.com"}).Build()
+	handler := newTestServer(mockRepo, "")
+
+	// Nor change them, or the ID, with an update
+	forged := `{"id": 2, "name": "Jane Smith", "email": "jane@example.com", "status": "suspended", "login_count": 7, "created_at": "2020-01-01T00:00:00Z"}`
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/users/1", strings.NewReader(forged)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	var updated *repository.User
+	for _, call := range mockRepo.Calls() {
+		if call.Method == "UpdateUser" {
+			updated = call.Args[0].(*repository.User)
+		}
+	}
+	if assert.NotNil(t, updated) {
+		assert.Equal(t, 1, updated.ID)
+		assert.Equal(t, "Jane Smith", updated.Name)
+		assert.Empty(t, updated.Status)
+		assert.Zero(t, updated.LoginCount)
+		assert.True(t, updated.CreatedAt.IsZero())
+	}
+}
+
+func TestCreateUserError(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().FailingOn("SaveUser", errors.New("database is down")).Build()
+	handler := newTestServer(mockRepo, "")
+
+	// Internal errors are not leaked to the client
+	body := strings.NewReader(`{"name": "Jane Doe"}`)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", body))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "database is down")
+}
+
+func TestCreateUserUnavailable(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().
+		FailingOn("SaveUser", fmt.Errorf("%w: no primary among 2 hosts", repository.ErrUnavailable)).
+		Build()
+	handler := newTestServer(mockRepo, "")
+
+	// Clients are told to try again rather than that something broke
+	body := strings.NewReader(`{"name": "Jane Doe"}`)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", body))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.JSONEq(t, `{"error": "database unavailable"}`, rec.Body.String())
+}
+
+func TestCreateUserPolicyViolation(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	users := &service.UserService{Repo: repo, Policies: service.UserPolicies{
+		MaxUsersPerTenant: 1,
+		BlockedDomains:    []string{"mailinator.com"},
+	}}
+	handler := NewServer(users, "").Handler()
+	create := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := create(`{"name": "Jane Doe", "email": "jane@mailinator.com"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"rule":"blocked_domain"`)
+
+	assert.Equal(t, http.StatusCreated, create(`{"name": "Jane Doe", "email": "jane@acme.com", "metadata": {"tenant": "acme"}}`).Code)
+	rec = create(`{"name": "John Doe", "email": "john@acme.com", "metadata": {"tenant": "acme"}}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"rule":"tenant_quota"`)
+}
+
+func TestAnonymizeUser(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1, Name: "John Doe"}).Build()
+	handler := newTestServer(mockRepo, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users/1/anonymize", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	mockRepo.AssertCalled(t, "AnonymizeUser", 1)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users/2/anonymize", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAuthentication(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1}).Build()
+	handler := newTestServer(mockRepo, "secret")
+
+	// No token
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/1", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	// Right token
+	req := httptest.NewRequest("GET", "/users/1", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestAuthenticationRotatedToken(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1}).Build()
+	server := NewServer(&service.UserService{Repo: mockRepo}, "")
+	token := "old"
+	server.TokenFunc = func() string { return token }
+	handler := server.Handler()
+
+	get := func(bearer string) int {
+		req := httptest.NewRequest("GET", "/users/1", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(t, http.StatusOK, get("old"))
+
+	// Once rotated only the new token works
+	token = "new"
+	assert.Equal(t, http.StatusUnauthorized, get("old"))
+	assert.Equal(t, http.StatusOK, get("new"))
+
+	// An unresolved token never matches an empty one
+	token = ""
+	assert.Equal(t, http.StatusUnauthorized, get(""))
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1}).Build()
+	assert.NoError(t, mockRepo.DeleteUser(1))
+	server := NewServer(&service.UserService{Repo: mockRepo}, "secret")
+	server.AdminToken = "admin"
+	handler := server.Handler()
+
+	restore := func(bearer string) int {
+		req := httptest.NewRequest("POST", "/admin/users/1/restore", nil)
+		req.Header.Set("Authorization", "Bearer "+bearer)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The user token is not enough
+	assert.Equal(t, http.StatusUnauthorized, restore("secret"))
+	assert.Equal(t, http.StatusOK, restore("admin"))
+
+	// Without an admin token the routes are closed
+	server.AdminToken = ""
+	handler = server.Handler()
+	assert.Equal(t, http.StatusUnauthorized, restore(""))
+	assert.Equal(t, http.StatusUnauthorized, restore("admin"))
+}
+
+func TestChangeUserStatus(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1}).Build()
+	server := NewServer(&service.UserService{Repo: mockRepo}, "")
+	server.AdminToken = "admin"
+	handler := server.Handler()
+
+	post := func(path string) int {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, post("/admin/users/1/suspend"))
+	assert.Equal(t, http.StatusConflict, post("/admin/users/1/suspend"))
+	assert.Equal(t, http.StatusNoContent, post("/users/1/deactivate"))
+	assert.Equal(t, http.StatusConflict, post("/admin/users/1/activate"))
+	assert.Equal(t, http.StatusNotFound, post("/admin/users/2/activate"))
+}
+
+func TestReadOnlyMode(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1, Name: "John Doe"}).Build()
+	readOnly := repository.NewReadOnlyUserRepository(mockRepo, false)
+	server := NewServer(&service.UserService{Repo: readOnly}, "")
+	server.AdminToken = "admin"
+	server.ReadOnly = readOnly
+	handler := server.Handler()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer admin")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Switch it on through the admin route
+	rec := do("PUT", "/admin/read-only", `{"read_only": true}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, readOnly.ReadOnly())
+	rec = do("GET", "/admin/read-only", "")
+	assert.JSONEq(t, `{"read_only": true}`, rec.Body.String())
+
+	// Writes are refused, and clients told when to retry
+	rec = do("POST", "/users", `{"name": "Jane Doe"}`)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+	assert.Equal(t, http.StatusServiceUnavailable, do("POST", "/admin/users/1/suspend", "").Code)
+	mockRepo.AssertNotCalled(t, "SaveUser")
+
+	// Reads are not
+	assert.Equal(t, http.StatusOK, do("GET", "/users/1", "").Code)
+
+	// A bad body leaves the mode alone
+	assert.Equal(t, http.StatusBadRequest, do("PUT", "/admin/read-only", `{}`).Code)
+	assert.True(t, readOnly.ReadOnly())
+
+	assert.Equal(t, http.StatusOK, do("PUT", "/admin/read-only", `{"read_only": false}`).Code)
+	assert.Equal(t, http.StatusCreated, do("POST", "/users", `{"name": "Jane Doe"}`).Code)
+}
+
+func TestReadOnlyError(t *testing.T) {
+	// A write racing with the switch is refused by the repository instead
+	mockRepo := mocks.NewUserRepo().FailingOn("SaveUser", repository.ErrReadOnly).Build()
+	handler := newTestServer(mockRepo, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/users", strings.NewReader(`{"name": "Jane Doe"}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "60", rec.Header().Get("Retry-After"))
+}
+
+func TestWriteBehindFullError(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().
+		WithUsers(&repository.User{ID: 1, Name: "Jane Doe"}).
+		FailingOn("UpdateUser", repository.ErrWriteBehindFull).
+		Build()
+	handler := newTestServer(mockRepo, "")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/users/1", strings.NewReader(`{"name": "Jane Smith"}`)))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestListUsers(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().
+		WithUsers(&repository.User{ID: 1, Name: "Ann"}, &repository.User{ID: 2, Name: "Bob"}, &repository.User{ID: 3, Name: "Cat"}).
+		Build()
+	handler := newTestServer(mockRepo, "")
+
+	// Test the first page, which links to the next
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users?limit=2&fields=id", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var page repository.Page[*repository.User]
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Len(t, page.Items, 2)
+	assert.Equal(t, int64(3), page.Total)
+	assert.Equal(t, 2, page.PageSize)
+	assert.Contains(t, rec.Header().Get("Link"), `cursor=`+page.Next)
+	assert.Contains(t, rec.Header().Get("Link"), `rel="next"`)
+
+	// Test the next page, which links back
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users?limit=2&cursor="+page.Next, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	page = repository.Page[*repository.User]{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Equal(t, 3, page.Items[0].ID)
+	assert.Empty(t, page.Next)
+	assert.Contains(t, rec.Header().Get("Link"), `rel="prev"`)
+
+	// Test filtering by status, where users saved without one are active
+	assert.NoError(t, mockRepo.SetUserStatus(2, repository.StatusActive, repository.StatusSuspended))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users?status=suspended", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	page = repository.Page[*repository.User]{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, "Bob", page.Items[0].Name)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users?status=banned", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// Test a bad cursor and limit
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users?cursor=bogus", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users?limit=0", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestExportUsers(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().
+		WithUsers(&repository.User{ID: 1, Name: "Ann", Email: "ann@example.com"}, &repository.User{ID: 2, Name: "Bob, Jr", Email: "bob@example.com"}).
+		Build()
+	handler := newTestServer(mockRepo, "")
+
+	// Test exporting as JSON lines
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/export", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	assert.Len(t, lines, 2)
+
+	var first ExportRecord
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &first))
+	assert.Equal(t, "Ann", first.User.Name)
+
+	// Test resuming after the first user
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/export?cursor="+first.Cursor, nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, lines[1], strings.TrimSpace(rec.Body.String()))
+
+	// Test exporting some fields as CSV
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/export?format=csv&fields=name", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "cursor,id,name\n"+first.Cursor+",1,Ann\n"+repository.CursorAfter(2)+",2,\"Bob, Jr\"\n", rec.Body.String())
+
+	// Test errors found before anything is sent
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/export?cursor=bogus", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/users/export?format=xml", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestUserStats(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	assert.NoError(t, repo.SaveUser(&repository.User{Name: "Jane Doe", Email: "jane@acme.com"}))
+	assert.NoError(t, repo.RecordLogin(1))
+
+	// Without a reporter there is no route
+	rec := httptest.NewRecorder()
+	newTestServer(repo, "").ServeHTTP(rec, httptest.NewRequest("GET", "/stats/users", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	server := NewServer(&service.UserService{Repo: repo}, "")
+	server.Stats = stats.NewReporter(repo)
+	rec = httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats/users", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var report stats.Report
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	assert.Equal(t, int64(1), report.Total)
+	assert.Equal(t, int64(1), report.Active)
+	assert.Equal(t, []repository.DomainCount{{Domain: "acme.com", Users: 1}}, report.TopDomains)
+	assert.Len(t, report.SignupsPerDay, 1)
+	assert.Equal(t, stats.DefaultDays, report.Days)
+}
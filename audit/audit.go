@@ -0,0 +1,66 @@
+// Package audit records sensitive actions taken on users.
+package audit
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Actions.
+const (
+	ActionAnonymize  = "anonymize"
+	ActionDelete     = "delete"
+	ActionRollback   = "rollback"
+	ActionRestore    = "restore"
+	ActionPurge      = "purge"
+	ActionSuspend    = "suspend"
+	ActionActivate   = "activate"
+	ActionDeactivate = "deactivate"
+)
+
+// Entry is one audited action.
+type Entry struct {
+	At     time.Time
+	Action string
+	UserID int
+}
+
+// Recorder stores audit entries.
+type Recorder interface {
+	Record(entry Entry) error
+}
+
+// LogRecorder writes audit entries to a logger, one line each.
+type LogRecorder struct {
+	Logger *log.Logger
+}
+
+func NewLogRecorder(logger *log.Logger) *LogRecorder {
+	return &LogRecorder{Logger: logger}
+}
+
+func (r *LogRecorder) Record(entry Entry) error {
+	r.Logger.Printf("audit: %s user=%d at=%s", entry.Action, entry.UserID, entry.At.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// MemoryRecorder keeps audit entries in memory, for tests.
+type MemoryRecorder struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (r *MemoryRecorder) Record(entry Entry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+	return nil
+}
+
+// Entries returns everything recorded so far, oldest first.
+func (r *MemoryRecorder) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Entry(nil), r.entries...)
+}
@@ -0,0 +1,263 @@
+// Package backup copies every user out of a repository into an archive and
+// back again.
+//
+// An archive is gzip-compressed JSON lines. The first line is a Header
+// naming the archive format version and the schema migration the data was
+// taken at; each line after it is one Record: every user, then every past
+// version of every user, deleted users' included. Both are read a page at
+// a time and written as they are read, so a backup never holds the whole
+// store in memory, and a restore saves them in batches as it reads.
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"gorepository/migrations"
+	"gorepository/repository"
+)
+
+// Format identifies a user archive.
+const Format = "gorepository-users"
+
+// Version is the archive format version written by Backup. Restore reads
+// archives up to this version.
+const Version = 1
+
+// DefaultBatchSize is the number of users read or saved at a time when
+// BatchSize is not set.
+const DefaultBatchSize = 1000
+
+// ErrIncompatible is returned by Restore for an archive it can't read:
+// another format, a newer version, or data from a schema this build
+// doesn't know.
+var ErrIncompatible = errors.New("incompatible backup archive")
+
+// ErrNotEmpty is returned by Restore when the repository already has users.
+var ErrNotEmpty = errors.New("repository is not empty")
+
+// Header is the first line of an archive.
+type Header struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Schema  string    `json:"schema"`
+	Created time.Time `json:"created"`
+}
+
+// Record types.
+const (
+	TypeUser        = "user"
+	TypeUserVersion = "user_version"
+)
+
+// Record is one line of an archive after the header. Type says which
+// field is set, so that other entities can be added later without a new
+// format version.
+type Record struct {
+	Type    string                  `json:"type"`
+	User    *repository.User        `json:"user,omitempty"`
+	Version *repository.UserVersion `json:"version,omitempty"`
+}
+
+// Archiver backs up and restores the users in Repo.
+type Archiver struct {
+	Repo      repository.UserRepository
+	BatchSize int
+
+	now func() time.Time
+}
+
+// Backup writes an archive of every user to w, returning how many it
+// wrote. Their history is archived too if the repository can read it out;
+// see repository.HistoryArchiver.
+func (a *Archiver) Backup(w io.Writer) (int, error) {
+	schema, err := a.schema()
+	if err != nil {
+		return 0, err
+	}
+
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	if err := enc.Encode(Header{Format: Format, Version: Version, Schema: schema, Created: a.clock()}); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	err = repository.EachUser(a.Repo, repository.And(), 0, a.batchSize(), func(user *repository.User) error {
+		if err := enc.Encode(Record{Type: TypeUser, User: user}); err != nil {
+			return err
+		}
+		written++
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+	if history := repository.FindHistoryArchiver(a.Repo); history != nil {
+		err := history.EachUserVersion(func(version repository.UserVersion) error {
+			return enc.Encode(Record{Type: TypeUserVersion, Version: &version})
+		})
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, zw.Close()
+}
+
+// Restore reads an archive from r and saves its users, and their history,
+// returning how many users it saved. The repository must be empty, so a
+// restore can't mix with or duplicate existing users. Users keep their
+// IDs, and the repository's next ID is moved past them and past any
+// deleted user's, so deleted users can still be restored.
+func (a *Archiver) Restore(r io.Reader) (int, error) {
+	history := repository.FindHistoryArchiver(a.Repo)
+	if err := a.checkEmpty(history); err != nil {
+		return 0, err
+	}
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrIncompatible, err)
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(bufio.NewReader(zr))
+
+	var header Header
+	if err := dec.Decode(&header); err != nil {
+		return 0, fmt.Errorf("%w: reading header: %w", ErrIncompatible, err)
+	}
+	if err := a.checkHeader(header); err != nil {
+		return 0, err
+	}
+
+	saved := 0
+	batch := make([]*repository.User, 0, a.batchSize())
+	var versions []repository.UserVersion
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := a.Repo.InsertUsers(batch); err != nil {
+				return err
+			}
+			saved += len(batch)
+			batch = batch[:0]
+		}
+		if len(versions) > 0 {
+			if err := history.InsertUserVersions(versions); err != nil {
+				return err
+			}
+			versions = versions[:0]
+		}
+		return nil
+	}
+
+	for line := 2; ; line++ {
+		var record Record
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return saved, fmt.Errorf("record %d: %w", line, err)
+		}
+		switch {
+		case record.Type == TypeUser && record.User != nil:
+			batch = append(batch, record.User)
+		case record.Type == TypeUserVersion && record.Version != nil:
+			if history == nil {
+				return saved, fmt.Errorf("record %d: restoring user history: %w", line, repository.ErrNotSupported)
+			}
+			versions = append(versions, *record.Version)
+		default:
+			return saved, fmt.Errorf("%w: record %d has unknown type %q", ErrIncompatible, line, record.Type)
+		}
+
+		if len(batch)+len(versions) >= a.batchSize() {
+			if err := flush(); err != nil {
+				return saved, err
+			}
+		}
+	}
+	return saved, flush()
+}
+
+// checkEmpty returns ErrNotEmpty if the repository has any users, or any
+// history.
+func (a *Archiver) checkEmpty(history repository.HistoryArchiver) error {
+	existing, err := a.Repo.FindUsersWhere(repository.And(), 0, 1, repository.Fields("id"))
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return ErrNotEmpty
+	}
+	if history == nil {
+		return nil
+	}
+	return history.EachUserVersion(func(repository.UserVersion) error {
+		return ErrNotEmpty
+	})
+}
+
+// checkHeader rejects archives this build, or the repository's schema,
+// can't restore.
+func (a *Archiver) checkHeader(header Header) error {
+	if header.Format != Format {
+		return fmt.Errorf("%w: not a user archive (format %q)", ErrIncompatible, header.Format)
+	}
+	if header.Version < 1 || header.Version > Version {
+		return fmt.Errorf("%w: archive version %d, but this build reads up to %d", ErrIncompatible, header.Version, Version)
+	}
+	names, err := migrations.Names()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(names, header.Schema) {
+		return fmt.Errorf("%w: archive was taken at schema %s, which this build doesn't have; upgrade first", ErrIncompatible, header.Schema)
+	}
+	schema, err := a.schema()
+	if err != nil {
+		return err
+	}
+	if schema < header.Schema {
+		return fmt.Errorf("%w: archive was taken at schema %s, but the database is at %s; migrate it first", ErrIncompatible, header.Schema, schema)
+	}
+	return nil
+}
+
+// schema returns the last migration applied to the repository's database
+// or, for backends without one, the latest this build knows, which they
+// always match.
+func (a *Archiver) schema() (string, error) {
+	schema, err := repository.SchemaVersion(a.Repo)
+	if err != nil || schema != "" {
+		return schema, err
+	}
+	names, err := migrations.Names()
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", errors.New("backup: no schema migrations")
+	}
+	return names[len(names)-1], nil
+}
+
+func (a *Archiver) batchSize() int {
+	if a.BatchSize > 0 {
+		return a.BatchSize
+	}
+	return DefaultBatchSize
+}
+
+func (a *Archiver) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gorepository/migrations"
+	"gorepository/repository"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	// Setup a repository with more users than fit in one batch
+	source := repository.NewMemoryUserRepository()
+	verified := time.Date(2024, 5, 2, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 25; i++ {
+		user := &repository.User{Name: "John Doe", Email: "john.doe@example.com", CreatedAt: time.Date(2024, 5, 1, 12, 0, i, 0, time.UTC)}
+		if i%2 == 0 {
+			user.VerifiedAt = &verified
+		}
+		assert.NoError(t, source.SaveUser(user))
+	}
+	// One user has changed and another has been deleted, leaving a gap
+	assert.NoError(t, source.UpdateUser(&repository.User{ID: 3, Name: "Johnny Doe", Email: "john.doe@example.com"}))
+	assert.NoError(t, source.DeleteUser(25))
+	assert.NoError(t, source.DeleteUser(7))
+
+	var archive bytes.Buffer
+	written, err := (&Archiver{Repo: source, BatchSize: 10}).Backup(&archive)
+	assert.NoError(t, err)
+	assert.Equal(t, 23, written)
+
+	// Test restoring into an empty repository
+	target := repository.NewMemoryUserRepository()
+	restored, err := (&Archiver{Repo: target, BatchSize: 10}).Restore(bytes.NewReader(archive.Bytes()))
+	assert.NoError(t, err)
+	assert.Equal(t, 23, restored)
+
+	// Users keep their IDs, and their history comes with them
+	want, _ := source.FindUsersWhere(repository.And(), 0, 100)
+	got, _ := target.FindUsersWhere(repository.And(), 0, 100)
+	assert.Equal(t, want, got)
+	history, err := target.FindUserHistory(3)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 1) {
+		assert.Equal(t, "John Doe", history[0].Name)
+	}
+
+	// Deleted users can still be restored, and new users don't take their
+	// IDs
+	user := &repository.User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, target.SaveUser(user))
+	assert.Equal(t, 26, user.ID)
+	restoredUser, err := target.RestoreUser(25)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", restoredUser.Name)
+
+	// Test restoring over existing users
+	_, err = (&Archiver{Repo: target}).Restore(bytes.NewReader(archive.Bytes()))
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestRestoreChecksHeader(t *testing.T) {
+	for name, header := range map[string]Header{
+		"other format":  {Format: "something-else", Version: 1, Schema: "0001_create_users.sql"},
+		"newer version": {Format: Format, Version: Version + 1, Schema: "0001_create_users.sql"},
+		"newer schema":  {Format: Format, Version: Version, Schema: "9999_from_the_future.sql"},
+	} {
+		_, err := (&Archiver{Repo: repository.NewMemoryUserRepository()}).Restore(archiveOf(t, header))
+		assert.ErrorIs(t, err, ErrIncompatible, name)
+	}
+
+	// Test an archive newer than the database's schema
+	names, err := migrations.Names()
+	assert.NoError(t, err)
+	older := &migratedRepository{UserRepository: repository.NewMemoryUserRepository(), schema: names[0]}
+	_, err = (&Archiver{Repo: older}).Restore(archiveOf(t, Header{Format: Format, Version: Version, Schema: names[1]}))
+	assert.ErrorIs(t, err, ErrIncompatible)
+
+	// Test an archive that isn't gzipped at all
+	_, err = (&Archiver{Repo: repository.NewMemoryUserRepository()}).Restore(bytes.NewReader([]byte("{}")))
+	assert.ErrorIs(t, err, ErrIncompatible)
+}
+
+func TestBackupRecordsAppliedSchema(t *testing.T) {
+	repo := &migratedRepository{UserRepository: repository.NewMemoryUserRepository(), schema: "0004_create_users_history.sql"}
+	var archive bytes.Buffer
+	_, err := (&Archiver{Repo: repo}).Backup(&archive)
+	assert.NoError(t, err)
+
+	zr, err := gzip.NewReader(&archive)
+	assert.NoError(t, err)
+	var header Header
+	assert.NoError(t, json.NewDecoder(zr).Decode(&header))
+	assert.Equal(t, "0004_create_users_history.sql", header.Schema)
+}
+
+// migratedRepository is a repository whose database is at schema.
+type migratedRepository struct {
+	repository.UserRepository
+	schema string
+}
+
+func (r *migratedRepository) SchemaVersion() (string, error) {
+	return r.schema, nil
+}
+
+func archiveOf(t *testing.T, header Header) *bytes.Buffer {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	assert.NoError(t, json.NewEncoder(zw).Encode(header))
+	assert.NoError(t, zw.Close())
+	return &buf
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Entity is what repogen generates code for: a named record with an
+// integer ID and the given fields.
+type Entity struct {
+	// Name is the Go type name, such as "Product".
+	Name   string
+	Fields []Field
+}
+
+// Field is one field of an Entity besides its ID.
+type Field struct {
+	// Column is the snake_case column name, and GoName the field name.
+	Column string
+	GoName string
+	// Type is the Go type without the pointer an optional field has.
+	Type     string
+	Optional bool
+}
+
+// fieldTypes maps the Go types a field can have to their column types.
+var fieldTypes = map[string]string{
+	"string":    "TEXT",
+	"int":       "INTEGER",
+	"int64":     "BIGINT",
+	"float64":   "DOUBLE PRECISION",
+	"bool":      "BOOLEAN",
+	"time.Time": "TIMESTAMPTZ",
+}
+
+var (
+	entityName = regexp.MustCompile(`^[A-Z][A-Za-z0-9]*$`)
+	columnName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+)
+
+// parseEntity reads an entity from its type name and a field list such as
+// "name:string,price:int64,released_at:time.Time?", where a trailing "?"
+// makes a field optional.
+func parseEntity(name, fields string) (Entity, error) {
+	if !entityName.MatchString(name) {
+		return Entity{}, fmt.Errorf("entity name %q must be an exported Go identifier, such as Product", name)
+	}
+	entity := Entity{Name: name}
+	if token.IsKeyword(entity.Lower()) || token.IsKeyword(entity.LowerPlural()) {
+		return Entity{}, fmt.Errorf("entity name %q would make a Go keyword as a variable name", name)
+	}
+
+	seen := map[string]bool{"id": true}
+	for _, def := range strings.Split(fields, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		column, typ, ok := strings.Cut(def, ":")
+		if !ok {
+			return Entity{}, fmt.Errorf("field %q must be name:type", def)
+		}
+		field := Field{Column: column}
+		field.Type, field.Optional = strings.CutSuffix(typ, "?")
+
+		if !columnName.MatchString(column) {
+			return Entity{}, fmt.Errorf("field name %q must be snake_case", column)
+		}
+		if seen[column] {
+			return Entity{}, fmt.Errorf("field %q is defined twice, or is id, which every entity has", column)
+		}
+		if _, ok := fieldTypes[field.Type]; !ok {
+			return Entity{}, fmt.Errorf("field %q has unsupported type %q", column, field.Type)
+		}
+		seen[column] = true
+		field.GoName = goName(column)
+		entity.Fields = append(entity.Fields, field)
+	}
+	if len(entity.Fields) == 0 {
+		return Entity{}, fmt.Errorf("entity %s has no fields", name)
+	}
+	return entity, nil
+}
+
+// Lower is the entity's name for local variables, such as "product".
+func (e Entity) Lower() string {
+	return string(unicode.ToLower(rune(e.Name[0]))) + e.Name[1:]
+}
+
+// LowerPlural is Lower for lists, such as "products".
+func (e Entity) LowerPlural() string {
+	return plural(e.Lower())
+}
+
+// Plural is the entity's name for lists, such as "Products".
+func (e Entity) Plural() string {
+	return plural(e.Name)
+}
+
+// Snake is the entity's name in file names, such as "product_review".
+func (e Entity) Snake() string {
+	var b strings.Builder
+	for i, r := range e.Name {
+		if unicode.IsUpper(r) && i > 0 {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// Table is the entity's table name, such as "product_reviews".
+func (e Entity) Table() string {
+	return plural(e.Snake())
+}
+
+// HasTime reports whether any field is a time.Time, so needs the import.
+func (e Entity) HasTime() bool {
+	for _, field := range e.Fields {
+		if field.Type == "time.Time" {
+			return true
+		}
+	}
+	return false
+}
+
+// GoType is the field's type in the struct.
+func (f Field) GoType() string {
+	if f.Optional {
+		return "*" + f.Type
+	}
+	return f.Type
+}
+
+// SQLType is the field's column definition.
+func (f Field) SQLType() string {
+	if f.Optional {
+		return fieldTypes[f.Type]
+	}
+	return fieldTypes[f.Type] + " NOT NULL"
+}
+
+// goName turns a snake_case column into a Go field name, keeping the
+// initialisms Go style capitalizes whole.
+func goName(column string) string {
+	var b strings.Builder
+	for _, word := range strings.Split(column, "_") {
+		if word == "" {
+			continue
+		}
+		switch upper := strings.ToUpper(word); upper {
+		case "ID", "URL", "API", "HTTP", "JSON", "SQL", "UUID", "IP":
+			b.WriteString(upper)
+		default:
+			b.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return b.String()
+}
+
+// plural makes an English plural well enough for type and table names.
+func plural(s string) string {
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasSuffix(lower, "y") && len(s) > 1 && !strings.ContainsRune("aeiou", rune(lower[len(lower)-2])):
+		return s[:len(s)-1] + "ies"
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "x"),
+		strings.HasSuffix(lower, "ch"), strings.HasSuffix(lower, "sh"):
+		return s + "es"
+	}
+	return s + "s"
+}
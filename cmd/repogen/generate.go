@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"go/format"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS
+
+var templates = template.Must(template.New("").
+	Funcs(template.FuncMap{"inc": func(i int) int { return i + 1 }}).
+	ParseFS(templateFiles, "templates/*.tmpl"))
+
+// errExists is returned by generate when it would overwrite a file.
+var errExists = errors.New("file exists")
+
+// output is a file generate writes, relative to the module root.
+type output struct {
+	path     string
+	template string
+}
+
+// outputs lists what is generated for entity, migrations numbered after
+// the ones already in dir.
+func outputs(dir string, entity Entity) ([]output, error) {
+	migration, err := nextMigration(filepath.Join(dir, "migrations", "sql"))
+	if err != nil {
+		return nil, err
+	}
+	snake := entity.Snake()
+	return []output{
+		{filepath.Join("repository", snake+"_repository.go"), "repository.go.tmpl"},
+		{filepath.Join("repository", "memory_"+snake+"_repository.go"), "memory.go.tmpl"},
+		{filepath.Join("repository", "mock_"+snake+"_repository.go"), "mock.go.tmpl"},
+		{filepath.Join("repository", "postgres_"+snake+"_repository.go"), "postgres.go.tmpl"},
+		{filepath.Join("migrations", "sql", fmt.Sprintf("%04d_create_%s.sql", migration, entity.Table())), "migration.sql.tmpl"},
+		{filepath.Join("service", snake+"_service.go"), "service.go.tmpl"},
+	}, nil
+}
+
+// generate writes the files for entity under dir, the module root, and
+// returns their paths. Go files are gofmt'd. Unless force is set, it
+// writes nothing if any of them already exists.
+func generate(dir string, entity Entity, force bool) ([]string, error) {
+	files, err := outputs(dir, entity)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := make([][]byte, len(files))
+	for i, file := range files {
+		if _, err := os.Stat(filepath.Join(dir, file.path)); err == nil && !force {
+			return nil, fmt.Errorf("%w: %s (use -force to overwrite)", errExists, file.path)
+		}
+		if rendered[i], err = render(file, entity); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = filepath.Join(dir, file.path)
+		if err := os.WriteFile(paths[i], rendered[i], 0o644); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+func render(file output, entity Entity) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := templates.ExecuteTemplate(&buf, file.template, entity); err != nil {
+		return nil, fmt.Errorf("%s: %w", file.path, err)
+	}
+	if !strings.HasSuffix(file.path, ".go") {
+		return buf.Bytes(), nil
+	}
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s: generated invalid Go: %w", file.path, err)
+	}
+	return formatted, nil
+}
+
+var migrationName = regexp.MustCompile(`^(\d+)_.*\.sql$`)
+
+// nextMigration returns the number after the highest migration in dir.
+func nextMigration(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, err
+	}
+	last := 0
+	for _, entry := range entries {
+		if m := migrationName.FindStringSubmatch(entry.Name()); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			last = max(last, n)
+		}
+	}
+	return last + 1, nil
+}
@@ -0,0 +1,45 @@
+// Command repogen scaffolds a new entity the way UserRepository is built:
+// the struct and its repository interface, Postgres, in-memory and mock
+// implementations, a migration creating its table and a service wrapping
+// it. Run it from the module root:
+//
+//	go run ./cmd/repogen -name Product -fields 'name:string,price_pence:int64,released_at:time.Time?'
+//
+// Fields are snake_case column names with a Go type: string, int, int64,
+// float64, bool or time.Time. A trailing "?" makes a field optional, a
+// pointer in Go and nullable in the table. Every entity also gets an ID.
+//
+// The generated code is a starting point to edit, not something to
+// regenerate: it covers the basic finds and writes, and leaves out what
+// UserRepository grew later, such as find options and history.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func main() {
+	name := flag.String("name", "", "entity type name, such as Product")
+	fields := flag.String("fields", "", "comma-separated name:type fields")
+	dir := flag.String("dir", ".", "module root to write into")
+	force := flag.Bool("force", false, "overwrite files that already exist")
+	flag.Parse()
+
+	entity, err := parseEntity(*name, *fields)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "repogen:", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	paths, err := generate(*dir, entity, *force)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "repogen:", err)
+		os.Exit(1)
+	}
+	for _, path := range paths {
+		fmt.Println(path)
+	}
+}
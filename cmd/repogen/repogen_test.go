@@ -0,0 +1,63 @@
+package main
+
+import (
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEntity(t *testing.T) {
+	entity, err := parseEntity("ProductCategory", "name:string, image_url:string?")
+	assert.NoError(t, err)
+	assert.Equal(t, "product_categories", entity.Table())
+	assert.Equal(t, "productCategories", entity.LowerPlural())
+	assert.Equal(t, "ImageURL", entity.Fields[1].GoName)
+	assert.Equal(t, "*string", entity.Fields[1].GoType())
+	assert.Equal(t, "TEXT NOT NULL", entity.Fields[0].SQLType())
+
+	// Test definitions that can't be generated
+	for name, fields := range map[string]string{
+		"product": "name:string",
+		"Product": "",
+		"Type":    "name:string",
+		"Item":    "id:int",
+		"Order":   "total:decimal",
+		"Box":     "Name:string",
+	} {
+		_, err := parseEntity(name, fields)
+		assert.Error(t, err, "%s %s", name, fields)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "migrations", "sql"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "migrations", "sql", "0007_add_user_phone.sql"), nil, 0o644))
+	for _, sub := range []string{"repository", "service"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, sub), 0o755))
+	}
+
+	entity, err := parseEntity("Product", "name:string,released_at:time.Time?")
+	assert.NoError(t, err)
+	paths, err := generate(dir, entity, false)
+	assert.NoError(t, err)
+	assert.Len(t, paths, 6)
+	assert.FileExists(t, filepath.Join(dir, "migrations", "sql", "0008_create_products.sql"))
+
+	// Every Go file is valid
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".go") {
+			_, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+			assert.NoError(t, err, path)
+		}
+	}
+
+	// Test that nothing is overwritten without -force
+	_, err = generate(dir, entity, false)
+	assert.ErrorIs(t, err, errExists)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gorepository/backup"
+)
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	file := fs.String("file", "-", "archive to write, or - for stdout")
+	batchSize := fs.Int("batch-size", backup.DefaultBatchSize, "users read per query")
+	fs.Parse(args)
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	var out io.Writer = os.Stdout
+	if *file != "-" {
+		f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	archiver := &backup.Archiver{Repo: repo, BatchSize: *batchSize}
+	written, err := archiver.Backup(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Backed up %d users\n", written)
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	file := fs.String("file", "-", "archive to read, or - for stdin")
+	batchSize := fs.Int("batch-size", backup.DefaultBatchSize, "users per bulk insert")
+	fs.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	archiver := &backup.Archiver{Repo: repo, BatchSize: *batchSize}
+	restored, err := archiver.Restore(in)
+	fmt.Fprintf(os.Stderr, "Restored %d users\n", restored)
+	return err
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+
+	"gorepository/audit"
+	"gorepository/repository"
+	"gorepository/service"
+)
+
+func runDeleteUsers(args []string) error {
+	fs := flag.NewFlagSet("delete-users", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	domain := fs.String("email-domain", "", "delete users with emails at this domain")
+	unverified := fs.Bool("unverified", false, "only delete users who haven't verified their email")
+	fs.Parse(args)
+
+	var specs []repository.Specification
+	if *domain != "" {
+		specs = append(specs, repository.EmailDomain(*domain))
+	}
+	if *unverified {
+		specs = append(specs, repository.Unverified())
+	}
+	if len(specs) == 0 {
+		return errors.New("delete-users: give at least one of -email-domain or -unverified")
+	}
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	users := &service.UserService{Repo: repo, Audit: audit.NewLogRecorder(log.Default())}
+	deleted, err := users.DeleteUsersWhere(repository.And(specs...))
+	fmt.Printf("Deleted %d users\n", deleted)
+	return err
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gorepository/importer"
+	"gorepository/service"
+)
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	file := fs.String("file", "-", "CSV or JSON users to import, or - for stdin")
+	formatName := fs.String("format", "", "csv or json (default from the file's extension)")
+	batchSize := fs.Int("batch-size", importer.DefaultBatchSize, "users per bulk insert")
+	countryCode := fs.String("phone-country-code", os.Getenv("PHONE_COUNTRY_CODE"), "calling code assumed for phone numbers without one")
+	policyRules := fs.String("policies", os.Getenv("USER_POLICIES"), "quotas and email rules imported users are held to, as in USER_POLICIES")
+	dryRun := fs.Bool("dry-run", false, "check every row without saving any")
+	reportFile := fs.String("report", "", "write the report as JSON to this file")
+	fs.Parse(args)
+
+	if *formatName == "" {
+		*formatName = strings.TrimPrefix(filepath.Ext(*file), ".")
+	}
+	format, err := importer.ParseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	policies, err := service.ParseUserPolicies(*policyRules)
+	if err != nil {
+		return err
+	}
+
+	var in io.Reader = os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	imp := &importer.Importer{
+		Users:     &service.UserService{Repo: repo, PhoneCountryCode: strings.TrimPrefix(*countryCode, "+"), Policies: policies},
+		Emails:    repoCfg.Emails,
+		BatchSize: *batchSize,
+		DryRun:    *dryRun,
+	}
+	report, err := imp.Import(in, format)
+	fmt.Fprint(os.Stderr, report)
+	if *reportFile != "" {
+		if writeErr := writeReport(*reportFile, report); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+	if err == nil && len(report.Rejected) > 0 {
+		err = fmt.Errorf("%d of %d rows rejected", len(report.Rejected), report.Rows)
+	}
+	return err
+}
+
+func writeReport(path string, report importer.Report) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
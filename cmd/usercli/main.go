@@ -0,0 +1,109 @@
+// Command usercli runs administrative tasks against the user store.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gorepository/config"
+	"gorepository/repository"
+)
+
+const defaultDSN = "user=youruser dbname=yourdb sslmode=disable"
+
+const usage = `usage: usercli <command> [flags]
+
+commands:
+  migrate    create or upgrade the Postgres schema
+  seed       generate fake users and bulk-insert them
+  retention  apply the data retention rules once
+  delete-users
+             delete every user matching the given criteria
+  backup     write every user to a compressed archive
+  restore    load the users in an archive into an empty store
+  import     load users from a CSV or JSON export, reporting rejected rows
+  stats      report signups per day, active users and users per domain
+  reencrypt  encrypt every user again with the primary encryption key
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "migrate":
+		err = runMigrate(args)
+	case "seed":
+		err = runSeed(args)
+	case "retention":
+		err = runRetention(args)
+	case "delete-users":
+		err = runDeleteUsers(args)
+	case "backup":
+		err = runBackup(args)
+	case "restore":
+		err = runRestore(args)
+	case "import":
+		err = runImport(args)
+	case "stats":
+		err = runStats(args)
+	case "reencrypt":
+		err = runReencrypt(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "usercli:", err)
+		os.Exit(1)
+	}
+}
+
+// repositoryFlags adds -driver, -dsn, -fold-gmail and the Postgres TLS flags
+// to fs. The DSN falls back to $DATABASE_URL and then the example
+// connection string, -fold-gmail to $EMAIL_FOLD_GMAIL, and each TLS flag to
+// its $DB_SSL* variable.
+func repositoryFlags(fs *flag.FlagSet) *repository.Config {
+	cfg := &repository.Config{}
+	fs.StringVar(&cfg.Driver, "driver", "postgres", "repository backend: "+strings.Join(repository.Drivers(), ", "))
+	fs.StringVar(&cfg.DSN, "dsn", "", "connection string (default $DATABASE_URL)")
+	fs.BoolVar(&cfg.Emails.FoldGmail, "fold-gmail", os.Getenv("EMAIL_FOLD_GMAIL") == "true", "normalize Gmail addresses ignoring dots and +tags")
+	fs.StringVar(&cfg.TLS.Mode, "sslmode", os.Getenv("DB_SSLMODE"), "postgres sslmode, overriding the DSN's")
+	fs.StringVar(&cfg.TLS.RootCert, "sslrootcert", os.Getenv("DB_SSLROOTCERT"), "CA bundle to verify postgres against")
+	fs.StringVar(&cfg.TLS.Cert, "sslcert", os.Getenv("DB_SSLCERT"), "client certificate for postgres")
+	fs.StringVar(&cfg.TLS.Key, "sslkey", os.Getenv("DB_SSLKEY"), "client key for postgres")
+	return cfg
+}
+
+// openRepository builds the repository selected by repositoryFlags. If
+// $ENCRYPTION_KEYS is set, it is encrypted with the keys the server would
+// load; see config.Config.EncryptionKeys.
+func openRepository(cfg *repository.Config) (repository.UserRepository, func(), error) {
+	cfg.DSN = dsnOrDefault(cfg.DSN)
+	if os.Getenv("ENCRYPTION_KEYS") != "" {
+		appCfg, err := config.Load()
+		if err != nil {
+			return nil, nil, err
+		}
+		if cfg.Encryption, err = repository.NewKeyring(appCfg.EncryptionPrimaryKey, appCfg.EncryptionKeyValues(), appCfg.EncryptionIndexKey.Get()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return repository.New(*cfg)
+}
+
+func dsnOrDefault(dsn string) string {
+	if dsn == "" {
+		dsn = os.Getenv("DATABASE_URL")
+	}
+	if dsn == "" {
+		dsn = defaultDSN
+	}
+	return dsn
+}
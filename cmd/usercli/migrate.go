@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+
+	"gorepository/migrations"
+
+	_ "github.com/lib/pq"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	fs.Parse(args)
+
+	if repoCfg.Driver != "postgres" {
+		return fmt.Errorf("migrate only supports the postgres driver, not %q", repoCfg.Driver)
+	}
+
+	dsn, err := repoCfg.TLS.Apply(dsnOrDefault(repoCfg.DSN))
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	applied, err := migrations.Up(db)
+	for _, name := range applied {
+		fmt.Println("applied", name)
+	}
+	if err == nil && len(applied) == 0 {
+		fmt.Println("schema is up to date")
+	}
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gorepository/repository"
+)
+
+func runReencrypt(args []string) error {
+	fs := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	fs.Parse(args)
+
+	if os.Getenv("ENCRYPTION_KEYS") == "" {
+		return errors.New("reencrypt: set ENCRYPTION_KEYS and ENCRYPTION_INDEX_KEY_SECRET as the server has them")
+	}
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	n, err := repository.Reencrypt(repo)
+	fmt.Printf("Re-encrypted %d users and past versions\n", n)
+	return err
+}
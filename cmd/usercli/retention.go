@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"gorepository/retention"
+	"gorepository/service"
+)
+
+func runRetention(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	unverifiedAfter := fs.Duration("unverified-after", 30*24*time.Hour, "delete users still unverified after this long (0 turns it off)")
+	inactiveAfter := fs.Duration("inactive-after", 0, "anonymize users who haven't logged in for this long (default off)")
+	dryRun := fs.Bool("dry-run", false, "report what would be done without changing anything")
+	fs.Parse(args)
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	engine := &retention.Engine{
+		Users:  &service.UserService{Repo: repo},
+		Rules:  retention.Rules(*unverifiedAfter, *inactiveAfter),
+		DryRun: *dryRun,
+	}
+
+	report, err := engine.Run()
+	fmt.Print(report)
+	return err
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"gorepository/seed"
+)
+
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	count := fs.Int("count", 1000, "number of users to generate")
+	batchSize := fs.Int("batch-size", seed.DefaultBatchSize, "users per bulk insert")
+	randSeed := fs.Int64("seed", time.Now().UnixNano(), "random seed, for repeatable data sets")
+	fs.Parse(args)
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	seeder := &seed.Seeder{
+		Repo:      repo,
+		Generator: seed.NewGenerator(*randSeed),
+		BatchSize: *batchSize,
+	}
+
+	start := time.Now()
+	saved, err := seeder.Seed(*count)
+	fmt.Printf("Seeded %d users in %s\n", saved, time.Since(start).Round(time.Millisecond))
+	return err
+}
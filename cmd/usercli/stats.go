@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"gorepository/stats"
+)
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	repoCfg := repositoryFlags(fs)
+	days := fs.Int("days", stats.DefaultDays, "report signups for this many days, today included")
+	activeWithin := fs.Duration("active-within", stats.DefaultActiveWithin, "count users who have logged in this recently as active")
+	topDomains := fs.Int("top-domains", 0, "report this many email domains (default 10)")
+	asJSON := fs.Bool("json", false, "print the report as JSON, as GET /stats/users returns it")
+	fs.Parse(args)
+
+	repo, cleanup, err := openRepository(repoCfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	reporter := &stats.Reporter{Repo: repo, Days: *days, ActiveWithin: *activeWithin, TopDomains: *topDomains}
+	report, err := reporter.Refresh()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	fmt.Print(report)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Command userserver serves the user API over HTTP.
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gorepository/di"
+)
+
+// shutdownTimeout is how long requests in flight get to finish on shutdown.
+const shutdownTimeout = 30 * time.Second
+
+// notificationWorkers is how many notifications are sent at once.
+const notificationWorkers = 4
+
+func main() {
+	app, cleanup, err := di.InitializeApp()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cleanup()
+
+	if app.Config.SecretsRefresh > 0 {
+		for _, secret := range app.Config.Secrets() {
+			stop := secret.RefreshEvery(app.Config.SecretsRefresh, log.Default())
+			defer stop()
+		}
+	}
+
+	// Settings such as CACHE_TTL and LOG_QUERIES are reloaded on SIGHUP,
+	// and when CONFIG_FILE changes.
+	stopSignals := app.Live.WatchSignals(log.Default())
+	defer stopSignals()
+	if app.Config.ConfigFile != "" {
+		stop := app.Live.WatchFile(app.Config.ConfigFile, 5*time.Second, log.Default())
+		defer stop()
+	}
+
+	if app.Config.RetentionInterval > 0 {
+		stop := app.Retention.Schedule(app.Config.RetentionInterval, log.Default())
+		defer stop()
+	}
+
+	if app.Notifications != nil {
+		stop := app.Notifications.Start(notificationWorkers)
+		defer stop()
+	}
+
+	// On SIGINT or SIGTERM, finish the requests in flight and return, so
+	// the deferred cleanup flushes any buffered writes before exiting.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server := &http.Server{Addr: app.Config.HTTPAddr, Handler: app.Server.Handler()}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Printf("listening on %s", app.Config.HTTPAddr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Print(err)
+		return
+	}
+	<-shutdown
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gorepository/repository"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// input is a single line of text being typed.
+type input struct {
+	label string
+	value []rune
+}
+
+// update applies a key to the text. Keys that don't edit text are ignored.
+func (in *input) update(key tea.KeyMsg) {
+	switch key.Type {
+	case tea.KeyRunes, tea.KeySpace:
+		in.value = append(in.value, key.Runes...)
+	case tea.KeyBackspace:
+		if len(in.value) > 0 {
+			in.value = in.value[:len(in.value)-1]
+		}
+	case tea.KeyCtrlU:
+		in.value = nil
+	}
+}
+
+func (in *input) String() string {
+	return strings.TrimSpace(string(in.value))
+}
+
+// form edits a user's name, email and phone number: a new user if user has
+// no ID, otherwise a copy of an existing one.
+type form struct {
+	user   repository.User
+	inputs []*input
+	focus  int
+}
+
+func newForm(user repository.User) *form {
+	var phone string
+	if user.Phone != nil {
+		phone = *user.Phone
+	}
+	return &form{user: user, inputs: []*input{
+		{label: "Name", value: []rune(user.Name)},
+		{label: "Email", value: []rune(user.Email)},
+		{label: "Phone", value: []rune(phone)},
+	}}
+}
+
+// update applies a key to the focused field, or moves between fields.
+func (f *form) update(key tea.KeyMsg) {
+	switch key.Type {
+	case tea.KeyTab, tea.KeyDown:
+		f.focus = (f.focus + 1) % len(f.inputs)
+	case tea.KeyShiftTab, tea.KeyUp:
+		f.focus = (f.focus + len(f.inputs) - 1) % len(f.inputs)
+	default:
+		f.inputs[f.focus].update(key)
+	}
+}
+
+// result returns the user with the fields as typed.
+func (f *form) result() *repository.User {
+	user := f.user
+	user.Name, user.Email = f.inputs[0].String(), f.inputs[1].String()
+	user.Phone = nil
+	if phone := f.inputs[2].String(); phone != "" {
+		user.Phone = &phone
+	}
+	return &user
+}
+
+func (f *form) view() string {
+	var b strings.Builder
+	if f.user.ID == 0 {
+		b.WriteString("New user\n\n")
+	} else {
+		fmt.Fprintf(&b, "Edit user %d\n\n", f.user.ID)
+	}
+	for i, in := range f.inputs {
+		marker, cursor := "  ", ""
+		if i == f.focus {
+			marker, cursor = "> ", "_"
+		}
+		fmt.Fprintf(&b, "%s%-6s %s%s\n", marker, in.label+":", string(in.value), cursor)
+	}
+	return b.String()
+}
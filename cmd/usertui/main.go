@@ -0,0 +1,60 @@
+// Command usertui is a terminal UI for browsing and editing users. It
+// works through the same UserService as the HTTP API, against whichever
+// backend is configured, read from the environment and $CONFIG_FILE as
+// userserver reads it.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"gorepository/di"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// notificationWorkers is how many notifications are sent at once. Edits
+// are made one at a time here, so one is enough.
+const notificationWorkers = 1
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "usertui:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	logFile := flag.String("log", "", "write logs to this file; by default they are discarded, as they would garble the screen")
+	pageSize := flag.Int("page-size", 20, "users shown at a time")
+	flag.Parse()
+
+	if *logFile != "" {
+		f, err := tea.LogToFile(*logFile, "usertui: ")
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	} else {
+		log.SetOutput(io.Discard)
+	}
+
+	app, cleanup, err := di.InitializeApp()
+	if err != nil {
+		return err
+	}
+	// Flushes any buffered writes once the UI has closed
+	defer cleanup()
+
+	// Users edited here are notified as they would be through the API
+	if app.Notifications != nil {
+		stop := app.Notifications.Start(notificationWorkers)
+		defer stop()
+	}
+
+	_, err = tea.NewProgram(newModel(app.Users, *pageSize), tea.WithAltScreen()).Run()
+	return err
+}
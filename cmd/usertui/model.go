@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gorepository/repository"
+	"gorepository/service"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// mode is what the keyboard is being used for.
+type mode int
+
+const (
+	browsing mode = iota
+	searching
+	editing
+	confirmingDelete
+)
+
+const browseHelp = "↑/↓ select · n/p next/previous page · / search · a add · e edit · d delete · r reload · q quit"
+
+// model is the UI's state. It reaches users only through the service, and
+// does so in commands, so the screen never waits on the backend.
+type model struct {
+	users    *service.UserService
+	pageSize int
+	mode     mode
+
+	page repository.Page[*repository.User]
+	// cursor is the cursor page was read from, and query the name prefix
+	// searched for, if page holds search results.
+	cursor   string
+	query    string
+	selected int
+
+	search input
+	form   *form
+	// status reports the last thing done, or the last error.
+	status string
+}
+
+func newModel(users *service.UserService, pageSize int) *model {
+	return &model{users: users, pageSize: pageSize, search: input{label: "Search"}}
+}
+
+// Messages carrying the results of commands.
+type (
+	pageMsg struct {
+		page   repository.Page[*repository.User]
+		cursor string
+		query  string
+	}
+	savedMsg struct {
+		user    *repository.User
+		created bool
+	}
+	deletedMsg struct{ id int }
+	errMsg     struct{ err error }
+)
+
+func (m *model) Init() tea.Cmd {
+	return m.load("", "")
+}
+
+// load reads the page of users at cursor, or the users whose name starts
+// with query if it is set.
+func (m *model) load(cursor, query string) tea.Cmd {
+	return func() tea.Msg {
+		var page repository.Page[*repository.User]
+		var err error
+		if query != "" {
+			page, err = m.users.SearchUsers(query, repository.Limit(m.pageSize))
+		} else {
+			page, err = m.users.ListUsers(cursor, m.pageSize)
+		}
+		if err != nil {
+			return errMsg{err}
+		}
+		return pageMsg{page, cursor, query}
+	}
+}
+
+// reload reads the page being shown again.
+func (m *model) reload() tea.Cmd {
+	return m.load(m.cursor, m.query)
+}
+
+func (m *model) save(user *repository.User) tea.Cmd {
+	return func() tea.Msg {
+		if user.ID == 0 {
+			if err := m.users.CreateUser(user); err != nil {
+				return errMsg{err}
+			}
+			return savedMsg{user, true}
+		}
+		if err := m.users.UpdateUser(user); err != nil {
+			return errMsg{err}
+		}
+		return savedMsg{user, false}
+	}
+}
+
+func (m *model) delete(id int) tea.Cmd {
+	return func() tea.Msg {
+		if err := m.users.DeleteUser(id); err != nil {
+			return errMsg{err}
+		}
+		return deletedMsg{id}
+	}
+}
+
+func (m *model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case pageMsg:
+		m.page, m.cursor, m.query = msg.page, msg.cursor, msg.query
+		m.selected = min(m.selected, max(len(m.page.Items)-1, 0))
+		return m, nil
+	case savedMsg:
+		m.mode, m.form = browsing, nil
+		verb := "Updated"
+		if msg.created {
+			verb = "Created"
+		}
+		m.status = fmt.Sprintf("%s user %d", verb, msg.user.ID)
+		return m, m.reload()
+	case deletedMsg:
+		m.status = fmt.Sprintf("Deleted user %d; it can be restored until purged", msg.id)
+		return m, m.reload()
+	case errMsg:
+		// A form stays open to fix what was wrong
+		m.status = "Error: " + msg.err.Error()
+		return m, nil
+	case tea.KeyMsg:
+		if msg.Type == tea.KeyCtrlC {
+			return m, tea.Quit
+		}
+		return m.updateKey(msg)
+	}
+	return m, nil
+}
+
+func (m *model) updateKey(key tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch m.mode {
+	case searching:
+		switch key.Type {
+		case tea.KeyEnter:
+			m.mode, m.selected = browsing, 0
+			return m, m.load("", m.search.String())
+		case tea.KeyEsc:
+			m.mode = browsing
+		default:
+			m.search.update(key)
+		}
+		return m, nil
+
+	case editing:
+		switch key.Type {
+		case tea.KeyEnter:
+			return m, m.save(m.form.result())
+		case tea.KeyEsc:
+			m.mode, m.form, m.status = browsing, nil, ""
+		default:
+			m.form.update(key)
+		}
+		return m, nil
+
+	case confirmingDelete:
+		m.mode = browsing
+		if user := m.current(); user != nil && key.String() == "y" {
+			return m, m.delete(user.ID)
+		}
+		m.status = ""
+		return m, nil
+	}
+
+	switch key.String() {
+	case "q":
+		return m, tea.Quit
+	case "up", "k":
+		m.selected = max(m.selected-1, 0)
+	case "down", "j":
+		m.selected = min(m.selected+1, max(len(m.page.Items)-1, 0))
+	case "n":
+		if m.page.Next != "" {
+			m.selected = 0
+			return m, m.load(m.page.Next, "")
+		}
+	case "p":
+		if m.page.Prev != "" {
+			m.selected = 0
+			return m, m.load(m.page.Prev, "")
+		}
+	case "/":
+		m.mode, m.search.value = searching, nil
+	case "esc":
+		// Back from search results to the list
+		if m.query != "" {
+			m.selected = 0
+			return m, m.load("", "")
+		}
+	case "r":
+		return m, m.reload()
+	case "a":
+		m.mode, m.form, m.status = editing, newForm(repository.User{}), ""
+	case "e":
+		if user := m.current(); user != nil {
+			m.mode, m.form, m.status = editing, newForm(*user), ""
+		}
+	case "d":
+		if user := m.current(); user != nil {
+			m.mode = confirmingDelete
+			m.status = fmt.Sprintf("Delete user %d, %s? (y/n)", user.ID, user.Name)
+		}
+	}
+	return m, nil
+}
+
+// current returns the selected user, or nil if there are none.
+func (m *model) current() *repository.User {
+	if m.selected < len(m.page.Items) {
+		return m.page.Items[m.selected]
+	}
+	return nil
+}
+
+func (m *model) View() string {
+	var b strings.Builder
+	if m.mode == editing {
+		b.WriteString(m.form.view())
+		fmt.Fprintf(&b, "\n%s\n\ntab next field · enter save · esc cancel\n", m.status)
+		return b.String()
+	}
+
+	if m.query != "" {
+		fmt.Fprintf(&b, "Users named %q (esc to list all)\n\n", m.query)
+	} else {
+		fmt.Fprintf(&b, "Users (%d in all)\n\n", m.page.Total)
+	}
+	fmt.Fprintf(&b, "  %-6s %-24s %-32s %s\n", "ID", "Name", "Email", "Status")
+	for i, user := range m.page.Items {
+		marker := "  "
+		if i == m.selected {
+			marker = "> "
+		}
+		fmt.Fprintf(&b, "%s%-6d %-24s %-32s %s\n", marker, user.ID, truncate(user.Name, 24), truncate(user.Email, 32), user.Status)
+	}
+	if len(m.page.Items) == 0 {
+		b.WriteString("  No users\n")
+	}
+
+	b.WriteString("\n")
+	if m.mode == searching {
+		fmt.Fprintf(&b, "Search names starting with: %s_\n", string(m.search.value))
+	} else {
+		b.WriteString(m.status + "\n")
+	}
+	b.WriteString("\n" + browseHelp + "\n")
+	return b.String()
+}
+
+// truncate shortens s to at most n runes, marking where it was cut.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"gorepository/repository"
+	"gorepository/service"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// send gives m each message in turn, running the commands it returns as
+// the program would, until it has nothing more to do or quits.
+func send(m *model, msgs ...tea.Msg) {
+	for _, msg := range msgs {
+		_, cmd := m.Update(msg)
+		for cmd != nil {
+			next := cmd()
+			if _, ok := next.(tea.QuitMsg); ok {
+				return
+			}
+			_, cmd = m.Update(next)
+		}
+	}
+}
+
+func typed(s string) tea.KeyMsg {
+	return tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)}
+}
+
+func key(t tea.KeyType) tea.KeyMsg {
+	return tea.KeyMsg{Type: t}
+}
+
+func newTestModel(t *testing.T, n int) (*model, *repository.MemoryUserRepository) {
+	repo := repository.NewMemoryUserRepository()
+	for i := 1; i <= n; i++ {
+		require.NoError(t, repo.SaveUser(&repository.User{Name: fmt.Sprintf("User %d", i), Email: fmt.Sprintf("user%d@example.com", i)}))
+	}
+	m := newModel(&service.UserService{Repo: repo}, 2)
+	send(m, m.Init()())
+	return m, repo
+}
+
+func TestBrowse(t *testing.T) {
+	m, _ := newTestModel(t, 3)
+	assert.Contains(t, m.View(), "Users (3 in all)")
+	assert.Contains(t, m.View(), "> 1      User 1")
+
+	// Page forward and back, selecting as we go
+	send(m, typed("j"), typed("n"))
+	assert.Equal(t, 3, m.current().ID)
+	send(m, typed("p"), typed("j"))
+	assert.Equal(t, 2, m.current().ID)
+
+	// Searching shows the matches until esc
+	send(m, typed("/"), typed("User 3"), key(tea.KeyEnter))
+	assert.Contains(t, m.View(), `Users named "User 3"`)
+	require.Len(t, m.page.Items, 1)
+	send(m, key(tea.KeyEsc))
+	assert.Len(t, m.page.Items, 2)
+}
+
+func TestCreateAndEdit(t *testing.T) {
+	m, repo := newTestModel(t, 0)
+	assert.Contains(t, m.View(), "No users")
+
+	send(m, typed("a"), typed("Jane Doe"), key(tea.KeyTab), typed("jane.doe@example.com"), key(tea.KeyTab), typed("not a phone"), key(tea.KeyEnter))
+
+	// A user the service won't take keeps the form open
+	assert.Equal(t, editing, m.mode)
+	assert.Contains(t, m.View(), "Error: ")
+
+	send(m, key(tea.KeyCtrlU), key(tea.KeyEnter))
+	assert.Equal(t, browsing, m.mode)
+	assert.Contains(t, m.View(), "Created user 1")
+
+	send(m, typed("e"), key(tea.KeyBackspace), key(tea.KeyBackspace), key(tea.KeyBackspace), typed("Smith"), key(tea.KeyEnter))
+	assert.Contains(t, m.View(), "Updated user 1")
+	user, err := repo.FindUserByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Smith", user.Name)
+	assert.Equal(t, "jane.doe@example.com", user.Email)
+}
+
+func TestDelete(t *testing.T) {
+	m, repo := newTestModel(t, 2)
+
+	// Anything but y leaves the user be
+	send(m, typed("d"), typed("n"))
+	_, err := repo.FindUserByID(1)
+	require.NoError(t, err)
+
+	send(m, typed("d"))
+	assert.Contains(t, m.View(), "Delete user 1, User 1? (y/n)")
+	send(m, typed("y"))
+	assert.Contains(t, m.View(), "Deleted user 1")
+	assert.Len(t, m.page.Items, 1)
+
+	// It was only soft-deleted
+	_, err = repo.RestoreUser(1)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,505 @@
+// Package config loads application settings from the environment.
+//
+// Settings can also be kept in a file named by $CONFIG_FILE, which
+// overrides the environment. A Live config re-reads it on SIGHUP or when
+// it changes, for the settings that can change without a restart.
+//
+// Credentials can instead be kept in a secret store: set
+// $SECRETS_PROVIDER to env, file, vault or aws, and name the secret with
+// $DB_PASSWORD_SECRET, $API_TOKEN_SECRET, $ADMIN_TOKEN_SECRET or
+// $SMTP_PASSWORD_SECRET, and the encryption keys with $ENCRYPTION_KEYS
+// and $ENCRYPTION_INDEX_KEY_SECRET. See the secrets package for how each provider
+// reads its references.
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorepository/secrets"
+)
+
+// Config holds the settings needed to build the application.
+type Config struct {
+	// ConfigFile, when set, holds settings overriding the environment
+	// ($CONFIG_FILE).
+	ConfigFile string
+
+	// DBDriver selects the repository backend ($DB_DRIVER).
+	DBDriver string
+	// DatabaseURL is the backend's connection string ($DATABASE_URL).
+	DatabaseURL string
+	// DatabaseStandbyURLs are Postgres standbys to fail over to, comma
+	// separated in $DATABASE_STANDBY_URLS.
+	DatabaseStandbyURLs []string
+	// DatabaseReplicaURL is a read replica that hedged reads go to
+	// ($DATABASE_REPLICA_URL).
+	DatabaseReplicaURL string
+	// DBSSLMode is the Postgres sslmode, overriding any in DatabaseURL
+	// ($DB_SSLMODE).
+	DBSSLMode string
+	// DBSSLRootCert is a CA bundle to verify Postgres against
+	// ($DB_SSLROOTCERT).
+	DBSSLRootCert string
+	// DBSSLCert and DBSSLKey are a client certificate and key for Postgres
+	// ($DB_SSLCERT, $DB_SSLKEY).
+	DBSSLCert string
+	DBSSLKey  string
+	// RepositoryToken authenticates the remote backend ($REPOSITORY_TOKEN).
+	RepositoryToken string
+	// StatementTimeout bounds each database statement when greater than
+	// zero ($STATEMENT_TIMEOUT).
+	StatementTimeout time.Duration
+
+	// MigrationTargetDriver and MigrationTargetURL name a backend being
+	// migrated to through the repository, which writes are copied to while
+	// the dual_write feature flag is on ($MIGRATION_TARGET_DRIVER,
+	// defaulting to DBDriver, and $MIGRATION_TARGET_URL).
+	MigrationTargetDriver string
+	MigrationTargetURL    string
+	// MigrationStage is how far the migration has got, such as
+	// "dual-write", the default, or "new-primary" ($MIGRATION_STAGE); see
+	// repository.MigrationStage.
+	MigrationStage string
+	// MigrationCompareReads compares finds against the migration's
+	// secondary backend, logging where they differ
+	// ($MIGRATION_COMPARE_READS).
+	MigrationCompareReads bool
+
+	// OperationPolicies sets per-operation timeouts and hedging for
+	// reads, such as "FindUserByID:timeout=200ms:hedge=20ms"
+	// ($OPERATION_POLICIES); see repository.ParsePolicies.
+	OperationPolicies string
+
+	// CacheTTL enables the user cache when greater than zero ($CACHE_TTL).
+	CacheTTL time.Duration
+	// CacheSize caps the user cache ($CACHE_SIZE).
+	CacheSize int
+	// CacheInvalidation drops cached users when other instances change
+	// them, through Postgres notifications ($CACHE_INVALIDATION).
+	CacheInvalidation bool
+	// LogQueries logs every repository call ($LOG_QUERIES).
+	LogQueries bool
+	// Metrics publishes repository metrics through expvar ($METRICS).
+	Metrics bool
+	// WriteBehindInterval batches saves and buffers updates, flushing them
+	// at least this often, when greater than zero ($WRITE_BEHIND_INTERVAL).
+	WriteBehindInterval time.Duration
+	// WriteBehindBatchSize is how many buffered updates trigger a flush
+	// ($WRITE_BEHIND_BATCH_SIZE).
+	WriteBehindBatchSize int
+	// ReadOnly refuses every write while still serving reads, for
+	// migrations and failovers ($READ_ONLY).
+	ReadOnly bool
+	// FeatureFlags switches on behaviours being rolled out, such as
+	// "dual_write,fuzzy_search" ($FEATURE_FLAGS); see features.Parse.
+	FeatureFlags string
+	// PhoneCountryCode is the calling code assumed for phone numbers given
+	// without one, such as "44" ($PHONE_COUNTRY_CODE).
+	PhoneCountryCode string
+	// UserPolicies sets tenant quotas and email rules for new users, such
+	// as "max_users=100,block_disposable" ($USER_POLICIES); see
+	// service.ParseUserPolicies.
+	UserPolicies string
+	// EmailFoldGmail makes Gmail addresses that differ only in dots or a
+	// +tag find the same user ($EMAIL_FOLD_GMAIL).
+	EmailFoldGmail bool
+
+	// HTTPAddr is the address the API server listens on ($HTTP_ADDR).
+	HTTPAddr string
+	// APIToken, when set, is required from API clients ($API_TOKEN).
+	APIToken string
+	// AdminToken enables the API's admin routes and is required by them
+	// ($ADMIN_TOKEN).
+	AdminToken string
+
+	// DBPassword, when set, is the database password, resolved from the
+	// secret named by $DB_PASSWORD_SECRET.
+	DBPassword *secrets.Value
+	// APITokenSecret, when set, supersedes APIToken with the secret named
+	// by $API_TOKEN_SECRET.
+	APITokenSecret *secrets.Value
+	// AdminTokenSecret, when set, supersedes AdminToken with the secret
+	// named by $ADMIN_TOKEN_SECRET.
+	AdminTokenSecret *secrets.Value
+	// SMTPPassword, when set, authenticates with the SMTP server, resolved
+	// from the secret named by $SMTP_PASSWORD_SECRET.
+	SMTPPassword *secrets.Value
+	// EncryptionKeys, when set, encrypts users' personal data at rest.
+	// They are AES keys by ID, base64 encoded, resolved from the secrets
+	// named in $ENCRYPTION_KEYS as comma separated id=secret pairs, such
+	// as "2025=ENC_KEY_2025,2024=ENC_KEY_2024". See
+	// repository.EncryptedUserRepository.
+	EncryptionKeys map[string]*secrets.Value
+	// EncryptionPrimaryKey is the ID of the first key in $ENCRYPTION_KEYS,
+	// which new values are encrypted with. The others only decrypt.
+	EncryptionPrimaryKey string
+	// EncryptionIndexKey is the HMAC key for the blind index, base64
+	// encoded, resolved from the secret named by
+	// $ENCRYPTION_INDEX_KEY_SECRET. EncryptionKeys need it.
+	EncryptionIndexKey *secrets.Value
+	// SecretsRefresh re-reads secrets this often when greater than zero,
+	// so rotated credentials are picked up ($SECRETS_REFRESH).
+	SecretsRefresh time.Duration
+
+	// Notifications tells users about changes to their accounts, such as
+	// welcoming them and alerting them to a suspension ($NOTIFICATIONS).
+	Notifications bool
+	// SMTPAddr is the host:port of the SMTP server notification emails
+	// are sent through ($SMTP_ADDR). Without it they are only logged.
+	SMTPAddr string
+	// SMTPFrom is the address they are sent from ($SMTP_FROM).
+	SMTPFrom string
+	// SMTPUsername authenticates with the SMTP server, along with
+	// SMTPPassword ($SMTP_USERNAME).
+	SMTPUsername string
+
+	// RetentionInterval schedules the retention job when greater than zero
+	// ($RETENTION_INTERVAL).
+	RetentionInterval time.Duration
+	// RetentionUnverifiedAfter is how long unverified users are kept, or
+	// zero to keep them ($RETENTION_UNVERIFIED_AFTER).
+	RetentionUnverifiedAfter time.Duration
+	// RetentionInactiveAfter anonymizes users who haven't logged in for
+	// this long, when greater than zero ($RETENTION_INACTIVE_AFTER).
+	RetentionInactiveAfter time.Duration
+	// RetentionDryRun logs what the retention job would do instead of
+	// doing it ($RETENTION_DRY_RUN).
+	RetentionDryRun bool
+
+	// StatsMaxAge is how long user statistics are served before they are
+	// computed again ($STATS_MAX_AGE); see stats.Reporter.MaxAge.
+	StatsMaxAge time.Duration
+}
+
+// Load reads Config from the environment, overlaid with $CONFIG_FILE if
+// set, using the example defaults for anything unset.
+func Load() (Config, error) {
+	env, err := environment()
+	if err != nil {
+		return Config{}, err
+	}
+	cfg, err := load(env)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := cfg.loadSecrets(env); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// load reads every setting but the secrets from env.
+func load(env source) (Config, error) {
+	cfg := Config{
+		ConfigFile:         os.Getenv("CONFIG_FILE"),
+		DBDriver:           env.getenv("DB_DRIVER", "postgres"),
+		DatabaseURL:        env.getenv("DATABASE_URL", "user=youruser dbname=yourdb sslmode=disable"),
+		DBSSLMode:          env.get("DB_SSLMODE"),
+		DatabaseReplicaURL: env.get("DATABASE_REPLICA_URL"),
+		OperationPolicies:  env.get("OPERATION_POLICIES"),
+		MigrationTargetURL: env.get("MIGRATION_TARGET_URL"),
+		MigrationStage:     env.get("MIGRATION_STAGE"),
+		FeatureFlags:       env.get("FEATURE_FLAGS"),
+		DBSSLRootCert:      env.get("DB_SSLROOTCERT"),
+		DBSSLCert:          env.get("DB_SSLCERT"),
+		DBSSLKey:           env.get("DB_SSLKEY"),
+		RepositoryToken:    env.get("REPOSITORY_TOKEN"),
+		PhoneCountryCode:   strings.TrimPrefix(env.get("PHONE_COUNTRY_CODE"), "+"),
+		UserPolicies:       env.get("USER_POLICIES"),
+		HTTPAddr:           env.getenv("HTTP_ADDR", ":8080"),
+		APIToken:           env.get("API_TOKEN"),
+		AdminToken:         env.get("ADMIN_TOKEN"),
+		SMTPAddr:           env.get("SMTP_ADDR"),
+		SMTPFrom:           env.getenv("SMTP_FROM", "no-reply@example.com"),
+		SMTPUsername:       env.get("SMTP_USERNAME"),
+	}
+
+	cfg.MigrationTargetDriver = env.getenv("MIGRATION_TARGET_DRIVER", cfg.DBDriver)
+
+	if standbys := env.get("DATABASE_STANDBY_URLS"); standbys != "" {
+		for _, url := range strings.Split(standbys, ",") {
+			cfg.DatabaseStandbyURLs = append(cfg.DatabaseStandbyURLs, strings.TrimSpace(url))
+		}
+	}
+
+	var err error
+	if cfg.StatementTimeout, err = env.getDuration("STATEMENT_TIMEOUT", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.CacheTTL, err = env.getDuration("CACHE_TTL", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.CacheSize, err = env.getInt("CACHE_SIZE", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.CacheInvalidation, err = env.getBool("CACHE_INVALIDATION", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.LogQueries, err = env.getBool("LOG_QUERIES", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.Metrics, err = env.getBool("METRICS", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.EmailFoldGmail, err = env.getBool("EMAIL_FOLD_GMAIL", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.ReadOnly, err = env.getBool("READ_ONLY", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.MigrationCompareReads, err = env.getBool("MIGRATION_COMPARE_READS", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.WriteBehindInterval, err = env.getDuration("WRITE_BEHIND_INTERVAL", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.WriteBehindBatchSize, err = env.getInt("WRITE_BEHIND_BATCH_SIZE", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.Notifications, err = env.getBool("NOTIFICATIONS", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.RetentionInterval, err = env.getDuration("RETENTION_INTERVAL", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.RetentionUnverifiedAfter, err = env.getDuration("RETENTION_UNVERIFIED_AFTER", 30*24*time.Hour); err != nil {
+		return Config{}, err
+	}
+	if cfg.RetentionInactiveAfter, err = env.getDuration("RETENTION_INACTIVE_AFTER", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.RetentionDryRun, err = env.getBool("RETENTION_DRY_RUN", false); err != nil {
+		return Config{}, err
+	}
+	if cfg.StatsMaxAge, err = env.getDuration("STATS_MAX_AGE", 5*time.Minute); err != nil {
+		return Config{}, err
+	}
+	if cfg.SecretsRefresh, err = env.getDuration("SECRETS_REFRESH", 0); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// EncryptionKeyValues returns the value of each of EncryptionKeys by ID.
+func (cfg Config) EncryptionKeyValues() map[string]string {
+	keys := make(map[string]string, len(cfg.EncryptionKeys))
+	for id, value := range cfg.EncryptionKeys {
+		keys[id] = value.Get()
+	}
+	return keys
+}
+
+// Secrets returns the secrets the config was resolved from, for refreshing.
+// The encryption keys are left out, since they are only read at startup.
+func (cfg Config) Secrets() []*secrets.Value {
+	var values []*secrets.Value
+	for _, value := range []*secrets.Value{cfg.DBPassword, cfg.APITokenSecret, cfg.AdminTokenSecret, cfg.SMTPPassword} {
+		if value != nil {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func (cfg *Config) loadSecrets(env source) error {
+	wanted := []struct {
+		key   string
+		value **secrets.Value
+	}{
+		{"DB_PASSWORD_SECRET", &cfg.DBPassword},
+		{"API_TOKEN_SECRET", &cfg.APITokenSecret},
+		{"ADMIN_TOKEN_SECRET", &cfg.AdminTokenSecret},
+		{"SMTP_PASSWORD_SECRET", &cfg.SMTPPassword},
+	}
+	var provider secrets.Provider
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	resolve := func(key, ref string) (*secrets.Value, error) {
+		if provider == nil {
+			var err error
+			if provider, err = secretsProvider(env); err != nil {
+				return nil, err
+			}
+		}
+		value, err := secrets.Resolve(ctx, provider, ref)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s: %w", key, err)
+		}
+		return value, nil
+	}
+
+	for _, secret := range wanted {
+		ref := env.get(secret.key)
+		if ref == "" {
+			continue
+		}
+		value, err := resolve(secret.key, ref)
+		if err != nil {
+			return err
+		}
+		*secret.value = value
+	}
+
+	keys := env.get("ENCRYPTION_KEYS")
+	if keys == "" {
+		return nil
+	}
+	cfg.EncryptionKeys = map[string]*secrets.Value{}
+	for _, pair := range strings.Split(keys, ",") {
+		id, ref, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" || ref == "" {
+			return fmt.Errorf("config: ENCRYPTION_KEYS: want id=secret, not %q", pair)
+		}
+		if _, dup := cfg.EncryptionKeys[id]; dup {
+			return fmt.Errorf("config: ENCRYPTION_KEYS: key %q given twice", id)
+		}
+		value, err := resolve("ENCRYPTION_KEYS", ref)
+		if err != nil {
+			return err
+		}
+		cfg.EncryptionKeys[id] = value
+		if cfg.EncryptionPrimaryKey == "" {
+			cfg.EncryptionPrimaryKey = id
+		}
+	}
+	ref := env.get("ENCRYPTION_INDEX_KEY_SECRET")
+	if ref == "" {
+		return fmt.Errorf("config: ENCRYPTION_KEYS needs ENCRYPTION_INDEX_KEY_SECRET")
+	}
+	var err error
+	cfg.EncryptionIndexKey, err = resolve("ENCRYPTION_INDEX_KEY_SECRET", ref)
+	return err
+}
+
+// secretsProvider builds the provider chosen by $SECRETS_PROVIDER.
+func secretsProvider(env source) (secrets.Provider, error) {
+	switch provider := env.getenv("SECRETS_PROVIDER", "env"); provider {
+	case "env":
+		return secrets.Env{}, nil
+	case "file":
+		return secrets.File{Dir: env.getenv("SECRETS_DIR", "/run/secrets")}, nil
+	case "vault":
+		if env.get("VAULT_ADDR") == "" {
+			return nil, fmt.Errorf("config: SECRETS_PROVIDER=vault needs VAULT_ADDR")
+		}
+		vault := secrets.NewVault(env.get("VAULT_ADDR"), env.get("VAULT_TOKEN"))
+		vault.Mount = env.getenv("VAULT_MOUNT", vault.Mount)
+		return vault, nil
+	case "aws":
+		if env.get("AWS_REGION") == "" || env.get("AWS_ACCESS_KEY_ID") == "" {
+			return nil, fmt.Errorf("config: SECRETS_PROVIDER=aws needs AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		return secrets.NewAWSSecretsManager(
+			env.get("AWS_REGION"),
+			env.get("AWS_ACCESS_KEY_ID"),
+			env.get("AWS_SECRET_ACCESS_KEY"),
+			env.get("AWS_SESSION_TOKEN"),
+		), nil
+	default:
+		return nil, fmt.Errorf("config: SECRETS_PROVIDER: unknown provider %q (want env, file, vault or aws)", provider)
+	}
+}
+
+// source looks settings up by name.
+type source func(key string) (string, bool)
+
+// environment returns the process environment overlaid with the settings
+// in $CONFIG_FILE, which win so that editing the file and reloading
+// changes them.
+func environment() (source, error) {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return os.LookupEnv, nil
+	}
+	settings, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return func(key string) (string, bool) {
+		if value, ok := settings[key]; ok {
+			return value, true
+		}
+		return os.LookupEnv(key)
+	}, nil
+}
+
+// readFile reads KEY=VALUE settings, one per line, as in a .env file.
+// Blank lines and lines starting with # are skipped, and values may be
+// quoted.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	settings := map[string]string{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("config: %s:%d: want KEY=VALUE", path, n+1)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		settings[strings.TrimSpace(key)] = value
+	}
+	return settings, nil
+}
+
+func (env source) get(key string) string {
+	value, _ := env(key)
+	return value
+}
+
+func (env source) getenv(key, fallback string) string {
+	if value, ok := env(key); ok {
+		return value
+	}
+	return fallback
+}
+
+func (env source) getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := env(key)
+	if !ok {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("config: %s: %w", key, err)
+	}
+	return d, nil
+}
+
+func (env source) getInt(key string, fallback int) (int, error) {
+	value, ok := env(key)
+	if !ok {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("config: %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func (env source) getBool(key string, fallback bool) (bool, error) {
+	value, ok := env(key)
+	if !ok {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("config: %s: %w", key, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	t.Setenv("DB_DRIVER", "memory")
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "memory", cfg.DBDriver)
+	assert.Equal(t, time.Duration(0), cfg.CacheTTL)
+	assert.False(t, cfg.Metrics)
+}
+
+func TestLoad(t *testing.T) {
+	t.Setenv("CACHE_TTL", "30s")
+	t.Setenv("CACHE_SIZE", "500")
+	t.Setenv("METRICS", "true")
+	t.Setenv("STATEMENT_TIMEOUT", "2s")
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, cfg.StatementTimeout)
+	assert.Equal(t, 30*time.Second, cfg.CacheTTL)
+	assert.Equal(t, 500, cfg.CacheSize)
+	assert.True(t, cfg.Metrics)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Setenv("CACHE_TTL", "soon")
+
+	_, err := Load()
+	assert.ErrorContains(t, err, "CACHE_TTL")
+}
+
+func TestLoadSecrets(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "db_password"), []byte("hunter2\n"), 0o600))
+	t.Setenv("SECRETS_PROVIDER", "file")
+	t.Setenv("SECRETS_DIR", dir)
+	t.Setenv("DB_PASSWORD_SECRET", "db_password")
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", cfg.DBPassword.Get())
+	assert.Nil(t, cfg.APITokenSecret)
+	assert.Len(t, cfg.Secrets(), 1)
+
+	// A secret that can't be found stops startup
+	t.Setenv("API_TOKEN_SECRET", "api_token")
+	_, err = Load()
+	assert.ErrorContains(t, err, "API_TOKEN_SECRET")
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	t.Setenv("KEY_NEW", "bmV3")
+	t.Setenv("KEY_OLD", "b2xk")
+	t.Setenv("ENCRYPTION_KEYS", "new=KEY_NEW, old=KEY_OLD")
+
+	// The index key is needed too
+	_, err := Load()
+	assert.ErrorContains(t, err, "ENCRYPTION_INDEX_KEY_SECRET")
+
+	t.Setenv("INDEX_KEY", "aW5kZXg=")
+	t.Setenv("ENCRYPTION_INDEX_KEY_SECRET", "INDEX_KEY")
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, "new", cfg.EncryptionPrimaryKey)
+	assert.Equal(t, map[string]string{"new": "bmV3", "old": "b2xk"}, cfg.EncryptionKeyValues())
+	assert.Equal(t, "aW5kZXg=", cfg.EncryptionIndexKey.Get())
+	assert.Empty(t, cfg.Secrets())
+
+	t.Setenv("ENCRYPTION_KEYS", "new")
+	_, err = Load()
+	assert.ErrorContains(t, err, "want id=secret")
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.env")
+	assert.NoError(t, os.WriteFile(path, []byte("# Overrides\nCACHE_TTL = 1m\n\nHTTP_ADDR=\":9090\"\n"), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("CACHE_TTL", "30s")
+	t.Setenv("CACHE_SIZE", "500")
+
+	// The file wins over the environment, which fills in the rest
+	cfg, err := Load()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, cfg.CacheTTL)
+	assert.Equal(t, ":9090", cfg.HTTPAddr)
+	assert.Equal(t, 500, cfg.CacheSize)
+
+	assert.NoError(t, os.WriteFile(path, []byte("CACHE_TTL\n"), 0o600))
+	_, err = Load()
+	assert.ErrorContains(t, err, "app.env:1")
+}
+
+func TestLiveReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.env")
+	assert.NoError(t, os.WriteFile(path, []byte("CACHE_TTL=1m\n"), 0o600))
+	t.Setenv("CONFIG_FILE", path)
+
+	cfg, err := Load()
+	assert.NoError(t, err)
+	live := NewLive(cfg)
+
+	var reloaded []Config
+	live.Subscribe(func(cfg Config) { reloaded = append(reloaded, cfg) })
+
+	// Subscribers see the new settings
+	assert.NoError(t, os.WriteFile(path, []byte("CACHE_TTL=5m\nLOG_QUERIES=true\n"), 0o600))
+	assert.NoError(t, live.Reload())
+	assert.Equal(t, 5*time.Minute, live.Current().CacheTTL)
+	assert.Len(t, reloaded, 1)
+	assert.True(t, reloaded[0].LogQueries)
+
+	// A bad file keeps the current settings
+	assert.NoError(t, os.WriteFile(path, []byte("CACHE_TTL=soon\n"), 0o600))
+	assert.ErrorContains(t, live.Reload(), "CACHE_TTL")
+	assert.Equal(t, 5*time.Minute, live.Current().CacheTTL)
+	assert.Len(t, reloaded, 1)
+}
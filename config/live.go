@@ -0,0 +1,139 @@
+package config
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Live holds the running Config and reloads it from the environment and
+// $CONFIG_FILE on request, passing the new Config to subscribers so they
+// can apply what changed.
+//
+// Only some settings take effect without a restart: MigrationStage,
+// MigrationCompareReads, OperationPolicies, CacheTTL, LogQueries, ReadOnly
+// and FeatureFlags. The rest, such as the database connection, are read
+// once at startup. Secrets are not reloaded; they have SecretsRefresh.
+type Live struct {
+	mu          sync.RWMutex
+	current     Config
+	subscribers []func(Config)
+	load        func() (Config, error)
+}
+
+func NewLive(cfg Config) *Live {
+	return &Live{current: cfg, load: func() (Config, error) {
+		env, err := environment()
+		if err != nil {
+			return Config{}, err
+		}
+		return load(env)
+	}}
+}
+
+// Current returns the Config as of the last successful reload.
+func (l *Live) Current() Config {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.current
+}
+
+// Subscribe calls fn with the new Config after every successful reload.
+func (l *Live) Subscribe(fn func(Config)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subscribers = append(l.subscribers, fn)
+}
+
+// Reload reads the Config again and notifies subscribers. If it can't be
+// read, the current Config is kept and nobody is notified.
+func (l *Live) Reload() error {
+	cfg, err := l.load()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	cfg.DBPassword = l.current.DBPassword
+	cfg.APITokenSecret = l.current.APITokenSecret
+	cfg.AdminTokenSecret = l.current.AdminTokenSecret
+	cfg.SMTPPassword = l.current.SMTPPassword
+	l.current = cfg
+	subscribers := append([]func(Config){}, l.subscribers...)
+	l.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(cfg)
+	}
+	return nil
+}
+
+// WatchSignals reloads on SIGHUP until the returned function is called.
+// Failures are logged and the current Config kept.
+func (l *Live) WatchSignals(logger *log.Logger) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				l.reload(logger)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// WatchFile checks path every interval and reloads when it has been
+// modified, until the returned function is called.
+func (l *Live) WatchFile(path string, interval time.Duration, logger *log.Logger) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	modified := modTime(path)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if m := modTime(path); !m.Equal(modified) {
+					modified = m
+					l.reload(logger)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+func (l *Live) reload(logger *log.Logger) {
+	if err := l.Reload(); err != nil {
+		logger.Printf("config: reload failed, keeping current settings: %v", err)
+		return
+	}
+	logger.Printf("config: reloaded")
+}
+
+// modTime returns when path was last modified, or the zero time if it
+// can't be read.
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,250 @@
+// Package di wires the application's object graph together with
+// google/wire. Providers live here; the injector is declared in wire.go
+// and generated into wire_gen.go by `go generate ./di`.
+package di
+
+import (
+	"errors"
+	"log"
+
+	"gorepository/api"
+	"gorepository/audit"
+	"gorepository/config"
+	"gorepository/events"
+	"gorepository/features"
+	"gorepository/notifications"
+	"gorepository/repository"
+	"gorepository/retention"
+	"gorepository/service"
+	"gorepository/stats"
+
+	"github.com/google/wire"
+)
+
+// App is the fully wired application.
+type App struct {
+	Config config.Config
+	// Live reloads the settings that can change while running.
+	Live   *config.Live
+	Users  *service.UserService
+	Server *api.Server
+	Events *events.Bus
+	// Retention is scheduled by the server when Config.RetentionInterval
+	// is set.
+	Retention *retention.Engine
+	// Notifications is started by userserver and usertui; it is nil unless
+	// Config.Notifications is set.
+	Notifications *notifications.Dispatcher
+}
+
+// ProviderSet provides everything needed to build an App.
+var ProviderSet = wire.NewSet(
+	config.Load,
+	config.NewLive,
+	ProvideLogger,
+	ProvideRepositoryConfig,
+	ProvideUserRepository,
+	ProvideEventBus,
+	wire.Bind(new(events.Publisher), new(*events.Bus)),
+	ProvideAuditRecorder,
+	ProvideFeatureFlags,
+	wire.Bind(new(features.Provider), new(*features.Set)),
+	ProvideUserService,
+	ProvideStatsReporter,
+	ProvideServer,
+	ProvideRetentionEngine,
+	ProvideNotifications,
+	wire.Struct(new(App), "*"),
+)
+
+// ProvideLogger returns the logger used by the logging decorator.
+func ProvideLogger() *log.Logger {
+	return log.Default()
+}
+
+// ProvideRepositoryConfig maps application settings onto the repository
+// factory's configuration. A migration target is migrated to through the
+// repository, copying writes to it while flags has features.DualWrite on.
+// With encryption keys, every backend is encrypted with them.
+func ProvideRepositoryConfig(cfg config.Config, logger *log.Logger, flags features.Provider) (repository.Config, error) {
+	policies, err := repository.ParsePolicies(cfg.OperationPolicies)
+	if err != nil {
+		return repository.Config{}, err
+	}
+	repoCfg := repository.Config{
+		Driver:      cfg.DBDriver,
+		DSN:         cfg.DatabaseURL,
+		StandbyDSNs: cfg.DatabaseStandbyURLs,
+		ReplicaDSN:  cfg.DatabaseReplicaURL,
+		Policies:    policies,
+		Token:       cfg.RepositoryToken,
+		TLS: repository.TLSConfig{
+			Mode:     cfg.DBSSLMode,
+			RootCert: cfg.DBSSLRootCert,
+			Cert:     cfg.DBSSLCert,
+			Key:      cfg.DBSSLKey,
+		},
+		StatementTimeout:  cfg.StatementTimeout,
+		Emails:            repository.EmailNormalizer{FoldGmail: cfg.EmailFoldGmail},
+		CacheTTL:          cfg.CacheTTL,
+		CacheSize:         cfg.CacheSize,
+		CacheInvalidation: cfg.CacheInvalidation,
+		Metrics:           cfg.Metrics,
+		ReadOnly:          cfg.ReadOnly,
+		Reloadable:        true,
+
+		WriteBehindInterval:  cfg.WriteBehindInterval,
+		WriteBehindBatchSize: cfg.WriteBehindBatchSize,
+	}
+	if cfg.MigrationStage != "" && cfg.MigrationTargetURL == "" {
+		return repository.Config{}, errors.New("MIGRATION_STAGE needs MIGRATION_TARGET_URL")
+	}
+	if cfg.MigrationTargetURL != "" {
+		if cfg.MigrationStage != "" {
+			if repoCfg.MigrationStage, err = repository.ParseMigrationStage(cfg.MigrationStage); err != nil {
+				return repository.Config{}, err
+			}
+		}
+		repoCfg.MigrationDriver = cfg.MigrationTargetDriver
+		repoCfg.MigrationDSN = cfg.MigrationTargetURL
+		repoCfg.CompareReads = cfg.MigrationCompareReads
+		repoCfg.MigrationFlags = flags
+	}
+	if cfg.DBPassword != nil {
+		repoCfg.Password = cfg.DBPassword.Get
+	}
+	if len(cfg.EncryptionKeys) > 0 {
+		if repoCfg.Encryption, err = repository.NewKeyring(cfg.EncryptionPrimaryKey, cfg.EncryptionKeyValues(), cfg.EncryptionIndexKey.Get()); err != nil {
+			return repository.Config{}, err
+		}
+	}
+	if cfg.LogQueries {
+		repoCfg.Logger = logger
+	}
+	return repoCfg, nil
+}
+
+// ProvideUserRepository builds the configured backend and its decorators,
+// which are reconfigured whenever live settings are reloaded. The cleanup
+// function closes the backend's database connections.
+func ProvideUserRepository(cfg repository.Config, live *config.Live, logger *log.Logger, flags features.Provider) (repository.UserRepository, func(), error) {
+	repo, cleanup, err := repository.New(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	live.Subscribe(func(cfg config.Config) {
+		repoCfg, err := ProvideRepositoryConfig(cfg, logger, flags)
+		if err != nil {
+			logger.Printf("config: not reconfiguring the repository: %v", err)
+			return
+		}
+		repository.Reconfigure(repo, repoCfg)
+	})
+	return repo, cleanup, nil
+}
+
+// ProvideEventBus returns the in-process bus domain events are published on.
+func ProvideEventBus() *events.Bus {
+	return events.NewBus()
+}
+
+// ProvideAuditRecorder returns where audited actions are recorded.
+func ProvideAuditRecorder(logger *log.Logger) audit.Recorder {
+	return audit.NewLogRecorder(logger)
+}
+
+// ProvideFeatureFlags returns the feature flags enabled in cfg, which are
+// replaced whenever live settings are reloaded.
+func ProvideFeatureFlags(cfg config.Config, live *config.Live, logger *log.Logger) (*features.Set, error) {
+	flags, err := features.Parse(cfg.FeatureFlags)
+	if err != nil {
+		return nil, err
+	}
+	set := features.NewSet(flags...)
+	live.Subscribe(func(cfg config.Config) {
+		flags, err := features.Parse(cfg.FeatureFlags)
+		if err != nil {
+			logger.Printf("config: not changing feature flags: %v", err)
+			return
+		}
+		set.Replace(flags)
+	})
+	return set, nil
+}
+
+// ProvideUserService returns a UserService backed by repo, holding new
+// users to cfg.UserPolicies.
+func ProvideUserService(cfg config.Config, repo repository.UserRepository, publisher events.Publisher, recorder audit.Recorder, flags features.Provider) (*service.UserService, error) {
+	policies, err := service.ParseUserPolicies(cfg.UserPolicies)
+	if err != nil {
+		return nil, err
+	}
+	return &service.UserService{
+		Repo:             repo,
+		Events:           publisher,
+		Audit:            recorder,
+		PhoneCountryCode: cfg.PhoneCountryCode,
+		Policies:         policies,
+		Flags:            flags,
+	}, nil
+}
+
+// ProvideServer returns the HTTP API over users, able to switch the
+// repository's read-only mode and serving reporter's statistics.
+func ProvideServer(cfg config.Config, users *service.UserService, reporter *stats.Reporter) *api.Server {
+	server := api.NewServer(users, cfg.APIToken)
+	server.AdminToken = cfg.AdminToken
+	server.Stats = reporter
+	if readOnly := repository.FindReadOnly(users.Repo); readOnly != nil {
+		server.ReadOnly = readOnly
+	}
+	if cfg.APITokenSecret != nil {
+		server.TokenFunc = cfg.APITokenSecret.Get
+	}
+	if cfg.AdminTokenSecret != nil {
+		server.AdminTokenFunc = cfg.AdminTokenSecret.Get
+	}
+	return server
+}
+
+// ProvideStatsReporter returns the reporter of user statistics over the
+// service's repository, recomputing them at most every cfg.StatsMaxAge.
+func ProvideStatsReporter(cfg config.Config, users *service.UserService) *stats.Reporter {
+	reporter := stats.NewReporter(users.Repo)
+	reporter.MaxAge = cfg.StatsMaxAge
+	return reporter
+}
+
+// ProvideRetentionEngine returns the retention policy engine, carrying out
+// its actions through users.
+func ProvideRetentionEngine(cfg config.Config, users *service.UserService) *retention.Engine {
+	return &retention.Engine{
+		Users:  users,
+		Rules:  retention.Rules(cfg.RetentionUnverifiedAfter, cfg.RetentionInactiveAfter),
+		DryRun: cfg.RetentionDryRun,
+	}
+}
+
+// ProvideNotifications returns the dispatcher notifying users of events
+// on bus, subscribed to it, or nil if notifications are off. Emails go
+// through SMTP when an SMTP server is configured, and are logged
+// otherwise; SMS messages are always logged, as there is no gateway yet.
+func ProvideNotifications(cfg config.Config, users *service.UserService, bus *events.Bus, logger *log.Logger) *notifications.Dispatcher {
+	if !cfg.Notifications {
+		return nil
+	}
+	var email notifications.Notifier = notifications.LogNotifier{Logger: logger}
+	if cfg.SMTPAddr != "" {
+		smtp := &notifications.SMTPNotifier{Addr: cfg.SMTPAddr, From: cfg.SMTPFrom, Username: cfg.SMTPUsername}
+		if cfg.SMTPPassword != nil {
+			smtp.Password = cfg.SMTPPassword.Get
+		}
+		email = smtp
+	}
+	dispatcher := notifications.NewDispatcher(users, map[notifications.Channel]notifications.Notifier{
+		notifications.Email: email,
+		notifications.SMS:   &notifications.SMSNotifier{Logger: logger},
+	}, logger)
+	bus.Subscribe(dispatcher.Handle)
+	return dispatcher
+}
@@ -0,0 +1,12 @@
+//go:build wireinject
+
+package di
+
+import "github.com/google/wire"
+
+// InitializeApp builds the App from the environment. The returned cleanup
+// function releases everything the App holds open.
+func InitializeApp() (*App, func(), error) {
+	wire.Build(ProviderSet)
+	return nil, nil, nil
+}
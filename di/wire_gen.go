@@ -0,0 +1,59 @@
+// Code generated by Wire. DO NOT EDIT.
+
+//go:generate go run -mod=mod github.com/google/wire/cmd/wire
+//go:build !wireinject
+// +build !wireinject
+
+package di
+
+import (
+	"gorepository/config"
+)
+
+// Injectors from wire.go:
+
+// InitializeApp builds the App from the environment. The returned cleanup
+// function releases everything the App holds open.
+func InitializeApp() (*App, func(), error) {
+	configConfig, err := config.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+	live := config.NewLive(configConfig)
+	logger := ProvideLogger()
+	set, err := ProvideFeatureFlags(configConfig, live, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	repositoryConfig, err := ProvideRepositoryConfig(configConfig, logger, set)
+	if err != nil {
+		return nil, nil, err
+	}
+	userRepository, cleanup, err := ProvideUserRepository(repositoryConfig, live, logger, set)
+	if err != nil {
+		return nil, nil, err
+	}
+	bus := ProvideEventBus()
+	recorder := ProvideAuditRecorder(logger)
+	userService, err := ProvideUserService(configConfig, userRepository, bus, recorder, set)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	reporter := ProvideStatsReporter(configConfig, userService)
+	server := ProvideServer(configConfig, userService, reporter)
+	engine := ProvideRetentionEngine(configConfig, userService)
+	dispatcher := ProvideNotifications(configConfig, userService, bus, logger)
+	app := &App{
+		Config:        configConfig,
+		Live:          live,
+		Users:         userService,
+		Server:        server,
+		Events:        bus,
+		Retention:     engine,
+		Notifications: dispatcher,
+	}
+	return app, func() {
+		cleanup()
+	}, nil
+}
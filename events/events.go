@@ -0,0 +1,62 @@
+// Package events carries domain events from the service layer to whoever
+// is interested in them.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	UserCreated     = "UserCreated"
+	UserAnonymized  = "UserAnonymized"
+	UserDeleted     = "UserDeleted"
+	UserUpdated     = "UserUpdated"
+	UserRestored    = "UserRestored"
+	UserPurged      = "UserPurged"
+	UserLoggedIn    = "UserLoggedIn"
+	UserActivated   = "UserActivated"
+	UserSuspended   = "UserSuspended"
+	UserDeactivated = "UserDeactivated"
+)
+
+// Event records something that happened to a user.
+type Event struct {
+	Type   string
+	UserID int
+	At     time.Time
+}
+
+// Publisher accepts events.
+type Publisher interface {
+	Publish(event Event)
+}
+
+// Bus is an in-process Publisher that hands each event to every subscriber,
+// synchronously and in the order they subscribed.
+type Bus struct {
+	mu          sync.RWMutex
+	subscribers []func(Event)
+}
+
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Subscribe calls fn for every event published from now on.
+func (b *Bus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+func (b *Bus) Publish(event Event) {
+	b.mu.RLock()
+	subscribers := b.subscribers
+	b.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
@@ -0,0 +1,20 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+
+	var first, second []Event
+	bus.Subscribe(func(e Event) { first = append(first, e) })
+	bus.Subscribe(func(e Event) { second = append(second, e) })
+
+	// Every subscriber sees every event
+	bus.Publish(Event{Type: UserAnonymized, UserID: 1})
+	assert.Equal(t, []Event{{Type: UserAnonymized, UserID: 1}}, first)
+	assert.Equal(t, first, second)
+}
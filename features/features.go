@@ -0,0 +1,129 @@
+// Package features switches new behaviours on and off while they are
+// rolled out, so a migration can be taken a step at a time and backed out
+// without a deploy. The service layer and repository decorators ask a
+// Provider whether each Flag is enabled; Set is one kept in configuration,
+// and any external flag service can stand in for it by implementing
+// Provider.
+package features
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Flag names a behaviour that can be switched on.
+type Flag string
+
+// Flags.
+const (
+	// DualWrite copies every write to the secondary backend of a
+	// repository.MigratingUserRepository, as well as the primary.
+	DualWrite Flag = "dual_write"
+	// FuzzySearch makes name searches tolerate typos, ranking by how
+	// close names are instead of matching a prefix.
+	FuzzySearch Flag = "fuzzy_search"
+)
+
+// Known lists every flag this build understands.
+var Known = []Flag{DualWrite, FuzzySearch}
+
+// ErrUnknownFlag is returned by Parse for a flag not in Known, which is
+// almost always a typo.
+var ErrUnknownFlag = errors.New("unknown feature flag")
+
+// Provider reports whether flags are enabled. It is asked on every call
+// that depends on a flag, so must be cheap and safe for concurrent use.
+type Provider interface {
+	Enabled(flag Flag) bool
+}
+
+// Enabled reports whether flag is enabled by p. A nil Provider enables
+// nothing.
+func Enabled(p Provider, flag Flag) bool {
+	return p != nil && p.Enabled(flag)
+}
+
+// Set is a Provider holding the flags enabled in configuration. Replace
+// swaps them while in use, such as when the configuration is reloaded.
+type Set struct {
+	mu      sync.RWMutex
+	enabled map[Flag]bool
+}
+
+// NewSet returns a Set with flags enabled.
+func NewSet(flags ...Flag) *Set {
+	s := &Set{}
+	s.Replace(flags)
+	return s
+}
+
+func (s *Set) Enabled(flag Flag) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled[flag]
+}
+
+// Replace enables flags and disables every other.
+func (s *Set) Replace(flags []Flag) {
+	enabled := make(map[Flag]bool, len(flags))
+	for _, flag := range flags {
+		enabled[flag] = true
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = enabled
+}
+
+// Flags returns the enabled flags in name order.
+func (s *Set) Flags() []Flag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := make([]Flag, 0, len(s.enabled))
+	for flag := range s.enabled {
+		flags = append(flags, flag)
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i] < flags[j] })
+	return flags
+}
+
+// Parse reads the flags enabled by s, a comma separated list such as
+// "dual_write,fuzzy_search". A flag may be given a boolean, as in
+// "fuzzy_search=false", so it can be switched off without deleting it.
+func Parse(s string) ([]Flag, error) {
+	var flags []Flag
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(item, "=")
+		flag := Flag(strings.TrimSpace(name))
+		if !known(flag) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownFlag, flag)
+		}
+		on := true
+		if hasValue {
+			var err error
+			if on, err = strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("feature flag %s: %q is not true or false", flag, value)
+			}
+		}
+		if on {
+			flags = append(flags, flag)
+		}
+	}
+	return flags, nil
+}
+
+func known(flag Flag) bool {
+	for _, k := range Known {
+		if k == flag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,36 @@
+package features
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	flags, err := Parse(" dual_write , fuzzy_search=false,")
+	assert.NoError(t, err)
+	assert.Equal(t, []Flag{DualWrite}, flags)
+
+	flags, err = Parse("")
+	assert.NoError(t, err)
+	assert.Empty(t, flags)
+
+	_, err = Parse("dual_wrte")
+	assert.ErrorIs(t, err, ErrUnknownFlag)
+	_, err = Parse("dual_write=maybe")
+	assert.ErrorContains(t, err, "dual_write")
+}
+
+func TestSet(t *testing.T) {
+	set := NewSet(FuzzySearch, DualWrite)
+	assert.True(t, Enabled(set, DualWrite))
+	assert.Equal(t, []Flag{DualWrite, FuzzySearch}, set.Flags())
+
+	// Replacing the flags switches off any left out
+	set.Replace([]Flag{FuzzySearch})
+	assert.False(t, set.Enabled(DualWrite))
+	assert.True(t, set.Enabled(FuzzySearch))
+
+	// Without a provider nothing is enabled
+	assert.False(t, Enabled(nil, FuzzySearch))
+}
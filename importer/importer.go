@@ -0,0 +1,235 @@
+// Package importer loads users exported from other systems, for migrating
+// them in. Sources are CSV or JSON (see Format); each row is checked
+// against the service's rules and for duplicate emails, good rows are
+// saved a batch at a time, and every rejected row is listed in a Report
+// with the reason, so the source can be fixed and the rejects imported
+// again.
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gorepository/repository"
+	"gorepository/service"
+)
+
+// DefaultBatchSize is the number of users saved at a time when
+// Importer.BatchSize is not set.
+const DefaultBatchSize = 500
+
+// ErrMissingEmail rejects a row without an email, which users are matched
+// on.
+var ErrMissingEmail = errors.New("email is required")
+
+// ErrDuplicateEmail rejects a row whose email is already taken, by an
+// existing user or an earlier row.
+var ErrDuplicateEmail = errors.New("duplicate email")
+
+// Importer imports users through Users, so they are validated and
+// normalized as if created one by one.
+type Importer struct {
+	Users *service.UserService
+	// Emails finds duplicate emails within a source. Set it as the
+	// repository's is, so that addresses it would treat as one are.
+	Emails    repository.EmailNormalizer
+	BatchSize int
+	// DryRun checks every row without saving any.
+	DryRun bool
+}
+
+// RowError is why a row was rejected. Row counts the source's users from
+// 1, leaving out a CSV header.
+type RowError struct {
+	Row   int
+	Email string
+	Err   error
+}
+
+func (e RowError) Error() string {
+	if e.Email == "" {
+		return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("row %d (%s): %v", e.Row, e.Email, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON writes the error as {"row": 3, "email": "...", "error": "..."}.
+func (e RowError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Row   int    `json:"row"`
+		Email string `json:"email,omitempty"`
+		Error string `json:"error"`
+	}{e.Row, e.Email, e.Err.Error()})
+}
+
+// Report is the outcome of an import, which can be written out as JSON.
+type Report struct {
+	// Rows is how many users the source held, and Imported how many of
+	// them were saved, or would have been in a dry run.
+	Rows     int        `json:"rows"`
+	Imported int        `json:"imported"`
+	DryRun   bool       `json:"dry_run,omitempty"`
+	Rejected []RowError `json:"rejected,omitempty"`
+}
+
+// String summarises the report, with a line per rejected row.
+func (r Report) String() string {
+	var b strings.Builder
+	verb := "Imported"
+	if r.DryRun {
+		verb = "Would import"
+	}
+	fmt.Fprintf(&b, "%s %d of %d users\n", verb, r.Imported, r.Rows)
+	for _, rejected := range r.Rejected {
+		fmt.Fprintf(&b, "rejected %v\n", rejected)
+	}
+	return b.String()
+}
+
+// pending is a row waiting to be saved.
+type pending struct {
+	row  int
+	user *repository.User
+}
+
+// Import reads users from r in format and saves those that pass, a batch
+// at a time. Each batch is saved in one call to CreateUsers, which the
+// Postgres repository runs as a transaction; if a batch fails, its users
+// are saved one by one so that only the rows at fault are rejected.
+//
+// Bad rows don't stop an import. It stops with an error, returning what
+// it managed, if the source can't be read any further or the repository
+// is unavailable, timing out or read-only; users already saved stay
+// saved.
+func (i *Importer) Import(r io.Reader, format Format) (Report, error) {
+	report := Report{DryRun: i.DryRun}
+	src, err := newSource(r, format)
+	if err != nil {
+		return report, err
+	}
+
+	// seen maps the normalized emails of accepted rows to their row
+	seen := map[string]int{}
+	batch := make([]pending, 0, i.batchSize())
+	for row := 1; ; row++ {
+		user, rowErr, err := src.next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("importer: row %d: %w", row, err)
+		}
+		report.Rows++
+
+		if rowErr == nil {
+			if rowErr, err = i.check(user, seen); err != nil {
+				return report, fmt.Errorf("importer: row %d: %w", row, err)
+			}
+		}
+		if rowErr != nil {
+			report.reject(row, user, rowErr)
+			continue
+		}
+
+		seen[i.Emails.Normalize(user.Email)] = row
+		batch = append(batch, pending{row, user})
+		if len(batch) == i.batchSize() {
+			if err := i.save(&report, batch); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	return report, i.save(&report, batch)
+}
+
+// check returns why user can't be imported, if they can't, or an error if
+// that can't be told.
+func (i *Importer) check(user *repository.User, seen map[string]int) (rowErr, err error) {
+	if strings.TrimSpace(user.Email) == "" {
+		return ErrMissingEmail, nil
+	}
+	if err := i.Users.ValidateUser(user); err != nil {
+		return err, nil
+	}
+	if row, ok := seen[i.Emails.Normalize(user.Email)]; ok {
+		return fmt.Errorf("%w: also on row %d", ErrDuplicateEmail, row), nil
+	}
+
+	existing, err := i.Users.GetUserByEmail(user.Email, repository.Fields("id"))
+	switch {
+	case err == nil:
+		return fmt.Errorf("%w: already belongs to user %d", ErrDuplicateEmail, existing.ID), nil
+	case errors.Is(err, repository.ErrUserNotFound):
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// save saves batch, falling back to one user at a time if it fails.
+func (i *Importer) save(report *Report, batch []pending) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	if i.DryRun {
+		report.Imported += len(batch)
+		return nil
+	}
+
+	users := make([]*repository.User, len(batch))
+	for n, p := range batch {
+		users[n] = p.user
+	}
+	err := i.Users.CreateUsers(users)
+	if err == nil {
+		report.Imported += len(batch)
+		return nil
+	}
+	if stopsImport(err) {
+		return fmt.Errorf("importer: saving rows %d to %d: %w", batch[0].row, batch[len(batch)-1].row, err)
+	}
+
+	for _, p := range batch {
+		p.user.ID = 0
+		err := i.Users.CreateUser(p.user)
+		switch {
+		case err == nil:
+			report.Imported++
+		case stopsImport(err):
+			return fmt.Errorf("importer: saving row %d: %w", p.row, err)
+		default:
+			report.reject(p.row, p.user, err)
+		}
+	}
+	return nil
+}
+
+func (r *Report) reject(row int, user *repository.User, err error) {
+	var email string
+	if user != nil {
+		email = user.Email
+	}
+	r.Rejected = append(r.Rejected, RowError{Row: row, Email: email, Err: err})
+}
+
+// stopsImport reports whether err means the repository can't take more
+// writes for now, so every row after would fail the same way.
+func stopsImport(err error) bool {
+	return errors.Is(err, repository.ErrUnavailable) || errors.Is(err, repository.ErrQueryTimeout) ||
+		errors.Is(err, repository.ErrReadOnly)
+}
+
+func (i *Importer) batchSize() int {
+	if i.BatchSize > 0 {
+		return i.BatchSize
+	}
+	return DefaultBatchSize
+}
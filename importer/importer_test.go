@@ -0,0 +1,158 @@
+package importer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gorepository/repository"
+	"gorepository/repository/mocks"
+	"gorepository/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const legacyCSV = "\ufefflegacy_id,Name,Email,phone,verified_at,created_at,status,metadata\n" +
+	"17,John Doe,john.doe@example.com,07700 900123,2020-01-02T03:04:05Z,2019-06-01T00:00:00Z,,\"{\"\"plan\"\": \"\"pro\"\"}\"\n" +
+	"18,John Again,JOHN.DOE@example.com,,,,,\n" +
+	"19,No Email,,,,,,\n" +
+	"20,Bad Phone,bad.phone@example.com,not a number,,,,\n" +
+	"21,Bad Time,bad.time@example.com,,yesterday,,,\n" +
+	"22,Taken,taken@example.com,,,,,\n" +
+	"23,Short,short@example.com\n" +
+	"24,Jane Doe,jane.doe@example.com,,,,suspended,\n"
+
+func newImporter(repo repository.UserRepository) *Importer {
+	return &Importer{Users: &service.UserService{Repo: repo, PhoneCountryCode: "44"}, BatchSize: 2}
+}
+
+func TestImportCSV(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	require.NoError(t, repo.SaveUser(&repository.User{Name: "Taken", Email: "taken@example.com"}))
+
+	report, err := newImporter(repo).Import(strings.NewReader(legacyCSV), CSV)
+	require.NoError(t, err)
+	assert.Equal(t, 8, report.Rows)
+	assert.Equal(t, 2, report.Imported)
+
+	// Every rejected row is reported with why
+	rejected := map[int]error{}
+	for _, rowErr := range report.Rejected {
+		rejected[rowErr.Row] = rowErr.Err
+	}
+	assert.Len(t, rejected, 6)
+	assert.ErrorIs(t, rejected[2], ErrDuplicateEmail)
+	assert.ErrorContains(t, rejected[2], "also on row 1")
+	assert.ErrorIs(t, rejected[3], ErrMissingEmail)
+	assert.ErrorIs(t, rejected[4], service.ErrInvalidPhone)
+	assert.ErrorContains(t, rejected[5], "verified_at must be an RFC 3339 time")
+	assert.ErrorIs(t, rejected[6], ErrDuplicateEmail)
+	assert.ErrorContains(t, rejected[6], "already belongs to user 1")
+	assert.ErrorContains(t, rejected[7], "wrong number of columns")
+
+	// The rest are saved as the service would save them
+	john, err := repo.FindUserByEmail("john.doe@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "John Doe", john.Name)
+	assert.Equal(t, "+447700900123", *john.Phone)
+	assert.Equal(t, time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), john.CreatedAt.UTC())
+	assert.Equal(t, repository.Metadata{"plan": "pro"}, john.Metadata)
+	jane, err := repo.FindUserByEmail("jane.doe@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, repository.StatusSuspended, jane.Status)
+}
+
+func TestImportJSON(t *testing.T) {
+	for name, source := range map[string]string{
+		"array": `[
+			{"id": 7, "name": "John Doe", "email": "john.doe@example.com"},
+			{"name": 42, "email": "bad.name@example.com"},
+			{"name": "Jane Doe", "email": "jane.doe@example.com", "status": "archived"}
+		]`,
+		"lines": `{"id": 7, "name": "John Doe", "email": "john.doe@example.com"}
+			{"name": 42, "email": "bad.name@example.com"}
+			{"name": "Jane Doe", "email": "jane.doe@example.com", "status": "archived"}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			repo := repository.NewMemoryUserRepository()
+			report, err := newImporter(repo).Import(strings.NewReader(source), JSON)
+			require.NoError(t, err)
+			assert.Equal(t, 3, report.Rows)
+			assert.Equal(t, 1, report.Imported)
+			require.Len(t, report.Rejected, 2)
+			assert.Equal(t, "bad.name@example.com", report.Rejected[0].Email)
+			assert.ErrorIs(t, report.Rejected[1], repository.ErrInvalidStatus)
+
+			// IDs from the source aren't kept
+			_, err = repo.FindUserByID(7)
+			assert.ErrorIs(t, err, repository.ErrUserNotFound)
+		})
+	}
+
+	// A source that can't be read stops the import
+	report, err := newImporter(repository.NewMemoryUserRepository()).Import(strings.NewReader(`[{"email": "a@example.com"}, {`), JSON)
+	assert.Error(t, err)
+	assert.Equal(t, 1, report.Rows)
+}
+
+func TestImportDryRun(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	importer := newImporter(repo)
+	importer.DryRun = true
+
+	report, err := importer.Import(strings.NewReader(legacyCSV), CSV)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Imported)
+	assert.Contains(t, report.String(), "Would import 3 of 8 users\n")
+
+	n, err := repo.CountUsersWhere(repository.And())
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestImportFailedBatch(t *testing.T) {
+	// A batch that fails is saved a user at a time, to find the culprit
+	conflict := errors.New("duplicate key value violates unique constraint")
+	mockRepo := mocks.NewUserRepo().
+		FailingOn("SaveUsers", conflict).
+		FailingWhen("SaveUser", func(call repository.Call, n int) bool {
+			return call.Args[0].(*repository.User).Email == "b@example.com"
+		}, conflict).
+		Build()
+	source := "email\na@example.com\nb@example.com\nc@example.com\n"
+
+	report, err := newImporter(mockRepo).Import(strings.NewReader(source), CSV)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Imported)
+	require.Len(t, report.Rejected, 1)
+	assert.Equal(t, 2, report.Rejected[0].Row)
+	assert.ErrorIs(t, report.Rejected[0], conflict)
+
+	// But one the repository can't take at all stops the import
+	mockRepo = mocks.NewUserRepo().
+		FailingOn("SaveUsers", fmt.Errorf("%w: no primary", repository.ErrUnavailable)).
+		Build()
+	report, err = newImporter(mockRepo).Import(strings.NewReader(source), CSV)
+	assert.ErrorIs(t, err, repository.ErrUnavailable)
+	assert.Zero(t, report.Imported)
+	mockRepo.AssertNotCalled(t, "SaveUser")
+}
+
+func TestReportJSON(t *testing.T) {
+	report := Report{Rows: 2, Imported: 1, Rejected: []RowError{{Row: 2, Email: "x@example.com", Err: ErrMissingEmail}}}
+	b, err := json.Marshal(report)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"rows": 2, "imported": 1, "rejected": [{"row": 2, "email": "x@example.com", "error": "email is required"}]}`, string(b))
+}
+
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("CSV")
+	assert.NoError(t, err)
+	assert.Equal(t, CSV, format)
+	_, err = ParseFormat("xml")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
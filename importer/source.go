@@ -0,0 +1,228 @@
+package importer
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gorepository/repository"
+)
+
+// Format is how a source is written.
+//
+// CSV needs a header row naming its columns, in any order: email, and any
+// of name, phone, verified_at, created_at, status and metadata. Times are
+// RFC 3339, metadata is a JSON object, and empty cells are left unset.
+//
+// JSON is either an array of users or one user per line, with the same
+// fields as the API's users.
+//
+// Other columns or fields, such as an ID from the old system, are ignored.
+// Users get new IDs; created_at is kept when given.
+type Format string
+
+const (
+	CSV  Format = "csv"
+	JSON Format = "json"
+)
+
+// ErrUnknownFormat is returned for a Format other than CSV or JSON.
+var ErrUnknownFormat = errors.New("unknown import format")
+
+// ParseFormat returns the Format named s, such as "csv".
+func ParseFormat(s string) (Format, error) {
+	switch format := Format(strings.ToLower(s)); format {
+	case CSV, JSON:
+		return format, nil
+	}
+	return "", fmt.Errorf("%w: %q (want csv or json)", ErrUnknownFormat, s)
+}
+
+// source reads users a row at a time. next returns the next row's user, or
+// why the row can't be read as one, or an error if the source can't be
+// read any further; io.EOF at the end.
+type source interface {
+	next() (user *repository.User, rowErr, err error)
+}
+
+func newSource(r io.Reader, format Format) (source, error) {
+	switch format {
+	case CSV:
+		return newCSVSource(r)
+	case JSON:
+		return newJSONSource(r)
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, format)
+}
+
+// record is a user as a source writes them.
+type record struct {
+	Name       string              `json:"name"`
+	Email      string              `json:"email"`
+	Phone      *string             `json:"phone"`
+	VerifiedAt *time.Time          `json:"verified_at"`
+	CreatedAt  *time.Time          `json:"created_at"`
+	Status     string              `json:"status"`
+	Metadata   repository.Metadata `json:"metadata"`
+}
+
+func (rec record) user() (*repository.User, error) {
+	user := &repository.User{
+		Name:       strings.TrimSpace(rec.Name),
+		Email:      strings.TrimSpace(rec.Email),
+		Phone:      rec.Phone,
+		VerifiedAt: rec.VerifiedAt,
+		Metadata:   rec.Metadata,
+	}
+	if rec.CreatedAt != nil {
+		user.CreatedAt = *rec.CreatedAt
+	}
+	if rec.Status != "" {
+		status, err := repository.ParseStatus(rec.Status)
+		if err != nil {
+			return user, err
+		}
+		user.Status = status
+	}
+	return user, nil
+}
+
+// csvColumns are the columns a CSV source may have.
+var csvColumns = []string{"name", "email", "phone", "verified_at", "created_at", "status", "metadata"}
+
+type csvSource struct {
+	r *csv.Reader
+	// columns maps the column names wanted to their index.
+	columns map[string]int
+}
+
+func newCSVSource(r io.Reader) (*csvSource, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("importer: CSV has no header row")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("importer: reading CSV header: %w", err)
+	}
+
+	src := &csvSource{r: cr, columns: map[string]int{}}
+	for i, name := range header {
+		// Spreadsheets often save a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		for _, column := range csvColumns {
+			if name == column {
+				src.columns[name] = i
+			}
+		}
+	}
+	if _, ok := src.columns["email"]; !ok {
+		return nil, errors.New("importer: CSV has no email column")
+	}
+	return src, nil
+}
+
+func (s *csvSource) next() (*repository.User, error, error) {
+	fields, err := s.r.Read()
+	if errors.Is(err, csv.ErrFieldCount) {
+		return nil, errors.New("wrong number of columns"), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cell := func(column string) string {
+		if i, ok := s.columns[column]; ok {
+			return strings.TrimSpace(fields[i])
+		}
+		return ""
+	}
+	rec := record{Name: cell("name"), Email: cell("email"), Status: cell("status")}
+	if phone := cell("phone"); phone != "" {
+		rec.Phone = &phone
+	}
+	for _, field := range []struct {
+		column string
+		at     **time.Time
+	}{{"verified_at", &rec.VerifiedAt}, {"created_at", &rec.CreatedAt}} {
+		value := cell(field.column)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return &repository.User{Email: rec.Email}, fmt.Errorf("%s must be an RFC 3339 time, got %q", field.column, value), nil
+		}
+		*field.at = &t
+	}
+	if metadata := cell("metadata"); metadata != "" {
+		if err := json.Unmarshal([]byte(metadata), &rec.Metadata); err != nil {
+			return &repository.User{Email: rec.Email}, fmt.Errorf("metadata must be a JSON object: %w", err), nil
+		}
+	}
+
+	user, err := rec.user()
+	return user, err, nil
+}
+
+type jsonSource struct {
+	dec *json.Decoder
+	// array is set when the users are in a JSON array rather than one per
+	// line.
+	array bool
+}
+
+func newJSONSource(r io.Reader) (*jsonSource, error) {
+	br := bufio.NewReader(r)
+	src := &jsonSource{}
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			// Empty, which next reports as the end
+			src.dec = json.NewDecoder(br)
+			return src, nil
+		}
+		if !strings.ContainsRune(" \t\r\n", rune(b[0])) {
+			src.array = b[0] == '['
+			break
+		}
+		br.ReadByte()
+	}
+
+	src.dec = json.NewDecoder(br)
+	if src.array {
+		if _, err := src.dec.Token(); err != nil {
+			return nil, fmt.Errorf("importer: reading JSON: %w", err)
+		}
+	}
+	return src, nil
+}
+
+func (s *jsonSource) next() (*repository.User, error, error) {
+	if s.array && !s.dec.More() {
+		if _, err := s.dec.Token(); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, io.EOF
+	}
+
+	var raw json.RawMessage
+	if err := s.dec.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+	var rec record
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		var email struct {
+			Email string `json:"email"`
+		}
+		json.Unmarshal(raw, &email)
+		return &repository.User{Email: email.Email}, fmt.Errorf("invalid user: %w", err), nil
+	}
+	user, err := rec.user()
+	return user, err, nil
+}
@@ -0,0 +1,94 @@
+// Package migrations creates and upgrades the Postgres schema used by the
+// repository package.
+//
+// Migrations are the SQL files in sql/, applied in name order. Each runs in
+// its own transaction and is recorded in schema_migrations, so Up only
+// applies the ones a database hasn't seen yet.
+package migrations
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"slices"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Up applies every migration not yet recorded in db, returning the names of
+// those it applied.
+func Up(db *sql.DB) ([]string, error) {
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name       TEXT PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := Names()
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, name := range names {
+		ok, err := apply(db, name)
+		if err != nil {
+			return applied, fmt.Errorf("migration %s: %w", name, err)
+		}
+		if ok {
+			applied = append(applied, name)
+		}
+	}
+	return applied, nil
+}
+
+// Names returns every migration, in the order they are applied.
+func Names() ([]string, error) {
+	names, err := fs.Glob(files, "sql/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		names[i] = name[len("sql/"):]
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// apply runs one migration unless it has already been recorded. The lock
+// on schema_migrations stops two processes applying the same migration.
+func apply(db *sql.DB, name string) (bool, error) {
+	script, err := files.ReadFile("sql/" + name)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+		return false, err
+	}
+
+	var done bool
+	err = tx.QueryRow("SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE name = $1)", name).Scan(&done)
+	if err != nil || done {
+		return false, err
+	}
+
+	if _, err := tx.Exec(string(script)); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_migrations (name) VALUES ($1)", name); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,17 @@
+package migrations
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNames(t *testing.T) {
+	names, err := Names()
+	assert.NoError(t, err)
+
+	// The users table has to come first; everything else builds on it
+	assert.NotEmpty(t, names)
+	assert.Equal(t, "0001_create_users.sql", names[0])
+	assert.IsIncreasing(t, names)
+}
@@ -0,0 +1,6 @@
+-- The users table as the example has always expected it.
+CREATE TABLE IF NOT EXISTS users (
+    id    SERIAL PRIMARY KEY,
+    name  TEXT NOT NULL,
+    email TEXT NOT NULL
+);
@@ -0,0 +1,7 @@
+-- Blind index for encrypted emails, maintained by EncryptedUserRepository.
+-- email_index is a keyed hash of the plaintext email, so users can be found
+-- by email without the email itself being stored in the clear.
+CREATE TABLE IF NOT EXISTS user_email_index (
+    email_index TEXT PRIMARY KEY,
+    user_id     INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+-- When users signed up and verified their email, for the retention rules.
+-- Existing users are treated as having signed up when this runs.
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN IF NOT EXISTS verified_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS users_created_at_idx ON users (created_at);
@@ -0,0 +1,34 @@
+-- Past versions of users, written by triggers so that every update and
+-- delete is kept however it is made. A version is valid until changed_at.
+CREATE TABLE IF NOT EXISTS users_history (
+    history_id  BIGSERIAL PRIMARY KEY,
+    user_id     INTEGER NOT NULL,
+    name        TEXT NOT NULL,
+    email       TEXT NOT NULL,
+    created_at  TIMESTAMPTZ NOT NULL,
+    verified_at TIMESTAMPTZ,
+    changed_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+    operation   TEXT NOT NULL CHECK (operation IN ('update', 'delete'))
+);
+
+CREATE INDEX IF NOT EXISTS users_history_user_id_idx ON users_history (user_id, changed_at);
+
+CREATE OR REPLACE FUNCTION users_history_record() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, operation)
+    VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, lower(TG_OP));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_history_update ON users;
+CREATE TRIGGER users_history_update
+    AFTER UPDATE ON users
+    FOR EACH ROW WHEN (OLD IS DISTINCT FROM NEW)
+    EXECUTE FUNCTION users_history_record();
+
+DROP TRIGGER IF EXISTS users_history_delete ON users;
+CREATE TRIGGER users_history_delete
+    AFTER DELETE ON users
+    FOR EACH ROW
+    EXECUTE FUNCTION users_history_record();
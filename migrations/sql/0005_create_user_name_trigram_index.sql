@@ -0,0 +1,7 @@
+-- Trigram index over lower-cased names, for FindUsersByNamePrefix (LIKE
+-- 'prefix%') and SuggestUsers (the % similarity operator). pg_trgm ships
+-- with Postgres but must be enabled per database, which needs the CREATE
+-- privilege on it.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (lower(name) gin_trgm_ops);
@@ -0,0 +1,9 @@
+-- Normalized emails, which FindUserByEmail looks users up by. The
+-- repository sets them on every write; existing rows are filled in with
+-- the default normalization, trimmed and lowercased. The index is not
+-- unique, as existing addresses differing only in case would break it.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS normalized_email TEXT NOT NULL DEFAULT '';
+
+UPDATE users SET normalized_email = lower(btrim(email)) WHERE normalized_email = '';
+
+CREATE INDEX IF NOT EXISTS users_normalized_email_idx ON users (normalized_email);
@@ -0,0 +1,16 @@
+-- Optional phone numbers, stored in E.164 form (+447700900123) by the
+-- service layer, so equal numbers are always stored alike. NULL means the
+-- user has no phone number. History keeps them too, so the trigger
+-- function is replaced to copy the new column.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS phone TEXT;
+ALTER TABLE users_history ADD COLUMN IF NOT EXISTS phone TEXT;
+
+CREATE INDEX IF NOT EXISTS users_phone_idx ON users (phone) WHERE phone IS NOT NULL;
+
+CREATE OR REPLACE FUNCTION users_history_record() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, operation)
+    VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, lower(TG_OP));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
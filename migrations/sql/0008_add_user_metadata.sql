@@ -0,0 +1,17 @@
+-- Custom attributes integrators attach to users, as a JSON object. The GIN
+-- index serves FindUsersByMetadata's containment queries (metadata @>
+-- '{"plan": "pro"}'); jsonb_path_ops keeps it smaller than the default
+-- operator class, which would also index keys alone. History keeps
+-- metadata too, so the trigger function is replaced to copy it.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE users_history ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS users_metadata_idx ON users USING GIN (metadata jsonb_path_ops);
+
+CREATE OR REPLACE FUNCTION users_history_record() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, operation)
+    VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, OLD.metadata, lower(TG_OP));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,26 @@
+-- When each user last logged in and how many times they have, for the
+-- inactive-user retention rule. History keeps both so that restoring or
+-- reading an old version doesn't reset them, but a login alone isn't a new
+-- version: the update trigger now ignores changes to only these columns.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS login_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users_history ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ;
+ALTER TABLE users_history ADD COLUMN IF NOT EXISTS login_count INTEGER NOT NULL DEFAULT 0;
+
+-- Serves InactiveSince, which falls back to created_at for users who have
+-- never logged in.
+CREATE INDEX IF NOT EXISTS users_last_active_idx ON users ((COALESCE(last_login_at, created_at)));
+
+CREATE OR REPLACE FUNCTION users_history_record() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, operation)
+    VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, OLD.metadata, OLD.last_login_at, OLD.login_count, lower(TG_OP));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_history_update ON users;
+CREATE TRIGGER users_history_update
+    AFTER UPDATE ON users
+    FOR EACH ROW WHEN (to_jsonb(OLD) - 'last_login_at' - 'login_count' IS DISTINCT FROM to_jsonb(NEW) - 'last_login_at' - 'login_count')
+    EXECUTE FUNCTION users_history_record();
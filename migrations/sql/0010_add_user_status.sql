@@ -0,0 +1,18 @@
+-- Where each account is in its lifecycle. Existing users are active, as
+-- are new ones unless saved with another status. History keeps the status
+-- so a restored user comes back with it.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+    CHECK (status IN ('pending', 'active', 'suspended', 'deactivated'));
+ALTER TABLE users_history ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+
+-- Serves the HasStatus filter. Most users are active, so the index only
+-- covers the others, which are the ones filters usually look for.
+CREATE INDEX IF NOT EXISTS users_status_idx ON users (status) WHERE status <> 'active';
+
+CREATE OR REPLACE FUNCTION users_history_record() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, operation)
+    VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, OLD.metadata, OLD.last_login_at, OLD.login_count, OLD.status, lower(TG_OP));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
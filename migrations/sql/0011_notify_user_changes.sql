@@ -0,0 +1,15 @@
+-- Announce every change to a user on the users_changed channel, with their
+-- ID as the payload, so caches in every process sharing the database can
+-- drop their copy. See repository.ListenForInvalidations. Postgres only
+-- delivers the notifications once the change commits.
+CREATE OR REPLACE FUNCTION users_notify_change() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('users_changed', COALESCE(NEW.id, OLD.id)::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS users_notify_change ON users;
+CREATE TRIGGER users_notify_change
+    AFTER INSERT OR UPDATE OR DELETE ON users
+    FOR EACH ROW EXECUTE FUNCTION users_notify_change();
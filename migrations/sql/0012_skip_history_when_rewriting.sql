@@ -0,0 +1,14 @@
+-- Let a transaction rewrite users in place without the rewrite becoming
+-- part of their history, by setting users.rewriting. RewriteUsers does so
+-- when re-encrypting users under a new key, which would otherwise leave a
+-- copy of each sealed under the old one in users_history.
+CREATE OR REPLACE FUNCTION users_history_record() RETURNS trigger AS $$
+BEGIN
+    IF current_setting('users.rewriting', true) = 'on' THEN
+        RETURN NULL;
+    END IF;
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, operation)
+    VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, OLD.metadata, OLD.last_login_at, OLD.login_count, OLD.status, lower(TG_OP));
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,183 @@
+package notifications
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorepository/events"
+	"gorepository/repository"
+)
+
+// Defaults NewDispatcher sets up a Dispatcher with.
+const (
+	DefaultMaxAttempts = 5
+	DefaultBackoff     = time.Second
+	DefaultQueueSize   = 1024
+)
+
+// UserFinder looks up the user an event is about. *service.UserService
+// is one.
+type UserFinder interface {
+	GetUser(id int, opts ...repository.FindOption) (*repository.User, error)
+}
+
+// Dispatcher turns events into notifications. Handle only queues an
+// event, so publishing never waits on a mail server; workers started by
+// Start look up the user, render the event's templates and send the
+// messages. A message that fails to send, or an event whose user can't be
+// looked up, is queued again after Backoff, doubling each time, until
+// MaxAttempts have failed.
+type Dispatcher struct {
+	Users     UserFinder
+	Notifiers map[Channel]Notifier
+	// Templates are rendered for each event type; events without any
+	// are ignored.
+	Templates   map[string][]Template
+	MaxAttempts int
+	Backoff     time.Duration
+	Logger      *log.Logger
+
+	jobs    chan job
+	pending sync.WaitGroup
+}
+
+// job is an event to render, or, once rendered, a message to send.
+type job struct {
+	event   events.Event
+	msg     *Message
+	attempt int
+}
+
+// NewDispatcher returns a Dispatcher sending DefaultTemplates through
+// notifiers.
+func NewDispatcher(users UserFinder, notifiers map[Channel]Notifier, logger *log.Logger) *Dispatcher {
+	return &Dispatcher{
+		Users:       users,
+		Notifiers:   notifiers,
+		Templates:   DefaultTemplates(),
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		Logger:      logger,
+		jobs:        make(chan job, DefaultQueueSize),
+	}
+}
+
+// Handle queues event to be notified, if it has templates. It is meant
+// for events.Bus.Subscribe. If the queue is full the event is dropped and
+// logged, rather than hold up the caller.
+func (d *Dispatcher) Handle(event events.Event) {
+	if len(d.Templates[event.Type]) == 0 {
+		return
+	}
+	d.enqueue(job{event: event, attempt: 1})
+}
+
+func (d *Dispatcher) enqueue(j job) {
+	d.pending.Add(1)
+	select {
+	case d.jobs <- j:
+	default:
+		d.pending.Done()
+		d.Logger.Printf("notifications: queue full, dropping %s", j)
+	}
+}
+
+// Start runs workers sending notifications until the returned function
+// is called. Stopping waits for messages being sent; those still queued,
+// or waiting to be retried, are dropped.
+func (d *Dispatcher) Start(workers int) (stop func()) {
+	done := make(chan struct{})
+	var running sync.WaitGroup
+	for i := 0; i < max(workers, 1); i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for {
+				select {
+				case <-done:
+					return
+				case j := <-d.jobs:
+					d.run(j)
+					d.pending.Done()
+				}
+			}
+		}()
+	}
+	return func() {
+		close(done)
+		running.Wait()
+	}
+}
+
+// Wait waits until everything queued has been sent or given up on,
+// retries included. The workers must be running.
+func (d *Dispatcher) Wait() {
+	d.pending.Wait()
+}
+
+// run carries out j, queueing it again if it fails.
+func (d *Dispatcher) run(j job) {
+	err := d.do(j)
+	if err == nil {
+		return
+	}
+	if j.attempt >= d.MaxAttempts {
+		d.Logger.Printf("notifications: giving up on %s after %d attempts: %v", j, j.attempt, err)
+		return
+	}
+	backoff := d.Backoff << (j.attempt - 1)
+	d.Logger.Printf("notifications: %s failed, retrying in %s: %v", j, backoff, err)
+	j.attempt++
+	d.pending.Add(1)
+	time.AfterFunc(backoff, func() {
+		defer d.pending.Done()
+		d.enqueue(j)
+	})
+}
+
+func (d *Dispatcher) do(j job) error {
+	if j.msg == nil {
+		return d.render(j.event)
+	}
+	notifier, ok := d.Notifiers[j.msg.Channel]
+	if !ok {
+		d.Logger.Printf("notifications: no notifier for %s, dropping %s", j.msg.Channel, j)
+		return nil
+	}
+	return notifier.Notify(*j.msg)
+}
+
+// render queues the messages for event.
+func (d *Dispatcher) render(event events.Event) error {
+	user, err := d.Users.GetUser(event.UserID)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		// Gone before they could be told; there is no one to tell
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, t := range d.Templates[event.Type] {
+		msg, ok, err := t.Render(Data{User: user, Event: event})
+		if err != nil {
+			// A broken template won't render any better next time
+			d.Logger.Printf("notifications: rendering %s %s for user %d: %v", event.Type, t.Channel, event.UserID, err)
+			continue
+		}
+		if ok {
+			d.enqueue(job{event: event, msg: &msg, attempt: 1})
+		}
+	}
+	return nil
+}
+
+func (j job) String() string {
+	if j.msg == nil {
+		return fmt.Sprintf("%s for user %d", j.event.Type, j.event.UserID)
+	}
+	return fmt.Sprintf("%s %s for user %d", j.event.Type, j.msg.Channel, j.event.UserID)
+}
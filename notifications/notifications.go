@@ -0,0 +1,165 @@
+// Package notifications tells users about things that happen to their
+// accounts, driven by the service's domain events: a welcome email when
+// they are created, and an alert when they are suspended.
+//
+// A Dispatcher subscribes to the events bus, renders each event's
+// Templates for the user it concerns, and hands the messages to the
+// Notifier for their Channel, retrying those that fail. Notifiers are
+// pluggable: SMTPNotifier sends email, SMSNotifier is a stub until an SMS
+// gateway is chosen, and LogNotifier writes messages to a log instead of
+// sending them.
+package notifications
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gorepository/events"
+	"gorepository/repository"
+)
+
+// Channel is a way of reaching a user.
+type Channel string
+
+const (
+	// Email reaches a user at their email address.
+	Email Channel = "email"
+	// SMS reaches a user at their phone number, if they have one.
+	SMS Channel = "sms"
+)
+
+// Message is a notification ready to send.
+type Message struct {
+	Channel Channel
+	// To is the address for the channel: an email address or an E.164
+	// phone number.
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier sends messages over a channel.
+type Notifier interface {
+	Notify(msg Message) error
+}
+
+// LogNotifier writes each message to Logger rather than sending it, for
+// development and for channels with nowhere to send to yet.
+type LogNotifier struct {
+	Logger *log.Logger
+}
+
+func (n LogNotifier) Notify(msg Message) error {
+	n.Logger.Printf("notifications: %s to %s: %s: %s", msg.Channel, msg.To, msg.Subject, strings.ReplaceAll(msg.Body, "\n", " "))
+	return nil
+}
+
+// SMSNotifier is a stub standing in for an SMS gateway. It keeps the
+// messages it is given, for tests, and logs them if Logger is set.
+type SMSNotifier struct {
+	Logger *log.Logger
+
+	mu   sync.Mutex
+	sent []Message
+}
+
+func (n *SMSNotifier) Notify(msg Message) error {
+	n.mu.Lock()
+	n.sent = append(n.sent, msg)
+	n.mu.Unlock()
+	if n.Logger != nil {
+		n.Logger.Printf("notifications: SMS to %s (not sent, no gateway): %s", msg.To, msg.Body)
+	}
+	return nil
+}
+
+// Sent returns the messages given to the stub, in order.
+func (n *SMSNotifier) Sent() []Message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Message(nil), n.sent...)
+}
+
+// Data is what templates are rendered with.
+type Data struct {
+	User  *repository.User
+	Event events.Event
+}
+
+// Template renders one message for an event, with text/template syntax in
+// its subject and body. SMS messages have no subject.
+type Template struct {
+	Channel       Channel
+	subject, body *template.Template
+}
+
+// NewTemplate parses the subject and body of a template for channel.
+func NewTemplate(channel Channel, subject, body string) (Template, error) {
+	t := Template{Channel: channel}
+	var err error
+	if t.subject, err = template.New("subject").Parse(subject); err != nil {
+		return Template{}, fmt.Errorf("notifications: %s subject: %w", channel, err)
+	}
+	if t.body, err = template.New("body").Parse(body); err != nil {
+		return Template{}, fmt.Errorf("notifications: %s body: %w", channel, err)
+	}
+	return t, nil
+}
+
+func mustTemplate(channel Channel, subject, body string) Template {
+	t, err := NewTemplate(channel, subject, body)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// Render renders the message for data, addressed to data.User. ok is
+// false if the user can't be reached on the template's channel, such as
+// by SMS without a phone number.
+func (t Template) Render(data Data) (msg Message, ok bool, err error) {
+	msg.Channel = t.Channel
+	switch t.Channel {
+	case Email:
+		msg.To = data.User.Email
+	case SMS:
+		if data.User.Phone != nil {
+			msg.To = *data.User.Phone
+		}
+	}
+	if msg.To == "" {
+		return Message{}, false, nil
+	}
+
+	var b strings.Builder
+	if err := t.subject.Execute(&b, data); err != nil {
+		return Message{}, false, err
+	}
+	msg.Subject = b.String()
+	b.Reset()
+	if err := t.body.Execute(&b, data); err != nil {
+		return Message{}, false, err
+	}
+	msg.Body = b.String()
+	return msg, true, nil
+}
+
+// DefaultTemplates returns the templates for each event type that users
+// are told about: a welcome on UserCreated, and an alert on UserSuspended.
+func DefaultTemplates() map[string][]Template {
+	return map[string][]Template{
+		events.UserCreated: {
+			mustTemplate(Email, "Welcome, {{.User.Name}}",
+				"Hi {{.User.Name}},\n\nYour account is ready. You can sign in with {{.User.Email}}.\n"),
+		},
+		events.UserSuspended: {
+			mustTemplate(Email, "Your account has been suspended",
+				"Hi {{.User.Name}},\n\nYour account was suspended on {{.Event.At.Format \"2 January 2006\"}}. "+
+					"If you think this is a mistake, reply to this email.\n"),
+			mustTemplate(SMS, "", "Your account has been suspended. Check your email for details."),
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package notifications
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gorepository/events"
+	"gorepository/repository"
+	"gorepository/repository/mocks"
+	"gorepository/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyNotifier fails the first failures messages, then keeps the rest.
+type flakyNotifier struct {
+	mu       sync.Mutex
+	failures int
+	sent     []Message
+}
+
+func (n *flakyNotifier) Notify(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.failures > 0 {
+		n.failures--
+		return errors.New("connection refused")
+	}
+	n.sent = append(n.sent, msg)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	bus := events.NewBus()
+	users := &service.UserService{Repo: repo, Events: bus, PhoneCountryCode: "44"}
+	email, sms := &flakyNotifier{failures: 2}, &SMSNotifier{}
+	var logs bytes.Buffer
+	d := NewDispatcher(users, map[Channel]Notifier{Email: email, SMS: sms}, log.New(&logs, "", 0))
+	d.Backoff = time.Millisecond
+	bus.Subscribe(d.Handle)
+	stop := d.Start(2)
+	defer stop()
+
+	phone := "07700 900123"
+	jane := &repository.User{Name: "Jane Doe", Email: "jane.doe@example.com", Phone: &phone}
+	require.NoError(t, users.CreateUser(jane))
+	require.NoError(t, users.CreateUser(&repository.User{Name: "John Doe", Email: "john.doe@example.com"}))
+	require.NoError(t, users.SuspendUser(jane.ID))
+	d.Wait()
+
+	// Every welcome and alert got through, in spite of the failures
+	require.Len(t, email.sent, 3)
+	subjects := map[string]string{}
+	for _, msg := range email.sent {
+		subjects[msg.Subject] = msg.To
+	}
+	assert.Equal(t, map[string]string{
+		"Welcome, Jane Doe":               "jane.doe@example.com",
+		"Welcome, John Doe":               "john.doe@example.com",
+		"Your account has been suspended": "jane.doe@example.com",
+	}, subjects)
+	assert.Equal(t, 2, strings.Count(logs.String(), "retrying in"))
+
+	// Only the user with a phone number is texted
+	require.Len(t, sms.Sent(), 1)
+	assert.Equal(t, "+447700900123", sms.Sent()[0].To)
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	email := &flakyNotifier{failures: 10}
+	var logs bytes.Buffer
+	users := &service.UserService{Repo: mocks.NewUserRepo().WithUser(&repository.User{ID: 1, Name: "Jane Doe", Email: "jane.doe@example.com"}).Build()}
+	d := NewDispatcher(users, map[Channel]Notifier{Email: email}, log.New(&logs, "", 0))
+	d.Backoff, d.MaxAttempts = time.Millisecond, 3
+	stop := d.Start(1)
+	defer stop()
+
+	d.Handle(events.Event{Type: events.UserCreated, UserID: 1})
+	d.Handle(events.Event{Type: events.UserLoggedIn, UserID: 1})
+	d.Handle(events.Event{Type: events.UserCreated, UserID: 2})
+	d.Wait()
+
+	assert.Empty(t, email.sent)
+	assert.Contains(t, logs.String(), "giving up on UserCreated email for user 1 after 3 attempts: connection refused")
+	// A user who has gone is never told
+	assert.NotContains(t, logs.String(), "user 2")
+}
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := NewTemplate(SMS, "", "Hi {{.User.Name}}")
+	require.NoError(t, err)
+
+	_, ok, err := tmpl.Render(Data{User: &repository.User{Name: "Jane Doe"}})
+	assert.NoError(t, err)
+	assert.False(t, ok, "no phone, no SMS")
+
+	phone := "+447700900123"
+	msg, ok, err := tmpl.Render(Data{User: &repository.User{Name: "Jane Doe", Phone: &phone}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Message{Channel: SMS, To: phone, Body: "Hi Jane Doe"}, msg)
+
+	_, err = NewTemplate(Email, "{{.User.Name", "")
+	assert.ErrorContains(t, err, "email subject")
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	var gotAddr, gotFrom string
+	var gotTo []string
+	var gotMsg []byte
+	n := &SMTPNotifier{
+		Addr:     "mail.example.com:587",
+		From:     "accounts@example.com",
+		Username: "accounts",
+		Password: func() string { return "hunter2" },
+		sendMail: func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+			gotAddr, gotFrom, gotTo, gotMsg = addr, from, to, msg
+			assert.NotNil(t, a)
+			return nil
+		},
+	}
+
+	err := n.Notify(Message{Channel: Email, To: "jane.doe@example.com", Subject: "Welcome,\r\nBcc: x@example.com", Body: "Hi\nthere"})
+	require.NoError(t, err)
+	assert.Equal(t, "mail.example.com:587", gotAddr)
+	assert.Equal(t, "accounts@example.com", gotFrom)
+	assert.Equal(t, []string{"jane.doe@example.com"}, gotTo)
+	// A subject can't add headers of its own
+	assert.Contains(t, string(gotMsg), "Subject: Welcome,  Bcc: x@example.com\r\n")
+	assert.True(t, strings.HasSuffix(string(gotMsg), "\r\n\r\nHi\r\nthere"))
+}
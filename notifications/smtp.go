@@ -0,0 +1,68 @@
+package notifications
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPNotifier sends email through an SMTP server, with PLAIN
+// authentication if Username is set.
+type SMTPNotifier struct {
+	// Addr is the server's host:port.
+	Addr string
+	From string
+	// Username and Password authenticate with the server. Password is
+	// called for each message, so a rotated one takes effect without a
+	// restart.
+	Username string
+	Password func() string
+
+	// sendMail is smtp.SendMail, replaced in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func (n *SMTPNotifier) Notify(msg Message) error {
+	var auth smtp.Auth
+	if n.Username != "" {
+		host, _, err := net.SplitHostPort(n.Addr)
+		if err != nil {
+			return fmt.Errorf("notifications: SMTP address %q: %w", n.Addr, err)
+		}
+		var password string
+		if n.Password != nil {
+			password = n.Password()
+		}
+		auth = smtp.PlainAuth("", n.Username, password, host)
+	}
+
+	send := n.sendMail
+	if send == nil {
+		send = smtp.SendMail
+	}
+	if err := send(n.Addr, auth, n.From, []string{msg.To}, n.format(msg)); err != nil {
+		return fmt.Errorf("notifications: sending email: %w", err)
+	}
+	return nil
+}
+
+// format writes msg as a plain text email.
+func (n *SMTPNotifier) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", n.From)
+	fmt.Fprintf(&b, "To: %s\r\n", headerSafe(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerSafe(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// headerSafe keeps a value, such as a subject with a user's name in it,
+// to one header line.
+func headerSafe(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"hash/fnv"
+)
+
+// LockKey turns a lock name such as "importer" into an advisory lock key.
+func LockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// WithAdvisoryLock runs fn while holding the Postgres session-level
+// advisory lock key, waiting for it if another session has it. This lets
+// processes sharing a database take turns at a critical section, such as
+// only running one importer at a time.
+//
+// The lock is held on one connection taken from db for the duration, and
+// is released when fn returns, whether or not it failed.
+func WithAdvisoryLock(ctx context.Context, db *sql.DB, key int64, fn func(ctx context.Context) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", key); err != nil {
+		return err
+	}
+	defer unlock(conn, key)
+
+	return fn(ctx)
+}
+
+// TryWithAdvisoryLock is like WithAdvisoryLock, but if another session
+// holds the lock it returns false straight away without running fn.
+func TryWithAdvisoryLock(ctx context.Context, db *sql.DB, key int64, fn func(ctx context.Context) error) (bool, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&acquired); err != nil {
+		return false, err
+	}
+	if !acquired {
+		return false, nil
+	}
+	defer unlock(conn, key)
+
+	return true, fn(ctx)
+}
+
+// unlock releases key on conn. It doesn't use the caller's context, which
+// may be why fn returned. If the unlock fails the connection is discarded
+// rather than returned to the pool, since closing the session is the only
+// other way to release the lock.
+func unlock(conn *sql.Conn, key int64) {
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key); err != nil {
+		conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+}
+
+// WithAdvisoryLock runs fn while holding advisory lock key on the
+// repository's database; see the package-level WithAdvisoryLock.
+func (r *PostgresUserRepository) WithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) error {
+	return WithAdvisoryLock(ctx, r.DB, key, fn)
+}
+
+// TryWithAdvisoryLock runs fn if advisory lock key is free on the
+// repository's database; see the package-level TryWithAdvisoryLock.
+func (r *PostgresUserRepository) TryWithAdvisoryLock(ctx context.Context, key int64, fn func(ctx context.Context) error) (bool, error) {
+	return TryWithAdvisoryLock(ctx, r.DB, key, fn)
+}
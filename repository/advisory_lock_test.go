@@ -0,0 +1,15 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLockKey(t *testing.T) {
+	// Keys must be stable across processes and releases, or two versions
+	// running side by side would not exclude each other
+	assert.Equal(t, LockKey("importer"), LockKey("importer"))
+	assert.Equal(t, int64(2782400229151754467), LockKey("importer"))
+	assert.NotEqual(t, LockKey("importer"), LockKey("retention"))
+}
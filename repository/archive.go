@@ -0,0 +1,71 @@
+package repository
+
+// HistoryArchiver is implemented by backends that can read out and write
+// back every user's history, deleted users' included, so that a backup
+// keeps what FindUserHistory, FindUserAsOf and RestoreUser rely on.
+type HistoryArchiver interface {
+	// EachUserVersion calls fn with every past version of every user, a
+	// user at a time, oldest first. It stops at the first error fn
+	// returns.
+	EachUserVersion(fn func(UserVersion) error) error
+	// InsertUserVersions adds versions to their users' history as they
+	// are, and moves ID generation past their user IDs, so a deleted
+	// user's ID isn't handed out again.
+	InsertUserVersions(versions []UserVersion) error
+}
+
+// SchemaVersioner is implemented by backends with a migrated schema, to
+// name the last migration applied to it.
+type SchemaVersioner interface {
+	SchemaVersion() (string, error)
+}
+
+// Rewriter is implemented by backends that can rewrite stored users in
+// place, for EncryptedUserRepository.Reencrypt.
+type Rewriter interface {
+	// RewriteUsers calls fn with every user and every past version of one,
+	// and stores the email and phone number of those fn reports it changed,
+	// without recording the rewrite in their history. fn is only given
+	// their ID, email and phone number. A user changed meanwhile keeps the
+	// change, and isn't rewritten. It returns how many users and versions
+	// were rewritten.
+	RewriteUsers(fn func(*User) (bool, error)) (int, error)
+}
+
+// FindHistoryArchiver returns the HistoryArchiver among repo and the
+// repositories it wraps, or nil if there is none. An
+// EncryptedUserRepository is only one if its backend is.
+func FindHistoryArchiver(repo UserRepository) HistoryArchiver {
+	archiver, _ := findCapability[HistoryArchiver](repo)
+	if encrypted, ok := archiver.(*EncryptedUserRepository); ok && FindHistoryArchiver(encrypted.UserRepository) == nil {
+		return nil
+	}
+	return archiver
+}
+
+// SchemaVersion returns the last migration applied to the backend beneath
+// repo, or "" if it has no schema of its own, such as the memory backend.
+func SchemaVersion(repo UserRepository) (string, error) {
+	versioner, ok := findCapability[SchemaVersioner](repo)
+	if !ok {
+		return "", nil
+	}
+	return versioner.SchemaVersion()
+}
+
+// findCapability returns the first of repo and the repositories it wraps
+// that implements T.
+func findCapability[T any](repo UserRepository) (T, bool) {
+	for repo != nil {
+		if c, ok := repo.(T); ok {
+			return c, true
+		}
+		wrapper, ok := repo.(interface{ Unwrap() UserRepository })
+		if !ok {
+			break
+		}
+		repo = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// BlindIndex maps blind indexes (see Keyring.BlindIndex) to user IDs.
+type BlindIndex interface {
+	Put(index string, id int) error
+	Delete(index string) error
+	// Lookup returns ErrUserNotFound for an unknown index.
+	Lookup(index string) (int, error)
+}
+
+// MemoryBlindIndex is a BlindIndex for use with MemoryUserRepository.
+type MemoryBlindIndex struct {
+	mu  sync.RWMutex
+	ids map[string]int
+}
+
+func NewMemoryBlindIndex() *MemoryBlindIndex {
+	return &MemoryBlindIndex{ids: map[string]int{}}
+}
+
+func (i *MemoryBlindIndex) Put(index string, id int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.ids[index] = id
+	return nil
+}
+
+func (i *MemoryBlindIndex) Delete(index string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.ids, index)
+	return nil
+}
+
+func (i *MemoryBlindIndex) Lookup(index string) (int, error) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	id, ok := i.ids[index]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return id, nil
+}
+
+// PostgresBlindIndex keeps blind indexes in the user_email_index table
+// created by the migrations package. Despite the name it holds phone
+// numbers' too; blind indexes are bound to their field, so the two can't
+// collide.
+type PostgresBlindIndex struct {
+	DB *sql.DB
+	// Hooks are told about every statement the index runs; see QueryHook.
+	Hooks []QueryHook
+}
+
+func NewPostgresBlindIndex(db *sql.DB) *PostgresBlindIndex {
+	return &PostgresBlindIndex{DB: db}
+}
+
+func (i *PostgresBlindIndex) Put(index string, id int) error {
+	query := `
+	INSERT INTO user_email_index (email_index, user_id)
+	VALUES ($1, $2)
+	ON CONFLICT (email_index) DO UPDATE SET user_id = EXCLUDED.user_id`
+
+	_, err := withHooks(i.DB, i.Hooks).ExecContext(context.Background(), query, index, id)
+	return err
+}
+
+func (i *PostgresBlindIndex) Delete(index string) error {
+	_, err := withHooks(i.DB, i.Hooks).ExecContext(context.Background(), "DELETE FROM user_email_index WHERE email_index = $1", index)
+	return err
+}
+
+func (i *PostgresBlindIndex) Lookup(index string) (int, error) {
+	var id int
+	err := withHooks(i.DB, i.Hooks).QueryRowContext(context.Background(), "SELECT user_id FROM user_email_index WHERE email_index = $1", index).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	return id, err
+}
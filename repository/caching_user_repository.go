@@ -0,0 +1,261 @@
+package repository
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is the number of users CachingUserRepository holds when
+// no size is given.
+const DefaultCacheSize = 10000
+
+// CachingUserRepository wraps a UserRepository and keeps users it has found
+// for TTL, so repeated lookups of the same ID skip the wrapped repository.
+// Users that are not found are never cached.
+//
+// Whole users are cached whatever fields a find asks for, and the fields
+// are selected from the cached copy.
+//
+// A TTL of zero or less turns caching off; use SetTTL to change it while
+// the repository is in use.
+//
+// Writes made through the repository invalidate what it has cached.
+// When several instances share a database, also run
+// ListenForInvalidations, so each drops users the others change.
+type CachingUserRepository struct {
+	UserRepository
+	TTL  time.Duration
+	Size int
+
+	mu      sync.Mutex
+	entries map[int]cacheEntry
+	now     func() time.Time
+	// invalidations counts calls to Invalidate and Purge, so a find can
+	// tell whether a user it read may have changed before it cached them.
+	invalidations uint64
+}
+
+var _ UserRepository = (*CachingUserRepository)(nil)
+
+type cacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+func NewCachingUserRepository(repo UserRepository, ttl time.Duration, size int) *CachingUserRepository {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	return &CachingUserRepository{
+		UserRepository: repo,
+		TTL:            ttl,
+		Size:           size,
+		entries:        map[int]cacheEntry{},
+		now:            time.Now,
+	}
+}
+
+func (r *CachingUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	if !r.enabled() {
+		return r.UserRepository.FindUserByID(id, opts...)
+	}
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	entry, ok := r.entries[id]
+	if ok && r.now().Before(entry.expires) {
+		r.mu.Unlock()
+		return fields.apply(copyUser(entry.user)), nil
+	}
+	delete(r.entries, id)
+	invalidations := r.invalidations
+	r.mu.Unlock()
+
+	user, err := r.UserRepository.FindUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store(user, invalidations)
+	return fields.apply(user), nil
+}
+
+// FindUsersByIDs serves what it can from the cache and looks up the rest
+// in one call to the wrapped repository.
+func (r *CachingUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	if !r.enabled() {
+		return r.UserRepository.FindUsersByIDs(ids, opts...)
+	}
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int]*User, len(ids))
+	var missing []int
+	r.mu.Lock()
+	now := r.now()
+	for _, id := range ids {
+		if entry, ok := r.entries[id]; ok && now.Before(entry.expires) {
+			users[id] = fields.apply(copyUser(entry.user))
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	invalidations := r.invalidations
+	r.mu.Unlock()
+
+	if len(missing) == 0 {
+		return users, nil
+	}
+	found, err := r.UserRepository.FindUsersByIDs(missing)
+	if err != nil {
+		return nil, err
+	}
+	for id, user := range found {
+		r.store(user, invalidations)
+		users[id] = fields.apply(user)
+	}
+	return users, nil
+}
+
+func (r *CachingUserRepository) SaveUser(user *User) error {
+	err := r.UserRepository.SaveUser(user)
+	r.Invalidate(user.ID)
+	return err
+}
+
+func (r *CachingUserRepository) SaveUsers(users []*User) error {
+	err := r.UserRepository.SaveUsers(users)
+	for _, user := range users {
+		r.Invalidate(user.ID)
+	}
+	return err
+}
+
+func (r *CachingUserRepository) InsertUsers(users []*User) error {
+	err := r.UserRepository.InsertUsers(users)
+	for _, user := range users {
+		r.Invalidate(user.ID)
+	}
+	return err
+}
+
+func (r *CachingUserRepository) UpdateUser(user *User) error {
+	err := r.UserRepository.UpdateUser(user)
+	r.Invalidate(user.ID)
+	return err
+}
+
+func (r *CachingUserRepository) UpdateUsers(users []*User) error {
+	err := r.UserRepository.UpdateUsers(users)
+	for _, user := range users {
+		r.Invalidate(user.ID)
+	}
+	return err
+}
+
+func (r *CachingUserRepository) RecordLogin(id int) error {
+	err := r.UserRepository.RecordLogin(id)
+	r.Invalidate(id)
+	return err
+}
+
+func (r *CachingUserRepository) SetUserStatus(id int, from, to Status) error {
+	err := r.UserRepository.SetUserStatus(id, from, to)
+	r.Invalidate(id)
+	return err
+}
+
+func (r *CachingUserRepository) AnonymizeUser(id int) error {
+	err := r.UserRepository.AnonymizeUser(id)
+	r.Invalidate(id)
+	return err
+}
+
+func (r *CachingUserRepository) DeleteUser(id int) error {
+	err := r.UserRepository.DeleteUser(id)
+	r.Invalidate(id)
+	return err
+}
+
+func (r *CachingUserRepository) PurgeUser(id int) error {
+	err := r.UserRepository.PurgeUser(id)
+	r.Invalidate(id)
+	return err
+}
+
+// store caches a copy of user, read when r.invalidations was as given. If
+// anything has been invalidated since, the copy may be stale, so it isn't
+// cached.
+func (r *CachingUserRepository) store(user *User, invalidations uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.invalidations != invalidations {
+		return
+	}
+	if len(r.entries) >= r.Size {
+		// Make room by dropping an arbitrary entry; expired entries are
+		// otherwise only removed when they are next looked up.
+		for evict := range r.entries {
+			delete(r.entries, evict)
+			break
+		}
+	}
+	r.entries[user.ID] = cacheEntry{user: copyUser(user), expires: r.now().Add(r.TTL)}
+}
+
+// DeleteUsersWhere purges the whole cache, as it can't tell which users
+// were deleted.
+func (r *CachingUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	n, err := r.UserRepository.DeleteUsersWhere(spec)
+	r.Purge()
+	return n, err
+}
+
+func (r *CachingUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	ids, err := r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+	r.Purge()
+	return ids, err
+}
+
+// SetTTL changes how long users are cached for. Cached users are dropped,
+// so none outlive the new TTL.
+func (r *CachingUserRepository) SetTTL(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ttl != r.TTL {
+		r.TTL = ttl
+		r.entries = map[int]cacheEntry{}
+	}
+}
+
+func (r *CachingUserRepository) enabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.TTL > 0
+}
+
+// Unwrap returns the wrapped repository.
+func (r *CachingUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// Invalidate drops any cached copy of the user with this ID.
+func (r *CachingUserRepository) Invalidate(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, id)
+	r.invalidations++
+}
+
+// Purge drops every cached user.
+func (r *CachingUserRepository) Purge() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = map[int]cacheEntry{}
+	r.invalidations++
+}
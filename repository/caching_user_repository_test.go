@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachingUserRepository(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe"}},
+	}
+	cache := NewCachingUserRepository(mockRepo, time.Minute, 0)
+
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	// The second lookup is served from the cache
+	_, err := cache.FindUserByID(1)
+	assert.NoError(t, err)
+	user, err := cache.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+	assert.Equal(t, 1, mockRepo.CallCount("FindUserByID"))
+
+	// Once the entry expires the wrapped repository is asked again
+	now = now.Add(2 * time.Minute)
+	_, err = cache.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, mockRepo.CallCount("FindUserByID"))
+
+	// Misses are not cached
+	_, err = cache.FindUserByID(2)
+	assert.Error(t, err)
+	_, err = cache.FindUserByID(2)
+	assert.Error(t, err)
+	assert.Equal(t, 4, mockRepo.CallCount("FindUserByID"))
+}
+
+func TestCachingUserRepositoryInvalidatesOnSave(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe"}},
+	}
+	cache := NewCachingUserRepository(mockRepo, time.Minute, 0)
+
+	_, _ = cache.FindUserByID(1)
+	assert.NoError(t, cache.SaveUser(&User{ID: 1, Name: "Johnny Doe"}))
+
+	user, err := cache.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "Johnny Doe", user.Name)
+}
+
+func TestCachingUserRepositorySize(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}},
+	}
+	cache := NewCachingUserRepository(mockRepo, time.Minute, 2)
+
+	for id := 1; id <= 3; id++ {
+		_, _ = cache.FindUserByID(id)
+	}
+	assert.Len(t, cache.entries, 2)
+}
+
+func TestCachingUserRepositoryFindUsersByIDs(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe"}, 2: {ID: 2, Name: "Jane Doe"}},
+	}
+	cache := NewCachingUserRepository(mockRepo, time.Minute, 0)
+
+	// Warm the cache with one user
+	_, err := cache.FindUserByID(1)
+	assert.NoError(t, err)
+
+	// Only the uncached IDs are looked up, in one call
+	users, err := cache.FindUsersByIDs([]int{1, 2, 3})
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "Jane Doe", users[2].Name)
+	mockRepo.AssertCalled(t, "FindUsersByIDs", []int{2, 3})
+
+	// After which both are cached
+	_, err = cache.FindUsersByIDs([]int{1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, mockRepo.CallCount("FindUsersByIDs"))
+}
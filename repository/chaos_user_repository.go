@@ -0,0 +1,271 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrChaos is returned by ChaosUserRepository when it injects a failure and
+// no ChaosConfig.Err is set.
+var ErrChaos = errors.New("chaos: injected failure")
+
+// ChaosConfig sets how often, and how badly, ChaosUserRepository misbehaves.
+// Probabilities are between 0 (never) and 1 (every call).
+type ChaosConfig struct {
+	// LatencyProbability is the chance of delaying a call by a random
+	// duration up to Latency.
+	LatencyProbability float64
+	Latency            time.Duration
+
+	// ErrorProbability is the chance of failing a call with Err.
+	ErrorProbability float64
+	Err              error
+
+	// TimeoutProbability is the chance of hanging for Timeout and then
+	// failing as a statement timing out does, with an error that wraps
+	// ErrQueryTimeout and context.DeadlineExceeded.
+	TimeoutProbability float64
+	Timeout            time.Duration
+
+	// Seed makes the injected faults repeatable. Zero uses the current time.
+	Seed int64
+}
+
+// ChaosUserRepository wraps a UserRepository and injects latency, errors and
+// timeouts, for checking that callers cope with an unreliable store. Faults
+// are injected before the wrapped repository is called, so a failed write
+// never reaches it.
+type ChaosUserRepository struct {
+	UserRepository
+	Config ChaosConfig
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	sleep func(time.Duration)
+}
+
+var _ UserRepository = (*ChaosUserRepository)(nil)
+
+func NewChaosUserRepository(repo UserRepository, config ChaosConfig) *ChaosUserRepository {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &ChaosUserRepository{
+		UserRepository: repo,
+		Config:         config,
+		rand:           rand.New(rand.NewSource(seed)),
+		sleep:          time.Sleep,
+	}
+}
+
+func (r *ChaosUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUserByID(id, opts...)
+}
+
+func (r *ChaosUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUserByEmail(email, opts...)
+}
+
+func (r *ChaosUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUserByPhone(phone, opts...)
+}
+
+func (r *ChaosUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUsersByIDs(ids, opts...)
+}
+
+func (r *ChaosUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUsersWhere(spec, afterID, limit, opts...)
+}
+
+func (r *ChaosUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	if err := r.inject(); err != nil {
+		return 0, err
+	}
+	return r.UserRepository.CountUsersWhere(spec)
+}
+
+func (r *ChaosUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUsersByNamePrefix(prefix, opts...)
+}
+
+func (r *ChaosUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.SuggestUsers(q, opts...)
+}
+
+func (r *ChaosUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUsersByMetadata(key, value, opts...)
+}
+
+func (r *ChaosUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUserHistory(id)
+}
+
+func (r *ChaosUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.FindUserAsOf(id, at)
+}
+
+func (r *ChaosUserRepository) SaveUser(user *User) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.SaveUser(user)
+}
+
+func (r *ChaosUserRepository) SaveUsers(users []*User) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.SaveUsers(users)
+}
+
+func (r *ChaosUserRepository) InsertUsers(users []*User) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.InsertUsers(users)
+}
+
+func (r *ChaosUserRepository) UpdateUser(user *User) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.UpdateUser(user)
+}
+
+func (r *ChaosUserRepository) UpdateUsers(users []*User) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.UpdateUsers(users)
+}
+
+func (r *ChaosUserRepository) RecordLogin(id int) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.RecordLogin(id)
+}
+
+func (r *ChaosUserRepository) SetUserStatus(id int, from, to Status) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.SetUserStatus(id, from, to)
+}
+
+func (r *ChaosUserRepository) AnonymizeUser(id int) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.AnonymizeUser(id)
+}
+
+func (r *ChaosUserRepository) DeleteUser(id int) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.DeleteUser(id)
+}
+
+func (r *ChaosUserRepository) RestoreUser(id int) (*User, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.RestoreUser(id)
+}
+
+func (r *ChaosUserRepository) PurgeUser(id int) error {
+	if err := r.inject(); err != nil {
+		return err
+	}
+	return r.UserRepository.PurgeUser(id)
+}
+
+func (r *ChaosUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	if err := r.inject(); err != nil {
+		return 0, err
+	}
+	return r.UserRepository.DeleteUsersWhere(spec)
+}
+
+func (r *ChaosUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	if err := r.inject(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+}
+
+// inject rolls for each kind of fault in turn: latency, then timeout, then
+// error.
+func (r *ChaosUserRepository) inject() error {
+	r.mu.Lock()
+	latency := r.roll(r.Config.LatencyProbability)
+	delay := time.Duration(0)
+	if latency && r.Config.Latency > 0 {
+		delay = time.Duration(r.rand.Int63n(int64(r.Config.Latency)))
+	}
+	timeout := r.roll(r.Config.TimeoutProbability)
+	fail := r.roll(r.Config.ErrorProbability)
+	r.mu.Unlock()
+
+	if delay > 0 {
+		r.sleep(delay)
+	}
+	if timeout {
+		r.sleep(r.Config.Timeout)
+		return fmt.Errorf("chaos: injected timeout after %s: %w: %w", r.Config.Timeout, ErrQueryTimeout, context.DeadlineExceeded)
+	}
+	if fail {
+		if r.Config.Err != nil {
+			return r.Config.Err
+		}
+		return ErrChaos
+	}
+	return nil
+}
+
+// Unwrap returns the wrapped repository.
+func (r *ChaosUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// roll returns true with probability p. Callers must hold r.mu.
+func (r *ChaosUserRepository) roll(p float64) bool {
+	return p > 0 && r.rand.Float64() < p
+}
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChaosUserRepositoryPassesThrough(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe"}},
+	}
+
+	// No probabilities set, so nothing is injected
+	chaos := NewChaosUserRepository(mockRepo, ChaosConfig{Seed: 1})
+
+	user, err := chaos.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+}
+
+func TestChaosUserRepositoryInjectsErrors(t *testing.T) {
+	mockRepo := &MockUserRepository{}
+	injected := errors.New("connection reset")
+
+	chaos := NewChaosUserRepository(mockRepo, ChaosConfig{ErrorProbability: 1, Err: injected, Seed: 1})
+
+	// The failure happens before the wrapped repository is reached
+	err := chaos.SaveUser(&User{Name: "Jane Doe"})
+	assert.Equal(t, injected, err)
+	mockRepo.AssertNotCalled(t, "SaveUser")
+}
+
+func TestChaosUserRepositoryInjectsTimeouts(t *testing.T) {
+	mockRepo := &MockUserRepository{}
+
+	chaos := NewChaosUserRepository(mockRepo, ChaosConfig{
+		TimeoutProbability: 1,
+		Timeout:            time.Second,
+		LatencyProbability: 1,
+		Latency:            time.Millisecond,
+		Seed:               1,
+	})
+
+	// Record the sleeps rather than waiting for them
+	var slept time.Duration
+	chaos.sleep = func(d time.Duration) { slept += d }
+
+	_, err := chaos.FindUserByID(1)
+	assert.ErrorIs(t, err, ErrQueryTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.GreaterOrEqual(t, slept, time.Second)
+	assert.Less(t, slept, time.Second+time.Millisecond)
+}
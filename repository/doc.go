@@ -0,0 +1,18 @@
+// Package repository holds the User entity and the UserRepository port,
+// together with the adapters that implement it.
+//
+// In ports-and-adapters terms:
+//
+//   - User and UserRepository are the domain: the entity and the port the
+//     application depends on.
+//   - PostgresUserRepository, MemoryUserRepository and RemoteUserRepository
+//     are storage adapters, and MockUserRepository is a test adapter.
+//   - The Caching, Logging, Metrics, Chaos and Encrypted repositories are
+//     decorators: adapters that wrap another UserRepository and add
+//     behaviour. MigratingUserRepository wraps two, to move between them.
+//
+// The service package is the application layer. It depends only on the
+// UserRepository interface, never on a concrete adapter, so adapters can be
+// swapped without touching it. Every adapter asserts at compile time that it
+// satisfies the port.
+package repository
@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// dsnSetting is one Postgres connection setting.
+type dsnSetting struct {
+	key, value string
+}
+
+// withDSNSettings returns dsn with settings added, overriding any it
+// already has. Settings with an empty value are skipped. dsn may be a
+// postgres:// URL or a list of key=value settings.
+func withDSNSettings(dsn string, settings []dsnSetting) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for _, s := range settings {
+			if s.value != "" {
+				query.Set(s.key, s.value)
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	// Later settings win in a key=value DSN, so appending overrides.
+	for _, s := range settings {
+		if s.value != "" {
+			dsn += " " + s.key + "=" + quoteDSNValue(s.value)
+		}
+	}
+	return strings.TrimSpace(dsn), nil
+}
+
+// withStatementTimeout returns dsn with statement_timeout set to timeout,
+// so every connection opened with it starts with that timeout rather than
+// each statement setting it. It returns dsn unchanged for a timeout of
+// zero.
+func withStatementTimeout(dsn string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dsn, nil
+	}
+	// At least 1ms, since 0 would turn the timeout off.
+	ms := max(timeout.Milliseconds(), 1)
+	return withDSNSettings(dsn, []dsnSetting{{"statement_timeout", strconv.FormatInt(ms, 10)}})
+}
+
+// quoteDSNValue quotes a value for a key=value DSN.
+func quoteDSNValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// passwordConnector opens Postgres connections with whatever password is
+// current, so a rotated password is used by every new connection without
+// reopening the pool.
+type passwordConnector struct {
+	dsn      string
+	password func() string
+}
+
+// openPostgres opens a pool of connections to the primary among dsns,
+// taking the password from password for each new connection when it is
+// set. With more than one DSN the pool fails over between them; see
+// failoverConnector.
+func openPostgres(dsns []string, password func() string) (*sql.DB, error) {
+	switch {
+	case len(dsns) > 1:
+		return sql.OpenDB(newFailoverConnector(dsns, password)), nil
+	case password != nil:
+		return sql.OpenDB(passwordConnector{dsn: dsns[0], password: password}), nil
+	default:
+		return sql.Open("postgres", dsns[0])
+	}
+}
+
+func (c passwordConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return connectPostgres(ctx, c.dsn, c.password)
+}
+
+func (c passwordConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// connectPostgres opens one connection to dsn, with the current password
+// if password is set.
+func connectPostgres(ctx context.Context, dsn string, password func() string) (driver.Conn, error) {
+	if password != nil {
+		var err error
+		if dsn, err = withDSNSettings(dsn, []dsnSetting{{"password", password()}}); err != nil {
+			return nil, err
+		}
+	}
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return connector.Connect(ctx)
+}
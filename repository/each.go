@@ -0,0 +1,24 @@
+package repository
+
+// EachUser calls fn with every user matching spec with an ID greater than
+// afterID, in ID order, reading batchSize users at a time. Only one batch
+// is held at once, and the next isn't read until fn has returned for the
+// last, so a slow fn slows the reads rather than letting them pile up. It
+// stops at the first error, from the repository or fn.
+func EachUser(repo UserRepository, spec Specification, afterID, batchSize int, fn func(*User) error, opts ...FindOption) error {
+	for {
+		users, err := repo.FindUsersWhere(spec, afterID, batchSize, opts...)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+		if len(users) < batchSize {
+			return nil
+		}
+		afterID = users[len(users)-1].ID
+	}
+}
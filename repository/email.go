@@ -0,0 +1,48 @@
+package repository
+
+import "strings"
+
+// EmailNormalizer puts email addresses into the form users are looked up
+// by, so that " Jane.Doe@Example.com" finds the user who signed up as
+// "jane.doe@example.com". Users keep the address as they gave it in Email;
+// the normalized form is stored alongside it in NormalizedEmail.
+//
+// The zero value trims space and lowercases the whole address. Strictly the
+// local part is case-sensitive, but no mainstream provider treats it so.
+type EmailNormalizer struct {
+	// FoldGmail also drops dots and any +tag from the local part of Gmail
+	// addresses, and reads googlemail.com as gmail.com, since Gmail
+	// delivers all of those to the same mailbox. Other providers' plus
+	// addresses are left alone, as not all of them ignore the tag.
+	FoldGmail bool
+}
+
+// Normalize returns email in normalized form. Anything without an @ is
+// only trimmed and lowercased.
+func (n EmailNormalizer) Normalize(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !n.FoldGmail {
+		return email
+	}
+
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || (domain != "gmail.com" && domain != "googlemail.com") {
+		return email
+	}
+	local, _, _ = strings.Cut(local, "+")
+	return strings.ReplaceAll(local, ".", "") + "@gmail.com"
+}
+
+// findByEmail implements FindUserByEmail over a map of users, comparing
+// normalized addresses. Should several users share one, the earliest
+// saved is returned.
+func findByEmail(users map[int]*User, emails EmailNormalizer, email string) (*User, bool) {
+	want := emails.Normalize(email)
+	var found *User
+	for _, user := range users {
+		if emails.Normalize(user.Email) == want && (found == nil || user.ID < found.ID) {
+			found = user
+		}
+	}
+	return found, found != nil
+}
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEmailNormalizer(t *testing.T) {
+	// By default only space and case are ignored
+	var plain EmailNormalizer
+	assert.Equal(t, "jane.doe@example.com", plain.Normalize(" Jane.Doe@Example.COM\n"))
+	assert.Equal(t, "jane.doe+news@gmail.com", plain.Normalize("Jane.Doe+news@gmail.com"))
+
+	// Gmail folding drops dots and tags, for Gmail only
+	gmail := EmailNormalizer{FoldGmail: true}
+	assert.Equal(t, "janedoe@gmail.com", gmail.Normalize("Jane.Doe+news@gmail.com"))
+	assert.Equal(t, "janedoe@gmail.com", gmail.Normalize("jane.doe@googlemail.com"))
+	assert.Equal(t, "jane.doe+news@example.com", gmail.Normalize("jane.doe+news@example.com"))
+	assert.Equal(t, "not an email", gmail.Normalize("Not an email"))
+}
+
+func TestMemoryUserRepositoryFindUserByNormalizedEmail(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	repo.Emails = EmailNormalizer{FoldGmail: true}
+
+	// The address is kept as given, alongside its normalized form
+	user := &User{Name: "Jane Doe", Email: "Jane.Doe+signup@Gmail.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.Equal(t, "janedoe@gmail.com", user.NormalizedEmail)
+
+	found, err := repo.FindUserByEmail(" janedoe@googlemail.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane.Doe+signup@Gmail.com", found.Email)
+
+	// Updating the email normalizes the new one
+	found.Email = "JANE@example.com"
+	assert.NoError(t, repo.UpdateUser(found))
+	found, err = repo.FindUserByEmail("jane@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@example.com", found.NormalizedEmail)
+	_, err = repo.FindUserByEmail("janedoe@gmail.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
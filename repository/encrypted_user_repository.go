@@ -0,0 +1,734 @@
+package repository
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrUnknownKey is returned when a stored value was encrypted with a key
+// that is not in the Keyring.
+var ErrUnknownKey = errors.New("encryption key not in keyring")
+
+// encryptedPrefix marks a stored value as ciphertext. The full format is
+// "enc:<key id>:<base64 nonce and ciphertext>".
+const encryptedPrefix = "enc:"
+
+// deleteBatchSize is how many users DeleteUsersWhere reads at a time.
+const deleteBatchSize = 500
+
+// Keyring holds the keys used to encrypt personal data.
+//
+// To rotate, add a new key and make it Primary. New writes use the primary
+// key; values written under older keys stay readable for as long as those
+// keys remain in Keys, and once EncryptedUserRepository.Reencrypt has run
+// they can be removed. IndexKey is separate and is not rotated, because
+// changing it would orphan every blind index entry.
+type Keyring struct {
+	// Primary is the ID of the key new values are encrypted with.
+	Primary string
+	// Keys are AES keys (16, 24 or 32 bytes) by ID.
+	Keys map[string][]byte
+	// IndexKey is the HMAC key for blind indexes.
+	IndexKey []byte
+}
+
+// NewKeyring builds a Keyring from base64-encoded keys by ID. It checks
+// that each key is a valid AES key, that primary is one of them, and that
+// there is an index key of at least 16 bytes.
+func NewKeyring(primary string, keys map[string]string, indexKey string) (*Keyring, error) {
+	k := &Keyring{Primary: primary, Keys: make(map[string][]byte, len(keys))}
+	for id, encoded := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("encryption key ID %q must be non-empty and contain no colon", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		k.Keys[id] = key
+	}
+	if _, ok := k.Keys[primary]; !ok {
+		return nil, fmt.Errorf("%w: primary %q", ErrUnknownKey, primary)
+	}
+
+	var err error
+	if k.IndexKey, err = base64.StdEncoding.DecodeString(indexKey); err != nil {
+		return nil, fmt.Errorf("index key: %w", err)
+	}
+	if len(k.IndexKey) < 16 {
+		return nil, errors.New("index key must be at least 16 bytes")
+	}
+	return k, nil
+}
+
+// Encrypt seals plaintext with the primary key. field is bound into the
+// ciphertext, so a value can't be moved to a different field undetected.
+func (k *Keyring) Encrypt(field, plaintext string) (string, error) {
+	aead, err := k.aead(k.Primary)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(field))
+
+	return encryptedPrefix + k.Primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt with whichever key sealed it.
+// Values without the encrypted prefix, written before encryption was
+// turned on, are returned unchanged.
+func (k *Keyring) Decrypt(field, value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, encryptedPrefix)
+	if !ok {
+		return value, nil
+	}
+	keyID, encoded, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	aead, err := k.aead(keyID)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(field))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// BlindIndex returns a keyed hash of a field's plaintext value. Equal values
+// give equal indexes, so they can be looked up without decrypting anything,
+// but the value can't be recovered from the index without IndexKey.
+func (k *Keyring) BlindIndex(field, value string) string {
+	mac := hmac.New(sha256.New, k.IndexKey)
+	mac.Write([]byte(field + ":" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// current reports whether value was sealed with the primary key.
+func (k *Keyring) current(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix+k.Primary+":")
+}
+
+func (k *Keyring) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := k.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedUserRepository wraps a UserRepository and encrypts personal data
+// with AES-GCM before it is stored, decrypting it again on the way out.
+// Emails and phone numbers are also recorded in a BlindIndex so
+// FindUserByEmail and FindUserByPhone keep working even though what is
+// stored is ciphertext. An index entry leads to one user, so of several
+// users sharing a phone number, the last one saved is found.
+//
+// Users are saved before their index entries, so if indexing fails the user
+// exists but can't be found by email until it is saved again.
+//
+// The index holds normalized emails, and the normalized_email the backend
+// stores is derived from ciphertext, so it is Emails here that decides how
+// addresses match. Entries indexed before normalization was added match
+// only if the address was already in normalized form; saving the user
+// again reindexes them.
+type EncryptedUserRepository struct {
+	UserRepository
+	Keys  *Keyring
+	Index BlindIndex
+	// Emails normalizes addresses before they are indexed or looked up.
+	Emails EmailNormalizer
+}
+
+var (
+	_ UserRepository  = (*EncryptedUserRepository)(nil)
+	_ HistoryArchiver = (*EncryptedUserRepository)(nil)
+)
+
+// encryptedFields lists every User field that is encrypted at rest. Adding
+// personal data to User means adding it here. value returns nil for an
+// optional field that isn't set.
+var encryptedFields = []struct {
+	name  string
+	value func(*User) *string
+}{
+	{"email", func(u *User) *string { return &u.Email }},
+	{"phone", func(u *User) *string { return u.Phone }},
+}
+
+func NewEncryptedUserRepository(repo UserRepository, keys *Keyring, index BlindIndex) *EncryptedUserRepository {
+	return &EncryptedUserRepository{UserRepository: repo, Keys: keys, Index: index}
+}
+
+func (r *EncryptedUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	user, err := r.UserRepository.FindUserByID(id, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r.decrypt(user)
+}
+
+// FindUserByEmail reads the whole user, whatever fields are asked for, so
+// the email can be checked against the index entry.
+func (r *EncryptedUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	id, err := r.Index.Lookup(r.emailIndex(email))
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.FindUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	// Guard against a stale index entry pointing at a different user.
+	if r.Emails.Normalize(user.Email) != r.Emails.Normalize(email) {
+		return nil, ErrUserNotFound
+	}
+	return fields.apply(user), nil
+}
+
+// FindUserByPhone, like FindUserByEmail, reads the whole user.
+func (r *EncryptedUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	id, err := r.Index.Lookup(r.Keys.BlindIndex("phone", phone))
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.FindUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if user.Phone == nil || *user.Phone != phone {
+		return nil, ErrUserNotFound
+	}
+	return fields.apply(user), nil
+}
+
+func (r *EncryptedUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	users, err := r.UserRepository.FindUsersByIDs(ids, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if _, err := r.decrypt(user); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// FindUsersWhere, CountUsersWhere and the deletes by specification return
+// ErrNotSupported for a spec that matches on an encrypted field, such as
+// EmailDomain, rather than quietly matching nothing.
+func (r *EncryptedUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	if err := checkSpec(spec); err != nil {
+		return nil, err
+	}
+	users, err := r.UserRepository.FindUsersWhere(spec, afterID, limit, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r.decryptAll(users)
+}
+
+func (r *EncryptedUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	if err := checkSpec(spec); err != nil {
+		return 0, err
+	}
+	return r.UserRepository.CountUsersWhere(spec)
+}
+
+// FindUsersByNamePrefix and SuggestUsers search names, which aren't
+// encrypted, so only the results need decrypting.
+func (r *EncryptedUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	users, err := r.UserRepository.FindUsersByNamePrefix(prefix, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r.decryptAll(users)
+}
+
+func (r *EncryptedUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	users, err := r.UserRepository.SuggestUsers(q, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r.decryptAll(users)
+}
+
+func (r *EncryptedUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	users, err := r.UserRepository.FindUsersByMetadata(key, value, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return r.decryptAll(users)
+}
+
+func (r *EncryptedUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	versions, err := r.UserRepository.FindUserHistory(id)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		if _, err := r.decrypt(&versions[i].User); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+func (r *EncryptedUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	user, err := r.UserRepository.FindUserAsOf(id, at)
+	if err != nil {
+		return nil, err
+	}
+	return r.decrypt(user)
+}
+
+func (r *EncryptedUserRepository) SaveUser(user *User) error {
+	encrypted, err := r.encrypt(user)
+	if err != nil {
+		return err
+	}
+	if err := r.UserRepository.SaveUser(encrypted); err != nil {
+		return err
+	}
+	user.ID, user.CreatedAt, user.NormalizedEmail = encrypted.ID, encrypted.CreatedAt, r.Emails.Normalize(user.Email)
+	user.Status = encrypted.Status
+	return r.index(user)
+}
+
+func (r *EncryptedUserRepository) SaveUsers(users []*User) error {
+	return r.saveUsers(users, r.UserRepository.SaveUsers)
+}
+
+func (r *EncryptedUserRepository) InsertUsers(users []*User) error {
+	return r.saveUsers(users, r.UserRepository.InsertUsers)
+}
+
+// saveUsers encrypts users, saves them with save, and indexes them.
+func (r *EncryptedUserRepository) saveUsers(users []*User, save func([]*User) error) error {
+	encrypted := make([]*User, len(users))
+	for i, user := range users {
+		var err error
+		if encrypted[i], err = r.encrypt(user); err != nil {
+			return err
+		}
+	}
+	if err := save(encrypted); err != nil {
+		return err
+	}
+	for i, user := range users {
+		user.ID, user.CreatedAt, user.NormalizedEmail = encrypted[i].ID, encrypted[i].CreatedAt, r.Emails.Normalize(user.Email)
+		user.Status = encrypted[i].Status
+		if err := r.index(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateUser updates the user and, if their email or phone number changed,
+// moves their blind index entries to the new ones.
+func (r *EncryptedUserRepository) UpdateUser(user *User) error {
+	old, err := r.FindUserByID(user.ID)
+	if err != nil {
+		return err
+	}
+	encrypted, err := r.encrypt(user)
+	if err != nil {
+		return err
+	}
+	if err := r.UserRepository.UpdateUser(encrypted); err != nil {
+		return err
+	}
+	user.NormalizedEmail = r.Emails.Normalize(user.Email)
+	return r.reindex(old, user)
+}
+
+// UpdateUsers updates the users together, then moves their blind index
+// entries as UpdateUser does.
+func (r *EncryptedUserRepository) UpdateUsers(users []*User) error {
+	ids := make([]int, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+	old, err := r.FindUsersByIDs(ids)
+	if err != nil {
+		return err
+	}
+	encrypted := make([]*User, len(users))
+	for i, user := range users {
+		if _, ok := old[user.ID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrUserNotFound, user.ID)
+		}
+		if encrypted[i], err = r.encrypt(user); err != nil {
+			return err
+		}
+	}
+	if err := r.UserRepository.UpdateUsers(encrypted); err != nil {
+		return err
+	}
+	for _, user := range users {
+		user.NormalizedEmail = r.Emails.Normalize(user.Email)
+		if err := r.reindex(old[user.ID], user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex moves the blind index entries of old, the user as they were, to
+// those of user.
+func (r *EncryptedUserRepository) reindex(old, user *User) error {
+	oldEntries, newEntries := r.indexEntries(old), r.indexEntries(user)
+	for _, entry := range oldEntries {
+		if !slices.Contains(newEntries, entry) {
+			if err := r.unindexEntry(entry, user.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range newEntries {
+		if !slices.Contains(oldEntries, entry) {
+			if err := r.Index.Put(entry, user.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AnonymizeUser anonymizes the user and drops them from the blind index, so
+// their old email and phone number no longer find them.
+func (r *EncryptedUserRepository) AnonymizeUser(id int) error {
+	user, err := r.FindUserByID(id)
+	if err != nil {
+		return err
+	}
+	if err := r.UserRepository.AnonymizeUser(id); err != nil {
+		return err
+	}
+	return r.unindex(user)
+}
+
+// DeleteUser deletes the user and their blind index entries.
+func (r *EncryptedUserRepository) DeleteUser(id int) error {
+	user, err := r.FindUserByID(id)
+	if err != nil {
+		return err
+	}
+	if err := r.UserRepository.DeleteUser(id); err != nil {
+		return err
+	}
+	return r.unindex(user)
+}
+
+// RestoreUser restores the user and puts their blind index entries back.
+func (r *EncryptedUserRepository) RestoreUser(id int) (*User, error) {
+	user, err := r.UserRepository.RestoreUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.decrypt(user); err != nil {
+		return nil, err
+	}
+	return user, r.index(user)
+}
+
+// PurgeUser purges the user and, if they hadn't been deleted, their blind
+// index entries.
+func (r *EncryptedUserRepository) PurgeUser(id int) error {
+	user, err := r.FindUserByID(id)
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	if err := r.UserRepository.PurgeUser(id); err != nil {
+		return err
+	}
+	if user == nil {
+		return nil
+	}
+	return r.unindex(user)
+}
+
+// DeleteUsersWhere deletes the matching users one at a time, so that each
+// one's blind index entries are removed with it.
+func (r *EncryptedUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	ids, err := r.DeleteUsersWhereReturningIDs(spec)
+	return int64(len(ids)), err
+}
+
+func (r *EncryptedUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	if IsEmpty(spec) {
+		return nil, ErrEmptySpecification
+	}
+	if err := checkSpec(spec); err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for {
+		users, err := r.UserRepository.FindUsersWhere(spec, 0, deleteBatchSize, Fields("id"))
+		if err != nil || len(users) == 0 {
+			return ids, err
+		}
+		for _, user := range users {
+			err := r.DeleteUser(user.ID)
+			switch {
+			case err == nil:
+				ids = append(ids, user.ID)
+			case !errors.Is(err, ErrUserNotFound):
+				return ids, err
+			}
+		}
+	}
+}
+
+// EachUserVersion reads the history of the backend beneath, decrypted.
+func (r *EncryptedUserRepository) EachUserVersion(fn func(UserVersion) error) error {
+	archiver := FindHistoryArchiver(r.UserRepository)
+	if archiver == nil {
+		return ErrNotSupported
+	}
+	return archiver.EachUserVersion(func(version UserVersion) error {
+		if _, err := r.decrypt(&version.User); err != nil {
+			return err
+		}
+		return fn(version)
+	})
+}
+
+// InsertUserVersions encrypts the versions and inserts them into the
+// history of the backend beneath.
+func (r *EncryptedUserRepository) InsertUserVersions(versions []UserVersion) error {
+	archiver := FindHistoryArchiver(r.UserRepository)
+	if archiver == nil {
+		return ErrNotSupported
+	}
+	encrypted := make([]UserVersion, len(versions))
+	for i, version := range versions {
+		user, err := r.encrypt(&version.User)
+		if err != nil {
+			return err
+		}
+		encrypted[i] = UserVersion{User: *user, ChangedAt: version.ChangedAt, Operation: version.Operation}
+	}
+	return archiver.InsertUserVersions(encrypted)
+}
+
+// Reencrypt seals again, with the primary key, every stored value that was
+// sealed with another key or not at all, in current users and their history
+// alike, so that the other keys can be removed from the Keyring.
+// Anonymized users are left as they are. Users
+// whose email was stored in plaintext, from before encryption was turned
+// on, are also indexed, since nothing could find them by email before. It
+// returns how many users and past versions it rewrote, and ErrNotSupported
+// if the backend beneath can't rewrite them in place.
+func (r *EncryptedUserRepository) Reencrypt() (int, error) {
+	rewriter, ok := findCapability[Rewriter](r.UserRepository)
+	if !ok {
+		return 0, ErrNotSupported
+	}
+
+	var unindexed []int
+	n, err := rewriter.RewriteUsers(func(user *User) (bool, error) {
+		// Anonymized users' tombstones are stored in plaintext, to be
+		// matched by Anonymized.
+		if Anonymized().IsSatisfiedBy(user) {
+			return false, nil
+		}
+		changed := false
+		for _, field := range encryptedFields {
+			value := field.value(user)
+			if value == nil || r.Keys.current(*value) {
+				continue
+			}
+			if field.name == "email" && !strings.HasPrefix(*value, encryptedPrefix) {
+				unindexed = append(unindexed, user.ID)
+			}
+			plaintext, err := r.Keys.Decrypt(field.name, *value)
+			if err != nil {
+				return false, fmt.Errorf("decrypting %s of user %d: %w", field.name, user.ID, err)
+			}
+			if *value, err = r.Keys.Encrypt(field.name, plaintext); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+		return changed, nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	// Past versions of a user are rewritten too, so an ID can turn up more
+	// than once, and for users since deleted.
+	slices.Sort(unindexed)
+	users, err := r.FindUsersByIDs(slices.Compact(unindexed))
+	if err != nil {
+		return n, err
+	}
+	for _, user := range users {
+		if err := r.index(user); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Reencrypt runs EncryptedUserRepository.Reencrypt on the first of repo
+// and the repositories it wraps that is one. It returns ErrNotSupported if
+// none is.
+func Reencrypt(repo UserRepository) (int, error) {
+	encrypted, ok := findCapability[*EncryptedUserRepository](repo)
+	if !ok {
+		return 0, fmt.Errorf("%w: the repository isn't encrypted", ErrNotSupported)
+	}
+	return encrypted.Reencrypt()
+}
+
+// Unwrap returns the wrapped repository.
+func (r *EncryptedUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// encrypt returns a copy of user with every encrypted field sealed.
+func (r *EncryptedUserRepository) encrypt(user *User) (*User, error) {
+	c := copyUser(user)
+	for _, field := range encryptedFields {
+		value := field.value(c)
+		if value == nil {
+			continue
+		}
+		sealed, err := r.Keys.Encrypt(field.name, *value)
+		if err != nil {
+			return nil, err
+		}
+		*value = sealed
+	}
+	return c, nil
+}
+
+// decrypt opens every encrypted field of user in place.
+func (r *EncryptedUserRepository) decrypt(user *User) (*User, error) {
+	for _, field := range encryptedFields {
+		value := field.value(user)
+		if value == nil {
+			continue
+		}
+		plaintext, err := r.Keys.Decrypt(field.name, *value)
+		if err != nil {
+			return nil, fmt.Errorf("decrypting %s of user %d: %w", field.name, user.ID, err)
+		}
+		*value = plaintext
+	}
+	if user.NormalizedEmail != "" {
+		user.NormalizedEmail = r.Emails.Normalize(user.Email)
+	}
+	return user, nil
+}
+
+// emailIndex returns the blind index entry for email.
+func (r *EncryptedUserRepository) emailIndex(email string) string {
+	return r.Keys.BlindIndex("email", r.Emails.Normalize(email))
+}
+
+// indexEntries returns the blind index entries that find user.
+func (r *EncryptedUserRepository) indexEntries(user *User) []string {
+	entries := []string{r.emailIndex(user.Email)}
+	if user.Phone != nil {
+		entries = append(entries, r.Keys.BlindIndex("phone", *user.Phone))
+	}
+	return entries
+}
+
+// index puts the user's blind index entries.
+func (r *EncryptedUserRepository) index(user *User) error {
+	for _, entry := range r.indexEntries(user) {
+		if err := r.Index.Put(entry, user.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindex deletes the user's blind index entries.
+func (r *EncryptedUserRepository) unindex(user *User) error {
+	for _, entry := range r.indexEntries(user) {
+		if err := r.unindexEntry(entry, user.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unindexEntry deletes entry if it finds the user with id. Users can share
+// a phone number, and an entry finds only the last of them indexed, so an
+// entry pointing at someone else is theirs to keep.
+func (r *EncryptedUserRepository) unindexEntry(entry string, id int) error {
+	owner, err := r.Index.Lookup(entry)
+	if errors.Is(err, ErrUserNotFound) || (err == nil && owner != id) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.Index.Delete(entry)
+}
+
+// checkSpec returns ErrNotSupported if spec matches on an encrypted field.
+func checkSpec(spec Specification) error {
+	if matchesEncrypted(spec) {
+		return fmt.Errorf("%w: specifications can't match on encrypted fields", ErrNotSupported)
+	}
+	return nil
+}
+
+func (r *EncryptedUserRepository) decryptAll(users []*User) ([]*User, error) {
+	for _, user := range users {
+		if _, err := r.decrypt(user); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,324 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyring() *Keyring {
+	return &Keyring{
+		Primary:  "2024",
+		Keys:     map[string][]byte{"2024": bytes.Repeat([]byte{1}, 32)},
+		IndexKey: bytes.Repeat([]byte{9}, 32),
+	}
+}
+
+func TestEncryptedUserRepository(t *testing.T) {
+	backend := NewMemoryUserRepository()
+	repo := NewEncryptedUserRepository(backend, newTestKeyring(), NewMemoryBlindIndex())
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// The caller's user is left in plaintext, but the stored email is not
+	assert.Equal(t, "jane.doe@example.com", user.Email)
+	stored, err := backend.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored.Email, "enc:2024:"))
+	assert.NotContains(t, stored.Email, "jane")
+
+	// Reads are decrypted
+	found, err := repo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", found.Email)
+
+	// Lookups by email go through the blind index
+	found, err = repo.FindUserByEmail("jane.doe@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	_, err = repo.FindUserByEmail("john.doe@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestEncryptedUserRepositoryNormalizesEmails(t *testing.T) {
+	backend := NewMemoryUserRepository()
+	repo := NewEncryptedUserRepository(backend, newTestKeyring(), NewMemoryBlindIndex())
+
+	user := &User{Name: "Jane Doe", Email: "Jane.Doe@Example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.Equal(t, "jane.doe@example.com", user.NormalizedEmail)
+
+	// The normalized form isn't stored in plaintext either
+	stored, err := backend.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.NotContains(t, stored.NormalizedEmail, "jane")
+
+	found, err := repo.FindUserByEmail(" jane.doe@EXAMPLE.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane.Doe@Example.com", found.Email)
+	assert.Equal(t, "jane.doe@example.com", found.NormalizedEmail)
+}
+
+func TestEncryptedUserRepositoryAnonymize(t *testing.T) {
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), newTestKeyring(), NewMemoryBlindIndex())
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.NoError(t, repo.AnonymizeUser(user.ID))
+
+	// The old email no longer leads anywhere
+	_, err := repo.FindUserByEmail("jane.doe@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	found, err := repo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Anonymized User", found.Name)
+	assert.Equal(t, fmt.Sprintf("anonymized-%d@invalid", user.ID), found.Email)
+}
+
+func TestEncryptedUserRepositoryUpdate(t *testing.T) {
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), newTestKeyring(), NewMemoryBlindIndex())
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.NoError(t, repo.UpdateUser(&User{ID: user.ID, Name: "Jane Doe", Email: "jane@example.org"}))
+
+	// The index follows the email
+	_, err := repo.FindUserByEmail("jane.doe@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	found, err := repo.FindUserByEmail("jane@example.org")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// History is decrypted too
+	versions, err := repo.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "jane.doe@example.com", versions[0].Email)
+}
+
+func TestEncryptedUserRepositoryRestore(t *testing.T) {
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), newTestKeyring(), NewMemoryBlindIndex())
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.NoError(t, repo.DeleteUser(user.ID))
+
+	// The restored user can be found by email again
+	restored, err := repo.RestoreUser(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", restored.Email)
+	found, err := repo.FindUserByEmail("jane.doe@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// Until they are purged
+	assert.NoError(t, repo.PurgeUser(user.ID))
+	_, err = repo.FindUserByEmail("jane.doe@example.com")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestEncryptedUserRepositoryDeleteUsersWhere(t *testing.T) {
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), newTestKeyring(), NewMemoryBlindIndex())
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	n, err := repo.DeleteUsersWhere(Unverified())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	// The index entry went with the user
+	_, err = repo.Index.Lookup(repo.Keys.BlindIndex("email", user.Email))
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestEncryptedUserRepositoryRefusesEncryptedSpecs(t *testing.T) {
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), newTestKeyring(), NewMemoryBlindIndex())
+	assert.NoError(t, repo.SaveUser(&User{Name: "Jane Doe", Email: "jane.doe@example.com"}))
+
+	// The backend only sees ciphertext, so it could never match an email
+	// domain
+	for _, spec := range []Specification{EmailDomain("example.com"), And(Unverified(), Not(EmailDomain("example.com")))} {
+		_, err := repo.FindUsersWhere(spec, 0, 10)
+		assert.ErrorIs(t, err, ErrNotSupported)
+		_, err = repo.CountUsersWhere(spec)
+		assert.ErrorIs(t, err, ErrNotSupported)
+		_, err = repo.DeleteUsersWhere(spec)
+		assert.ErrorIs(t, err, ErrNotSupported)
+	}
+
+	// Anonymized users' tombstones aren't encrypted, so they can be
+	n, err := repo.CountUsersWhere(Not(Anonymized()))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestEncryptedUserRepositoryKeyRotation(t *testing.T) {
+	keys := newTestKeyring()
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), keys, NewMemoryBlindIndex())
+
+	before := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(before))
+
+	// Rotate: add a new primary key, keeping the old one for reads
+	keys.Keys["2025"] = bytes.Repeat([]byte{2}, 32)
+	keys.Primary = "2025"
+
+	after := &User{Name: "John Doe", Email: "john.doe@example.com"}
+	assert.NoError(t, repo.SaveUsers([]*User{after}))
+
+	for _, user := range []*User{before, after} {
+		found, err := repo.FindUserByEmail(user.Email)
+		assert.NoError(t, err)
+		assert.Equal(t, user.ID, found.ID)
+	}
+
+	// Once the old key is retired its values can no longer be read
+	delete(keys.Keys, "2024")
+	_, err := repo.FindUserByID(before.ID)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestEncryptedUserRepositoryReencrypt(t *testing.T) {
+	backend := NewMemoryUserRepository()
+	keys := newTestKeyring()
+	repo := NewEncryptedUserRepository(backend, keys, NewMemoryBlindIndex())
+
+	// One user from before encryption was turned on, one under the old key
+	// with a past version, and one anonymized
+	plain := &User{Name: "Ann", Email: "ann@example.com"}
+	assert.NoError(t, backend.SaveUser(plain))
+	phone := "+447700900123"
+	old := &User{Name: "Bob", Email: "bob@example.com", Phone: &phone}
+	assert.NoError(t, repo.SaveUser(old))
+	old.Name = "Bobby"
+	assert.NoError(t, repo.UpdateUser(old))
+	gone := &User{Name: "Cat", Email: "cat@example.com"}
+	assert.NoError(t, repo.SaveUser(gone))
+	assert.NoError(t, repo.AnonymizeUser(gone.ID))
+
+	keys.Keys["2025"] = bytes.Repeat([]byte{2}, 32)
+	keys.Primary = "2025"
+	n, err := Reencrypt(repo)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// Rewriting isn't a change of the user's
+	history, err := repo.FindUserHistory(old.ID)
+	assert.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// The old key can go, and the user from before encryption can now be
+	// found by email
+	delete(keys.Keys, "2024")
+	for _, user := range []*User{plain, old} {
+		found, err := repo.FindUserByEmail(user.Email)
+		assert.NoError(t, err)
+		assert.Equal(t, user.Name, found.Name)
+	}
+	history, err = repo.FindUserHistory(old.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob@example.com", history[0].Email)
+	assert.Equal(t, phone, *history[0].Phone)
+	stored, err := backend.FindUserByID(gone.ID)
+	assert.NoError(t, err)
+	assert.True(t, Anonymized().IsSatisfiedBy(stored))
+
+	// Running it again finds nothing left to do
+	n, err = Reencrypt(repo)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+
+	_, err = Reencrypt(backend)
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestNewKeyring(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	keys, err := NewKeyring("2024", map[string]string{"2024": key}, key)
+	assert.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte{1}, 32), keys.Keys["2024"])
+
+	_, err = NewKeyring("2025", map[string]string{"2024": key}, key)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	_, err = NewKeyring("2024", map[string]string{"2024": "c2hvcnQ="}, key)
+	assert.ErrorContains(t, err, "invalid key size")
+	_, err = NewKeyring("20:24", map[string]string{"20:24": key}, key)
+	assert.ErrorContains(t, err, "colon")
+	_, err = NewKeyring("2024", map[string]string{"2024": key}, "")
+	assert.ErrorContains(t, err, "index key")
+}
+
+func TestKeyringBindsField(t *testing.T) {
+	keys := newTestKeyring()
+
+	sealed, err := keys.Encrypt("email", "jane.doe@example.com")
+	assert.NoError(t, err)
+
+	// A value sealed for one field can't be opened as another
+	_, err = keys.Decrypt("name", sealed)
+	assert.Error(t, err)
+
+	// Values written before encryption was enabled pass straight through
+	plain, err := keys.Decrypt("email", "john.doe@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", plain)
+}
+
+func TestEncryptedUserRepositoryPhone(t *testing.T) {
+	backend := NewMemoryUserRepository()
+	repo := NewEncryptedUserRepository(backend, newTestKeyring(), NewMemoryBlindIndex())
+
+	phone := "+447700900123"
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com", Phone: &phone}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// The phone number is encrypted too, without touching the caller's
+	assert.Equal(t, "+447700900123", *user.Phone)
+	stored, err := backend.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.NotContains(t, *stored.Phone, "7700")
+
+	found, err := repo.FindUserByPhone("+447700900123")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.Equal(t, "+447700900123", *found.Phone)
+
+	// Removing the number drops it from the index
+	found.Phone = nil
+	assert.NoError(t, repo.UpdateUser(found))
+	_, err = repo.FindUserByPhone("+447700900123")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = repo.FindUserByEmail("jane.doe@example.com")
+	assert.NoError(t, err)
+}
+
+func TestEncryptedUserRepositorySharedPhone(t *testing.T) {
+	repo := NewEncryptedUserRepository(NewMemoryUserRepository(), newTestKeyring(), NewMemoryBlindIndex())
+
+	phone := "+447700900123"
+	jane := &User{Name: "Jane Doe", Email: "jane.doe@example.com", Phone: &phone}
+	john := &User{Name: "John Doe", Email: "john.doe@example.com", Phone: &phone}
+	assert.NoError(t, repo.SaveUser(jane))
+	assert.NoError(t, repo.SaveUser(john))
+
+	// The number finds John, whose entry survives Jane leaving or changing
+	// her number
+	jane.Phone = nil
+	assert.NoError(t, repo.UpdateUser(jane))
+	assert.NoError(t, repo.DeleteUser(jane.ID))
+	found, err := repo.FindUserByPhone(phone)
+	assert.NoError(t, err)
+	assert.Equal(t, john.ID, found.ID)
+
+	assert.NoError(t, repo.DeleteUser(john.ID))
+	_, err = repo.FindUserByPhone(phone)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gorepository/features"
+)
+
+// ErrUnsupportedDriver is returned by New for a driver that has not been
+// registered.
+var ErrUnsupportedDriver = errors.New("unsupported repository driver")
+
+// Config selects and configures the UserRepository built by New.
+type Config struct {
+	// Driver is the registered backend to use, such as "postgres" or
+	// "memory". See Register.
+	Driver string
+	// DSN is the connection string for database-backed drivers, the
+	// database file for the sqlite driver, or the base URL for the remote
+	// driver.
+	DSN string
+	// StandbyDSNs are the postgres driver's standbys, any of which may be
+	// promoted if the primary at DSN fails. When set, new connections go
+	// to whichever server is the primary, and calls made while there is
+	// none fail with ErrUnavailable.
+	StandbyDSNs []string
+	// Token authenticates the remote driver with the remote API.
+	Token string
+	// TLS secures the postgres driver's connections.
+	TLS TLSConfig
+	// Password, when set, returns the database password, overriding the
+	// DSN's. It is called for each new connection, so a rotated password
+	// takes effect without a restart.
+	Password func() string
+	// StatementTimeout bounds each database statement when greater than
+	// zero.
+	StatementTimeout time.Duration
+	// Emails normalizes addresses in the postgres, sqlite and memory
+	// drivers. The remote driver leaves it to the remote instance.
+	Emails EmailNormalizer
+	// QueryHooks are told about every statement the postgres and sqlite
+	// drivers run; see QueryHook.
+	QueryHooks []QueryHook
+	// Encryption, when set, wraps each backend in EncryptedUserRepository
+	// with these keys. Only the postgres, pgx and memory drivers support
+	// it, keeping the blind index in the user_email_index table and in
+	// memory respectively.
+	Encryption *Keyring
+
+	// MigrationDSN, when set, is a backend to migrate to through
+	// MigratingUserRepository, using MigrationDriver, or Driver if that
+	// isn't set.
+	MigrationDriver string
+	MigrationDSN    string
+	// MigrationStage is how far the migration has got; the zero stage is
+	// MigrateDualWrite.
+	MigrationStage MigrationStage
+	// CompareReads compares finds against the migration's secondary
+	// backend, logging where they differ.
+	CompareReads bool
+	// MigrationFlags, when set, copies writes to the migration's secondary
+	// backend only while features.DualWrite is on.
+	MigrationFlags features.Provider
+
+	// Policies enables PolicyUserRepository, bounding the latency of
+	// reads, when not empty.
+	Policies Policies
+	// ReplicaDSN, when set, is a read replica for the same driver that
+	// hedged reads go to; see PolicyUserRepository.
+	ReplicaDSN string
+
+	// CacheTTL enables CachingUserRepository when greater than zero.
+	CacheTTL time.Duration
+	// CacheSize caps the cache; zero uses DefaultCacheSize.
+	CacheSize int
+	// CacheInvalidation keeps the cache consistent with changes made by
+	// other processes sharing the database; see ListenForInvalidations.
+	// Only the postgres driver supports it.
+	CacheInvalidation bool
+	// Logger enables LoggingUserRepository when set.
+	Logger *log.Logger
+	// Metrics enables MetricsUserRepository.
+	Metrics bool
+	// WriteBehindInterval enables WriteBehindUserRepository when greater
+	// than zero, flushing at least this often.
+	WriteBehindInterval time.Duration
+	// WriteBehindBatchSize is how many buffered updates trigger a flush;
+	// zero uses DefaultWriteBehindBatchSize.
+	WriteBehindBatchSize int
+	// ReadOnly makes every write fail with ErrReadOnly; see
+	// ReadOnlyUserRepository.
+	ReadOnly bool
+	// Reloadable installs the policy, cache, read-only and logging
+	// decorators even while they are off, so that Reconfigure can turn
+	// them on later.
+	Reloadable bool
+}
+
+// New builds the UserRepository described by cfg, wrapped in the configured
+// decorators. From the inside out the order is always:
+//
+//	backend -> encryption -> migration -> policies -> cache -> write-behind -> read-only -> logging -> metrics
+//
+// so nothing outside the backend sees ciphertext, a migration sees every write that reaches a backend, only reads that
+// miss the cache are hedged, cache hits are still logged and measured,
+// metrics reflect what callers actually see, the cache is only invalidated
+// once buffered writes reach the backend, and writes refused while
+// read-only are never buffered. The returned cleanup function flushes any
+// buffered writes and then releases the backend's resources, such as its
+// database connections.
+func New(cfg Config) (UserRepository, func(), error) {
+	repo, cleanup, err := newBackend(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.MigrationDSN != "" {
+		targetCfg := cfg
+		targetCfg.DSN, targetCfg.StandbyDSNs = cfg.MigrationDSN, nil
+		if cfg.MigrationDriver != "" {
+			targetCfg.Driver = cfg.MigrationDriver
+		}
+		target, closeTarget, err := newBackend(targetCfg)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		migrating := NewMigratingUserRepository(repo, target, cfg.MigrationStage, cfg.Logger)
+		migrating.SetCompareReads(cfg.CompareReads)
+		migrating.Flags = cfg.MigrationFlags
+		closeBackend := cleanup
+		cleanup = func() {
+			migrating.Wait()
+			closeTarget()
+			closeBackend()
+		}
+		repo = migrating
+	}
+
+	if len(cfg.Policies) > 0 || cfg.Reloadable {
+		var replica UserRepository
+		if cfg.ReplicaDSN != "" {
+			replicaCfg := cfg
+			replicaCfg.DSN, replicaCfg.StandbyDSNs = cfg.ReplicaDSN, nil
+			var closeReplica func()
+			if replica, closeReplica, err = newBackend(replicaCfg); err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			closeBackend := cleanup
+			cleanup = func() {
+				closeReplica()
+				closeBackend()
+			}
+		}
+		repo = NewPolicyUserRepository(repo, replica, cfg.Policies)
+	}
+	if cfg.CacheTTL > 0 || cfg.Reloadable {
+		cache := NewCachingUserRepository(repo, cfg.CacheTTL, cfg.CacheSize)
+		if cfg.CacheInvalidation {
+			stop, err := listenForInvalidations(cfg, cache)
+			if err != nil {
+				cleanup()
+				return nil, nil, err
+			}
+			closeBackend := cleanup
+			cleanup = func() {
+				stop()
+				closeBackend()
+			}
+		}
+		repo = cache
+	}
+	if cfg.WriteBehindInterval > 0 {
+		logger := cfg.Logger
+		if logger == nil {
+			logger = log.Default()
+		}
+		writeBehind := NewWriteBehindUserRepository(repo, cfg.WriteBehindBatchSize, logger)
+		stop, closeBackend := writeBehind.FlushEvery(cfg.WriteBehindInterval), cleanup
+		cleanup = func() {
+			stop()
+			closeBackend()
+		}
+		repo = writeBehind
+	}
+	if cfg.ReadOnly || cfg.Reloadable {
+		repo = NewReadOnlyUserRepository(repo, cfg.ReadOnly)
+	}
+	if cfg.Logger != nil || cfg.Reloadable {
+		repo = NewLoggingUserRepository(repo, cfg.Logger)
+	}
+	if cfg.Metrics {
+		repo = NewMetricsUserRepository(repo)
+	}
+
+	return repo, cleanup, nil
+}
+
+// listenForInvalidations runs ListenForInvalidations for cache against the
+// primary database in cfg.
+func listenForInvalidations(cfg Config, cache *CachingUserRepository) (stop func(), err error) {
+	if cfg.Driver != "postgres" {
+		return nil, fmt.Errorf("%w: cache invalidation needs the postgres driver, not %q", ErrNotSupported, cfg.Driver)
+	}
+	dsn, err := cfg.TLS.Apply(cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Password != nil {
+		if dsn, err = withDSNSettings(dsn, []dsnSetting{{"password", cfg.Password()}}); err != nil {
+			return nil, err
+		}
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	return ListenForInvalidations(dsn, cache, logger)
+}
+
+// Reconfigure applies the settings in cfg that can change while repo is in
+// use, MigrationStage, CompareReads, Policies, CacheTTL, ReadOnly and
+// Logger, to the decorators New wrapped it in. ReadOnly is only applied if
+// it has changed, so that it doesn't undo SetReadOnly. Other settings are
+// ignored.
+// Decorators that New left out because they were off can't be turned on;
+// build with Config.Reloadable to avoid that.
+func Reconfigure(repo UserRepository, cfg Config) {
+	for repo != nil {
+		switch r := repo.(type) {
+		case *MigratingUserRepository:
+			r.SetStage(cfg.MigrationStage)
+			r.SetCompareReads(cfg.CompareReads)
+		case *PolicyUserRepository:
+			r.SetPolicies(cfg.Policies)
+		case *CachingUserRepository:
+			r.SetTTL(cfg.CacheTTL)
+		case *ReadOnlyUserRepository:
+			r.configure(cfg.ReadOnly)
+		case *LoggingUserRepository:
+			r.SetLogger(cfg.Logger)
+		}
+
+		wrapper, ok := repo.(interface{ Unwrap() UserRepository })
+		if !ok {
+			return
+		}
+		repo = wrapper.Unwrap()
+	}
+}
@@ -0,0 +1,227 @@
+package repository
+
+import (
+	"bytes"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewMemory(t *testing.T) {
+	repo, cleanup, err := New(Config{Driver: "memory"})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	// The memory backend hands out IDs like a database would
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.Equal(t, 1, user.ID)
+
+	found, err := repo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+}
+
+func TestNewUnsupportedDriver(t *testing.T) {
+	for _, driver := range []string{"", "oracle"} {
+		_, _, err := New(Config{Driver: driver})
+		assert.ErrorIs(t, err, ErrUnsupportedDriver)
+	}
+}
+
+func TestNewPgx(t *testing.T) {
+	// The pool connects lazily, so no database is needed to build it
+	repo, cleanup, err := New(Config{Driver: "pgx", DSN: "postgres://user@localhost/db"})
+	assert.NoError(t, err)
+	defer cleanup()
+	assert.IsType(t, &PostgresUserRepository{}, repo)
+
+	_, _, err = New(Config{Driver: "pgx", DSN: "postgres://user@a/db", StandbyDSNs: []string{"postgres://user@b/db"}})
+	assert.ErrorContains(t, err, "multi-host")
+}
+
+func TestNewSQLite(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "users.db")
+	repo, cleanup, err := New(Config{Driver: "sqlite", DSN: dsn})
+	require.NoError(t, err)
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	cleanup()
+
+	// The users outlive the process that saved them
+	repo, cleanup, err = New(Config{Driver: "sqlite", DSN: dsn})
+	require.NoError(t, err)
+	defer cleanup()
+	found, err := repo.FindUserByEmail("jane.doe@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.True(t, user.CreatedAt.Equal(found.CreatedAt))
+}
+
+func TestNewEncrypted(t *testing.T) {
+	repo, cleanup, err := New(Config{Driver: "memory", Encryption: newTestKeyring(), Metrics: true})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	encrypted, ok := repo.(*MetricsUserRepository).Unwrap().(*EncryptedUserRepository)
+	assert.True(t, ok)
+	assert.IsType(t, &MemoryBlindIndex{}, encrypted.Index)
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	stored, err := encrypted.Unwrap().FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.NotContains(t, stored.Email, "jane")
+	found, err := repo.FindUserByEmail("jane.doe@example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// Postgres keeps the blind index in its own database
+	repo, cleanup, err = New(Config{Driver: "pgx", DSN: "postgres://user@localhost/db", Encryption: newTestKeyring()})
+	assert.NoError(t, err)
+	defer cleanup()
+	assert.IsType(t, &PostgresBlindIndex{}, repo.(*EncryptedUserRepository).Index)
+
+	// The remote backend leaves encryption to the remote instance
+	_, _, err = New(Config{Driver: "remote", DSN: "http://localhost", Encryption: newTestKeyring()})
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
+
+func TestNewDecoratorOrder(t *testing.T) {
+	var buf bytes.Buffer
+	repo, cleanup, err := New(Config{
+		Driver:   "memory",
+		CacheTTL: time.Minute,
+		Logger:   log.New(&buf, "", 0),
+		Metrics:  true,
+
+		WriteBehindInterval: time.Minute,
+	})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	// Peel the decorators off from the outside in
+	metrics, ok := repo.(*MetricsUserRepository)
+	assert.True(t, ok)
+	logging, ok := metrics.UserRepository.(*LoggingUserRepository)
+	assert.True(t, ok)
+	writeBehind, ok := logging.UserRepository.(*WriteBehindUserRepository)
+	assert.True(t, ok)
+	cache, ok := writeBehind.UserRepository.(*CachingUserRepository)
+	assert.True(t, ok)
+	_, ok = cache.UserRepository.(*MemoryUserRepository)
+	assert.True(t, ok)
+
+	_, _ = repo.FindUserByID(1)
+	assert.Contains(t, buf.String(), "FindUserByID(1)")
+}
+
+func TestNewWriteBehindFlushesOnCleanup(t *testing.T) {
+	repo, cleanup, err := New(Config{Driver: "memory", WriteBehindInterval: time.Hour})
+	assert.NoError(t, err)
+	backend := repo.(*WriteBehindUserRepository).UserRepository
+
+	assert.NoError(t, repo.SaveUser(&User{Name: "Jane Doe", Email: "jane.doe@example.com"}))
+	cleanup()
+	_, err = backend.FindUserByID(1)
+	assert.NoError(t, err)
+}
+
+func TestNewPolicies(t *testing.T) {
+	policies := Policies{"FindUserByID": {HedgeAfter: time.Millisecond}}
+	repo, cleanup, err := New(Config{Driver: "memory", Policies: policies, ReplicaDSN: "replica"})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	policy, ok := repo.(*PolicyUserRepository)
+	assert.True(t, ok)
+	_, ok = policy.Replica.(*MemoryUserRepository)
+	assert.True(t, ok)
+	assert.NotSame(t, policy.UserRepository, policy.Replica)
+}
+
+func TestNewMigration(t *testing.T) {
+	repo, cleanup, err := New(Config{Driver: "memory", MigrationDSN: "new", MigrationStage: MigrateNewPrimary})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	migrating, ok := repo.(*MigratingUserRepository)
+	assert.True(t, ok)
+	assert.Equal(t, MigrateNewPrimary, migrating.Stage())
+	assert.NotSame(t, migrating.Old, migrating.New)
+
+	// The stage can be moved on without a restart
+	Reconfigure(repo, Config{MigrationStage: MigrateNew, CompareReads: true})
+	assert.Equal(t, MigrateNew, migrating.Stage())
+}
+
+func TestReconfigure(t *testing.T) {
+	repo, cleanup, err := New(Config{Driver: "memory", Reloadable: true})
+	assert.NoError(t, err)
+	defer cleanup()
+
+	// The decorators are installed but do nothing yet
+	logging, ok := repo.(*LoggingUserRepository)
+	assert.True(t, ok)
+	readOnly, ok := logging.UserRepository.(*ReadOnlyUserRepository)
+	assert.True(t, ok)
+	cache, ok := readOnly.UserRepository.(*CachingUserRepository)
+	assert.True(t, ok)
+	assert.NoError(t, repo.SaveUser(&User{Name: "Jane Doe", Email: "jane.doe@example.com"}))
+	_, _ = repo.FindUserByID(1)
+	assert.Empty(t, cache.entries)
+
+	// Turn them on
+	var buf bytes.Buffer
+	Reconfigure(repo, Config{CacheTTL: time.Minute, Logger: log.New(&buf, "", 0)})
+	_, _ = repo.FindUserByID(1)
+	assert.Len(t, cache.entries, 1)
+	assert.Contains(t, buf.String(), "FindUserByID(1)")
+
+	Reconfigure(repo, Config{ReadOnly: true})
+	assert.ErrorIs(t, repo.DeleteUser(1), ErrReadOnly)
+
+	// A reload that leaves ReadOnly alone keeps an admin's override
+	readOnly.SetReadOnly(false)
+	Reconfigure(repo, Config{ReadOnly: true})
+	assert.False(t, readOnly.ReadOnly())
+	readOnly.SetReadOnly(true)
+
+	// And off again, dropping what was cached
+	buf.Reset()
+	Reconfigure(repo, Config{})
+	assert.Empty(t, cache.entries)
+	_, _ = repo.FindUserByID(1)
+	assert.Empty(t, cache.entries)
+	assert.Empty(t, buf.String())
+}
+
+func TestRegister(t *testing.T) {
+	backend := NewMemoryUserRepository()
+	Register("test-register", func(cfg Config) (UserRepository, func(), error) {
+		return backend, func() {}, nil
+	})
+	t.Cleanup(func() {
+		driversMu.Lock()
+		delete(drivers, "test-register")
+		driversMu.Unlock()
+	})
+
+	// New selects the registered backend by name
+	assert.Contains(t, Drivers(), "test-register")
+	repo, cleanup, err := New(Config{Driver: "test-register"})
+	assert.NoError(t, err)
+	defer cleanup()
+	assert.Same(t, backend, repo)
+
+	// Names can't be taken twice
+	assert.Panics(t, func() {
+		Register("test-register", func(cfg Config) (UserRepository, func(), error) {
+			return nil, nil, nil
+		})
+	})
+}
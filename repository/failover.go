@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrUnavailable is returned when the database can't be reached, such as
+// while a standby is being promoted after the primary fails. The call may
+// succeed if tried again later.
+var ErrUnavailable = errors.New("database unavailable")
+
+// Postgres error codes that mean the server is going away, isn't accepting
+// connections yet, or is a standby that can't take writes.
+const (
+	adminShutdown           = "57P01"
+	crashShutdown           = "57P02"
+	cannotConnectNow        = "57P03"
+	readOnlySQLTransaction  = "25006"
+	connectionExceptionCode = "08"
+)
+
+// failoverConnector connects to whichever of a primary and its standbys is
+// currently the primary. When the primary fails, database/sql drops the
+// broken connections and asks for new ones; failoverConnector then looks
+// through the DSNs again for a server that isn't in recovery, so the pool
+// moves to the promoted standby on its own.
+//
+// Host names are resolved again on every attempt, so DSNs naming a DNS
+// record that is repointed on failover work too.
+type failoverConnector struct {
+	dsns     []string
+	password func() string
+
+	// retries is how many more times the DSNs are tried when none is the
+	// primary, waiting backoff, then twice that, and so on in between.
+	retries int
+	backoff time.Duration
+
+	mu      sync.Mutex
+	primary int
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+func newFailoverConnector(dsns []string, password func() string) *failoverConnector {
+	return &failoverConnector{
+		dsns:     dsns,
+		password: password,
+		retries:  5,
+		backoff:  200 * time.Millisecond,
+		sleep:    sleepContext,
+	}
+}
+
+// Connect returns a connection to the primary, trying the one that was
+// primary last time first. If no DSN leads to a primary after retries
+// rounds, it returns ErrUnavailable.
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		c.mu.Lock()
+		first := c.primary
+		c.mu.Unlock()
+
+		for i := range c.dsns {
+			n := (first + i) % len(c.dsns)
+			conn, err := c.connect(ctx, c.dsns[n])
+			if err == nil {
+				c.mu.Lock()
+				c.primary = n
+				c.mu.Unlock()
+				return conn, nil
+			}
+			lastErr = err
+		}
+
+		if attempt >= c.retries {
+			return nil, fmt.Errorf("%w: no primary among %d hosts: %w", ErrUnavailable, len(c.dsns), lastErr)
+		}
+		Metrics.Add("Failover.retries", 1)
+		if err := c.sleep(ctx, c.backoff<<attempt); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+	}
+}
+
+func (c *failoverConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// connect opens a connection to dsn and keeps it only if the server is a
+// primary.
+func (c *failoverConnector) connect(ctx context.Context, dsn string) (driver.Conn, error) {
+	conn, err := connectPostgres(ctx, dsn, c.password)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := isPrimary(ctx, conn)
+	if err != nil || !primary {
+		conn.Close()
+		if err == nil {
+			err = errors.New("server is a standby")
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// isPrimary reports whether conn is to a server that can take writes.
+func isPrimary(ctx context.Context, conn driver.Conn) (bool, error) {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return true, nil
+	}
+	rows, err := queryer.QueryContext(ctx, "SELECT pg_is_in_recovery()", nil)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return false, err
+	}
+	inRecovery, _ := dest[0].(bool)
+	return !inRecovery, nil
+}
+
+// unavailableError marks err as ErrUnavailable if it means the database
+// couldn't be reached or has stopped being the primary, rather than that
+// the statement itself failed.
+func unavailableError(err error) error {
+	if err == nil || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrQueryTimeout) || !isUnavailable(err) {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrUnavailable, err)
+}
+
+func isUnavailable(err error) bool {
+	if code := sqlState(err); code != "" {
+		switch code {
+		case adminShutdown, crashShutdown, cannotConnectNow, readOnlySQLTransaction:
+			return true
+		}
+		return strings.HasPrefix(code, connectionExceptionCode)
+	}
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr)
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnavailableError(t *testing.T) {
+	// Lost connections, shutdowns and standbys refusing writes count
+	for _, err := range []error{
+		driver.ErrBadConn,
+		io.ErrUnexpectedEOF,
+		&pq.Error{Code: adminShutdown},
+		&pq.Error{Code: cannotConnectNow},
+		&pq.Error{Code: readOnlySQLTransaction},
+		&pq.Error{Code: "08006"},
+		fmt.Errorf("saving: %w", driver.ErrBadConn),
+	} {
+		assert.ErrorIs(t, unavailableError(err), ErrUnavailable, err.Error())
+	}
+
+	// Errors from the statement itself are left alone, as are timeouts
+	for _, err := range []error{
+		&pq.Error{Code: "23505"},
+		errors.New("sql: no rows in result set"),
+		timeoutError(&pq.Error{Code: queryCanceled}),
+	} {
+		assert.Equal(t, err, unavailableError(err))
+	}
+	assert.Nil(t, unavailableError(nil))
+}
+
+func TestFailoverConnectorGivesUp(t *testing.T) {
+	// Nothing listens on port 1, so no host is ever the primary
+	c := newFailoverConnector([]string{
+		"host=127.0.0.1 port=1 sslmode=disable connect_timeout=1",
+		"host=127.0.0.1 port=1 dbname=standby sslmode=disable connect_timeout=1",
+	}, nil)
+	var waits []time.Duration
+	c.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+
+	_, err := c.Connect(context.Background())
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorContains(t, err, "no primary among 2 hosts")
+
+	// Retries are bounded and back off
+	assert.Equal(t, []time.Duration{
+		200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond,
+		1600 * time.Millisecond, 3200 * time.Millisecond,
+	}, waits)
+}
+
+func TestFailoverConnectorCancelled(t *testing.T) {
+	c := newFailoverConnector([]string{"host=127.0.0.1 port=1 sslmode=disable connect_timeout=1"}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := c.Connect(ctx)
+	assert.ErrorIs(t, err, ErrUnavailable)
+	assert.ErrorIs(t, err, context.Canceled)
+}
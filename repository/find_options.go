@@ -0,0 +1,56 @@
+package repository
+
+import "time"
+
+// FindOption adjusts a find.
+type FindOption func(*findOptions)
+
+type findOptions struct {
+	fields   []string
+	timeout  time.Duration
+	limit    int
+	backward bool
+}
+
+func resolve(opts []FindOption) findOptions {
+	var o findOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Fields limits a find to the named fields, using their JSON names ("id",
+// "name", "email", ...). Fields left out are zero in the users returned.
+// The ID is always included, so results can still be paged and looked up.
+func Fields(fields ...string) FindOption {
+	return func(o *findOptions) {
+		o.fields = append(o.fields, fields...)
+	}
+}
+
+// Timeout bounds how long a find may run, overriding the repository's own
+// statement timeout. A find that runs out of time fails with
+// ErrQueryTimeout. Backends with nothing to time out ignore it.
+func Timeout(d time.Duration) FindOption {
+	return func(o *findOptions) {
+		o.timeout = d
+	}
+}
+
+// Backward makes FindUsersWhere read towards lower IDs: it returns users
+// with IDs less than afterID, or any ID if afterID is zero, in descending
+// ID order.
+func Backward() FindOption {
+	return func(o *findOptions) {
+		o.backward = true
+	}
+}
+
+// Limit caps how many users a search returns; see DefaultSearchLimit. The
+// finds that take a limit of their own ignore it.
+func Limit(n int) FindOption {
+	return func(o *findOptions) {
+		o.limit = n
+	}
+}
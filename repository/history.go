@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"slices"
+	"time"
+)
+
+// Operations that end a UserVersion.
+const (
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// UserVersion is a past version of a user: the user as it was until
+// ChangedAt, when Operation replaced or removed it.
+type UserVersion struct {
+	User
+	ChangedAt time.Time `json:"changed_at"`
+	Operation string    `json:"operation"`
+}
+
+// userHistory keeps past versions of users in memory, oldest first, for
+// the backends without a users_history table.
+type userHistory map[int][]UserVersion
+
+// record keeps a copy of user as it was before op.
+func (h userHistory) record(user *User, op string) {
+	h[user.ID] = append(h[user.ID], UserVersion{User: *copyUser(user), ChangedAt: time.Now(), Operation: op})
+}
+
+// all returns every version, a user at a time in ID order, oldest first.
+func (h userHistory) all() []UserVersion {
+	ids := make([]int, 0, len(h))
+	for id := range h {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var all []UserVersion
+	for _, id := range ids {
+		all = append(all, copyVersions(h[id])...)
+	}
+	return all
+}
+
+// insert adds versions to the history, keeping each user's in the order
+// they changed.
+func (h userHistory) insert(versions []UserVersion) {
+	for _, version := range versions {
+		h[version.ID] = append(h[version.ID], copyVersions([]UserVersion{version})...)
+	}
+	for _, version := range versions {
+		slices.SortStableFunc(h[version.ID], func(a, b UserVersion) int {
+			return a.ChangedAt.Compare(b.ChangedAt)
+		})
+	}
+}
+
+// anonymize scrubs the personal data from every past version of a user, so
+// that anonymizing them isn't undone by their history.
+func (h userHistory) anonymize(id int) {
+	for i := range h[id] {
+		h[id][i].User.Anonymize()
+	}
+}
+
+// lastDeleted returns the version of a user removed by their most recent
+// delete.
+func (h userHistory) lastDeleted(id int) (*User, bool) {
+	versions := h[id]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Operation == OperationDelete {
+			return copyUser(&versions[i].User), true
+		}
+	}
+	return nil, false
+}
+
+// versions implements FindUserHistory. current is the user as they are
+// now, or nil if there is no such user.
+func (h userHistory) versions(id int, current *User) ([]UserVersion, error) {
+	if current == nil && len(h[id]) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return copyVersions(h[id]), nil
+}
+
+// asOf implements FindUserAsOf. current is the user as they are now, or
+// nil if there is no such user.
+func (h userHistory) asOf(id int, current *User, at time.Time) (*User, error) {
+	for _, version := range h[id] {
+		if at.Before(version.ChangedAt) {
+			return existedAt(&version.User, at)
+		}
+	}
+	if current == nil {
+		return nil, ErrUserNotFound
+	}
+	return existedAt(current, at)
+}
+
+// copyVersions returns a copy of versions that shares nothing with them,
+// so callers can't change the history through what it returns.
+func copyVersions(versions []UserVersion) []UserVersion {
+	c := make([]UserVersion, len(versions))
+	for i, version := range versions {
+		c[i] = UserVersion{User: *copyUser(&version.User), ChangedAt: version.ChangedAt, Operation: version.Operation}
+	}
+	return c
+}
+
+// existedAt returns a copy of user if they had been created by at.
+func existedAt(user *User, at time.Time) (*User, error) {
+	if at.Before(user.CreatedAt) {
+		return nil, ErrUserNotFound
+	}
+	return copyUser(user), nil
+}
@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryUserRepositoryHistory(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	beforeCreated := time.Now()
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// A user who has never changed has no history
+	versions, err := repo.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Empty(t, versions)
+
+	original := time.Now()
+	assert.NoError(t, repo.UpdateUser(&User{ID: user.ID, Name: "Jane Smith", Email: "jane.smith@example.com"}))
+	renamed := time.Now()
+	assert.NoError(t, repo.DeleteUser(user.ID))
+
+	// Every version is kept, oldest first
+	versions, err = repo.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, "Jane Doe", versions[0].Name)
+	assert.Equal(t, OperationUpdate, versions[0].Operation)
+	assert.Equal(t, "Jane Smith", versions[1].Name)
+	assert.Equal(t, OperationDelete, versions[1].Operation)
+	assert.Equal(t, user.CreatedAt, versions[1].CreatedAt)
+
+	// And can be read as of any time the user existed
+	found, err := repo.FindUserAsOf(user.ID, original)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+	found, err = repo.FindUserAsOf(user.ID, renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Smith", found.Name)
+
+	_, err = repo.FindUserAsOf(user.ID, beforeCreated)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = repo.FindUserAsOf(user.ID, time.Now())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	_, err = repo.FindUserHistory(99)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.ErrorIs(t, repo.UpdateUser(&User{ID: 99}), ErrUserNotFound)
+}
+
+func TestMemoryUserRepositoryAnonymizeScrubsHistory(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+	assert.NoError(t, repo.UpdateUser(&User{ID: user.ID, Name: "Jane Smith", Email: "jane.doe@example.com"}))
+	assert.NoError(t, repo.AnonymizeUser(user.ID))
+
+	// No version still holds personal data
+	versions, err := repo.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	for _, version := range versions {
+		assert.Equal(t, "Anonymized User", version.Name)
+		assert.NotContains(t, version.Email, "jane")
+	}
+}
+
+func TestMemoryUserRepositoryRestoreAndPurge(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// Only deleted users can be restored
+	_, err := repo.RestoreUser(user.ID)
+	assert.ErrorIs(t, err, ErrUserExists)
+	_, err = repo.RestoreUser(99)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	// A restored user comes back with the same ID and data
+	assert.NoError(t, repo.DeleteUser(user.ID))
+	restored, err := repo.RestoreUser(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, user, restored)
+	found, err := repo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+
+	// Purging leaves nothing to restore or look back at
+	assert.NoError(t, repo.DeleteUser(user.ID))
+	assert.NoError(t, repo.PurgeUser(user.ID))
+	_, err = repo.RestoreUser(user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = repo.FindUserHistory(user.ID)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.ErrorIs(t, repo.PurgeUser(user.ID), ErrUserNotFound)
+}
+
+func TestMemoryUserRepositoryFindUserByPhone(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	phone := "+447700900123"
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com", Phone: &phone}
+	assert.NoError(t, repo.SaveUser(user))
+
+	found, err := repo.FindUserByPhone("+447700900123")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// Anonymizing removes the number, now and in the history
+	assert.NoError(t, repo.AnonymizeUser(user.ID))
+	_, err = repo.FindUserByPhone("+447700900123")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	versions, err := repo.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, versions[0].Phone)
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// IdentityMap remembers the users found while handling one request, so
+// finding the same user again doesn't go back to the database and returns
+// the same *User. It is meant to live as long as the request, attached to
+// its context with WithIdentityMap, and is safe for concurrent use.
+type IdentityMap struct {
+	mu sync.Mutex
+	// users holds each user found by ID, or nil for IDs with no user.
+	users map[int]*User
+}
+
+func NewIdentityMap() *IdentityMap {
+	return &IdentityMap{users: map[int]*User{}}
+}
+
+type identityMapKey struct{}
+
+// WithIdentityMap returns a copy of ctx carrying a new, empty IdentityMap.
+func WithIdentityMap(ctx context.Context) context.Context {
+	return context.WithValue(ctx, identityMapKey{}, NewIdentityMap())
+}
+
+// IdentityMapFrom returns the IdentityMap attached to ctx, or nil if there
+// is none.
+func IdentityMapFrom(ctx context.Context) *IdentityMap {
+	m, _ := ctx.Value(identityMapKey{}).(*IdentityMap)
+	return m
+}
+
+// IdentityMapUserRepository wraps a UserRepository and finds users by ID
+// through Map: FindUserByID and FindUsersByIDs only look up IDs Map hasn't
+// seen, and return the same *User for the same ID every time, so callers
+// mustn't change it. IDs with no user are remembered too. Finds asking for
+// only some fields are served from a remembered user if there is one, as a
+// copy, but never remembered themselves.
+//
+// Any write to a user through the repository makes Map forget them, so the
+// next find sees the change. Writes made elsewhere during the request
+// aren't seen, which is the point: one request sees one version of each
+// user.
+type IdentityMapUserRepository struct {
+	UserRepository
+	Map *IdentityMap
+}
+
+var _ UserRepository = (*IdentityMapUserRepository)(nil)
+
+func NewIdentityMapUserRepository(repo UserRepository, m *IdentityMap) *IdentityMapUserRepository {
+	return &IdentityMapUserRepository{UserRepository: repo, Map: m}
+}
+
+func (r *IdentityMapUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	if user, ok := r.Map.get(id); ok {
+		return r.project(user, fields)
+	}
+
+	if !fields.all() {
+		return r.UserRepository.FindUserByID(id, opts...)
+	}
+	user, err := r.UserRepository.FindUserByID(id, opts...)
+	switch {
+	case err == nil:
+		return r.Map.put(id, user), nil
+	case errors.Is(err, ErrUserNotFound):
+		r.Map.put(id, nil)
+	}
+	return nil, err
+}
+
+// FindUsersByIDs looks up the IDs Map hasn't seen in one call to the
+// wrapped repository, so resolving many references costs one query.
+func (r *IdentityMapUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int]*User, len(ids))
+	var missing []int
+	for _, id := range ids {
+		user, ok := r.Map.get(id)
+		switch {
+		case !ok:
+			missing = append(missing, id)
+		case user != nil:
+			users[id], _ = r.project(user, fields)
+		}
+	}
+	if len(missing) == 0 {
+		return users, nil
+	}
+
+	found, err := r.UserRepository.FindUsersByIDs(missing, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range missing {
+		user := found[id]
+		if fields.all() {
+			user = r.Map.put(id, user)
+		}
+		if user != nil {
+			users[id] = user
+		}
+	}
+	return users, nil
+}
+
+func (r *IdentityMapUserRepository) SaveUser(user *User) error {
+	err := r.UserRepository.SaveUser(user)
+	r.Map.forget(user.ID)
+	return err
+}
+
+func (r *IdentityMapUserRepository) SaveUsers(users []*User) error {
+	err := r.UserRepository.SaveUsers(users)
+	for _, user := range users {
+		r.Map.forget(user.ID)
+	}
+	return err
+}
+
+func (r *IdentityMapUserRepository) InsertUsers(users []*User) error {
+	err := r.UserRepository.InsertUsers(users)
+	for _, user := range users {
+		r.Map.forget(user.ID)
+	}
+	return err
+}
+
+func (r *IdentityMapUserRepository) UpdateUser(user *User) error {
+	err := r.UserRepository.UpdateUser(user)
+	r.Map.forget(user.ID)
+	return err
+}
+
+func (r *IdentityMapUserRepository) UpdateUsers(users []*User) error {
+	err := r.UserRepository.UpdateUsers(users)
+	for _, user := range users {
+		r.Map.forget(user.ID)
+	}
+	return err
+}
+
+func (r *IdentityMapUserRepository) RecordLogin(id int) error {
+	err := r.UserRepository.RecordLogin(id)
+	r.Map.forget(id)
+	return err
+}
+
+func (r *IdentityMapUserRepository) SetUserStatus(id int, from, to Status) error {
+	err := r.UserRepository.SetUserStatus(id, from, to)
+	r.Map.forget(id)
+	return err
+}
+
+func (r *IdentityMapUserRepository) AnonymizeUser(id int) error {
+	err := r.UserRepository.AnonymizeUser(id)
+	r.Map.forget(id)
+	return err
+}
+
+func (r *IdentityMapUserRepository) DeleteUser(id int) error {
+	err := r.UserRepository.DeleteUser(id)
+	r.Map.forget(id)
+	return err
+}
+
+func (r *IdentityMapUserRepository) RestoreUser(id int) (*User, error) {
+	user, err := r.UserRepository.RestoreUser(id)
+	r.Map.forget(id)
+	return user, err
+}
+
+func (r *IdentityMapUserRepository) PurgeUser(id int) error {
+	err := r.UserRepository.PurgeUser(id)
+	r.Map.forget(id)
+	return err
+}
+
+// DeleteUsersWhere makes Map forget everyone, as it can't tell which users
+// were deleted.
+func (r *IdentityMapUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	n, err := r.UserRepository.DeleteUsersWhere(spec)
+	r.Map.forgetAll()
+	return n, err
+}
+
+func (r *IdentityMapUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	ids, err := r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+	r.Map.forgetAll()
+	return ids, err
+}
+
+// Unwrap returns the wrapped repository.
+func (r *IdentityMapUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// project returns user, or ErrUserNotFound if it is nil. Unless every field
+// is wanted, it returns a copy with only those fields, leaving the shared
+// instance whole.
+func (r *IdentityMapUserRepository) project(user *User, fields projection) (*User, error) {
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	if fields.all() {
+		return user, nil
+	}
+	return fields.apply(copyUser(user)), nil
+}
+
+// get returns the user remembered for id, and whether there is one.
+func (m *IdentityMap) get(id int) (*User, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[id]
+	return user, ok
+}
+
+// put remembers user for id, unless another find got there first, and
+// returns whichever user is remembered, so concurrent finds agree.
+func (m *IdentityMap) put(id int, user *User) *User {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.users[id]; ok {
+		return existing
+	}
+	m.users[id] = user
+	return user
+}
+
+func (m *IdentityMap) forget(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, id)
+}
+
+func (m *IdentityMap) forgetAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users = map[int]*User{}
+}
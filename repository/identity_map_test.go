@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdentityMapUserRepository(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe"}, 2: {ID: 2, Name: "Jane Doe"}},
+	}
+	repo := NewIdentityMapUserRepository(mockRepo, NewIdentityMap())
+
+	// The same user comes back as the same instance, read once
+	first, err := repo.FindUserByID(1)
+	assert.NoError(t, err)
+	second, err := repo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Same(t, first, second)
+	assert.Equal(t, 1, mockRepo.CallCount("FindUserByID"))
+
+	// Misses are remembered too
+	_, err = repo.FindUserByID(3)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	_, err = repo.FindUserByID(3)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	assert.Equal(t, 2, mockRepo.CallCount("FindUserByID"))
+
+	// Only unseen IDs are looked up, and known ones keep their instance
+	users, err := repo.FindUsersByIDs([]int{1, 2, 3})
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Same(t, first, users[1])
+	mockRepo.AssertCalled(t, "FindUsersByIDs", []int{2})
+
+	// Some fields are a copy, leaving the shared instance whole
+	named, err := repo.FindUserByID(1, Fields("id"))
+	assert.NoError(t, err)
+	assert.Empty(t, named.Name)
+	assert.Equal(t, "John Doe", first.Name)
+
+	// A write makes the map forget the user
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Johnny Doe"}))
+	updated, err := repo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "Johnny Doe", updated.Name)
+	assert.Equal(t, 3, mockRepo.CallCount("FindUserByID"))
+}
+
+func TestIdentityMapFrom(t *testing.T) {
+	assert.Nil(t, IdentityMapFrom(context.Background()))
+
+	// Each context gets a map of its own
+	ctx := WithIdentityMap(context.Background())
+	assert.NotNil(t, IdentityMapFrom(ctx))
+	assert.NotSame(t, IdentityMapFrom(ctx), IdentityMapFrom(WithIdentityMap(context.Background())))
+}
@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// InvalidationChannel is the Postgres notification channel the users
+// table's triggers send the ID of each changed user on.
+const InvalidationChannel = "users_changed"
+
+// Invalidator drops cached users. CachingUserRepository is one.
+type Invalidator interface {
+	// Invalidate drops the user with this ID.
+	Invalidate(id int)
+	// Purge drops every user, for when changes may have been missed.
+	Purge()
+}
+
+// ListenForInvalidations keeps cache consistent with changes made by any
+// process sharing the database at dsn, such as other replicas of the
+// server, until the returned function is called. It listens for the
+// notifications the users table's triggers send on InvalidationChannel
+// and invalidates each changed user. Notifications are only sent once a
+// change commits, so an invalidated user is read afresh.
+//
+// The listener holds its own connection, and reconnects if it is lost.
+// Changes made while it was disconnected can't be known, so the whole
+// cache is purged when it reconnects. Problems with the connection are
+// logged to logger.
+func ListenForInvalidations(dsn string, cache Invalidator, logger *log.Logger) (stop func(), err error) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Printf("repository: cache invalidation listener: %v", err)
+		}
+	})
+	if err := listener.Listen(InvalidationChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ping := time.NewTicker(time.Minute)
+	go func() {
+		defer close(stopped)
+		defer ping.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case n := <-listener.Notify:
+				handleInvalidation(cache, n, logger)
+			case <-ping.C:
+				// Check the connection is still there, which pq.Listener
+				// otherwise only notices when it next sends something
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		listener.Close()
+	}, nil
+}
+
+// handleInvalidation applies one notification to cache. pq.Listener sends
+// a nil notification after reconnecting.
+func handleInvalidation(cache Invalidator, n *pq.Notification, logger *log.Logger) {
+	if n == nil {
+		cache.Purge()
+		return
+	}
+	id, err := strconv.Atoi(n.Extra)
+	if err != nil {
+		logger.Printf("repository: cache invalidation: bad user ID %q; purging", n.Extra)
+		cache.Purge()
+		return
+	}
+	cache.Invalidate(id)
+}
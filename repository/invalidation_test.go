@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"bytes"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingInvalidator struct {
+	invalidated []int
+	purges      int
+}
+
+func (r *recordingInvalidator) Invalidate(id int) { r.invalidated = append(r.invalidated, id) }
+func (r *recordingInvalidator) Purge()            { r.purges++ }
+
+func TestHandleInvalidation(t *testing.T) {
+	cache := &recordingInvalidator{}
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", 0)
+
+	handleInvalidation(cache, &pq.Notification{Channel: InvalidationChannel, Extra: "7"}, logger)
+	assert.Equal(t, []int{7}, cache.invalidated)
+	assert.Zero(t, cache.purges)
+
+	// After a reconnect, or a payload that makes no sense, everything goes
+	handleInvalidation(cache, nil, logger)
+	handleInvalidation(cache, &pq.Notification{Channel: InvalidationChannel, Extra: "seven"}, logger)
+	assert.Equal(t, 2, cache.purges)
+	assert.Contains(t, buf.String(), `"seven"`)
+}
+
+// invalidatingRepository invalidates a cache in the middle of every find,
+// as a notification of a change elsewhere might.
+type invalidatingRepository struct {
+	UserRepository
+	cache *CachingUserRepository
+}
+
+func (r *invalidatingRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	user, err := r.UserRepository.FindUserByID(id, opts...)
+	r.cache.Invalidate(id)
+	return user, err
+}
+
+func TestCachingUserRepositoryInvalidatedDuringFind(t *testing.T) {
+	mockRepo := &MockUserRepository{Users: map[int]*User{1: {ID: 1, Name: "John Doe"}}}
+	inner := &invalidatingRepository{UserRepository: mockRepo}
+	cache := NewCachingUserRepository(inner, time.Minute, 0)
+	inner.cache = cache
+
+	// What was read may be stale by the time it would be cached, so it isn't
+	_, err := cache.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Empty(t, cache.entries)
+}
+
+func TestNewCacheInvalidationNeedsPostgres(t *testing.T) {
+	_, _, err := New(Config{Driver: "memory", CacheTTL: time.Minute, CacheInvalidation: true})
+	assert.ErrorIs(t, err, ErrNotSupported)
+}
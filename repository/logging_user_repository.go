@@ -0,0 +1,221 @@
+package repository
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// LoggingUserRepository wraps a UserRepository and logs every call with how
+// long it took and any error. Nothing is logged while Logger is nil; use
+// SetLogger to change it while the repository is in use.
+type LoggingUserRepository struct {
+	UserRepository
+	Logger *log.Logger
+
+	mu sync.RWMutex
+}
+
+var _ UserRepository = (*LoggingUserRepository)(nil)
+
+func NewLoggingUserRepository(repo UserRepository, logger *log.Logger) *LoggingUserRepository {
+	return &LoggingUserRepository{UserRepository: repo, Logger: logger}
+}
+
+func (r *LoggingUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserByID(id, opts...)
+	r.log(start, err, "FindUserByID(%d)", id)
+	return user, err
+}
+
+func (r *LoggingUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserByEmail(email, opts...)
+	r.log(start, err, "FindUserByEmail")
+	return user, err
+}
+
+func (r *LoggingUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserByPhone(phone, opts...)
+	r.log(start, err, "FindUserByPhone")
+	return user, err
+}
+
+func (r *LoggingUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersByIDs(ids, opts...)
+	r.log(start, err, "FindUsersByIDs(%d ids) -> %d users", len(ids), len(users))
+	return users, err
+}
+
+func (r *LoggingUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersWhere(spec, afterID, limit, opts...)
+	r.log(start, err, "FindUsersWhere(after=%d, limit=%d) -> %d users", afterID, limit, len(users))
+	return users, err
+}
+
+func (r *LoggingUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	start := time.Now()
+	count, err := r.UserRepository.CountUsersWhere(spec)
+	r.log(start, err, "CountUsersWhere() -> %d", count)
+	return count, err
+}
+
+func (r *LoggingUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersByNamePrefix(prefix, opts...)
+	r.log(start, err, "FindUsersByNamePrefix(%q) -> %d users", prefix, len(users))
+	return users, err
+}
+
+func (r *LoggingUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.SuggestUsers(q, opts...)
+	r.log(start, err, "SuggestUsers(%q) -> %d users", q, len(users))
+	return users, err
+}
+
+func (r *LoggingUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersByMetadata(key, value, opts...)
+	r.log(start, err, "FindUsersByMetadata(%q) -> %d users", key, len(users))
+	return users, err
+}
+
+func (r *LoggingUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	start := time.Now()
+	versions, err := r.UserRepository.FindUserHistory(id)
+	r.log(start, err, "FindUserHistory(%d) -> %d versions", id, len(versions))
+	return versions, err
+}
+
+func (r *LoggingUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserAsOf(id, at)
+	r.log(start, err, "FindUserAsOf(%d, %s)", id, at.UTC().Format(time.RFC3339))
+	return user, err
+}
+
+func (r *LoggingUserRepository) SaveUser(user *User) error {
+	start := time.Now()
+	err := r.UserRepository.SaveUser(user)
+	r.log(start, err, "SaveUser(id=%d)", user.ID)
+	return err
+}
+
+func (r *LoggingUserRepository) SaveUsers(users []*User) error {
+	start := time.Now()
+	err := r.UserRepository.SaveUsers(users)
+	r.log(start, err, "SaveUsers(%d users)", len(users))
+	return err
+}
+
+func (r *LoggingUserRepository) InsertUsers(users []*User) error {
+	start := time.Now()
+	err := r.UserRepository.InsertUsers(users)
+	r.log(start, err, "InsertUsers(%d users)", len(users))
+	return err
+}
+
+func (r *LoggingUserRepository) UpdateUser(user *User) error {
+	start := time.Now()
+	err := r.UserRepository.UpdateUser(user)
+	r.log(start, err, "UpdateUser(id=%d)", user.ID)
+	return err
+}
+
+func (r *LoggingUserRepository) UpdateUsers(users []*User) error {
+	start := time.Now()
+	err := r.UserRepository.UpdateUsers(users)
+	r.log(start, err, "UpdateUsers(%d users)", len(users))
+	return err
+}
+
+func (r *LoggingUserRepository) RecordLogin(id int) error {
+	start := time.Now()
+	err := r.UserRepository.RecordLogin(id)
+	r.log(start, err, "RecordLogin(%d)", id)
+	return err
+}
+
+func (r *LoggingUserRepository) SetUserStatus(id int, from, to Status) error {
+	start := time.Now()
+	err := r.UserRepository.SetUserStatus(id, from, to)
+	r.log(start, err, "SetUserStatus(%d, %s, %s)", id, from, to)
+	return err
+}
+
+func (r *LoggingUserRepository) AnonymizeUser(id int) error {
+	start := time.Now()
+	err := r.UserRepository.AnonymizeUser(id)
+	r.log(start, err, "AnonymizeUser(%d)", id)
+	return err
+}
+
+func (r *LoggingUserRepository) DeleteUser(id int) error {
+	start := time.Now()
+	err := r.UserRepository.DeleteUser(id)
+	r.log(start, err, "DeleteUser(%d)", id)
+	return err
+}
+
+func (r *LoggingUserRepository) RestoreUser(id int) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.RestoreUser(id)
+	r.log(start, err, "RestoreUser(%d)", id)
+	return user, err
+}
+
+func (r *LoggingUserRepository) PurgeUser(id int) error {
+	start := time.Now()
+	err := r.UserRepository.PurgeUser(id)
+	r.log(start, err, "PurgeUser(%d)", id)
+	return err
+}
+
+func (r *LoggingUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	start := time.Now()
+	n, err := r.UserRepository.DeleteUsersWhere(spec)
+	r.log(start, err, "DeleteUsersWhere -> %d users", n)
+	return n, err
+}
+
+func (r *LoggingUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	start := time.Now()
+	ids, err := r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+	r.log(start, err, "DeleteUsersWhereReturningIDs -> %d users", len(ids))
+	return ids, err
+}
+
+// log writes one line per call. Emails and names are left out so that
+// personal data doesn't end up in the logs.
+func (r *LoggingUserRepository) log(start time.Time, err error, format string, args ...any) {
+	r.mu.RLock()
+	logger := r.Logger
+	r.mu.RUnlock()
+	if logger == nil {
+		return
+	}
+
+	args = append(args, time.Since(start).Round(time.Microsecond))
+	if err != nil {
+		logger.Printf("repository: "+format+" failed in %s: %v", append(args, err)...)
+		return
+	}
+	logger.Printf("repository: "+format+" ok in %s", args...)
+}
+
+// SetLogger changes where calls are logged; nil stops logging.
+func (r *LoggingUserRepository) SetLogger(logger *log.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Logger = logger
+}
+
+// Unwrap returns the wrapped repository.
+func (r *LoggingUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
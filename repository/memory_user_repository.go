@@ -0,0 +1,557 @@
+package repository
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MemoryUserRepository keeps users in memory. Unlike MockUserRepository it
+// is meant for running the application without a database, so it hands out
+// IDs itself and has no test hooks.
+type MemoryUserRepository struct {
+	// Emails normalizes addresses for FindUserByEmail.
+	Emails EmailNormalizer
+
+	mu      sync.RWMutex
+	users   map[int]*User
+	history userHistory
+	lastID  int
+}
+
+var (
+	_ UserRepository  = (*MemoryUserRepository)(nil)
+	_ HistoryArchiver = (*MemoryUserRepository)(nil)
+	_ Rewriter        = (*MemoryUserRepository)(nil)
+)
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[int]*User{}, history: userHistory{}}
+}
+
+func (r *MemoryUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, exists := r.users[id]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+	return fields.apply(copyUser(user)), nil
+}
+
+func (r *MemoryUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := findByEmail(r.users, r.Emails, email)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return fields.apply(copyUser(user)), nil
+}
+
+func (r *MemoryUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := findByPhone(r.users, phone)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return fields.apply(copyUser(user)), nil
+}
+
+func (r *MemoryUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return pickUsers(r.users, ids, fields), nil
+}
+
+func (r *MemoryUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return selectUsers(r.users, spec, afterID, limit, fields, resolve(opts).backward), nil
+}
+
+func (r *MemoryUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return countUsers(r.users, spec), nil
+}
+
+func (r *MemoryUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return prefixUsers(r.users, prefix, searchLimit(opts), fields), nil
+}
+
+func (r *MemoryUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return suggestUsers(r.users, q, searchLimit(opts), fields), nil
+}
+
+func (r *MemoryUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := metadataSpec(key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return selectUsers(r.users, spec, 0, metadataLimit(opts), fields, false), nil
+}
+
+func (r *MemoryUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.history.versions(id, r.users[id])
+}
+
+func (r *MemoryUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.history.asOf(id, r.users[id], at)
+}
+
+func (r *MemoryUserRepository) SaveUser(user *User) error {
+	metadata, err := user.Metadata.encoded()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.save(user, metadata)
+	return nil
+}
+
+// SaveUsers saves all of the users or, if any has invalid metadata, none.
+func (r *MemoryUserRepository) SaveUsers(users []*User) error {
+	metadata := make([]Metadata, len(users))
+	for i, user := range users {
+		var err error
+		if metadata[i], err = user.Metadata.encoded(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, user := range users {
+		r.save(user, metadata[i])
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) InsertUsers(users []*User) error {
+	metadata := make([]Metadata, len(users))
+	for i, user := range users {
+		var err error
+		if metadata[i], err = user.Metadata.encoded(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := takenID(r.users, users); err != nil {
+		return err
+	}
+	for i, user := range users {
+		r.lastID = max(r.lastID, user.ID)
+		r.store(user, metadata[i])
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdateUser(user *User) error {
+	metadata, err := user.Metadata.encoded()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := updateUser(r.users, r.history, r.Emails, user); err != nil {
+		return err
+	}
+	r.users[user.ID].Metadata = metadata
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdateUsers(users []*User) error {
+	metadata := make([]Metadata, len(users))
+	for i, user := range users {
+		var err error
+		if metadata[i], err = user.Metadata.encoded(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := missingID(r.users, users); err != nil {
+		return err
+	}
+	for i, user := range users {
+		updateUser(r.users, r.history, r.Emails, user)
+		r.users[user.ID].Metadata = metadata[i]
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) RecordLogin(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return recordLogin(r.users, id)
+}
+
+func (r *MemoryUserRepository) SetUserStatus(id int, from, to Status) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return setUserStatus(r.users, r.history, id, from, to)
+}
+
+func (r *MemoryUserRepository) AnonymizeUser(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return anonymizeUser(r.users, r.history, id)
+}
+
+func (r *MemoryUserRepository) DeleteUser(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user, exists := r.users[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	r.history.record(user, OperationDelete)
+	delete(r.users, id)
+	return nil
+}
+
+func (r *MemoryUserRepository) RestoreUser(id int) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return restoreUser(r.users, r.history, id)
+}
+
+func (r *MemoryUserRepository) PurgeUser(id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return purgeUser(r.users, r.history, id)
+}
+
+func (r *MemoryUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	if IsEmpty(spec) {
+		return 0, ErrEmptySpecification
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return int64(len(deleteUsers(r.users, r.history, spec))), nil
+}
+
+func (r *MemoryUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	if IsEmpty(spec) {
+		return nil, ErrEmptySpecification
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return deleteUsers(r.users, r.history, spec), nil
+}
+
+func (r *MemoryUserRepository) EachUserVersion(fn func(UserVersion) error) error {
+	r.mu.RLock()
+	versions := r.history.all()
+	r.mu.RUnlock()
+
+	for _, version := range versions {
+		if err := fn(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) InsertUserVersions(versions []UserVersion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.history.insert(versions)
+	for _, version := range versions {
+		r.lastID = max(r.lastID, version.ID)
+	}
+	return nil
+}
+
+func (r *MemoryUserRepository) RewriteUsers(fn func(*User) (bool, error)) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rewritten := 0
+	rewrite := func(user *User) error {
+		c := copyUser(&User{ID: user.ID, Email: user.Email, Phone: user.Phone})
+		changed, err := fn(c)
+		if err != nil || !changed {
+			return err
+		}
+		user.Email, user.NormalizedEmail, user.Phone = c.Email, r.Emails.Normalize(c.Email), c.Phone
+		rewritten++
+		return nil
+	}
+	for _, user := range r.users {
+		if err := rewrite(user); err != nil {
+			return rewritten, err
+		}
+	}
+	for _, versions := range r.history {
+		for i := range versions {
+			if err := rewrite(&versions[i].User); err != nil {
+				return rewritten, err
+			}
+		}
+	}
+	return rewritten, nil
+}
+
+// save assigns the next ID and stores a copy, with metadata as it would
+// come back from a database. Callers must hold r.mu.
+func (r *MemoryUserRepository) save(user *User, metadata Metadata) {
+	r.lastID++
+	user.ID = r.lastID
+	r.store(user, metadata)
+}
+
+// store stores a copy of the user under their ID. Callers must hold r.mu.
+func (r *MemoryUserRepository) store(user *User, metadata Metadata) {
+	user.NormalizedEmail = r.Emails.Normalize(user.Email)
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	user.Status = user.Status.orDefault()
+	r.users[user.ID] = copyUser(user)
+	r.users[user.ID].Metadata = metadata
+}
+
+// takenID returns ErrUserExists if any of users has the ID of one already
+// in users.
+func takenID(existing map[int]*User, users []*User) error {
+	for _, user := range users {
+		if _, ok := existing[user.ID]; ok {
+			return fmt.Errorf("%w: user %d", ErrUserExists, user.ID)
+		}
+	}
+	return nil
+}
+
+// missingID returns ErrUserNotFound if any of users isn't in users.
+func missingID(existing map[int]*User, users []*User) error {
+	for _, user := range users {
+		if _, ok := existing[user.ID]; !ok {
+			return fmt.Errorf("%w: user %d", ErrUserNotFound, user.ID)
+		}
+	}
+	return nil
+}
+
+// updateUser implements UpdateUser over a map of users.
+func updateUser(users map[int]*User, history userHistory, emails EmailNormalizer, user *User) error {
+	current, exists := users[user.ID]
+	if !exists {
+		return ErrUserNotFound
+	}
+	history.record(current, OperationUpdate)
+	user.NormalizedEmail = emails.Normalize(user.Email)
+	updated := copyUser(user)
+	updated.CreatedAt = current.CreatedAt
+	updated.LastLoginAt, updated.LoginCount = current.LastLoginAt, current.LoginCount
+	updated.Status = current.Status
+	user.Status = current.Status
+	users[user.ID] = updated
+	return nil
+}
+
+// recordLogin implements RecordLogin over a map of users.
+func recordLogin(users map[int]*User, id int) error {
+	user, exists := users[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	now := time.Now()
+	user.LastLoginAt = &now
+	user.LoginCount++
+	return nil
+}
+
+// anonymizeUser implements AnonymizeUser over a map of users.
+func anonymizeUser(users map[int]*User, history userHistory, id int) error {
+	user, exists := users[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	history.record(user, OperationUpdate)
+	user.Anonymize()
+	history.anonymize(id)
+	return nil
+}
+
+// restoreUser implements RestoreUser over a map of users.
+func restoreUser(users map[int]*User, history userHistory, id int) (*User, error) {
+	if _, exists := users[id]; exists {
+		return nil, ErrUserExists
+	}
+	user, ok := history.lastDeleted(id)
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	users[id] = copyUser(user)
+	return user, nil
+}
+
+// purgeUser implements PurgeUser over a map of users.
+func purgeUser(users map[int]*User, history userHistory, id int) error {
+	_, exists := users[id]
+	if !exists && len(history[id]) == 0 {
+		return ErrUserNotFound
+	}
+	delete(users, id)
+	delete(history, id)
+	return nil
+}
+
+// deleteUsers implements DeleteUsersWhere over a map of users.
+func deleteUsers(users map[int]*User, history userHistory, spec Specification) []int {
+	var ids []int
+	for id, user := range users {
+		if spec.IsSatisfiedBy(user) {
+			history.record(user, OperationDelete)
+			delete(users, id)
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// findByPhone implements FindUserByPhone over a map of users.
+func findByPhone(users map[int]*User, phone string) (*User, bool) {
+	var found *User
+	for _, user := range users {
+		if user.Phone != nil && *user.Phone == phone && (found == nil || user.ID < found.ID) {
+			found = user
+		}
+	}
+	return found, found != nil
+}
+
+// pickUsers implements FindUsersByIDs over a map of users, returning copies
+// with only the fields selected.
+func pickUsers(users map[int]*User, ids []int, fields projection) map[int]*User {
+	picked := make(map[int]*User, len(ids))
+	for _, id := range ids {
+		if user, ok := users[id]; ok {
+			picked[id] = fields.apply(copyUser(user))
+		}
+	}
+	return picked
+}
+
+// countUsers implements CountUsersWhere over a map of users.
+func countUsers(users map[int]*User, spec Specification) int64 {
+	var count int64
+	for _, user := range users {
+		if spec.IsSatisfiedBy(user) {
+			count++
+		}
+	}
+	return count
+}
+
+// selectUsers implements FindUsersWhere over a map of users, returning
+// copies with only the fields selected.
+func selectUsers(users map[int]*User, spec Specification, afterID, limit int, fields projection, backward bool) []*User {
+	var ids []int
+	for id, user := range users {
+		inRange := id > afterID
+		if backward {
+			inRange = afterID == 0 || id < afterID
+		}
+		if inRange && spec.IsSatisfiedBy(user) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	if backward {
+		slices.Reverse(ids)
+	}
+
+	matched := make([]*User, 0, min(len(ids), limit))
+	for _, id := range ids[:min(len(ids), limit)] {
+		matched = append(matched, fields.apply(copyUser(users[id])))
+	}
+	return matched
+}
@@ -0,0 +1,175 @@
+package repository
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidMetadata is returned for metadata, or a metadata value to find
+// by, that can't be encoded as JSON.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// Metadata holds custom attributes integrators attach to a user without
+// schema changes. Values may be anything that encodes as JSON; they come
+// back as JSON decodes them, so numbers are float64 and objects are
+// map[string]any.
+//
+// Metadata is stored as JSONB in Postgres and as JSON elsewhere. It is not
+// encrypted by EncryptedUserRepository, since it couldn't be searched if it
+// were, and it is cleared by AnonymizeUser, so keep personal data out of it.
+type Metadata map[string]any
+
+// Value stores m as JSON, an empty object when m is nil.
+func (m Metadata) Value() (driver.Value, error) {
+	if m == nil {
+		return []byte("{}"), nil
+	}
+	b, err := json.Marshal(map[string]any(m))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+	return b, nil
+}
+
+// Scan reads m from JSON. An empty object or NULL leaves m nil, so users
+// without metadata compare equal however they were stored.
+func (m *Metadata) Scan(src any) error {
+	var b []byte
+	switch src := src.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		b = src
+	case string:
+		b = []byte(src)
+	default:
+		return fmt.Errorf("metadata: cannot scan %T", src)
+	}
+
+	var decoded map[string]any
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	if len(decoded) == 0 {
+		decoded = nil
+	}
+	*m = decoded
+	return nil
+}
+
+// encoded returns m as it comes back from being stored as JSON, or
+// ErrInvalidMetadata if it can't be.
+func (m Metadata) encoded() (Metadata, error) {
+	b, err := m.Value()
+	if err != nil {
+		return nil, err
+	}
+	var decoded Metadata
+	return decoded, decoded.Scan(b)
+}
+
+// clone returns a deep copy of m, so copies of a user never share nested
+// maps or slices.
+func (m Metadata) clone() Metadata {
+	if m == nil {
+		return nil
+	}
+	return cloneValue(map[string]any(m)).(map[string]any)
+}
+
+func cloneValue(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		c := make(map[string]any, len(v))
+		for key, value := range v {
+			c[key] = cloneValue(value)
+		}
+		return c
+	case []any:
+		c := make([]any, len(v))
+		for i, value := range v {
+			c[i] = cloneValue(value)
+		}
+		return c
+	default:
+		return v
+	}
+}
+
+type hasMetadata struct {
+	key string
+	// value is the JSON encoding of the value to match, or nil if it
+	// couldn't be encoded.
+	value []byte
+}
+
+// HasMetadata matches users whose metadata has key set to value, compared
+// as JSON, so 1 and 1.0 match and so do objects with the same members. A
+// value that can't be encoded as JSON matches nobody.
+func HasMetadata(key string, value any) Specification {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded = nil
+	}
+	return hasMetadata{key: key, value: canonicalJSON(encoded)}
+}
+
+func (s hasMetadata) IsSatisfiedBy(user *User) bool {
+	value, ok := user.Metadata[s.key]
+	if !ok || s.value == nil {
+		return false
+	}
+	encoded, err := json.Marshal(value)
+	return err == nil && string(canonicalJSON(encoded)) == string(s.value)
+}
+
+// SQL checks containment first, which the GIN index on metadata serves,
+// then equality, as containment alone would let an object or array match
+// a larger one.
+func (s hasMetadata) SQL(args *[]any) string {
+	if s.value == nil {
+		return "FALSE"
+	}
+	key, value := placeholder(args, s.key), placeholder(args, string(s.value))
+	return fmt.Sprintf("metadata @> jsonb_build_object(%s::text, %s::jsonb) AND metadata -> %s::text = %s::jsonb", key, value, key, value)
+}
+
+// metadataSpec returns HasMetadata(key, value), or ErrInvalidMetadata if
+// value can't be encoded as JSON.
+func metadataSpec(key string, value any) (Specification, error) {
+	if _, err := json.Marshal(value); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+	return HasMetadata(key, value), nil
+}
+
+// canonicalJSON re-encodes JSON with numbers and object members in a fixed
+// form, so equal values encode alike. It returns nil for nil or invalid
+// input.
+func canonicalJSON(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil
+	}
+	canonical, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return canonical
+}
+
+// metadataLimit resolves the Limit option for FindUsersByMetadata, where no
+// limit means every match.
+func metadataLimit(opts []FindOption) int {
+	if n := resolve(opts).limit; n > 0 {
+		return n
+	}
+	return math.MaxInt
+}
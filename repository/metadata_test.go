@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetadataValueAndScan(t *testing.T) {
+	value, err := Metadata{"plan": "pro", "seats": 5}.Value()
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"plan": "pro", "seats": 5}`, string(value.([]byte)))
+
+	// Read back as JSON decodes it
+	var m Metadata
+	assert.NoError(t, m.Scan(value))
+	assert.Equal(t, Metadata{"plan": "pro", "seats": 5.0}, m)
+
+	// No metadata is stored as an empty object and read back as nil
+	value, err = Metadata(nil).Value()
+	assert.NoError(t, err)
+	assert.NoError(t, m.Scan(value))
+	assert.Nil(t, m)
+
+	_, err = Metadata{"bad": func() {}}.Value()
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+}
+
+func TestHasMetadata(t *testing.T) {
+	user := &User{Metadata: Metadata{"plan": "pro", "seats": 5.0, "tags": []any{"a", "b"}}}
+
+	assert.True(t, HasMetadata("plan", "pro").IsSatisfiedBy(user))
+	assert.True(t, HasMetadata("seats", 5).IsSatisfiedBy(user))
+	assert.True(t, HasMetadata("tags", []string{"a", "b"}).IsSatisfiedBy(user))
+	assert.False(t, HasMetadata("tags", []string{"a"}).IsSatisfiedBy(user))
+	assert.False(t, HasMetadata("plan", "free").IsSatisfiedBy(user))
+	assert.False(t, HasMetadata("region", nil).IsSatisfiedBy(user))
+
+	var args []any
+	sql := HasMetadata("plan", "pro").SQL(&args)
+	assert.Equal(t, "metadata @> jsonb_build_object($1::text, $2::jsonb) AND metadata -> $1::text = $2::jsonb", sql)
+	assert.Equal(t, []any{"plan", `"pro"`}, args)
+}
+
+func TestMemoryUserRepositoryFindUsersByMetadata(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	users := []*User{
+		{Name: "Jane Doe", Metadata: Metadata{"plan": "pro"}},
+		{Name: "John Doe", Metadata: Metadata{"plan": "free"}},
+		{Name: "Mary Major", Metadata: Metadata{"plan": "pro"}},
+	}
+	assert.NoError(t, repo.SaveUsers(users))
+
+	found, err := repo.FindUsersByMetadata("plan", "pro")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Jane Doe", "Mary Major"}, names(found))
+
+	found, err = repo.FindUsersByMetadata("plan", "pro", Limit(1))
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	// Changing what was returned doesn't change what is stored
+	found[0].Metadata["plan"] = "free"
+	found, err = repo.FindUsersByMetadata("plan", "pro")
+	assert.NoError(t, err)
+	assert.Len(t, found, 2)
+
+	// Metadata that can't be stored is rejected up front
+	err = repo.SaveUser(&User{Name: "Bad", Metadata: Metadata{"bad": make(chan int)}})
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+	_, err = repo.FindUsersByMetadata("plan", make(chan int))
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+}
@@ -0,0 +1,204 @@
+package repository
+
+import (
+	"expvar"
+	"time"
+)
+
+// Metrics holds call counts, error counts and total time in microseconds for
+// each repository method, keyed "<method>.calls", "<method>.errors" and
+// "<method>.micros". It is published through expvar as "repository".
+var Metrics = expvar.NewMap("repository")
+
+// MetricsUserRepository wraps a UserRepository and records every call in
+// Metrics.
+type MetricsUserRepository struct {
+	UserRepository
+}
+
+var _ UserRepository = (*MetricsUserRepository)(nil)
+
+func NewMetricsUserRepository(repo UserRepository) *MetricsUserRepository {
+	return &MetricsUserRepository{UserRepository: repo}
+}
+
+func (r *MetricsUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserByID(id, opts...)
+	observe("FindUserByID", start, err)
+	return user, err
+}
+
+func (r *MetricsUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserByEmail(email, opts...)
+	observe("FindUserByEmail", start, err)
+	return user, err
+}
+
+func (r *MetricsUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserByPhone(phone, opts...)
+	observe("FindUserByPhone", start, err)
+	return user, err
+}
+
+func (r *MetricsUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersByIDs(ids, opts...)
+	observe("FindUsersByIDs", start, err)
+	return users, err
+}
+
+func (r *MetricsUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersWhere(spec, afterID, limit, opts...)
+	observe("FindUsersWhere", start, err)
+	return users, err
+}
+
+func (r *MetricsUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	start := time.Now()
+	count, err := r.UserRepository.CountUsersWhere(spec)
+	observe("CountUsersWhere", start, err)
+	return count, err
+}
+
+func (r *MetricsUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersByNamePrefix(prefix, opts...)
+	observe("FindUsersByNamePrefix", start, err)
+	return users, err
+}
+
+func (r *MetricsUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.SuggestUsers(q, opts...)
+	observe("SuggestUsers", start, err)
+	return users, err
+}
+
+func (r *MetricsUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	start := time.Now()
+	users, err := r.UserRepository.FindUsersByMetadata(key, value, opts...)
+	observe("FindUsersByMetadata", start, err)
+	return users, err
+}
+
+func (r *MetricsUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	start := time.Now()
+	versions, err := r.UserRepository.FindUserHistory(id)
+	observe("FindUserHistory", start, err)
+	return versions, err
+}
+
+func (r *MetricsUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.FindUserAsOf(id, at)
+	observe("FindUserAsOf", start, err)
+	return user, err
+}
+
+func (r *MetricsUserRepository) SaveUser(user *User) error {
+	start := time.Now()
+	err := r.UserRepository.SaveUser(user)
+	observe("SaveUser", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) SaveUsers(users []*User) error {
+	start := time.Now()
+	err := r.UserRepository.SaveUsers(users)
+	observe("SaveUsers", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) InsertUsers(users []*User) error {
+	start := time.Now()
+	err := r.UserRepository.InsertUsers(users)
+	observe("InsertUsers", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) UpdateUser(user *User) error {
+	start := time.Now()
+	err := r.UserRepository.UpdateUser(user)
+	observe("UpdateUser", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) UpdateUsers(users []*User) error {
+	start := time.Now()
+	err := r.UserRepository.UpdateUsers(users)
+	observe("UpdateUsers", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) RecordLogin(id int) error {
+	start := time.Now()
+	err := r.UserRepository.RecordLogin(id)
+	observe("RecordLogin", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) SetUserStatus(id int, from, to Status) error {
+	start := time.Now()
+	err := r.UserRepository.SetUserStatus(id, from, to)
+	observe("SetUserStatus", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) AnonymizeUser(id int) error {
+	start := time.Now()
+	err := r.UserRepository.AnonymizeUser(id)
+	observe("AnonymizeUser", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) DeleteUser(id int) error {
+	start := time.Now()
+	err := r.UserRepository.DeleteUser(id)
+	observe("DeleteUser", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) RestoreUser(id int) (*User, error) {
+	start := time.Now()
+	user, err := r.UserRepository.RestoreUser(id)
+	observe("RestoreUser", start, err)
+	return user, err
+}
+
+func (r *MetricsUserRepository) PurgeUser(id int) error {
+	start := time.Now()
+	err := r.UserRepository.PurgeUser(id)
+	observe("PurgeUser", start, err)
+	return err
+}
+
+func (r *MetricsUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	start := time.Now()
+	n, err := r.UserRepository.DeleteUsersWhere(spec)
+	observe("DeleteUsersWhere", start, err)
+	return n, err
+}
+
+func (r *MetricsUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	start := time.Now()
+	ids, err := r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+	observe("DeleteUsersWhereReturningIDs", start, err)
+	return ids, err
+}
+
+// Unwrap returns the wrapped repository.
+func (r *MetricsUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+func observe(method string, start time.Time, err error) {
+	Metrics.Add(method+".calls", 1)
+	Metrics.Add(method+".micros", time.Since(start).Microseconds())
+	if err != nil {
+		Metrics.Add(method+".errors", 1)
+	}
+}
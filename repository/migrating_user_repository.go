@@ -0,0 +1,497 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorepository/features"
+)
+
+// ErrInvalidMigrationStage is returned by ParseMigrationStage for a stage
+// that isn't one of MigrationStages.
+var ErrInvalidMigrationStage = errors.New("invalid migration stage")
+
+// MigrationStage is how far a MigratingUserRepository has cut over from
+// its old backend to its new one. Stages are taken in order, and each can
+// be stepped back from while the next proves itself.
+type MigrationStage string
+
+const (
+	// MigrateOld uses only the old backend, as if there were no
+	// migration.
+	MigrateOld MigrationStage = "old"
+	// MigrateDualWrite writes to the old backend and then the new one,
+	// and reads from the old. It is the default.
+	MigrateDualWrite MigrationStage = "dual-write"
+	// MigrateNewPrimary writes to the new backend and then the old one,
+	// and reads from the new, so the old is kept up to date to fall back
+	// to.
+	MigrateNewPrimary MigrationStage = "new-primary"
+	// MigrateNew uses only the new backend: the cutover is complete.
+	MigrateNew MigrationStage = "new"
+)
+
+// MigrationStages lists every MigrationStage, in the order they are taken.
+var MigrationStages = []MigrationStage{MigrateOld, MigrateDualWrite, MigrateNewPrimary, MigrateNew}
+
+// ParseMigrationStage returns the MigrationStage named s.
+func ParseMigrationStage(s string) (MigrationStage, error) {
+	for _, stage := range MigrationStages {
+		if string(stage) == s {
+			return stage, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidMigrationStage, s)
+}
+
+// orDefault returns s, or MigrateDualWrite if it isn't set.
+func (s MigrationStage) orDefault() MigrationStage {
+	if s == "" {
+		return MigrateDualWrite
+	}
+	return s
+}
+
+// MigratingUserRepository moves users from one backend to another without
+// downtime, such as from lib/pq to pgx or from Postgres to CockroachDB.
+// While both are in use, every write is made to the primary backend and
+// then copied to the other; the primary decides whether the write
+// succeeds, and a copy that fails is logged and counted in FailedWrites.
+// Reads go to the primary only. SetStage moves between the
+// MigrationStages while in use.
+//
+// The new backend must start out holding the same users under the same
+// IDs as the old, such as a copy of its database taken before dual
+// writing begins, since writes find users by ID. Users saved during the
+// migration are given their IDs by the primary and inserted under the
+// same IDs on the other backend, with InsertUsers, so the two can't
+// drift apart however saves interleave.
+//
+// With Flags set, writes are only copied, and reads only compared, while
+// the features.DualWrite flag is on, so copying can be switched off without
+// a deploy should the secondary backend misbehave.
+//
+// With SetCompareReads, finds of single users and of users by ID are
+// repeated against the other backend in the background, and any
+// difference is logged and counted in Mismatches, to show the new backend
+// can be trusted before reads move to it.
+type MigratingUserRepository struct {
+	Old, New UserRepository
+	Logger   *log.Logger
+	// Flags, when set, decides whether the secondary backend is used; see
+	// features.DualWrite.
+	Flags features.Provider
+
+	stage        atomic.Value
+	compareReads atomic.Bool
+	comparing    sync.WaitGroup
+
+	mismatches   atomic.Int64
+	failedWrites atomic.Int64
+}
+
+var _ UserRepository = (*MigratingUserRepository)(nil)
+
+func NewMigratingUserRepository(old, new UserRepository, stage MigrationStage, logger *log.Logger) *MigratingUserRepository {
+	if logger == nil {
+		logger = log.Default()
+	}
+	r := &MigratingUserRepository{Old: old, New: new, Logger: logger}
+	r.SetStage(stage)
+	return r
+}
+
+// SetStage moves the migration to stage; the zero stage is
+// MigrateDualWrite.
+func (r *MigratingUserRepository) SetStage(stage MigrationStage) {
+	r.stage.Store(stage.orDefault())
+}
+
+// Stage returns the stage the migration is at.
+func (r *MigratingUserRepository) Stage() MigrationStage {
+	return r.stage.Load().(MigrationStage)
+}
+
+// SetCompareReads switches comparing reads against the other backend on
+// or off. Each compared read costs a second read of the other backend.
+func (r *MigratingUserRepository) SetCompareReads(compare bool) {
+	r.compareReads.Store(compare)
+}
+
+// Mismatches returns how many compared reads found the backends
+// disagreeing.
+func (r *MigratingUserRepository) Mismatches() int64 {
+	return r.mismatches.Load()
+}
+
+// FailedWrites returns how many writes couldn't be copied to the
+// secondary backend.
+func (r *MigratingUserRepository) FailedWrites() int64 {
+	return r.failedWrites.Load()
+}
+
+// Wait waits for the reads being compared in the background.
+func (r *MigratingUserRepository) Wait() {
+	r.comparing.Wait()
+}
+
+// Unwrap returns the primary backend.
+func (r *MigratingUserRepository) Unwrap() UserRepository {
+	primary, _ := r.backends()
+	return primary
+}
+
+// backends returns the backend the stage reads from and writes to first,
+// and the one writes are copied to, if any.
+func (r *MigratingUserRepository) backends() (primary, secondary UserRepository) {
+	primary, secondary = r.stageBackends()
+	if r.Flags != nil && !r.Flags.Enabled(features.DualWrite) {
+		secondary = nil
+	}
+	return primary, secondary
+}
+
+func (r *MigratingUserRepository) stageBackends() (primary, secondary UserRepository) {
+	switch r.Stage() {
+	case MigrateOld:
+		return r.Old, nil
+	case MigrateNewPrimary:
+		return r.New, r.Old
+	case MigrateNew:
+		return r.New, nil
+	default:
+		return r.Old, r.New
+	}
+}
+
+// name returns "old" or "new" for one of r's backends.
+func (r *MigratingUserRepository) name(backend UserRepository) string {
+	if backend == r.New {
+		return "new"
+	}
+	return "old"
+}
+
+// write makes a write with fn on the primary backend, then copies it to
+// the secondary.
+func (r *MigratingUserRepository) write(op string, fn func(repo UserRepository) error) error {
+	primary, secondary := r.backends()
+	if err := fn(primary); err != nil {
+		return err
+	}
+	if secondary != nil {
+		if err := fn(secondary); err != nil {
+			r.failedWrite(op, secondary, err)
+		}
+	}
+	return nil
+}
+
+func (r *MigratingUserRepository) failedWrite(op string, backend UserRepository, err error) {
+	r.failedWrites.Add(1)
+	r.Logger.Printf("repository: migration: %s failed on the %s backend: %v", op, r.name(backend), err)
+}
+
+// saveUsers saves users on the primary backend with save, then inserts
+// copies of them on the secondary under the IDs the primary gave them.
+func (r *MigratingUserRepository) saveUsers(op string, users []*User, save func(repo UserRepository, users []*User) error) error {
+	primary, secondary := r.backends()
+	if err := save(primary, users); err != nil {
+		return err
+	}
+	if secondary != nil {
+		if err := secondary.InsertUsers(copyUsers(users)); err != nil {
+			r.failedWrite(op, secondary, err)
+		}
+	}
+	return nil
+}
+
+// findUser reads a user from the primary backend with find, comparing
+// them with the secondary's in the background if asked to.
+func (r *MigratingUserRepository) findUser(op string, find func(repo UserRepository) (*User, error)) (*User, error) {
+	primary, secondary := r.backends()
+	user, err := find(primary)
+	if !r.comparable(secondary, err) {
+		return user, err
+	}
+
+	want := map[int]*User{}
+	if err == nil {
+		want[user.ID] = copyUser(user)
+	}
+	r.compare(op, secondary, want, func() (map[int]*User, error) {
+		other, err := find(secondary)
+		if errors.Is(err, ErrUserNotFound) {
+			return map[int]*User{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[int]*User{other.ID: other}, nil
+	})
+	return user, err
+}
+
+// comparable reports whether a read that gave err from the primary backend
+// should be compared with secondary. Reads that failed aren't.
+func (r *MigratingUserRepository) comparable(secondary UserRepository, err error) bool {
+	return secondary != nil && r.compareReads.Load() && (err == nil || errors.Is(err, ErrUserNotFound))
+}
+
+// compare reads the users read from the primary backend, want, from
+// secondary with read in the background, and logs where they differ.
+func (r *MigratingUserRepository) compare(op string, secondary UserRepository, want map[int]*User, read func() (map[int]*User, error)) {
+	r.comparing.Add(1)
+	go func() {
+		defer r.comparing.Done()
+		got, err := read()
+		if err != nil {
+			r.Logger.Printf("repository: migration: comparing %s: read failed on the %s backend: %v", op, r.name(secondary), err)
+			return
+		}
+		for _, mismatch := range diffUserMaps(want, got) {
+			r.mismatches.Add(1)
+			r.Logger.Printf("repository: migration: %s: user %s on the %s backend", op, mismatch, r.name(secondary))
+		}
+	}()
+}
+
+// diffUserMaps describes how the users in got differ from those in want,
+// a line per user.
+func diffUserMaps(want, got map[int]*User) []string {
+	var mismatches []string
+	for id, user := range want {
+		other, ok := got[id]
+		if !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%d is missing", id))
+			continue
+		}
+		if fields := diffUser(user, other); len(fields) > 0 {
+			mismatches = append(mismatches, fmt.Sprintf("%d differs in %s", id, strings.Join(fields, ", ")))
+		}
+	}
+	for id := range got {
+		if _, ok := want[id]; !ok {
+			mismatches = append(mismatches, fmt.Sprintf("%d is only", id))
+		}
+	}
+	return mismatches
+}
+
+// diffUser returns the names of the fields in which a and b differ. Times
+// are compared to the microsecond, which is as precisely as Postgres
+// keeps them.
+func diffUser(a, b *User) []string {
+	var fields []string
+	diff := func(name string, equal bool) {
+		if !equal {
+			fields = append(fields, name)
+		}
+	}
+	diff("name", a.Name == b.Name)
+	diff("email", a.Email == b.Email)
+	diff("normalized_email", a.NormalizedEmail == b.NormalizedEmail)
+	diff("phone", equalPtr(a.Phone, b.Phone, func(x, y string) bool { return x == y }))
+	diff("created_at", equalTime(a.CreatedAt, b.CreatedAt))
+	diff("verified_at", equalPtr(a.VerifiedAt, b.VerifiedAt, equalTime))
+	diff("last_login_at", equalPtr(a.LastLoginAt, b.LastLoginAt, equalTime))
+	diff("login_count", a.LoginCount == b.LoginCount)
+	diff("status", a.Status == b.Status)
+	diff("metadata", len(a.Metadata) == 0 && len(b.Metadata) == 0 || reflect.DeepEqual(a.Metadata, b.Metadata))
+	return fields
+}
+
+func equalTime(a, b time.Time) bool {
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
+
+func equalPtr[T any](a, b *T, equal func(x, y T) bool) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return equal(*a, *b)
+}
+
+func (r *MigratingUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	return r.findUser("FindUserByID", func(repo UserRepository) (*User, error) {
+		return repo.FindUserByID(id, opts...)
+	})
+}
+
+func (r *MigratingUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	return r.findUser("FindUserByEmail", func(repo UserRepository) (*User, error) {
+		return repo.FindUserByEmail(email, opts...)
+	})
+}
+
+func (r *MigratingUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	return r.findUser("FindUserByPhone", func(repo UserRepository) (*User, error) {
+		return repo.FindUserByPhone(phone, opts...)
+	})
+}
+
+func (r *MigratingUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	primary, secondary := r.backends()
+	users, err := primary.FindUsersByIDs(ids, opts...)
+	if err != nil || !r.comparable(secondary, err) {
+		return users, err
+	}
+
+	want := make(map[int]*User, len(users))
+	for id, user := range users {
+		want[id] = copyUser(user)
+	}
+	r.compare("FindUsersByIDs", secondary, want, func() (map[int]*User, error) {
+		return secondary.FindUsersByIDs(ids, opts...)
+	})
+	return users, nil
+}
+
+func (r *MigratingUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	primary, _ := r.backends()
+	return primary.FindUsersWhere(spec, afterID, limit, opts...)
+}
+
+func (r *MigratingUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	primary, _ := r.backends()
+	return primary.CountUsersWhere(spec)
+}
+
+func (r *MigratingUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	primary, _ := r.backends()
+	return primary.FindUsersByNamePrefix(prefix, opts...)
+}
+
+func (r *MigratingUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	primary, _ := r.backends()
+	return primary.SuggestUsers(q, opts...)
+}
+
+func (r *MigratingUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	primary, _ := r.backends()
+	return primary.FindUsersByMetadata(key, value, opts...)
+}
+
+func (r *MigratingUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	primary, _ := r.backends()
+	return primary.FindUserHistory(id)
+}
+
+func (r *MigratingUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	primary, _ := r.backends()
+	return primary.FindUserAsOf(id, at)
+}
+
+func (r *MigratingUserRepository) SaveUser(user *User) error {
+	return r.saveUsers("SaveUser", []*User{user}, func(repo UserRepository, users []*User) error {
+		return repo.SaveUser(users[0])
+	})
+}
+
+func (r *MigratingUserRepository) SaveUsers(users []*User) error {
+	return r.saveUsers("SaveUsers", users, UserRepository.SaveUsers)
+}
+
+func (r *MigratingUserRepository) InsertUsers(users []*User) error {
+	return r.saveUsers("InsertUsers", users, UserRepository.InsertUsers)
+}
+
+func (r *MigratingUserRepository) UpdateUser(user *User) error {
+	primary, secondary := r.backends()
+	if err := primary.UpdateUser(user); err != nil {
+		return err
+	}
+	if secondary != nil {
+		if err := secondary.UpdateUser(copyUser(user)); err != nil {
+			r.failedWrite("UpdateUser", secondary, err)
+		}
+	}
+	return nil
+}
+
+func (r *MigratingUserRepository) UpdateUsers(users []*User) error {
+	primary, secondary := r.backends()
+	if err := primary.UpdateUsers(users); err != nil {
+		return err
+	}
+	if secondary != nil {
+		if err := secondary.UpdateUsers(copyUsers(users)); err != nil {
+			r.failedWrite("UpdateUsers", secondary, err)
+		}
+	}
+	return nil
+}
+
+func (r *MigratingUserRepository) RecordLogin(id int) error {
+	return r.write("RecordLogin", func(repo UserRepository) error {
+		return repo.RecordLogin(id)
+	})
+}
+
+func (r *MigratingUserRepository) SetUserStatus(id int, from, to Status) error {
+	return r.write("SetUserStatus", func(repo UserRepository) error {
+		return repo.SetUserStatus(id, from, to)
+	})
+}
+
+func (r *MigratingUserRepository) AnonymizeUser(id int) error {
+	return r.write("AnonymizeUser", func(repo UserRepository) error {
+		return repo.AnonymizeUser(id)
+	})
+}
+
+func (r *MigratingUserRepository) DeleteUser(id int) error {
+	return r.write("DeleteUser", func(repo UserRepository) error {
+		return repo.DeleteUser(id)
+	})
+}
+
+func (r *MigratingUserRepository) RestoreUser(id int) (*User, error) {
+	primary, secondary := r.backends()
+	user, err := primary.RestoreUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if secondary != nil {
+		if _, err := secondary.RestoreUser(id); err != nil {
+			r.failedWrite("RestoreUser", secondary, err)
+		}
+	}
+	return user, nil
+}
+
+func (r *MigratingUserRepository) PurgeUser(id int) error {
+	return r.write("PurgeUser", func(repo UserRepository) error {
+		return repo.PurgeUser(id)
+	})
+}
+
+// DeleteUsersWhere deletes from the secondary backend the users the
+// primary deleted, by ID, so both lose the same users even if their data
+// has drifted.
+func (r *MigratingUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	ids, err := r.deleteUsersWhere("DeleteUsersWhere", spec)
+	return int64(len(ids)), err
+}
+
+func (r *MigratingUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	return r.deleteUsersWhere("DeleteUsersWhereReturningIDs", spec)
+}
+
+func (r *MigratingUserRepository) deleteUsersWhere(op string, spec Specification) ([]int, error) {
+	primary, secondary := r.backends()
+	ids, err := primary.DeleteUsersWhereReturningIDs(spec)
+	if len(ids) > 0 && secondary != nil {
+		if _, err := secondary.DeleteUsersWhere(IDIn(ids...)); err != nil {
+			r.failedWrite(op, secondary, err)
+		}
+	}
+	return ids, err
+}
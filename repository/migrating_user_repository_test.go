@@ -0,0 +1,171 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"gorepository/features"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMigration returns a migration between two memory backends both
+// holding John Doe, as if the new one had been copied from the old.
+func newMigration(t *testing.T, stage MigrationStage) (r *MigratingUserRepository, old, new *MemoryUserRepository, logs *bytes.Buffer) {
+	old, new, logs = NewMemoryUserRepository(), NewMemoryUserRepository(), &bytes.Buffer{}
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, repo := range []*MemoryUserRepository{old, new} {
+		require.NoError(t, repo.SaveUser(&User{Name: "John Doe", Email: "john.doe@example.com", CreatedAt: createdAt}))
+	}
+	return NewMigratingUserRepository(old, new, stage, log.New(logs, "", 0)), old, new, logs
+}
+
+func TestMigratingUserRepositoryStages(t *testing.T) {
+	for _, test := range []struct {
+		stage  MigrationStage
+		reads  string
+		oldGot bool
+		newGot bool
+	}{
+		{MigrateOld, "old", true, false},
+		{MigrateDualWrite, "old", true, true},
+		{MigrateNewPrimary, "new", true, true},
+		{MigrateNew, "new", false, true},
+	} {
+		t.Run(string(test.stage), func(t *testing.T) {
+			r, old, new, logs := newMigration(t, test.stage)
+
+			// Writes reach whichever backends the stage uses
+			jane := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+			require.NoError(t, r.SaveUser(jane))
+			assert.Equal(t, 2, jane.ID)
+			require.NoError(t, r.UpdateUser(&User{ID: 1, Name: "John Smith", Email: "john.doe@example.com"}))
+			require.NoError(t, r.DeleteUser(2))
+			for backend, got := range map[*MemoryUserRepository]bool{old: test.oldGot, new: test.newGot} {
+				john, err := backend.FindUserByID(1)
+				require.NoError(t, err)
+				assert.Equal(t, got, john.Name == "John Smith")
+				_, err = backend.RestoreUser(2)
+				assert.Equal(t, got, err == nil)
+			}
+
+			// Reads come from the primary
+			require.NoError(t, old.UpdateUser(&User{ID: 1, Name: "Old", Email: "john.doe@example.com"}))
+			require.NoError(t, new.UpdateUser(&User{ID: 1, Name: "New", Email: "john.doe@example.com"}))
+			john, err := r.FindUserByID(1)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"old": "Old", "new": "New"}[test.reads], john.Name)
+			assert.Empty(t, logs.String())
+		})
+	}
+}
+
+func TestMigratingUserRepositoryDualWriteFlag(t *testing.T) {
+	r, old, new, _ := newMigration(t, MigrateDualWrite)
+	flags := features.NewSet()
+	r.Flags = flags
+
+	// With the flag off only the primary is written to
+	require.NoError(t, r.UpdateUser(&User{ID: 1, Name: "John Smith", Email: "john.doe@example.com"}))
+	john, err := new.FindUserByID(1)
+	require.NoError(t, err)
+	assert.Equal(t, "John Doe", john.Name)
+
+	flags.Replace([]features.Flag{features.DualWrite})
+	require.NoError(t, r.UpdateUser(&User{ID: 1, Name: "Johnny", Email: "john.doe@example.com"}))
+	for _, backend := range []*MemoryUserRepository{old, new} {
+		john, err := backend.FindUserByID(1)
+		require.NoError(t, err)
+		assert.Equal(t, "Johnny", john.Name)
+	}
+}
+
+func TestMigratingUserRepositoryFailedWrite(t *testing.T) {
+	r, _, _, logs := newMigration(t, MigrateDualWrite)
+	failure := errors.New("connection refused")
+	r.New = &MockUserRepository{Err: failure}
+
+	// The primary decides whether a write succeeds
+	require.NoError(t, r.DeleteUser(1))
+	assert.EqualValues(t, 1, r.FailedWrites())
+	assert.Contains(t, logs.String(), "repository: migration: DeleteUser failed on the new backend: connection refused")
+
+	// A user whose ID is taken on the secondary is reported
+	r.New = NewMemoryUserRepository()
+	require.NoError(t, r.New.InsertUsers([]*User{{ID: 2, Name: "Stray", Email: "stray@example.com"}}))
+	logs.Reset()
+	require.NoError(t, r.SaveUsers([]*User{{Name: "Jane Doe", Email: "jane.doe@example.com"}}))
+	assert.EqualValues(t, 2, r.FailedWrites())
+	assert.Contains(t, logs.String(), "SaveUsers failed on the new backend: user exists: user 2")
+
+	// But a write that fails on the primary isn't copied
+	r.Old = &MockUserRepository{Err: failure}
+	assert.ErrorIs(t, r.DeleteUser(2), failure)
+	_, err := r.New.FindUserByID(2)
+	assert.NoError(t, err)
+}
+
+func TestMigratingUserRepositoryKeepsIDs(t *testing.T) {
+	r, _, new, _ := newMigration(t, MigrateDualWrite)
+
+	// The secondary has handed out an ID the primary hasn't, yet the
+	// user saved next is copied under the primary's ID
+	require.NoError(t, new.SaveUser(&User{Name: "Stray", Email: "stray@example.com"}))
+	require.NoError(t, new.DeleteUser(2))
+	jane := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	require.NoError(t, r.SaveUser(jane))
+	assert.Equal(t, 2, jane.ID)
+	copied, err := new.FindUserByID(2)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", copied.Name)
+	assert.Zero(t, r.FailedWrites())
+
+	// Deletes match users on the primary and delete the same IDs on the
+	// secondary, even where its data differs
+	require.NoError(t, new.UpdateUser(&User{ID: 1, Name: "John Doe", Email: "john.doe@example.org"}))
+	n, err := r.DeleteUsersWhere(EmailDomain("example.com"))
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, n)
+	count, err := new.CountUsersWhere(And())
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestMigratingUserRepositoryCompareReads(t *testing.T) {
+	r, old, new, logs := newMigration(t, MigrateDualWrite)
+	r.SetCompareReads(true)
+	require.NoError(t, new.UpdateUser(&User{ID: 1, Name: "Jon Doe", Email: "john.doe@example.com"}))
+	require.NoError(t, old.SaveUser(&User{Name: "Jane Doe", Email: "jane.doe@example.com"}))
+
+	john, err := r.FindUserByEmail("john.doe@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "John Doe", john.Name)
+	_, err = r.FindUsersByIDs([]int{1, 2})
+	require.NoError(t, err)
+	r.Wait()
+
+	assert.EqualValues(t, 3, r.Mismatches())
+	assert.Contains(t, logs.String(), "repository: migration: FindUserByEmail: user 1 differs in name on the new backend")
+	assert.Contains(t, logs.String(), "repository: migration: FindUsersByIDs: user 2 is missing on the new backend")
+
+	// Matching reads, and reads while there is one backend, aren't reported
+	logs.Reset()
+	_, _ = r.FindUserByID(3)
+	r.SetStage(MigrateOld)
+	_, _ = r.FindUserByID(1)
+	r.Wait()
+	assert.EqualValues(t, 3, r.Mismatches())
+	assert.Empty(t, logs.String())
+}
+
+func TestParseMigrationStage(t *testing.T) {
+	stage, err := ParseMigrationStage("new-primary")
+	assert.NoError(t, err)
+	assert.Equal(t, MigrateNewPrimary, stage)
+	_, err = ParseMigrationStage("cutover")
+	assert.ErrorIs(t, err, ErrInvalidMigrationStage)
+}
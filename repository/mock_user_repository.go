@@ -1,27 +1,560 @@
 package repository
 
-import "errors"
+import (
+    "fmt"
+    "reflect"
+    "slices"
+    "sync"
+    "time"
+)
 
+// MockUserRepository is an in-memory UserRepository for tests. Configure it
+// through Users and Err before use; after that it is safe for concurrent use.
+// Users are copied on the way in and out, so callers never share a *User
+// with the mock's map.
+//
+// Every call is recorded, so tests can check how the repository was used as
+// well as what ended up in it.
+//
+// Err fails every method. MethodErrs fails only the named methods, and
+// FailWhen fails calls matching a condition; the most specific one wins.
 type MockUserRepository struct {
-    Users map[int]*User
-    Err   error
+    Users      map[int]*User
+    Err        error
+    MethodErrs map[string]error
+    // Emails normalizes addresses for FindUserByEmail, as a real backend
+    // would.
+    Emails EmailNormalizer
+
+    mu       sync.RWMutex
+    lastID   int
+    history  userHistory
+    calls    []Call
+    failures []failure
+}
+
+var _ UserRepository = (*MockUserRepository)(nil)
+
+// CallMatcher decides whether a call should fail. n is the call's position
+// among calls to the same method, starting at 1.
+type CallMatcher func(call Call, n int) bool
+
+type failure struct {
+    method string
+    when   CallMatcher
+    err    error
 }
 
-func (m *MockUserRepository) FindUserByID(id int) (*User, error) {
-    if m.Err != nil {
-        return nil, m.Err
+// Call is a single recorded call on MockUserRepository. Users passed as
+// arguments are copied as they were at the time of the call.
+type Call struct {
+    Method string
+    Args   []any
+}
+
+// TestingT is the subset of *testing.T used by the mock's assertions.
+type TestingT interface {
+    Helper()
+    Errorf(format string, args ...any)
+}
+
+// The find methods record their key arguments only; options are applied
+// but not recorded.
+func (m *MockUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUserByID", id); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
     }
     user, exists := m.Users[id]
     if !exists {
-        return nil, errors.New("user not found")
+        return nil, ErrUserNotFound
+    }
+    return fields.apply(copyUser(user)), nil
+}
+
+func (m *MockUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUserByEmail", email); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    user, ok := findByEmail(m.Users, m.Emails, email)
+    if !ok {
+        return nil, ErrUserNotFound
+    }
+    return fields.apply(copyUser(user)), nil
+}
+
+func (m *MockUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUserByPhone", phone); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    user, ok := findByPhone(m.Users, phone)
+    if !ok {
+        return nil, ErrUserNotFound
+    }
+    return fields.apply(copyUser(user)), nil
+}
+
+func (m *MockUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUsersByIDs", slices.Clone(ids)); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    return pickUsers(m.Users, ids, fields), nil
+}
+
+func (m *MockUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUsersWhere", spec, afterID, limit); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    return selectUsers(m.Users, spec, afterID, limit, fields, resolve(opts).backward), nil
+}
+
+func (m *MockUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("CountUsersWhere", spec); err != nil {
+        return 0, err
+    }
+    return countUsers(m.Users, spec), nil
+}
+
+func (m *MockUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUsersByNamePrefix", prefix); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    return prefixUsers(m.Users, prefix, searchLimit(opts), fields), nil
+}
+
+func (m *MockUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("SuggestUsers", q); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    return suggestUsers(m.Users, q, searchLimit(opts), fields), nil
+}
+
+func (m *MockUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUsersByMetadata", key, value); err != nil {
+        return nil, err
+    }
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    spec, err := metadataSpec(key, value)
+    if err != nil {
+        return nil, err
+    }
+    return selectUsers(m.Users, spec, 0, metadataLimit(opts), fields, false), nil
+}
+
+func (m *MockUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUserHistory", id); err != nil {
+        return nil, err
+    }
+    return m.past().versions(id, m.Users[id])
+}
+
+func (m *MockUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("FindUserAsOf", id, at); err != nil {
+        return nil, err
     }
-    return user, nil
+    return m.past().asOf(id, m.Users[id], at)
 }
 
 func (m *MockUserRepository) SaveUser(user *User) error {
-    if m.Err != nil {
-        return m.Err
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("SaveUser", copyUser(user)); err != nil {
+        return err
+    }
+    m.save(user)
+    return nil
+}
+
+func (m *MockUserRepository) SaveUsers(users []*User) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("SaveUsers", copyUsers(users)); err != nil {
+        return err
+    }
+    for _, user := range users {
+        m.save(user)
+    }
+    return nil
+}
+
+func (m *MockUserRepository) InsertUsers(users []*User) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("InsertUsers", copyUsers(users)); err != nil {
+        return err
+    }
+    if err := takenID(m.Users, users); err != nil {
+        return err
+    }
+    for _, user := range users {
+        m.lastID = max(m.lastID, user.ID)
+        m.save(user)
+    }
+    return nil
+}
+
+func (m *MockUserRepository) UpdateUser(user *User) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("UpdateUser", copyUser(user)); err != nil {
+        return err
+    }
+    return updateUser(m.Users, m.past(), m.Emails, user)
+}
+
+func (m *MockUserRepository) UpdateUsers(users []*User) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("UpdateUsers", copyUsers(users)); err != nil {
+        return err
+    }
+    if err := missingID(m.Users, users); err != nil {
+        return err
+    }
+    for _, user := range users {
+        updateUser(m.Users, m.past(), m.Emails, user)
+    }
+    return nil
+}
+
+func (m *MockUserRepository) RecordLogin(id int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("RecordLogin", id); err != nil {
+        return err
+    }
+    return recordLogin(m.Users, id)
+}
+
+func (m *MockUserRepository) SetUserStatus(id int, from, to Status) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("SetUserStatus", id, from, to); err != nil {
+        return err
+    }
+    return setUserStatus(m.Users, m.past(), id, from, to)
+}
+
+func (m *MockUserRepository) AnonymizeUser(id int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("AnonymizeUser", id); err != nil {
+        return err
     }
-    m.Users[user.ID] = user
+    return anonymizeUser(m.Users, m.past(), id)
+}
+
+func (m *MockUserRepository) DeleteUser(id int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("DeleteUser", id); err != nil {
+        return err
+    }
+    user, exists := m.Users[id]
+    if !exists {
+        return ErrUserNotFound
+    }
+    m.past().record(user, OperationDelete)
+    delete(m.Users, id)
     return nil
 }
+
+func (m *MockUserRepository) RestoreUser(id int) (*User, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("RestoreUser", id); err != nil {
+        return nil, err
+    }
+    if m.Users == nil {
+        m.Users = map[int]*User{}
+    }
+    return restoreUser(m.Users, m.past(), id)
+}
+
+func (m *MockUserRepository) PurgeUser(id int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("PurgeUser", id); err != nil {
+        return err
+    }
+    return purgeUser(m.Users, m.past(), id)
+}
+
+func (m *MockUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("DeleteUsersWhere", spec); err != nil {
+        return 0, err
+    }
+    if IsEmpty(spec) {
+        return 0, ErrEmptySpecification
+    }
+    return int64(len(deleteUsers(m.Users, m.past(), spec))), nil
+}
+
+func (m *MockUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if err := m.record("DeleteUsersWhereReturningIDs", spec); err != nil {
+        return nil, err
+    }
+    if IsEmpty(spec) {
+        return nil, ErrEmptySpecification
+    }
+    return deleteUsers(m.Users, m.past(), spec), nil
+}
+
+// save stores a copy of the user, handing out the next free ID when none is
+// set, the same way the database would. Callers must hold m.mu.
+func (m *MockUserRepository) save(user *User) {
+    if m.Users == nil {
+        m.Users = map[int]*User{}
+    }
+    if user.ID == 0 {
+        m.lastID++
+        for m.Users[m.lastID] != nil {
+            m.lastID++
+        }
+        user.ID = m.lastID
+    }
+    if user.CreatedAt.IsZero() {
+        user.CreatedAt = time.Now()
+    }
+    user.Status = user.Status.orDefault()
+    user.NormalizedEmail = m.Emails.Normalize(user.Email)
+    m.Users[user.ID] = copyUser(user)
+}
+
+// past returns the users' past versions. Callers must hold m.mu.
+func (m *MockUserRepository) past() userHistory {
+    if m.history == nil {
+        m.history = userHistory{}
+    }
+    return m.history
+}
+
+// Calls returns every call made on the mock, in order.
+func (m *MockUserRepository) Calls() []Call {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    return append([]Call(nil), m.calls...)
+}
+
+// CallCount returns how many times method was called.
+func (m *MockUserRepository) CallCount(method string) int {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    count := 0
+    for _, call := range m.calls {
+        if call.Method == method {
+            count++
+        }
+    }
+    return count
+}
+
+// Called reports whether method was called with exactly args.
+func (m *MockUserRepository) Called(method string, args ...any) bool {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    for _, call := range m.calls {
+        if call.Method == method && reflect.DeepEqual(call.Args, args) {
+            return true
+        }
+    }
+    return false
+}
+
+// AssertCalled fails the test unless method was called with exactly args.
+func (m *MockUserRepository) AssertCalled(t TestingT, method string, args ...any) bool {
+    t.Helper()
+    if !m.Called(method, args...) {
+        t.Errorf("expected call %s, got calls:\n%s", formatCall(Call{method, args}), m.formatCalls())
+        return false
+    }
+    return true
+}
+
+// AssertNotCalled fails the test if method was called at all.
+func (m *MockUserRepository) AssertNotCalled(t TestingT, method string) bool {
+    t.Helper()
+    if m.CallCount(method) > 0 {
+        t.Errorf("expected no calls to %s, got calls:\n%s", method, m.formatCalls())
+        return false
+    }
+    return true
+}
+
+// AssertCallOrder fails the test unless the recorded calls were made to
+// exactly these methods, in this order.
+func (m *MockUserRepository) AssertCallOrder(t TestingT, methods ...string) bool {
+    t.Helper()
+    calls := m.Calls()
+    got := make([]string, len(calls))
+    for i, call := range calls {
+        got[i] = call.Method
+    }
+    if !slices.Equal(got, methods) {
+        t.Errorf("expected calls in order %v, got %v", methods, got)
+        return false
+    }
+    return true
+}
+
+// FailWhen makes calls to method that match when return err. Conditions are
+// checked in the order they were added.
+func (m *MockUserRepository) FailWhen(method string, when CallMatcher, err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.failures = append(m.failures, failure{method: method, when: when, err: err})
+}
+
+// OnCall matches the nth call to a method, starting at 1.
+func OnCall(n int) CallMatcher {
+    return func(_ Call, got int) bool {
+        return got == n
+    }
+}
+
+// OnArgs matches calls made with exactly args.
+func OnArgs(args ...any) CallMatcher {
+    return func(call Call, _ int) bool {
+        return reflect.DeepEqual(call.Args, args)
+    }
+}
+
+// record appends a call and returns the error it should fail with, if any.
+// Callers must hold m.mu.
+func (m *MockUserRepository) record(method string, args ...any) error {
+    call := Call{Method: method, Args: args}
+    m.calls = append(m.calls, call)
+
+    n := 0
+    for _, c := range m.calls {
+        if c.Method == method {
+            n++
+        }
+    }
+
+    for _, f := range m.failures {
+        if f.method == method && f.when(call, n) {
+            return f.err
+        }
+    }
+    if err, ok := m.MethodErrs[method]; ok {
+        return err
+    }
+    return m.Err
+}
+
+func (m *MockUserRepository) formatCalls() string {
+    calls := m.Calls()
+    if len(calls) == 0 {
+        return "  (none)"
+    }
+    s := ""
+    for i, call := range calls {
+        s += fmt.Sprintf("  %d: %s\n", i+1, formatCall(call))
+    }
+    return s
+}
+
+func formatCall(call Call) string {
+    args := ""
+    for i, arg := range call.Args {
+        if i > 0 {
+            args += ", "
+        }
+        args += fmt.Sprintf("%+v", deref(arg))
+    }
+    return call.Method + "(" + args + ")"
+}
+
+// deref makes recorded users print as values rather than addresses.
+func deref(arg any) any {
+    switch v := arg.(type) {
+    case *User:
+        return *v
+    case []*User:
+        users := make([]User, len(v))
+        for i, user := range v {
+            users[i] = *user
+        }
+        return users
+    }
+    return arg
+}
+
+// copyUser copies user deeply: the phone number it points to, which
+// EncryptedUserRepository overwrites in place, and its metadata.
+func copyUser(user *User) *User {
+    c := *user
+    if user.Phone != nil {
+        phone := *user.Phone
+        c.Phone = &phone
+    }
+    c.Metadata = user.Metadata.clone()
+    return &c
+}
+
+func copyUsers(users []*User) []*User {
+    c := make([]*User, len(users))
+    for i, user := range users {
+        c[i] = copyUser(user)
+    }
+    return c
+}
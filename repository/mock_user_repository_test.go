@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMockUserRepositoryConcurrentAccess(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{},
+	}
+
+	// Save and read from many goroutines at once
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			user := &User{Name: "John Doe", Email: "john.doe@example.com"}
+			assert.NoError(t, mockRepo.SaveUser(user))
+			_, err := mockRepo.FindUserByID(user.ID)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, mockRepo.Users, 50)
+}
+
+func TestMockUserRepositoryCopiesUsers(t *testing.T) {
+	mockRepo := &MockUserRepository{}
+
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, mockRepo.SaveUser(user))
+
+	// Changing the caller's copy must not change what is stored
+	user.Name = "Changed"
+	found, err := mockRepo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+
+	// Nor must changing what was returned
+	found.Name = "Changed again"
+	found, err = mockRepo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+}
+
+// fakeT captures assertion failures so they can be checked.
+type fakeT struct {
+	failed bool
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...any) {
+	f.failed = true
+}
+
+func TestMockUserRepositoryRecordsCalls(t *testing.T) {
+	mockRepo := &MockUserRepository{}
+
+	assert.NoError(t, mockRepo.SaveUser(&User{Name: "Jane Doe", Email: "jane.doe@example.com"}))
+	_, _ = mockRepo.FindUserByID(1)
+	_, _ = mockRepo.FindUserByID(7)
+
+	assert.Equal(t, 2, mockRepo.CallCount("FindUserByID"))
+	assert.Equal(t, 0, mockRepo.CallCount("SaveUsers"))
+
+	// Arguments are recorded as they were passed, before the ID was assigned
+	mockRepo.AssertCalled(t, "SaveUser", &User{Name: "Jane Doe", Email: "jane.doe@example.com"})
+	mockRepo.AssertCalled(t, "FindUserByID", 7)
+	mockRepo.AssertNotCalled(t, "SaveUsers")
+	mockRepo.AssertCallOrder(t, "SaveUser", "FindUserByID", "FindUserByID")
+
+	// Failed expectations are reported to the test
+	ft := &fakeT{}
+	assert.False(t, mockRepo.AssertCalled(ft, "FindUserByID", 3))
+	assert.True(t, ft.failed)
+
+	ft = &fakeT{}
+	assert.False(t, mockRepo.AssertCallOrder(ft, "FindUserByID", "SaveUser"))
+	assert.True(t, ft.failed)
+}
+
+func TestMockUserRepositoryMethodErrors(t *testing.T) {
+	saveErr := errors.New("disk full")
+	mockRepo := &MockUserRepository{
+		Users:      map[int]*User{1: {ID: 1, Name: "John Doe"}},
+		MethodErrs: map[string]error{"SaveUser": saveErr},
+	}
+
+	// Only SaveUser fails
+	assert.Equal(t, saveErr, mockRepo.SaveUser(&User{Name: "Jane Doe"}))
+	_, err := mockRepo.FindUserByID(1)
+	assert.NoError(t, err)
+}
+
+func TestMockUserRepositoryConditionalErrors(t *testing.T) {
+	notFound := errors.New("gone")
+	timeout := errors.New("timeout")
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{
+			1: {ID: 1, Name: "John Doe"},
+			7: {ID: 7, Name: "Jane Doe"},
+		},
+	}
+	mockRepo.FailWhen("FindUserByID", OnArgs(7), notFound)
+	mockRepo.FailWhen("FindUserByID", OnCall(3), timeout)
+
+	// Fail only when id == 7
+	_, err := mockRepo.FindUserByID(1)
+	assert.NoError(t, err)
+	_, err = mockRepo.FindUserByID(7)
+	assert.Equal(t, notFound, err)
+
+	// Fail on the 3rd call, whatever the id
+	_, err = mockRepo.FindUserByID(1)
+	assert.Equal(t, timeout, err)
+	_, err = mockRepo.FindUserByID(1)
+	assert.NoError(t, err)
+}
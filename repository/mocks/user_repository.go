@@ -0,0 +1,74 @@
+// Package mocks builds configured test doubles for the repository package.
+package mocks
+
+import "gorepository/repository"
+
+// UserRepoBuilder configures a repository.MockUserRepository step by step.
+type UserRepoBuilder struct {
+	users      []*repository.User
+	err        error
+	methodErrs map[string]error
+	failures   []failure
+}
+
+type failure struct {
+	method string
+	when   repository.CallMatcher
+	err    error
+}
+
+// NewUserRepo starts building an empty mock user repository.
+func NewUserRepo() *UserRepoBuilder {
+	return &UserRepoBuilder{methodErrs: map[string]error{}}
+}
+
+// WithUser stores u in the built repository, keyed by its ID.
+func (b *UserRepoBuilder) WithUser(u *repository.User) *UserRepoBuilder {
+	b.users = append(b.users, u)
+	return b
+}
+
+// WithUsers stores each of users in the built repository.
+func (b *UserRepoBuilder) WithUsers(users ...*repository.User) *UserRepoBuilder {
+	b.users = append(b.users, users...)
+	return b
+}
+
+// Failing makes every method return err.
+func (b *UserRepoBuilder) Failing(err error) *UserRepoBuilder {
+	b.err = err
+	return b
+}
+
+// FailingOn makes method return err.
+func (b *UserRepoBuilder) FailingOn(method string, err error) *UserRepoBuilder {
+	b.methodErrs[method] = err
+	return b
+}
+
+// FailingWhen makes calls to method that match when return err.
+func (b *UserRepoBuilder) FailingWhen(method string, when repository.CallMatcher, err error) *UserRepoBuilder {
+	b.failures = append(b.failures, failure{method: method, when: when, err: err})
+	return b
+}
+
+// Build returns the configured mock. Each call returns a new mock with its
+// own copy of the users, so one builder can seed several tests.
+func (b *UserRepoBuilder) Build() *repository.MockUserRepository {
+	m := &repository.MockUserRepository{
+		Users:      map[int]*repository.User{},
+		Err:        b.err,
+		MethodErrs: map[string]error{},
+	}
+	for _, u := range b.users {
+		c := *u
+		m.Users[u.ID] = &c
+	}
+	for method, err := range b.methodErrs {
+		m.MethodErrs[method] = err
+	}
+	for _, f := range b.failures {
+		m.FailWhen(f.method, f.when, f.err)
+	}
+	return m
+}
@@ -0,0 +1,50 @@
+package mocks
+
+import (
+	"errors"
+	"gorepository/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild(t *testing.T) {
+	saveErr := errors.New("disk full")
+	findErr := errors.New("gone")
+
+	mockRepo := NewUserRepo().
+		WithUser(&repository.User{ID: 1, Name: "John Doe"}).
+		WithUsers(&repository.User{ID: 7, Name: "Jane Doe"}).
+		FailingOn("SaveUser", saveErr).
+		FailingWhen("FindUserByID", repository.OnArgs(7), findErr).
+		Build()
+
+	user, err := mockRepo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+
+	_, err = mockRepo.FindUserByID(7)
+	assert.Equal(t, findErr, err)
+
+	assert.Equal(t, saveErr, mockRepo.SaveUser(&repository.User{Name: "Someone"}))
+}
+
+func TestBuildReturnsIndependentMocks(t *testing.T) {
+	builder := NewUserRepo().WithUser(&repository.User{ID: 1, Name: "John Doe"})
+
+	first := builder.Build()
+	assert.NoError(t, first.SaveUser(&repository.User{ID: 2, Name: "Jane Doe"}))
+
+	// Saving into one mock doesn't leak into the next
+	second := builder.Build()
+	assert.Len(t, second.Users, 1)
+}
+
+func TestFailing(t *testing.T) {
+	dbErr := errors.New("database is down")
+
+	mockRepo := NewUserRepo().Failing(dbErr).Build()
+
+	_, err := mockRepo.FindUserByID(1)
+	assert.Equal(t, dbErr, err)
+}
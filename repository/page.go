@@ -0,0 +1,158 @@
+package repository
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+)
+
+// DefaultPageSize is the page size Paginate uses when none is given, and
+// MaxPageSize the largest it allows.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 1000
+)
+
+// ErrInvalidCursor is returned for a page cursor that wasn't produced by
+// Paginate.
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// Page is one page of a list result, the envelope every list is returned
+// in. Lists that aren't paged, such as a user's history, are a single page
+// with no cursors.
+type Page[T any] struct {
+	Items []T `json:"items"`
+	// Total is how many items there are over every page.
+	Total int64 `json:"total"`
+	// PageSize is the most items a page holds.
+	PageSize int `json:"page_size"`
+	// Next and Prev are cursors for the pages after and before this one,
+	// empty at either end.
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+// NewPage returns items as a single, complete page.
+func NewPage[T any](items []T) Page[T] {
+	if items == nil {
+		items = []T{}
+	}
+	return Page[T]{Items: items, Total: int64(len(items)), PageSize: len(items)}
+}
+
+// Paginate returns the page of users matching spec that cursor points at,
+// or the first page if cursor is empty. Users are in ID order, and pages
+// are keyed by ID rather than offset, so users added or removed while
+// paging don't shift the pages after them.
+func Paginate(repo UserRepository, spec Specification, cursor string, size int, opts ...FindOption) (Page[*User], error) {
+	if size <= 0 {
+		size = DefaultPageSize
+	}
+	size = min(size, MaxPageSize)
+	pos, err := decodeCursor(cursor)
+	if err != nil {
+		return Page[*User]{}, err
+	}
+	// Read one more than a page to learn whether there is another
+	var users []*User
+	if pos.before > 0 {
+		users, err = repo.FindUsersWhere(spec, pos.before, size+1, append(slices.Clip(opts), Backward())...)
+		slices.Reverse(users)
+	} else {
+		users, err = repo.FindUsersWhere(spec, pos.after, size+1, opts...)
+	}
+	if err != nil {
+		return Page[*User]{}, err
+	}
+
+	page := Page[*User]{PageSize: size}
+	more := len(users) > size
+	switch {
+	case pos.before > 0 && more:
+		users = users[1:]
+		page.Prev = encodeCursor(position{before: users[0].ID})
+	case pos.before == 0 && more:
+		users = users[:size]
+		page.Next = encodeCursor(position{after: users[len(users)-1].ID})
+	}
+	if page.Items = users; page.Items == nil {
+		page.Items = []*User{}
+	}
+
+	// The end we didn't read past: there is more there if we came from it
+	if len(users) > 0 {
+		if pos.before > 0 {
+			page.Next = encodeCursor(position{after: users[len(users)-1].ID})
+		} else if pos.after > 0 {
+			earlier, err := repo.FindUsersWhere(spec, users[0].ID, 1, Fields("id"), Backward())
+			if err != nil {
+				return Page[*User]{}, err
+			}
+			if len(earlier) > 0 {
+				page.Prev = encodeCursor(position{before: users[0].ID})
+			}
+		}
+	}
+
+	if page.Total, err = repo.CountUsersWhere(spec); err != nil {
+		return Page[*User]{}, err
+	}
+	return page, nil
+}
+
+// CursorAfter returns a cursor for whatever comes after the user with ID
+// id, the same as a page ending with them would have for Next.
+func CursorAfter(id int) string {
+	return encodeCursor(position{after: id})
+}
+
+// ParseCursorAfter returns the ID a cursor from CursorAfter, or a page's
+// Next, starts after: zero for an empty cursor.
+func ParseCursorAfter(cursor string) (int, error) {
+	pos, err := decodeCursor(cursor)
+	if err != nil {
+		return 0, err
+	}
+	if pos.before > 0 {
+		return 0, fmt.Errorf("%w: %q points backwards", ErrInvalidCursor, cursor)
+	}
+	return pos.after, nil
+}
+
+// position is where a page starts: after one ID, or ending before one.
+type position struct {
+	after, before int
+}
+
+// encodeCursor makes an opaque cursor for pos. Cursors are only meant to
+// be passed back, so their format may change.
+func encodeCursor(pos position) string {
+	s := "a" + strconv.Itoa(pos.after)
+	if pos.before > 0 {
+		s = "b" + strconv.Itoa(pos.before)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeCursor(cursor string) (position, error) {
+	if cursor == "" {
+		return position{}, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(b) < 2 {
+		return position{}, ErrInvalidCursor
+	}
+	id, err := strconv.Atoi(string(b[1:]))
+	if err != nil || id < 0 {
+		return position{}, ErrInvalidCursor
+	}
+	switch b[0] {
+	case 'a':
+		return position{after: id}, nil
+	case 'b':
+		return position{before: id}, nil
+	}
+	return position{}, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+}
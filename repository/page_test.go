@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPaginate(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	for _, name := range []string{"Ann", "Bob", "Cat", "Dan", "Eve"} {
+		assert.NoError(t, repo.SaveUser(&User{Name: name, Email: name + "@example.com"}))
+	}
+
+	// Test the first page
+	first, err := Paginate(repo, And(), "", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Ann", "Bob"}, names(first.Items))
+	assert.Equal(t, int64(5), first.Total)
+	assert.Equal(t, 2, first.PageSize)
+	assert.Empty(t, first.Prev)
+	assert.NotEmpty(t, first.Next)
+
+	// Test following next to the last page
+	second, err := Paginate(repo, And(), first.Next, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Cat", "Dan"}, names(second.Items))
+	assert.NotEmpty(t, second.Prev)
+
+	last, err := Paginate(repo, And(), second.Next, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Eve"}, names(last.Items))
+	assert.Empty(t, last.Next)
+
+	// Test following prev back to the start
+	back, err := Paginate(repo, And(), last.Prev, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Cat", "Dan"}, names(back.Items))
+	assert.NotEmpty(t, back.Next)
+
+	back, err = Paginate(repo, And(), back.Prev, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Ann", "Bob"}, names(back.Items))
+	assert.Empty(t, back.Prev)
+
+	// Test that the total counts only matching users
+	page, err := Paginate(repo, IDIn(2, 4), "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bob", "Dan"}, names(page.Items))
+	assert.Equal(t, int64(2), page.Total)
+	assert.Equal(t, DefaultPageSize, page.PageSize)
+
+	// Test a cursor that wasn't made by Paginate
+	_, err = Paginate(repo, And(), "not-a-cursor", 2)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestNewPage(t *testing.T) {
+	page := NewPage[*User](nil)
+	assert.NotNil(t, page.Items)
+	assert.Equal(t, int64(0), page.Total)
+}
@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/lib/pq"
+)
+
+// openPgx opens a pool of connections to dsn through pgx rather than
+// lib/pq, taking the password from password for each new connection when
+// it is set. The pool speaks to the same PostgresUserRepository; only the
+// wire driver differs. For failover, give pgx a multi-host DSN such as
+// "host=a,b target_session_attrs=read-write" instead of standbys.
+func openPgx(dsn string, password func() string) (*sql.DB, error) {
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+	var opts []stdlib.OptionOpenDB
+	if password != nil {
+		opts = append(opts, stdlib.OptionBeforeConnect(func(ctx context.Context, cfg *pgx.ConnConfig) error {
+			cfg.Password = password()
+			return nil
+		}))
+	}
+	return stdlib.OpenDB(*config, opts...), nil
+}
+
+// sqlState returns the SQLSTATE code of a Postgres error from either
+// driver, or "" if err isn't one.
+func sqlState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
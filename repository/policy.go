@@ -0,0 +1,295 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPolicy is the Policies key whose policy applies to every read
+// operation without one of its own.
+const DefaultPolicy = "*"
+
+// ReadOperations are the operations Policies can be given for: every find.
+// Writes aren't hedged, and are bounded by the backend's statement timeout.
+var ReadOperations = []string{
+	"FindUserByID", "FindUserByEmail", "FindUserByPhone", "FindUsersByIDs",
+	"FindUsersWhere", "CountUsersWhere", "FindUsersByNamePrefix", "SuggestUsers",
+	"FindUsersByMetadata", "FindUserHistory", "FindUserAsOf",
+}
+
+// OperationPolicy bounds the latency of one read operation.
+type OperationPolicy struct {
+	// Timeout fails the operation with ErrQueryTimeout if it hasn't
+	// answered in this long, when greater than zero. It is passed on to
+	// finds as their Timeout, so the database gives up too.
+	Timeout time.Duration
+	// HedgeAfter, when greater than zero, makes a second attempt at the
+	// operation if the first hasn't answered in this long, and takes
+	// whichever answers first.
+	HedgeAfter time.Duration
+}
+
+// Policies assigns OperationPolicies to read operations by method name,
+// such as "FindUserByID". The policy under DefaultPolicy fills in what an
+// operation's own leaves unset.
+type Policies map[string]OperationPolicy
+
+// For returns the policy for op.
+func (p Policies) For(op string) OperationPolicy {
+	policy, fallback := p[op], p[DefaultPolicy]
+	if policy.Timeout <= 0 {
+		policy.Timeout = fallback.Timeout
+	}
+	if policy.HedgeAfter <= 0 {
+		policy.HedgeAfter = fallback.HedgeAfter
+	}
+	return policy
+}
+
+// ParsePolicies reads Policies written as comma-separated operations,
+// each followed by its settings after colons, as in
+//
+//	FindUserByID:timeout=200ms:hedge=20ms,*:timeout=2s
+//
+// where timeout sets Timeout and hedge sets HedgeAfter. An empty string
+// has no policies.
+func ParsePolicies(s string) (Policies, error) {
+	policies := Policies{}
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		parts := strings.Split(def, ":")
+		op := strings.TrimSpace(parts[0])
+		if op != DefaultPolicy && !slices.Contains(ReadOperations, op) {
+			return nil, fmt.Errorf("repository: policy for unknown read operation %q", op)
+		}
+		if _, dup := policies[op]; dup {
+			return nil, fmt.Errorf("repository: policy for %s given twice", op)
+		}
+
+		var policy OperationPolicy
+		for _, setting := range parts[1:] {
+			key, value, ok := strings.Cut(strings.TrimSpace(setting), "=")
+			if !ok {
+				return nil, fmt.Errorf("repository: policy for %s: want setting=duration, got %q", op, setting)
+			}
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("repository: policy for %s: %s must be a positive duration, got %q", op, key, value)
+			}
+			switch key {
+			case "timeout":
+				policy.Timeout = d
+			case "hedge":
+				policy.HedgeAfter = d
+			default:
+				return nil, fmt.Errorf("repository: policy for %s: unknown setting %q (want timeout or hedge)", op, key)
+			}
+		}
+		if policy.Timeout > 0 && policy.HedgeAfter >= policy.Timeout {
+			return nil, fmt.Errorf("repository: policy for %s: hedge must come before the timeout", op)
+		}
+		policies[op] = policy
+	}
+	return policies, nil
+}
+
+// PolicyUserRepository wraps a UserRepository and applies Policies to its
+// reads, to tame their tail latencies. Writes pass straight through.
+//
+// Hedged attempts go to Replica when it is set, and otherwise to the
+// wrapped repository again, which for Postgres means another connection.
+// A replica may lag, so a hedged read can return a user as they were a
+// moment ago, and one the replica can't find yet doesn't count as an
+// answer. The first attempt's user, or its ErrUserNotFound, is always
+// taken as soon as it arrives; an attempt that fails waits for the other.
+// Attempts overtaken by the other, or by the timeout, run on in the
+// background and their results are dropped.
+type PolicyUserRepository struct {
+	UserRepository
+	Replica UserRepository
+
+	mu       sync.RWMutex
+	policies Policies
+}
+
+var _ UserRepository = (*PolicyUserRepository)(nil)
+
+func NewPolicyUserRepository(repo, replica UserRepository, policies Policies) *PolicyUserRepository {
+	return &PolicyUserRepository{UserRepository: repo, Replica: replica, policies: policies}
+}
+
+// SetPolicies replaces the policies, taking effect from the next call.
+func (r *PolicyUserRepository) SetPolicies(policies Policies) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policies = policies
+}
+
+func (r *PolicyUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	policy, opts := r.policy("FindUserByID", opts)
+	return hedged(r, policy, "FindUserByID", func(repo UserRepository) (*User, error) {
+		return repo.FindUserByID(id, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	policy, opts := r.policy("FindUserByEmail", opts)
+	return hedged(r, policy, "FindUserByEmail", func(repo UserRepository) (*User, error) {
+		return repo.FindUserByEmail(email, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	policy, opts := r.policy("FindUserByPhone", opts)
+	return hedged(r, policy, "FindUserByPhone", func(repo UserRepository) (*User, error) {
+		return repo.FindUserByPhone(phone, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	policy, opts := r.policy("FindUsersByIDs", opts)
+	return hedged(r, policy, "FindUsersByIDs", func(repo UserRepository) (map[int]*User, error) {
+		return repo.FindUsersByIDs(ids, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	policy, opts := r.policy("FindUsersWhere", opts)
+	return hedged(r, policy, "FindUsersWhere", func(repo UserRepository) ([]*User, error) {
+		return repo.FindUsersWhere(spec, afterID, limit, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	policy, _ := r.policy("CountUsersWhere", nil)
+	return hedged(r, policy, "CountUsersWhere", func(repo UserRepository) (int64, error) {
+		return repo.CountUsersWhere(spec)
+	})
+}
+
+func (r *PolicyUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	policy, opts := r.policy("FindUsersByNamePrefix", opts)
+	return hedged(r, policy, "FindUsersByNamePrefix", func(repo UserRepository) ([]*User, error) {
+		return repo.FindUsersByNamePrefix(prefix, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	policy, opts := r.policy("SuggestUsers", opts)
+	return hedged(r, policy, "SuggestUsers", func(repo UserRepository) ([]*User, error) {
+		return repo.SuggestUsers(q, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	policy, opts := r.policy("FindUsersByMetadata", opts)
+	return hedged(r, policy, "FindUsersByMetadata", func(repo UserRepository) ([]*User, error) {
+		return repo.FindUsersByMetadata(key, value, opts...)
+	})
+}
+
+func (r *PolicyUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	policy, _ := r.policy("FindUserHistory", nil)
+	return hedged(r, policy, "FindUserHistory", func(repo UserRepository) ([]UserVersion, error) {
+		return repo.FindUserHistory(id)
+	})
+}
+
+func (r *PolicyUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	policy, _ := r.policy("FindUserAsOf", nil)
+	return hedged(r, policy, "FindUserAsOf", func(repo UserRepository) (*User, error) {
+		return repo.FindUserAsOf(id, at)
+	})
+}
+
+// Unwrap returns the wrapped repository.
+func (r *PolicyUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// policy returns the policy for op, and opts with its timeout added ahead
+// of them, so a Timeout the caller gave still wins.
+func (r *PolicyUserRepository) policy(op string, opts []FindOption) (OperationPolicy, []FindOption) {
+	r.mu.RLock()
+	policy := r.policies.For(op)
+	r.mu.RUnlock()
+
+	if policy.Timeout > 0 {
+		opts = append([]FindOption{Timeout(policy.Timeout)}, opts...)
+	}
+	return policy, opts
+}
+
+// attempt is the outcome of one try at a read.
+type attempt[T any] struct {
+	value  T
+	err    error
+	hedged bool
+}
+
+// hedged runs find against r's wrapped repository under policy, hedging
+// against its replica; see PolicyUserRepository.
+func hedged[T any](r *PolicyUserRepository, policy OperationPolicy, op string, find func(UserRepository) (T, error)) (T, error) {
+	if policy.Timeout <= 0 && policy.HedgeAfter <= 0 {
+		return find(r.UserRepository)
+	}
+
+	// Buffered, so attempts that lose the race don't block forever
+	results := make(chan attempt[T], 2)
+	start := func(repo UserRepository, hedged bool) {
+		go func() {
+			value, err := find(repo)
+			results <- attempt[T]{value, err, hedged}
+		}()
+	}
+
+	var hedge, timeout <-chan time.Time
+	if policy.HedgeAfter > 0 {
+		timer := time.NewTimer(policy.HedgeAfter)
+		defer timer.Stop()
+		hedge = timer.C
+	}
+	if policy.Timeout > 0 {
+		timer := time.NewTimer(policy.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	start(r.UserRepository, false)
+	running := 1
+	var firstErr error
+	var zero T
+	for {
+		select {
+		case <-hedge:
+			hedge = nil
+			replica := r.Replica
+			if replica == nil {
+				replica = r.UserRepository
+			}
+			start(replica, true)
+			running++
+		case result := <-results:
+			running--
+			if result.err == nil || (!result.hedged && errors.Is(result.err, ErrUserNotFound)) {
+				return result.value, result.err
+			}
+			// Report the first attempt's error over the replica's
+			if firstErr == nil || !result.hedged {
+				firstErr = result.err
+			}
+			if running == 0 {
+				return zero, firstErr
+			}
+		case <-timeout:
+			return zero, fmt.Errorf("%w: %s took longer than %v", ErrQueryTimeout, op, policy.Timeout)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowRepository answers FindUserByID after delay, or with err.
+type slowRepository struct {
+	UserRepository
+	delay   time.Duration
+	err     error
+	timeout chan time.Duration
+}
+
+func (r *slowRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	if r.timeout != nil {
+		r.timeout <- resolve(opts).timeout
+	}
+	time.Sleep(r.delay)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &User{ID: id, Name: "John Doe"}, nil
+}
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("FindUserByID:timeout=200ms:hedge=20ms, *:timeout=2s")
+	assert.NoError(t, err)
+	assert.Equal(t, Policies{
+		"FindUserByID": {Timeout: 200 * time.Millisecond, HedgeAfter: 20 * time.Millisecond},
+		"*":            {Timeout: 2 * time.Second},
+	}, policies)
+
+	policies, err = ParsePolicies("")
+	assert.NoError(t, err)
+	assert.Empty(t, policies)
+
+	for _, s := range []string{
+		"SaveUser:timeout=1s",
+		"FindUserByID:timeout=fast",
+		"FindUserByID:timeout=-1s",
+		"FindUserByID:retries=2",
+		"FindUserByID:timeout",
+		"FindUserByID:timeout=1s:hedge=1s",
+		"FindUserByID:timeout=1s,FindUserByID:hedge=5ms",
+	} {
+		_, err := ParsePolicies(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestPoliciesFor(t *testing.T) {
+	policies := Policies{
+		"FindUserByID": {HedgeAfter: 20 * time.Millisecond},
+		"*":            {Timeout: time.Second},
+	}
+	assert.Equal(t, OperationPolicy{Timeout: time.Second, HedgeAfter: 20 * time.Millisecond}, policies.For("FindUserByID"))
+	assert.Equal(t, OperationPolicy{Timeout: time.Second}, policies.For("SuggestUsers"))
+	assert.Equal(t, OperationPolicy{}, Policies(nil).For("FindUserByID"))
+}
+
+func TestPolicyUserRepositoryHedges(t *testing.T) {
+	hedge := Policies{"FindUserByID": {HedgeAfter: 10 * time.Millisecond}}
+
+	// The replica answers while the primary is still going
+	repo := NewPolicyUserRepository(&slowRepository{delay: time.Second}, &slowRepository{}, hedge)
+	start := time.Now()
+	user, err := repo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// A primary that fails after the hedge leaves the replica to answer
+	primary := &slowRepository{delay: 20 * time.Millisecond, err: ErrUnavailable}
+	repo = NewPolicyUserRepository(primary, &slowRepository{delay: 50 * time.Millisecond}, hedge)
+	_, err = repo.FindUserByID(1)
+	assert.NoError(t, err)
+
+	// Both failing report the primary's error
+	repo = NewPolicyUserRepository(primary, &slowRepository{err: errors.New("replica down")}, hedge)
+	_, err = repo.FindUserByID(1)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	// But the primary not finding a user is an answer, even after the hedge
+	primary = &slowRepository{delay: 20 * time.Millisecond, err: ErrUserNotFound}
+	repo = NewPolicyUserRepository(primary, &slowRepository{delay: 50 * time.Millisecond}, hedge)
+	_, err = repo.FindUserByID(1)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestPolicyUserRepositoryTimeout(t *testing.T) {
+	timeout := Policies{"*": {Timeout: 10 * time.Millisecond}}
+
+	primary := &slowRepository{delay: time.Second, timeout: make(chan time.Duration, 1)}
+	repo := NewPolicyUserRepository(primary, nil, timeout)
+	_, err := repo.FindUserByID(1)
+	assert.ErrorIs(t, err, ErrQueryTimeout)
+	// The timeout is passed on, for the database to give up too
+	assert.Equal(t, 10*time.Millisecond, <-primary.timeout)
+
+	// A Timeout the caller gives wins
+	primary = &slowRepository{timeout: make(chan time.Duration, 1)}
+	repo = NewPolicyUserRepository(primary, nil, timeout)
+	_, err = repo.FindUserByID(1, Timeout(time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, <-primary.timeout)
+
+	// And without policies reads go straight through
+	repo.SetPolicies(nil)
+	_, err = repo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), <-primary.timeout)
+}
@@ -1,46 +1,1107 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// bulkInsertBatchSize caps how many rows SaveUsers sends per statement.
+const bulkInsertBatchSize = 5000
+
+// historyPageSize is how many rows EachUserVersion and RewriteUsers read at
+// a time.
+const historyPageSize = 1000
+
+// ErrQueryTimeout is returned when a statement runs past its timeout.
+var ErrQueryTimeout = errors.New("query timed out")
+
+// queryCanceled is the Postgres error code for a statement cancelled by
+// statement_timeout.
+const queryCanceled = "57014"
+
 type PostgresUserRepository struct {
     DB *sql.DB
+    // Tx runs the repository's multi-statement writes, retrying them on
+    // serialization failures and deadlocks.
+    Tx *TxManager
+    // StatementTimeout, when greater than zero, bounds every statement the
+    // repository runs, so one pathological query can't hold a connection
+    // indefinitely. Finds can override it with the Timeout option.
+    StatementTimeout time.Duration
+    // SessionStatementTimeout is the statement_timeout every connection in
+    // DB already has, set through the DSN. Statements under that timeout
+    // run as they are; only other timeouts are set per transaction.
+    SessionStatementTimeout time.Duration
+    // Emails normalizes addresses into the normalized_email column, which
+    // FindUserByEmail looks them up by.
+    Emails EmailNormalizer
+    // Hooks are told about every statement the repository runs; see
+    // QueryHook. Set them before the repository is used.
+    Hooks []QueryHook
 }
 
+var (
+    _ UserRepository  = (*PostgresUserRepository)(nil)
+    _ HistoryArchiver = (*PostgresUserRepository)(nil)
+    _ SchemaVersioner = (*PostgresUserRepository)(nil)
+    _ Rewriter        = (*PostgresUserRepository)(nil)
+)
+
 func NewPostgresUserRepository(db *sql.DB) *PostgresUserRepository {
-    return &PostgresUserRepository{DB: db}
+    return &PostgresUserRepository{DB: db, Tx: NewTxManager(db, sql.LevelDefault)}
 }
 
-func (r *PostgresUserRepository) FindUserByID(id int) (*User, error) {
-    var user User
-    query := "SELECT id, name, email FROM users WHERE id = $1"
-    row := r.DB.QueryRow(query, id)
+func (r *PostgresUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    query := "SELECT " + fields.columns() + " FROM users WHERE id = $1"
+
+    var user *User
+    err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+        user, err = fields.scan(q.QueryRowContext(ctx, query, id))
+        return err
+    })
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    return user, err
+}
+
+func (r *PostgresUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    query := "SELECT " + fields.columns() + " FROM users WHERE normalized_email = $1 ORDER BY id LIMIT 1"
+
+    var user *User
+    err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+        user, err = fields.scan(q.QueryRowContext(ctx, query, r.Emails.Normalize(email)))
+        return err
+    })
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    return user, err
+}
+
+func (r *PostgresUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    query := "SELECT " + fields.columns() + " FROM users WHERE phone = $1 ORDER BY id LIMIT 1"
+
+    var user *User
+    err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+        user, err = fields.scan(q.QueryRowContext(ctx, query, phone))
+        return err
+    })
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    return user, err
+}
+
+func (r *PostgresUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    users := make(map[int]*User, len(ids))
+    if len(ids) == 0 {
+        return users, nil
+    }
+
+    query := "SELECT " + fields.columns() + " FROM users WHERE id = ANY($1)"
+
+    err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+        rows, err := q.QueryContext(ctx, query, pq.Array(ids))
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+            user, err := fields.scan(rows)
+            if err != nil {
+                return err
+            }
+            users[user.ID] = user
+        }
+        return rows.Err()
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return users, nil
+}
 
-    err := row.Scan(&user.ID, &user.Name, &user.Email)
+func (r *PostgresUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+    fields, err := projectionOf(opts)
     if err != nil {
-        if errors.Is(err, sql.ErrNoRows) {
-            return nil, errors.New("user not found")
+        return nil, err
+    }
+    args := []any{afterID, limit}
+    query := "SELECT " + fields.columns() + " FROM users WHERE id > $1 AND (" + spec.SQL(&args) + ") ORDER BY id LIMIT $2"
+    if resolve(opts).backward {
+        query = "SELECT " + fields.columns() + " FROM users WHERE ($1 = 0 OR id < $1) AND (" + spec.SQL(&args) + ") ORDER BY id DESC LIMIT $2"
+    }
+
+    var users []*User
+    err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+        rows, err := q.QueryContext(ctx, query, args...)
+        if err != nil {
+            return err
         }
+        defer rows.Close()
+
+        for rows.Next() {
+            user, err := fields.scan(rows)
+            if err != nil {
+                return err
+            }
+            users = append(users, user)
+        }
+        return rows.Err()
+    })
+    if err != nil {
         return nil, err
     }
 
-    return &user, nil
+    return users, nil
+}
+
+func (r *PostgresUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+    var args []any
+    query := "SELECT count(*) FROM users WHERE " + spec.SQL(&args)
+
+    var count int64
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        return q.QueryRowContext(ctx, query, args...).Scan(&count)
+    })
+    return count, err
+}
+
+// FindUsersByNamePrefix uses the trigram index on lower(name), which serves
+// LIKE as well as similarity.
+func (r *PostgresUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    query := "SELECT " + fields.columns() + " FROM users WHERE lower(name) LIKE $1 ORDER BY lower(name), id LIMIT $2"
+    return r.search(fields, opts, query, likePrefix(prefix), searchLimit(opts))
+}
+
+// SuggestUsers matches with pg_trgm's % operator, which keeps names whose
+// similarity to q is above pg_trgm.similarity_threshold (0.3 by default).
+func (r *PostgresUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    query := "SELECT " + fields.columns() + " FROM users WHERE lower(name) % $1 ORDER BY similarity(lower(name), $1) DESC, id LIMIT $2"
+    return r.search(fields, opts, query, strings.ToLower(strings.TrimSpace(q)), searchLimit(opts))
+}
+
+// search runs a query returning a list of users.
+func (r *PostgresUserRepository) search(fields projection, opts []FindOption, query string, args ...any) ([]*User, error) {
+    var users []*User
+    err := r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+        rows, err := q.QueryContext(ctx, query, args...)
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+            user, err := fields.scan(rows)
+            if err != nil {
+                return err
+            }
+            users = append(users, user)
+        }
+        return rows.Err()
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return users, nil
+}
+
+func (r *PostgresUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+    fields, err := projectionOf(opts)
+    if err != nil {
+        return nil, err
+    }
+    spec, err := metadataSpec(key, value)
+    if err != nil {
+        return nil, err
+    }
+    args := []any{metadataLimit(opts)}
+    query := "SELECT " + fields.columns() + " FROM users WHERE " + spec.SQL(&args) + " ORDER BY id LIMIT $1"
+    return r.search(fields, opts, query, args...)
+}
+
+// FindUserHistory reads users_history, which triggers keep up to date.
+func (r *PostgresUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+    query := `
+    SELECT user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation
+    FROM users_history WHERE user_id = $1 ORDER BY changed_at, history_id`
+
+    versions := []UserVersion{}
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        rows, err := q.QueryContext(ctx, query, id)
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+
+        for rows.Next() {
+            var v UserVersion
+            if err := rows.Scan(&v.ID, &v.Name, &v.Email, &v.CreatedAt, &v.VerifiedAt, &v.Phone, &v.Metadata, &v.LastLoginAt, &v.LoginCount, &v.Status, &v.ChangedAt, &v.Operation); err != nil {
+                return err
+            }
+            v.NormalizedEmail = r.Emails.Normalize(v.Email)
+            versions = append(versions, v)
+        }
+        return rows.Err()
+    })
+    if err != nil || len(versions) > 0 {
+        return versions, err
+    }
+
+    // No history is fine as long as the user exists
+    if _, err := r.FindUserByID(id, Fields("id")); err != nil {
+        return nil, err
+    }
+    return versions, nil
+}
+
+// FindUserAsOf picks the first version still valid at the given time: the
+// earliest history row changed after it, or failing that the current row.
+func (r *PostgresUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+    query := `
+    SELECT id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status FROM (
+        SELECT user_id AS id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, history_id
+        FROM users_history WHERE user_id = $1 AND changed_at > $2
+        UNION ALL
+        SELECT id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, 'infinity', 0
+        FROM users WHERE id = $1
+    ) AS versions
+    ORDER BY changed_at, history_id LIMIT 1`
+
+    var user User
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        return q.QueryRowContext(ctx, query, id, at).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.VerifiedAt, &user.Phone, &user.Metadata, &user.LastLoginAt, &user.LoginCount, &user.Status)
+    })
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    user.NormalizedEmail = r.Emails.Normalize(user.Email)
+    return existedAt(&user, at)
 }
 
 func (r *PostgresUserRepository) SaveUser(user *User) error {
     query := `
-    INSERT INTO users (name, email) 
-    VALUES ($1, $2) 
-    RETURNING id`
-    
-    err := r.DB.QueryRow(query, user.Name, user.Email).Scan(&user.ID)
+    INSERT INTO users (name, email, created_at, verified_at, normalized_email, phone, metadata, last_login_at, login_count, status)
+    VALUES ($1, $2, COALESCE($3, now()), $4, $5, $6, $7, $8, $9, $10)
+    RETURNING id, created_at`
+
+    normalized := r.Emails.Normalize(user.Email)
+    status := user.Status.orDefault()
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        row := q.QueryRowContext(ctx, query, user.Name, user.Email, nullTime(user.CreatedAt), user.VerifiedAt, normalized, user.Phone, user.Metadata, user.LastLoginAt, user.LoginCount, status)
+        return row.Scan(&user.ID, &user.CreatedAt)
+    })
+    if err != nil {
+        return err
+    }
+    user.NormalizedEmail, user.Status = normalized, status
+    return nil
+}
+
+// SaveUsers inserts many users in a single transaction, sending them in
+// batches of unnested arrays rather than one statement per row. The
+// generated IDs are written back to the users they belong to once the
+// transaction commits.
+//
+// StatementTimeout applies to each batch rather than the whole insert.
+func (r *PostgresUserRepository) SaveUsers(users []*User) error {
+    ids := make([]int, len(users))
+    createdAts := make([]time.Time, len(users))
+
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        return insertUsers(ctx, withHooks(tx, r.Hooks), r.Emails, users, false, ids, createdAts)
+    })
+    if err != nil {
+        return dbError(err)
+    }
+
+    for i, user := range users {
+        user.ID, user.CreatedAt = ids[i], createdAts[i]
+        user.NormalizedEmail = r.Emails.Normalize(user.Email)
+        user.Status = user.Status.orDefault()
+    }
+    return nil
+}
+
+// InsertUsers inserts the users with their own IDs in one transaction,
+// as SaveUsers does, then advances the ID sequence past the highest of
+// them. The sequence is only ever moved forward, so the IDs of deleted
+// users are never handed out again.
+func (r *PostgresUserRepository) InsertUsers(users []*User) error {
+    taken := "SELECT id FROM users WHERE id = ANY($1) LIMIT 1"
+    advance := "SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST(nextval(pg_get_serial_sequence('users', 'id')), $1))"
+
+    ids := make([]int, len(users))
+    createdAts := make([]time.Time, len(users))
+    highest := 0
+    for i, user := range users {
+        ids[i] = user.ID
+        highest = max(highest, user.ID)
+    }
+
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        q := withHooks(tx, r.Hooks)
+        var id int
+        err := q.QueryRowContext(ctx, taken, pq.Array(ids)).Scan(&id)
+        if err == nil {
+            return fmt.Errorf("%w: user %d", ErrUserExists, id)
+        }
+        if !errors.Is(err, sql.ErrNoRows) {
+            return err
+        }
+        if err := insertUsers(ctx, q, r.Emails, users, true, ids, createdAts); err != nil {
+            return err
+        }
+        _, err = q.ExecContext(ctx, advance, highest)
+        return err
+    })
+    if errors.Is(err, ErrUserExists) {
+        return err
+    }
+    if err != nil {
+        return dbError(err)
+    }
+
+    for i, user := range users {
+        user.CreatedAt = createdAts[i]
+        user.NormalizedEmail = r.Emails.Normalize(user.Email)
+        user.Status = user.Status.orDefault()
+    }
+    return nil
+}
+
+// insertUsers inserts users, storing their IDs and creation times in ids
+// and createdAts. With keepIDs, each user is inserted under their own ID;
+// otherwise one is drawn from the sequence. It leaves users untouched, so
+// it can be run again if the transaction is retried.
+//
+// Postgres doesn't promise RETURNING rows in the order they were given,
+// and RETURNING can't see the input's ordinality, so each row's ID is
+// settled alongside its ordinal first, and the returned rows are matched
+// back to their users by it.
+func insertUsers(ctx context.Context, q querier, normalizer EmailNormalizer, users []*User, keepIDs bool, ids []int, createdAts []time.Time) error {
+    query := `
+    WITH input AS MATERIALIZED (
+        SELECT COALESCE(u.given_id, nextval(pg_get_serial_sequence('users', 'id'))) AS id, u.*
+        FROM unnest($1::text[], $2::text[], $3::timestamptz[], $4::timestamptz[], $5::text[], $6::text[], $7::jsonb[], $8::timestamptz[], $9::integer[], $10::text[], $11::integer[])
+            WITH ORDINALITY AS u (name, email, created_at, verified_at, normalized_email, phone, metadata, last_login_at, login_count, status, given_id, ord)
+    ), inserted AS (
+        INSERT INTO users (id, name, email, created_at, verified_at, normalized_email, phone, metadata, last_login_at, login_count, status)
+        SELECT id, name, email, COALESCE(created_at, now()), verified_at, normalized_email, phone, metadata, last_login_at, login_count, status
+        FROM input
+        RETURNING id, created_at
+    )
+    SELECT input.ord, inserted.id, inserted.created_at FROM inserted JOIN input USING (id)`
+
+    for start := 0; start < len(users); start += bulkInsertBatchSize {
+        batch := users[start:min(start+bulkInsertBatchSize, len(users))]
+
+        names := make([]string, len(batch))
+        emails := make([]string, len(batch))
+        created := make([]sql.NullTime, len(batch))
+        verified := make([]sql.NullTime, len(batch))
+        normalized := make([]string, len(batch))
+        phones := make([]sql.NullString, len(batch))
+        metadata := make([]string, len(batch))
+        lastLogins := make([]sql.NullTime, len(batch))
+        loginCounts := make([]int64, len(batch))
+        statuses := make([]string, len(batch))
+        givenIDs := make([]sql.NullInt64, len(batch))
+        for i, user := range batch {
+            names[i] = user.Name
+            emails[i] = user.Email
+            normalized[i] = normalizer.Normalize(user.Email)
+            if user.Phone != nil {
+                phones[i] = sql.NullString{String: *user.Phone, Valid: true}
+            }
+            encoded, err := user.Metadata.Value()
+            if err != nil {
+                return err
+            }
+            metadata[i] = string(encoded.([]byte))
+            created[i] = nullTime(user.CreatedAt)
+            if user.VerifiedAt != nil {
+                verified[i] = nullTime(*user.VerifiedAt)
+            }
+            if user.LastLoginAt != nil {
+                lastLogins[i] = nullTime(*user.LastLoginAt)
+            }
+            loginCounts[i] = int64(user.LoginCount)
+            statuses[i] = string(user.Status.orDefault())
+            givenIDs[i] = sql.NullInt64{Int64: int64(user.ID), Valid: keepIDs}
+        }
+
+        rows, err := q.QueryContext(ctx, query, pq.Array(names), pq.Array(emails), pq.Array(created), pq.Array(verified), pq.Array(normalized), pq.Array(phones), pq.Array(metadata), pq.Array(lastLogins), pq.Array(loginCounts), pq.Array(statuses), pq.Array(givenIDs))
+        if err != nil {
+            return err
+        }
+        returned := 0
+        for rows.Next() {
+            var ord, id int
+            var createdAt time.Time
+            if err := rows.Scan(&ord, &id, &createdAt); err != nil {
+                rows.Close()
+                return err
+            }
+            if ord < 1 || ord > len(batch) {
+                rows.Close()
+                return fmt.Errorf("repository: insert returned ordinal %d for a batch of %d", ord, len(batch))
+            }
+            ids[start+ord-1], createdAts[start+ord-1] = id, createdAt
+            returned++
+        }
+        if err := rows.Err(); err != nil {
+            return err
+        }
+        if returned != len(batch) {
+            return fmt.Errorf("repository: insert returned %d rows for a batch of %d", returned, len(batch))
+        }
+    }
+
+    return nil
+}
+
+func (r *PostgresUserRepository) UpdateUser(user *User) error {
+    query := "UPDATE users SET name = $2, email = $3, verified_at = $4, normalized_email = $5, phone = $6, metadata = $7 WHERE id = $1"
+
+    normalized := r.Emails.Normalize(user.Email)
+    err := r.exec(func(ctx context.Context, q querier) (sql.Result, error) {
+        return q.ExecContext(ctx, query, user.ID, user.Name, user.Email, user.VerifiedAt, normalized, user.Phone, user.Metadata)
+    })
+    if err != nil {
+        return err
+    }
+    user.NormalizedEmail = normalized
+    return nil
+}
+
+// UpdateUsers updates users a batch at a time with UPDATE ... FROM unnest,
+// all in one transaction, rolling back if a batch matches fewer rows than
+// it has users.
+func (r *PostgresUserRepository) UpdateUsers(users []*User) error {
+    query := `
+    UPDATE users SET name = u.name, email = u.email, verified_at = u.verified_at, normalized_email = u.normalized_email, phone = u.phone, metadata = u.metadata
+    FROM unnest($1::integer[], $2::text[], $3::text[], $4::timestamptz[], $5::text[], $6::text[], $7::jsonb[])
+        AS u (id, name, email, verified_at, normalized_email, phone, metadata)
+    WHERE users.id = u.id`
+
+    if len(users) == 0 {
+        return nil
+    }
+    normalized := make([]string, len(users))
+    for i, user := range users {
+        normalized[i] = r.Emails.Normalize(user.Email)
+    }
+
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        q := withHooks(tx, r.Hooks)
+        for start := 0; start < len(users); start += bulkInsertBatchSize {
+            batch := users[start:min(start+bulkInsertBatchSize, len(users))]
+
+            ids := make([]int64, len(batch))
+            names := make([]string, len(batch))
+            emails := make([]string, len(batch))
+            verified := make([]sql.NullTime, len(batch))
+            phones := make([]sql.NullString, len(batch))
+            metadata := make([]string, len(batch))
+            for i, user := range batch {
+                ids[i], names[i], emails[i] = int64(user.ID), user.Name, user.Email
+                if user.VerifiedAt != nil {
+                    verified[i] = sql.NullTime{Time: *user.VerifiedAt, Valid: true}
+                }
+                phones[i] = nullString(user.Phone)
+                encoded, err := user.Metadata.Value()
+                if err != nil {
+                    return err
+                }
+                metadata[i] = string(encoded.([]byte))
+            }
+
+            result, err := q.ExecContext(ctx, query, pq.Array(ids), pq.Array(names), pq.Array(emails), pq.Array(verified), pq.Array(normalized[start:start+len(batch)]), pq.Array(phones), pq.Array(metadata))
+            if err != nil {
+                return err
+            }
+            n, err := result.RowsAffected()
+            if err != nil {
+                return err
+            }
+            if n != int64(len(batch)) {
+                return fmt.Errorf("%w: %d of a batch of %d", ErrUserNotFound, int64(len(batch))-n, len(batch))
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        return dbError(err)
+    }
+    for i, user := range users {
+        user.NormalizedEmail = normalized[i]
+    }
+    return nil
+}
+
+// RecordLogin updates both fields in one statement, so concurrent logins
+// can't overwrite each other's count. The history trigger ignores changes
+// to them alone.
+func (r *PostgresUserRepository) RecordLogin(id int) error {
+    query := "UPDATE users SET last_login_at = now(), login_count = login_count + 1 WHERE id = $1"
+    return r.exec(func(ctx context.Context, q querier) (sql.Result, error) {
+        return q.ExecContext(ctx, query, id)
+    })
+}
+
+// SetUserStatus only updates the row while it still has the from status.
+// When it doesn't, a second lookup tells a missing user from a changed one.
+func (r *PostgresUserRepository) SetUserStatus(id int, from, to Status) error {
+    if _, err := ParseStatus(string(to)); err != nil {
+        return err
+    }
+    query := "UPDATE users SET status = $3 WHERE id = $1 AND status = $2"
+    err := r.exec(func(ctx context.Context, q querier) (sql.Result, error) {
+        return q.ExecContext(ctx, query, id, from, to)
+    })
+    if !errors.Is(err, ErrUserNotFound) {
+        return err
+    }
+    user, err := r.FindUserByID(id, Fields("status"))
+    if err != nil {
+        return err
+    }
+    return fmt.Errorf("%w: user %d is %s, not %s", ErrStatusChanged, id, user.Status, from)
+}
+
+// AnonymizeUser scrubs the user and their history in one transaction, so
+// the history never holds personal data the user no longer does.
+func (r *PostgresUserRepository) AnonymizeUser(id int) error {
+    tombstone := &User{ID: id}
+    tombstone.Anonymize()
+
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        q := withHooks(tx, r.Hooks)
+        result, err := q.ExecContext(ctx, "UPDATE users SET name = $2, email = $3, normalized_email = $4, phone = NULL, metadata = '{}' WHERE id = $1", id, tombstone.Name, tombstone.Email, tombstone.NormalizedEmail)
+        if err != nil {
+            return err
+        }
+        if err := expectOneRow(result); err != nil {
+            return err
+        }
+        _, err = q.ExecContext(ctx, "UPDATE users_history SET name = $2, email = $3, phone = NULL, metadata = '{}' WHERE user_id = $1", id, tombstone.Name, tombstone.Email)
+        return err
+    })
+    return dbError(err)
+}
+
+func (r *PostgresUserRepository) DeleteUser(id int) error {
+    return r.exec(func(ctx context.Context, q querier) (sql.Result, error) {
+        return q.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
+    })
+}
+
+// RestoreUser re-inserts the version of the user kept in users_history by
+// their most recent delete. History doesn't keep normalized emails, so the
+// restored one is normalized afresh.
+func (r *PostgresUserRepository) RestoreUser(id int) (*User, error) {
+    query := `
+    SELECT user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status FROM users_history
+    WHERE user_id = $1 AND operation = 'delete'
+    ORDER BY changed_at DESC, history_id DESC LIMIT 1`
+    insert := `
+    INSERT INTO users (id, name, email, created_at, verified_at, normalized_email, phone, metadata, last_login_at, login_count, status)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+    var user User
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        q := withHooks(tx, r.Hooks)
+        var exists bool
+        if err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil {
+            return err
+        }
+        if exists {
+            return ErrUserExists
+        }
+        if err := q.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt, &user.VerifiedAt, &user.Phone, &user.Metadata, &user.LastLoginAt, &user.LoginCount, &user.Status); err != nil {
+            return err
+        }
+        user.NormalizedEmail = r.Emails.Normalize(user.Email)
+        _, err := q.ExecContext(ctx, insert, user.ID, user.Name, user.Email, user.CreatedAt, user.VerifiedAt, user.NormalizedEmail, user.Phone, user.Metadata, user.LastLoginAt, user.LoginCount, user.Status)
+        return err
+    })
+    if errors.Is(err, sql.ErrNoRows) {
+        return nil, ErrUserNotFound
+    }
     if err != nil {
+        return nil, dbError(err)
+    }
+    return &user, nil
+}
+
+// PurgeUser deletes the user and then their history, which includes the
+// version the delete itself just recorded.
+func (r *PostgresUserRepository) PurgeUser(id int) error {
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        q := withHooks(tx, r.Hooks)
+        var purged int64
+        for _, query := range []string{
+            "DELETE FROM users WHERE id = $1",
+            "DELETE FROM users_history WHERE user_id = $1",
+        } {
+            result, err := q.ExecContext(ctx, query, id)
+            if err != nil {
+                return err
+            }
+            n, err := result.RowsAffected()
+            if err != nil {
+                return err
+            }
+            purged += n
+        }
+        if purged == 0 {
+            return ErrUserNotFound
+        }
+        return nil
+    })
+    return dbError(err)
+}
+
+func (r *PostgresUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+    if IsEmpty(spec) {
+        return 0, ErrEmptySpecification
+    }
+    var args []any
+    query := "DELETE FROM users WHERE " + spec.SQL(&args)
+
+    var n int64
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        result, err := q.ExecContext(ctx, query, args...)
+        if err != nil {
+            return err
+        }
+        n, err = result.RowsAffected()
         return err
+    })
+    return n, err
+}
+
+// DeleteUsersWhereReturningIDs deletes the matching users with DELETE ...
+// RETURNING, so the IDs are those of the rows this statement removed.
+func (r *PostgresUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+    if IsEmpty(spec) {
+        return nil, ErrEmptySpecification
+    }
+    var args []any
+    query := "DELETE FROM users WHERE " + spec.SQL(&args) + " RETURNING id"
+
+    var ids []int
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        ids = nil
+        rows, err := q.QueryContext(ctx, query, args...)
+        if err != nil {
+            return err
+        }
+        defer rows.Close()
+        for rows.Next() {
+            var id int
+            if err := rows.Scan(&id); err != nil {
+                return err
+            }
+            ids = append(ids, id)
+        }
+        return rows.Err()
+    })
+    return ids, err
+}
+
+// EachUserVersion reads users_history a page at a time in the order it was
+// written, which is each user's oldest first, so the whole table is never
+// held at once. Each page is read under StatementTimeout.
+func (r *PostgresUserRepository) EachUserVersion(fn func(UserVersion) error) error {
+    query := `
+    SELECT history_id, user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation
+    FROM users_history WHERE history_id > $1 ORDER BY history_id LIMIT $2`
+
+    var after int64
+    for {
+        var versions []UserVersion
+        err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+            versions = nil
+            rows, err := q.QueryContext(ctx, query, after, historyPageSize)
+            if err != nil {
+                return err
+            }
+            defer rows.Close()
+            for rows.Next() {
+                var v UserVersion
+                if err := rows.Scan(&after, &v.ID, &v.Name, &v.Email, &v.CreatedAt, &v.VerifiedAt, &v.Phone, &v.Metadata, &v.LastLoginAt, &v.LoginCount, &v.Status, &v.ChangedAt, &v.Operation); err != nil {
+                    return err
+                }
+                v.NormalizedEmail = r.Emails.Normalize(v.Email)
+                versions = append(versions, v)
+            }
+            return rows.Err()
+        })
+        if err != nil {
+            return err
+        }
+        for _, version := range versions {
+            if err := fn(version); err != nil {
+                return err
+            }
+        }
+        if len(versions) < historyPageSize {
+            return nil
+        }
+    }
+}
+
+// InsertUserVersions inserts the versions into users_history in one
+// transaction, then advances the ID sequence past their users as
+// InsertUsers does.
+func (r *PostgresUserRepository) InsertUserVersions(versions []UserVersion) error {
+    query := `
+    INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation)
+    SELECT * FROM unnest($1::integer[], $2::text[], $3::text[], $4::timestamptz[], $5::timestamptz[], $6::text[], $7::jsonb[], $8::timestamptz[], $9::integer[], $10::text[], $11::timestamptz[], $12::text[])`
+    advance := "SELECT setval(pg_get_serial_sequence('users', 'id'), GREATEST(nextval(pg_get_serial_sequence('users', 'id')), $1))"
+
+    if len(versions) == 0 {
+        return nil
+    }
+    ctx := context.Background()
+    err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+        if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+            return err
+        }
+        q := withHooks(tx, r.Hooks)
+        highest := 0
+        for start := 0; start < len(versions); start += bulkInsertBatchSize {
+            batch := versions[start:min(start+bulkInsertBatchSize, len(versions))]
+
+            ids := make([]int64, len(batch))
+            names := make([]string, len(batch))
+            emails := make([]string, len(batch))
+            created := make([]time.Time, len(batch))
+            verified := make([]sql.NullTime, len(batch))
+            phones := make([]sql.NullString, len(batch))
+            metadata := make([]string, len(batch))
+            lastLogins := make([]sql.NullTime, len(batch))
+            loginCounts := make([]int64, len(batch))
+            statuses := make([]string, len(batch))
+            changed := make([]time.Time, len(batch))
+            operations := make([]string, len(batch))
+            for i, v := range batch {
+                ids[i], names[i], emails[i], created[i] = int64(v.ID), v.Name, v.Email, v.CreatedAt
+                if v.VerifiedAt != nil {
+                    verified[i] = nullTime(*v.VerifiedAt)
+                }
+                if v.Phone != nil {
+                    phones[i] = sql.NullString{String: *v.Phone, Valid: true}
+                }
+                encoded, err := v.Metadata.Value()
+                if err != nil {
+                    return err
+                }
+                metadata[i] = string(encoded.([]byte))
+                if v.LastLoginAt != nil {
+                    lastLogins[i] = nullTime(*v.LastLoginAt)
+                }
+                loginCounts[i] = int64(v.LoginCount)
+                statuses[i] = string(v.Status.orDefault())
+                changed[i], operations[i] = v.ChangedAt, v.Operation
+                highest = max(highest, v.ID)
+            }
+
+            if _, err := q.ExecContext(ctx, query, pq.Array(ids), pq.Array(names), pq.Array(emails), pq.Array(created), pq.Array(verified), pq.Array(phones), pq.Array(metadata), pq.Array(lastLogins), pq.Array(loginCounts), pq.Array(statuses), pq.Array(changed), pq.Array(operations)); err != nil {
+                return err
+            }
+        }
+        _, err := q.ExecContext(ctx, advance, highest)
+        return err
+    })
+    if err != nil {
+        return dbError(err)
     }
-    
     return nil
-}
\ No newline at end of file
+}
+
+// RewriteUsers pages through users and then users_history, and writes
+// each page's rewrites back in one transaction. The transaction sets
+// users.rewriting, which stops the history trigger recording them. Each
+// row is only rewritten if its email and phone are still what fn was
+// given.
+func (r *PostgresUserRepository) RewriteUsers(fn func(*User) (bool, error)) (int, error) {
+    users, err := r.rewrite(fn,
+        "SELECT id, id, email, phone FROM users WHERE id > $1 ORDER BY id LIMIT $2",
+        `UPDATE users SET email = u.email, normalized_email = u.normalized_email, phone = u.phone
+        FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[]) AS u (key, old_email, old_phone, email, normalized_email, phone)
+        WHERE users.id = u.key AND users.email = u.old_email AND users.phone IS NOT DISTINCT FROM u.old_phone`)
+    if err != nil {
+        return users, err
+    }
+    versions, err := r.rewrite(fn,
+        "SELECT history_id, user_id, email, phone FROM users_history WHERE history_id > $1 ORDER BY history_id LIMIT $2",
+        `UPDATE users_history SET email = u.email, phone = u.phone
+        FROM unnest($1::bigint[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[]) AS u (key, old_email, old_phone, email, normalized_email, phone)
+        WHERE users_history.history_id = u.key AND users_history.email = u.old_email AND users_history.phone IS NOT DISTINCT FROM u.old_phone`)
+    return users + versions, err
+}
+
+// rewrite implements RewriteUsers for one table. read selects a page of
+// rows as key, user ID, email and phone, after the key in $1; write
+// updates them from arrays of keys, old emails and phones, and new emails,
+// normalized emails and phones.
+func (r *PostgresUserRepository) rewrite(fn func(*User) (bool, error), read, write string) (int, error) {
+    rewritten := 0
+    var after int64
+    for {
+        var keys []int64
+        var users []*User
+        err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+            keys, users = nil, nil
+            rows, err := q.QueryContext(ctx, read, after, historyPageSize)
+            if err != nil {
+                return err
+            }
+            defer rows.Close()
+            for rows.Next() {
+                var key int64
+                user := &User{}
+                if err := rows.Scan(&key, &user.ID, &user.Email, &user.Phone); err != nil {
+                    return err
+                }
+                keys, users = append(keys, key), append(users, user)
+            }
+            return rows.Err()
+        })
+        if err != nil || len(keys) == 0 {
+            return rewritten, err
+        }
+        after = keys[len(keys)-1]
+
+        var changed []int64
+        var oldEmails, emails, normalized []string
+        var oldPhones, phones []sql.NullString
+        for i, user := range users {
+            oldEmail, oldPhone := user.Email, nullString(user.Phone)
+            ok, err := fn(user)
+            if err != nil {
+                return rewritten, err
+            }
+            if !ok {
+                continue
+            }
+            changed = append(changed, keys[i])
+            oldEmails, oldPhones = append(oldEmails, oldEmail), append(oldPhones, oldPhone)
+            emails, normalized = append(emails, user.Email), append(normalized, r.Emails.Normalize(user.Email))
+            phones = append(phones, nullString(user.Phone))
+        }
+
+        if len(changed) > 0 {
+            var n int64
+            ctx := context.Background()
+            err := r.Tx.WithinTx(ctx, func(tx *sql.Tx) error {
+                if err := r.setStatementTimeout(ctx, tx, r.StatementTimeout); err != nil {
+                    return err
+                }
+                if _, err := tx.ExecContext(ctx, "SET LOCAL users.rewriting = 'on'"); err != nil {
+                    return err
+                }
+                result, err := withHooks(tx, r.Hooks).ExecContext(ctx, write, pq.Array(changed), pq.Array(oldEmails), pq.Array(oldPhones), pq.Array(emails), pq.Array(normalized), pq.Array(phones))
+                if err != nil {
+                    return err
+                }
+                n, err = result.RowsAffected()
+                return err
+            })
+            if err != nil {
+                return rewritten, dbError(err)
+            }
+            rewritten += int(n)
+        }
+        if len(keys) < historyPageSize {
+            return rewritten, nil
+        }
+    }
+}
+
+// SchemaVersion returns the last migration recorded in schema_migrations.
+func (r *PostgresUserRepository) SchemaVersion() (string, error) {
+    var name sql.NullString
+    err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        return q.QueryRowContext(ctx, "SELECT max(name) FROM schema_migrations").Scan(&name)
+    })
+    return name.String, err
+}
+
+// querier runs statements: the database itself, or a transaction when
+// they need a statement timeout.
+type querier interface {
+    ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+    QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+    QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// timeout returns the timeout for a find: its Timeout option if given,
+// otherwise StatementTimeout.
+func (r *PostgresUserRepository) timeout(opts []FindOption) time.Duration {
+    if o := resolve(opts); o.timeout > 0 {
+        return o.timeout
+    }
+    return r.StatementTimeout
+}
+
+// run calls fn to run statements against the database, marking errors
+// with ErrQueryTimeout or ErrUnavailable where they apply. With a timeout,
+// they run under a context deadline so the client gives up on them if the
+// server can't be reached. The server gives up on its own when the timeout
+// is SessionStatementTimeout; any other timeout is set with SET LOCAL
+// statement_timeout in a transaction.
+func (r *PostgresUserRepository) run(timeout time.Duration, fn func(ctx context.Context, q querier) error) error {
+    if timeout <= 0 {
+        return dbError(fn(context.Background(), withHooks(r.DB, r.Hooks)))
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    if timeout == r.SessionStatementTimeout {
+        return dbError(fn(ctx, withHooks(r.DB, r.Hooks)))
+    }
+
+    tx, err := r.DB.BeginTx(ctx, nil)
+    if err != nil {
+        return dbError(err)
+    }
+    defer tx.Rollback()
+
+    if err := r.setStatementTimeout(ctx, tx, timeout); err != nil {
+        return dbError(err)
+    }
+    if err := fn(ctx, withHooks(tx, r.Hooks)); err != nil {
+        return dbError(err)
+    }
+    return dbError(tx.Commit())
+}
+
+// exec runs a single-row update under StatementTimeout.
+func (r *PostgresUserRepository) exec(fn func(ctx context.Context, q querier) (sql.Result, error)) error {
+    return r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+        result, err := fn(ctx, q)
+        if err != nil {
+            return err
+        }
+        return expectOneRow(result)
+    })
+}
+
+// setStatementTimeout bounds every later statement in tx. It does nothing
+// for a timeout of zero, or for SessionStatementTimeout, which tx's
+// connection already has.
+func (r *PostgresUserRepository) setStatementTimeout(ctx context.Context, tx *sql.Tx, timeout time.Duration) error {
+    if timeout <= 0 || timeout == r.SessionStatementTimeout {
+        return nil
+    }
+    // SET doesn't take parameters, but the value is only ever an integer.
+    // It is at least 1ms, since 0 would turn the timeout off.
+    ms := max(timeout.Milliseconds(), 1)
+    _, err := tx.ExecContext(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", ms))
+    return err
+}
+
+// dbError marks err as ErrQueryTimeout or ErrUnavailable if it is one.
+func dbError(err error) error {
+    return unavailableError(timeoutError(err))
+}
+
+// timeoutError marks err as ErrQueryTimeout if it came from a statement or
+// context timing out.
+func timeoutError(err error) error {
+    if errors.Is(err, context.DeadlineExceeded) || sqlState(err) == queryCanceled {
+        return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+    }
+    return err
+}
+
+// expectOneRow turns an update of a missing user into ErrUserNotFound.
+func expectOneRow(result sql.Result) error {
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrUserNotFound
+    }
+    return nil
+}
+
+// nullString maps a nil string to NULL.
+func nullString(s *string) sql.NullString {
+    if s == nil {
+        return sql.NullString{}
+    }
+    return sql.NullString{String: *s, Valid: true}
+}
+
+// nullTime maps the zero time to NULL, so the column default applies.
+func nullTime(t time.Time) sql.NullTime {
+    return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,60 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresUserRepositoryTimeout(t *testing.T) {
+	repo := &PostgresUserRepository{StatementTimeout: 5 * time.Second}
+
+	// A find's own timeout wins over the repository's
+	assert.Equal(t, 5*time.Second, repo.timeout(nil))
+	assert.Equal(t, time.Second, repo.timeout([]FindOption{Fields("id"), Timeout(time.Second)}))
+}
+
+func TestTimeoutError(t *testing.T) {
+	// Both the server cancelling a statement and the client deadline count
+	assert.ErrorIs(t, timeoutError(&pq.Error{Code: queryCanceled}), ErrQueryTimeout)
+	assert.ErrorIs(t, timeoutError(fmt.Errorf("reading: %w", context.DeadlineExceeded)), ErrQueryTimeout)
+	// Whichever driver reported it
+	assert.ErrorIs(t, timeoutError(&pgconn.PgError{Code: queryCanceled}), ErrQueryTimeout)
+
+	// Other errors are left alone
+	err := errors.New("connection refused")
+	assert.Equal(t, err, timeoutError(err))
+	assert.Nil(t, timeoutError(nil))
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	dsn, err := withStatementTimeout("user=app", 2*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "user=app statement_timeout='2000'", dsn)
+
+	dsn, err = withStatementTimeout("postgres://app@db.example.com/app", 2*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "postgres://app@db.example.com/app?statement_timeout=2000", dsn)
+
+	dsn, err = withStatementTimeout("user=app", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "user=app", dsn)
+}
+
+func TestPostgresUserRepositorySessionTimeout(t *testing.T) {
+	// Without a DB, only a statement that needs no transaction can run
+	repo := &PostgresUserRepository{StatementTimeout: time.Second, SessionStatementTimeout: time.Second}
+
+	err := repo.run(repo.StatementTimeout, func(ctx context.Context, q querier) error {
+		_, ok := ctx.Deadline()
+		assert.True(t, ok, "the client still gives up")
+		return nil
+	})
+	assert.NoError(t, err)
+}
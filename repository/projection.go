@@ -0,0 +1,139 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrUnknownField is returned when a find asks for a field User doesn't have.
+var ErrUnknownField = errors.New("unknown user field")
+
+// userField is a selectable User field and the column it is stored in.
+type userField struct {
+	name string
+	// ptr returns where the field lives in u, for scanning into.
+	ptr func(u *User) any
+	// clear zeroes the field in u.
+	clear func(u *User)
+}
+
+// userFields lists every User field in column order. Adding a field to
+// User means adding it here.
+var userFields = []userField{
+	{"id", func(u *User) any { return &u.ID }, func(u *User) { u.ID = 0 }},
+	{"name", func(u *User) any { return &u.Name }, func(u *User) { u.Name = "" }},
+	{"email", func(u *User) any { return &u.Email }, func(u *User) { u.Email = "" }},
+	{"created_at", func(u *User) any { return &u.CreatedAt }, func(u *User) { u.CreatedAt = time.Time{} }},
+	{"verified_at", func(u *User) any { return &u.VerifiedAt }, func(u *User) { u.VerifiedAt = nil }},
+	{"phone", func(u *User) any { return &u.Phone }, func(u *User) { u.Phone = nil }},
+	{"metadata", func(u *User) any { return &u.Metadata }, func(u *User) { u.Metadata = nil }},
+	{"normalized_email", func(u *User) any { return &u.NormalizedEmail }, func(u *User) { u.NormalizedEmail = "" }},
+	{"last_login_at", func(u *User) any { return &u.LastLoginAt }, func(u *User) { u.LastLoginAt = nil }},
+	{"login_count", func(u *User) any { return &u.LoginCount }, func(u *User) { u.LoginCount = 0 }},
+	{"status", func(u *User) any { return &u.Status }, func(u *User) { u.Status = "" }},
+}
+
+// projection is the set of fields a find returns, in column order.
+type projection []userField
+
+// allFields selects every field.
+var allFields = projection(userFields)
+
+// projectionOf resolves opts into the fields to return. Field names are
+// checked against userFields, so only known column names ever reach SQL.
+func projectionOf(opts []FindOption) (projection, error) {
+	o := resolve(opts)
+	if len(o.fields) == 0 {
+		return allFields, nil
+	}
+
+	wanted := map[string]bool{"id": true}
+	for _, name := range o.fields {
+		if !isUserField(name) {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownField, name)
+		}
+		wanted[name] = true
+	}
+
+	var p projection
+	for _, field := range userFields {
+		if wanted[field.name] {
+			p = append(p, field)
+		}
+	}
+	return p, nil
+}
+
+// FieldNames returns the fields a find with opts returns, in column order.
+func FieldNames(opts ...FindOption) ([]string, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	return fields.names(), nil
+}
+
+func isUserField(name string) bool {
+	for _, field := range userFields {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// all reports whether p selects every field.
+func (p projection) all() bool {
+	return len(p) == len(userFields)
+}
+
+// names returns the selected field names.
+func (p projection) names() []string {
+	names := make([]string, len(p))
+	for i, field := range p {
+		names[i] = field.name
+	}
+	return names
+}
+
+// columns returns the SELECT list for p.
+func (p projection) columns() string {
+	return strings.Join(p.names(), ", ")
+}
+
+// scan reads a row selected with p.columns.
+func (p projection) scan(row interface{ Scan(dest ...any) error }) (*User, error) {
+	var user User
+	dest := make([]any, len(p))
+	for i, field := range p {
+		dest[i] = field.ptr(&user)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// apply zeroes every field of user that p doesn't select, in place.
+func (p projection) apply(user *User) *User {
+	if p.all() {
+		return user
+	}
+	for _, field := range userFields {
+		if !p.has(field.name) {
+			field.clear(user)
+		}
+	}
+	return user
+}
+
+func (p projection) has(name string) bool {
+	for _, field := range p {
+		if field.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFields(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// Only the requested fields are returned, and the ID is always included
+	found, err := repo.FindUserByID(user.ID, Fields("name"))
+	assert.NoError(t, err)
+	assert.Equal(t, &User{ID: user.ID, Name: "Jane Doe"}, found)
+
+	found, err = repo.FindUserByEmail("jane.doe@example.com", Fields("email"))
+	assert.NoError(t, err)
+	assert.Equal(t, &User{ID: user.ID, Email: "jane.doe@example.com"}, found)
+
+	// Without Fields the whole user comes back
+	found, err = repo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", found.Email)
+	assert.False(t, found.CreatedAt.IsZero())
+
+	_, err = repo.FindUserByID(user.ID, Fields("password"))
+	assert.ErrorIs(t, err, ErrUnknownField)
+}
+
+func TestProjectionColumns(t *testing.T) {
+	// Columns come out in table order whatever order they were asked for
+	fields, err := projectionOf([]FindOption{Fields("email", "name")})
+	assert.NoError(t, err)
+	assert.Equal(t, "id, name, email", fields.columns())
+
+	fields, err = projectionOf(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "id, name, email, created_at, verified_at, phone, metadata, normalized_email, last_login_at, login_count, status", fields.columns())
+
+	// Anything that isn't a known field never reaches the query
+	_, err = projectionOf([]FindOption{Fields("name; DROP TABLE users")})
+	assert.ErrorIs(t, err, ErrUnknownField)
+}
+
+func TestCachingUserRepositoryFields(t *testing.T) {
+	repo := NewCachingUserRepository(NewMemoryUserRepository(), time.Minute, 0)
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// A narrow read doesn't leave a narrow user in the cache
+	found, err := repo.FindUserByID(user.ID, Fields("name"))
+	assert.NoError(t, err)
+	assert.Empty(t, found.Email)
+
+	found, err = repo.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "jane.doe@example.com", found.Email)
+}
@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryEvent describes one statement run by PostgresUserRepository.
+type QueryEvent struct {
+	// Query is the statement with its whitespace collapsed to single
+	// spaces, so the same statement always reads the same.
+	Query string
+	// Args is how many arguments it was run with. Their values are left
+	// out, as they may hold personal data.
+	Args  int
+	Start time.Time
+	// Duration and Err are set once the statement has run. For a query
+	// returning rows, that is when the first are ready to read.
+	Duration time.Duration
+	Err      error
+}
+
+// QueryHook is told about each statement a SQL-backed repository runs,
+// for logging, tracing or counting queries. BeforeQuery may return a
+// context derived from ctx, such as one carrying a tracing span, which the
+// statement runs under and AfterQuery is given. Hooks are called from
+// whichever goroutine runs the statement, so must be safe for concurrent
+// use.
+//
+// Only the repository's own statements are reported: not beginning and
+// ending transactions, or setting their statement timeouts.
+type QueryHook interface {
+	BeforeQuery(ctx context.Context, event *QueryEvent) context.Context
+	AfterQuery(ctx context.Context, event *QueryEvent)
+}
+
+// QueryCounter is a QueryHook recording the statements run, for tests
+// asserting how many queries an operation costs.
+type QueryCounter struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (c *QueryCounter) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+	return ctx
+}
+
+func (c *QueryCounter) AfterQuery(ctx context.Context, event *QueryEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = append(c.queries, event.Query)
+}
+
+// Count returns how many statements have run since the counter was made
+// or last reset.
+func (c *QueryCounter) Count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.queries)
+}
+
+// Queries returns the statements run, in order.
+func (c *QueryCounter) Queries() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.queries...)
+}
+
+// Reset forgets the statements run so far.
+func (c *QueryCounter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = nil
+}
+
+// normalizeQuery collapses the whitespace in query.
+func normalizeQuery(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// hookedQuerier runs statements on a querier, telling hooks about each.
+type hookedQuerier struct {
+	querier
+	hooks []QueryHook
+}
+
+// withHooks returns q reporting to hooks, or q itself if there are none.
+func withHooks(q querier, hooks []QueryHook) querier {
+	if len(hooks) == 0 {
+		return q
+	}
+	return hookedQuerier{querier: q, hooks: hooks}
+}
+
+func (q hookedQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, event := q.before(ctx, query, args)
+	result, err := q.querier.ExecContext(ctx, query, args...)
+	q.after(ctx, event, err)
+	return result, err
+}
+
+func (q hookedQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, event := q.before(ctx, query, args)
+	rows, err := q.querier.QueryContext(ctx, query, args...)
+	q.after(ctx, event, err)
+	return rows, err
+}
+
+func (q hookedQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, event := q.before(ctx, query, args)
+	row := q.querier.QueryRowContext(ctx, query, args...)
+	q.after(ctx, event, row.Err())
+	return row
+}
+
+func (q hookedQuerier) before(ctx context.Context, query string, args []any) (context.Context, *QueryEvent) {
+	event := &QueryEvent{Query: normalizeQuery(query), Args: len(args), Start: time.Now()}
+	for _, hook := range q.hooks {
+		ctx = hook.BeforeQuery(ctx, event)
+	}
+	return ctx, event
+}
+
+func (q hookedQuerier) after(ctx context.Context, event *QueryEvent, err error) {
+	event.Duration, event.Err = time.Since(event.Start), err
+	for _, hook := range q.hooks {
+		hook.AfterQuery(ctx, event)
+	}
+}
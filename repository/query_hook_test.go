@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeQuerier fails every statement with err, or runs none at all.
+type fakeQuerier struct {
+	err error
+}
+
+func (q fakeQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return nil, q.err
+}
+
+func (q fakeQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return nil, q.err
+}
+
+func (q fakeQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return &sql.Row{}
+}
+
+type hookKey struct{}
+
+// recordingHook records events, and passes a value through the context.
+type recordingHook struct {
+	events []QueryEvent
+	seen   []any
+}
+
+func (h *recordingHook) BeforeQuery(ctx context.Context, event *QueryEvent) context.Context {
+	return context.WithValue(ctx, hookKey{}, event.Query)
+}
+
+func (h *recordingHook) AfterQuery(ctx context.Context, event *QueryEvent) {
+	h.events = append(h.events, *event)
+	h.seen = append(h.seen, ctx.Value(hookKey{}))
+}
+
+func TestQueryHooks(t *testing.T) {
+	hook, counter := &recordingHook{}, &QueryCounter{}
+	failure := errors.New("connection reset")
+	q := withHooks(fakeQuerier{err: failure}, []QueryHook{hook, counter})
+
+	_, err := q.ExecContext(context.Background(), `
+	DELETE FROM users
+	WHERE id = $1`, 1)
+	assert.ErrorIs(t, err, failure)
+	_, _ = q.QueryContext(context.Background(), "SELECT id FROM users WHERE id = ANY($1) AND name = $2", 1, "Jane")
+	q.QueryRowContext(context.Background(), "SELECT 1")
+
+	// Statements read the same whatever their layout, without their values
+	assert.Equal(t, []string{
+		"DELETE FROM users WHERE id = $1",
+		"SELECT id FROM users WHERE id = ANY($1) AND name = $2",
+		"SELECT 1",
+	}, counter.Queries())
+	assert.Equal(t, 3, counter.Count())
+	assert.Equal(t, 1, hook.events[0].Args)
+	assert.Equal(t, 2, hook.events[1].Args)
+	assert.ErrorIs(t, hook.events[0].Err, failure)
+	assert.NoError(t, hook.events[2].Err)
+	assert.False(t, hook.events[0].Start.IsZero())
+
+	// The context BeforeQuery returns reaches AfterQuery
+	assert.Equal(t, "SELECT 1", hook.seen[2])
+
+	counter.Reset()
+	assert.Zero(t, counter.Count())
+
+	// Without hooks the querier is used as it is
+	assert.Equal(t, fakeQuerier{}, withHooks(fakeQuerier{}, nil))
+}
@@ -0,0 +1,162 @@
+package repository
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// ErrReadOnly is returned by every write while the repository is
+// read-only.
+var ErrReadOnly = errors.New("repository is read-only")
+
+// ReadOnlyUserRepository wraps a UserRepository and, while switched on
+// with SetReadOnly, refuses every write with ErrReadOnly without passing
+// it on. Finds carry on as normal, so a deployment can keep serving reads
+// during a migration or failover. It is safe to switch while in use.
+type ReadOnlyUserRepository struct {
+	UserRepository
+
+	readOnly atomic.Bool
+	// configured is the mode configuration last asked for; see configure.
+	configured atomic.Bool
+}
+
+var _ UserRepository = (*ReadOnlyUserRepository)(nil)
+
+func NewReadOnlyUserRepository(repo UserRepository, readOnly bool) *ReadOnlyUserRepository {
+	r := &ReadOnlyUserRepository{UserRepository: repo}
+	r.readOnly.Store(readOnly)
+	r.configured.Store(readOnly)
+	return r
+}
+
+// SetReadOnly switches read-only mode on or off.
+func (r *ReadOnlyUserRepository) SetReadOnly(readOnly bool) {
+	r.readOnly.Store(readOnly)
+}
+
+// configure switches to readOnly from configuration, but only if it isn't
+// what configuration last asked for, so reloading an unchanged setting
+// doesn't undo a SetReadOnly made since, such as by an admin.
+func (r *ReadOnlyUserRepository) configure(readOnly bool) {
+	if r.configured.Swap(readOnly) != readOnly {
+		r.SetReadOnly(readOnly)
+	}
+}
+
+// ReadOnly reports whether writes are being refused.
+func (r *ReadOnlyUserRepository) ReadOnly() bool {
+	return r.readOnly.Load()
+}
+
+func (r *ReadOnlyUserRepository) SaveUser(user *User) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.SaveUser(user)
+}
+
+func (r *ReadOnlyUserRepository) SaveUsers(users []*User) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.SaveUsers(users)
+}
+
+func (r *ReadOnlyUserRepository) InsertUsers(users []*User) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.InsertUsers(users)
+}
+
+func (r *ReadOnlyUserRepository) UpdateUser(user *User) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.UpdateUser(user)
+}
+
+func (r *ReadOnlyUserRepository) UpdateUsers(users []*User) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.UpdateUsers(users)
+}
+
+func (r *ReadOnlyUserRepository) RecordLogin(id int) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.RecordLogin(id)
+}
+
+func (r *ReadOnlyUserRepository) SetUserStatus(id int, from, to Status) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.SetUserStatus(id, from, to)
+}
+
+func (r *ReadOnlyUserRepository) AnonymizeUser(id int) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.AnonymizeUser(id)
+}
+
+func (r *ReadOnlyUserRepository) DeleteUser(id int) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.DeleteUser(id)
+}
+
+func (r *ReadOnlyUserRepository) RestoreUser(id int) (*User, error) {
+	if r.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	return r.UserRepository.RestoreUser(id)
+}
+
+func (r *ReadOnlyUserRepository) PurgeUser(id int) error {
+	if r.ReadOnly() {
+		return ErrReadOnly
+	}
+	return r.UserRepository.PurgeUser(id)
+}
+
+func (r *ReadOnlyUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	if r.ReadOnly() {
+		return 0, ErrReadOnly
+	}
+	return r.UserRepository.DeleteUsersWhere(spec)
+}
+
+func (r *ReadOnlyUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	if r.ReadOnly() {
+		return nil, ErrReadOnly
+	}
+	return r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+}
+
+// Unwrap returns the wrapped repository.
+func (r *ReadOnlyUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// FindReadOnly returns the ReadOnlyUserRepository among repo and the
+// repositories it wraps, or nil if there is none.
+func FindReadOnly(repo UserRepository) *ReadOnlyUserRepository {
+	for repo != nil {
+		if r, ok := repo.(*ReadOnlyUserRepository); ok {
+			return r
+		}
+		wrapper, ok := repo.(interface{ Unwrap() UserRepository })
+		if !ok {
+			return nil
+		}
+		repo = wrapper.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyUserRepository(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe"}},
+	}
+	repo := NewReadOnlyUserRepository(mockRepo, true)
+	assert.True(t, repo.ReadOnly())
+
+	// Writes are refused without reaching the wrapped repository
+	assert.ErrorIs(t, repo.SaveUser(&User{Name: "Jane Doe"}), ErrReadOnly)
+	assert.ErrorIs(t, repo.SaveUsers([]*User{{Name: "Jane Doe"}}), ErrReadOnly)
+	assert.ErrorIs(t, repo.UpdateUser(&User{ID: 1, Name: "Johnny Doe"}), ErrReadOnly)
+	assert.ErrorIs(t, repo.RecordLogin(1), ErrReadOnly)
+	assert.ErrorIs(t, repo.SetUserStatus(1, StatusActive, StatusSuspended), ErrReadOnly)
+	assert.ErrorIs(t, repo.AnonymizeUser(1), ErrReadOnly)
+	assert.ErrorIs(t, repo.DeleteUser(1), ErrReadOnly)
+	_, err := repo.RestoreUser(1)
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, repo.PurgeUser(1), ErrReadOnly)
+	_, err = repo.DeleteUsersWhere(EmailDomain("example.com"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.Empty(t, mockRepo.Calls())
+
+	// Reads carry on
+	user, err := repo.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+
+	// And writes resume once switched off
+	repo.SetReadOnly(false)
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Johnny Doe"}))
+	mockRepo.AssertCalled(t, "UpdateUser", &User{ID: 1, Name: "Johnny Doe"})
+}
+
+func TestFindReadOnly(t *testing.T) {
+	readOnly := NewReadOnlyUserRepository(NewMemoryUserRepository(), false)
+	repo := NewLoggingUserRepository(readOnly, nil)
+	assert.Same(t, readOnly, FindReadOnly(repo))
+	assert.Nil(t, FindReadOnly(NewMemoryUserRepository()))
+}
@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Factory builds a UserRepository backend from cfg. The returned cleanup
+// function releases whatever the backend holds open.
+type Factory func(cfg Config) (UserRepository, func(), error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = map[string]Factory{}
+)
+
+func init() {
+	Register("postgres", func(cfg Config) (UserRepository, func(), error) {
+		dsns := append([]string{cfg.DSN}, cfg.StandbyDSNs...)
+		for i, dsn := range dsns {
+			var err error
+			if dsns[i], err = cfg.TLS.Apply(dsn); err != nil {
+				return nil, nil, err
+			}
+			if dsns[i], err = withStatementTimeout(dsns[i], cfg.StatementTimeout); err != nil {
+				return nil, nil, err
+			}
+		}
+		db, err := openPostgres(dsns, cfg.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newPostgresBackend(db, cfg)
+	})
+	Register("pgx", func(cfg Config) (UserRepository, func(), error) {
+		if len(cfg.StandbyDSNs) > 0 {
+			return nil, nil, errors.New("repository: the pgx driver takes standbys as a multi-host DSN, not as standby DSNs")
+		}
+		dsn, err := cfg.TLS.Apply(cfg.DSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dsn, err = withStatementTimeout(dsn, cfg.StatementTimeout); err != nil {
+			return nil, nil, err
+		}
+		db, err := openPgx(dsn, cfg.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return newPostgresBackend(db, cfg)
+	})
+	Register("sqlite", func(cfg Config) (UserRepository, func(), error) {
+		db, err := OpenSQLite(cfg.DSN)
+		if err != nil {
+			return nil, nil, err
+		}
+		repo := NewSQLiteUserRepository(db)
+		repo.StatementTimeout = cfg.StatementTimeout
+		repo.Emails = cfg.Emails
+		repo.Hooks = cfg.QueryHooks
+		return repo, func() { db.Close() }, nil
+	})
+	Register("memory", func(cfg Config) (UserRepository, func(), error) {
+		repo := NewMemoryUserRepository()
+		repo.Emails = cfg.Emails
+		return repo, func() {}, nil
+	})
+	Register("remote", func(cfg Config) (UserRepository, func(), error) {
+		return NewRemoteUserRepository(cfg.DSN, cfg.Token), func() {}, nil
+	})
+}
+
+// newPostgresBackend returns the PostgresUserRepository over db, whichever
+// driver opened it, set up from cfg. db's connections must already have
+// cfg.StatementTimeout set; see withStatementTimeout.
+func newPostgresBackend(db *sql.DB, cfg Config) (UserRepository, func(), error) {
+	repo := NewPostgresUserRepository(db)
+	repo.StatementTimeout = cfg.StatementTimeout
+	repo.SessionStatementTimeout = cfg.StatementTimeout
+	repo.Emails = cfg.Emails
+	repo.Hooks = cfg.QueryHooks
+	return repo, func() { db.Close() }, nil
+}
+
+// Register makes a backend available to New under name. Other modules call
+// it from an init function to contribute backends without changing this
+// package, in the same way database/sql drivers register themselves.
+// Register panics if factory is nil or name is already taken.
+func Register(name string, factory Factory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if factory == nil {
+		panic("repository: Register factory is nil")
+	}
+	if _, dup := drivers[name]; dup {
+		panic("repository: Register called twice for driver " + name)
+	}
+	drivers[name] = factory
+}
+
+// Drivers returns the names of the registered backends, sorted.
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func newBackend(cfg Config) (UserRepository, func(), error) {
+	driversMu.RLock()
+	factory, ok := drivers[cfg.Driver]
+	driversMu.RUnlock()
+
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: %q (registered: %v)", ErrUnsupportedDriver, cfg.Driver, Drivers())
+	}
+	repo, cleanup, err := factory(cfg)
+	if err != nil || cfg.Encryption == nil {
+		return repo, cleanup, err
+	}
+
+	index, err := newBlindIndex(repo)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	encrypted := NewEncryptedUserRepository(repo, cfg.Encryption, index)
+	encrypted.Emails = cfg.Emails
+	return encrypted, cleanup, nil
+}
+
+// newBlindIndex returns the BlindIndex to keep alongside backend when it
+// is encrypted: the user_email_index table in a postgres backend's
+// database, or an index in memory for the memory backend.
+func newBlindIndex(backend UserRepository) (BlindIndex, error) {
+	switch b := backend.(type) {
+	case *PostgresUserRepository:
+		return &PostgresBlindIndex{DB: b.DB, Hooks: b.Hooks}, nil
+	case *MemoryUserRepository:
+		return NewMemoryBlindIndex(), nil
+	}
+	return nil, fmt.Errorf("%w: encryption needs a blind index, and there is none for %T", ErrNotSupported, backend)
+}
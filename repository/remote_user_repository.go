@@ -0,0 +1,440 @@
+package repository
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnauthorized is returned by RemoteUserRepository when the remote API
+// rejects its token.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// RemoteError is an unexpected error response from the remote API.
+type RemoteError struct {
+	StatusCode int
+	Message    string
+	// Rule names the policy the remote service refused a user by, if it
+	// did.
+	Rule string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote repository: %d %s", e.StatusCode, e.Message)
+}
+
+// Is matches the errors the remote instance reported: ErrPolicyViolation
+// for a user refused by a policy, ErrReadOnly for a write refused while it
+// is read-only, and ErrUnavailable for any other 503, as it reports its own
+// database being unavailable that way.
+func (e *RemoteError) Is(target error) bool {
+	switch target {
+	case ErrPolicyViolation:
+		return e.Rule != ""
+	case ErrReadOnly:
+		return e.readOnly()
+	case ErrUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable && !e.readOnly()
+	}
+	return false
+}
+
+func (e *RemoteError) readOnly() bool {
+	return e.StatusCode == http.StatusServiceUnavailable && strings.Contains(e.Message, ErrReadOnly.Error())
+}
+
+// RemoteUserRepository implements UserRepository over another instance's
+// REST API (see the api package), so a service can use a remote user store
+// exactly as it would a local database.
+//
+// Reads are retried on network errors and on 429 and 5xx responses. Writes
+// are only retried on 429 and 503, where the server has not acted on the
+// request, so a retry can never create a user twice.
+type RemoteUserRepository struct {
+	BaseURL string
+	Token   string
+	Client  *http.Client
+
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+var _ UserRepository = (*RemoteUserRepository)(nil)
+
+func NewRemoteUserRepository(baseURL, token string) *RemoteUserRepository {
+	return &RemoteUserRepository{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		Token:      token,
+		Client:     &http.Client{Timeout: 5 * time.Second},
+		MaxRetries: 3,
+		Backoff:    100 * time.Millisecond,
+	}
+}
+
+func (r *RemoteUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := r.do(http.MethodGet, "/users/"+strconv.Itoa(id)+fieldsQuery(fields), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *RemoteUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := r.do(http.MethodGet, "/users/by-email/"+url.PathEscape(email)+fieldsQuery(fields), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *RemoteUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	if err := r.do(http.MethodGet, "/users/by-phone/"+url.PathEscape(phone)+fieldsQuery(fields), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *RemoteUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[int]*User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.Itoa(id)
+	}
+	query := url.Values{"ids": {strings.Join(list, ",")}}
+	if !fields.all() {
+		query.Set("fields", strings.Join(fields.names(), ","))
+	}
+
+	var found Page[*User]
+	if err := r.do(http.MethodGet, "/users/by-ids?"+query.Encode(), nil, &found); err != nil {
+		return nil, err
+	}
+	for _, user := range found.Items {
+		users[user.ID] = user
+	}
+	return users, nil
+}
+
+// FindUsersWhere returns ErrNotSupported: specifications can't be sent over
+// the API.
+func (r *RemoteUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	return nil, ErrNotSupported
+}
+
+func (r *RemoteUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+func (r *RemoteUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	return r.search("/users/search", url.Values{"prefix": {prefix}}, opts)
+}
+
+func (r *RemoteUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	return r.search("/users/suggest", url.Values{"q": {q}}, opts)
+}
+
+// FindUsersByMetadata sends value as JSON, following the API's pages until
+// it has them all or as many as the Limit option asks for.
+func (r *RemoteUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+	limit := metadataLimit(opts)
+	query := url.Values{"key": {key}, "value": {string(encoded)}, "limit": {strconv.Itoa(min(limit, MaxPageSize))}}
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !fields.all() {
+		query.Set("fields", strings.Join(fields.names(), ","))
+	}
+
+	var users []*User
+	for len(users) < limit {
+		var page Page[*User]
+		if err := r.do(http.MethodGet, "/users/by-metadata?"+query.Encode(), nil, &page); err != nil {
+			return nil, err
+		}
+		users = append(users, page.Items...)
+		if page.Next == "" {
+			break
+		}
+		query.Set("cursor", page.Next)
+	}
+	if len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// search gets a list of users from one of the API's search routes.
+func (r *RemoteUserRepository) search(path string, query url.Values, opts []FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	query.Set("limit", strconv.Itoa(searchLimit(opts)))
+	if !fields.all() {
+		query.Set("fields", strings.Join(fields.names(), ","))
+	}
+
+	var page Page[*User]
+	if err := r.do(http.MethodGet, path+"?"+query.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return page.Items, nil
+}
+
+func (r *RemoteUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	var history Page[UserVersion]
+	if err := r.do(http.MethodGet, "/users/history/"+strconv.Itoa(id), nil, &history); err != nil {
+		return nil, err
+	}
+	return history.Items, nil
+}
+
+func (r *RemoteUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	var user User
+	query := url.Values{"as_of": {at.Format(time.RFC3339Nano)}}
+	if err := r.do(http.MethodGet, "/users/"+strconv.Itoa(id)+"?"+query.Encode(), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *RemoteUserRepository) SaveUser(user *User) error {
+	var saved User
+	if err := r.do(http.MethodPost, "/users", user, &saved); err != nil {
+		return err
+	}
+	user.ID = saved.ID
+	return nil
+}
+
+func (r *RemoteUserRepository) SaveUsers(users []*User) error {
+	var saved []User
+	if err := r.do(http.MethodPost, "/users/batch", users, &saved); err != nil {
+		return err
+	}
+	if len(saved) != len(users) {
+		return fmt.Errorf("remote repository: saved %d users, sent %d", len(saved), len(users))
+	}
+	for i := range users {
+		users[i].ID = saved[i].ID
+	}
+	return nil
+}
+
+// InsertUsers returns ErrNotSupported: the remote API always gives new
+// users their IDs.
+func (r *RemoteUserRepository) InsertUsers(users []*User) error {
+	return ErrNotSupported
+}
+
+func (r *RemoteUserRepository) UpdateUser(user *User) error {
+	return r.do(http.MethodPut, "/users/"+strconv.Itoa(user.ID), user, nil)
+}
+
+// UpdateUsers returns ErrNotSupported: the remote API updates users one at
+// a time, so it can't update several all or none.
+func (r *RemoteUserRepository) UpdateUsers(users []*User) error {
+	return ErrNotSupported
+}
+
+func (r *RemoteUserRepository) RecordLogin(id int) error {
+	return r.do(http.MethodPost, "/users/"+strconv.Itoa(id)+"/logins", nil, nil)
+}
+
+// statusRoutes are the remote API's routes that change a user's status to
+// each status.
+var statusRoutes = map[Status]string{
+	StatusActive:      "/admin/users/%d/activate",
+	StatusSuspended:   "/admin/users/%d/suspend",
+	StatusDeactivated: "/users/%d/deactivate",
+}
+
+// SetUserStatus checks the user's status is from, then posts to the remote
+// API's route for to; there is none for StatusPending. The remote API
+// applies its own transition rules, and a change they refuse comes back as
+// ErrStatusChanged. The check and the change are separate requests, so a
+// change made between them can slip through as long as those rules allow
+// it. Activating and suspending use the admin routes, so Token must be the
+// remote API's admin token for them.
+func (r *RemoteUserRepository) SetUserStatus(id int, from, to Status) error {
+	route, ok := statusRoutes[to]
+	if !ok {
+		return fmt.Errorf("%w: the remote API can't make a user %s", ErrNotSupported, to)
+	}
+	user, err := r.FindUserByID(id, Fields("status"))
+	if err != nil {
+		return err
+	}
+	if user.Status.orDefault() != from.orDefault() {
+		return fmt.Errorf("%w: user %d is %s, not %s", ErrStatusChanged, id, user.Status.orDefault(), from)
+	}
+
+	err = r.do(http.MethodPost, fmt.Sprintf(route, id), nil, nil)
+	if errors.Is(err, ErrUserExists) {
+		return fmt.Errorf("%w: the remote API refused to make user %d %s", ErrStatusChanged, id, to)
+	}
+	return err
+}
+
+func (r *RemoteUserRepository) AnonymizeUser(id int) error {
+	return r.do(http.MethodPost, "/users/"+strconv.Itoa(id)+"/anonymize", nil, nil)
+}
+
+func (r *RemoteUserRepository) DeleteUser(id int) error {
+	return r.do(http.MethodDelete, "/users/"+strconv.Itoa(id), nil, nil)
+}
+
+// RestoreUser and PurgeUser use the admin routes, so Token must be the
+// remote API's admin token.
+func (r *RemoteUserRepository) RestoreUser(id int) (*User, error) {
+	var user User
+	if err := r.do(http.MethodPost, "/admin/users/"+strconv.Itoa(id)+"/restore", nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (r *RemoteUserRepository) PurgeUser(id int) error {
+	return r.do(http.MethodDelete, "/admin/users/"+strconv.Itoa(id), nil, nil)
+}
+
+// DeleteUsersWhere returns ErrNotSupported: specifications can't be sent
+// over the API.
+func (r *RemoteUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	return 0, ErrNotSupported
+}
+
+// DeleteUsersWhereReturningIDs returns ErrNotSupported, as
+// DeleteUsersWhere does.
+func (r *RemoteUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	return nil, ErrNotSupported
+}
+
+// fieldsQuery asks the API for only the fields in p.
+func fieldsQuery(p projection) string {
+	if p.all() {
+		return ""
+	}
+	return "?fields=" + url.QueryEscape(strings.Join(p.names(), ","))
+}
+
+// do sends a request, retrying as described on RemoteUserRepository, and
+// decodes a successful response into out unless out is nil.
+func (r *RemoteUserRepository) do(method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(r.Backoff << (attempt - 1))
+		}
+
+		var retry bool
+		retry, err = r.send(method, path, body, out)
+		if !retry || attempt >= r.MaxRetries {
+			return err
+		}
+	}
+}
+
+// send makes a single attempt and reports whether it is safe and worth
+// trying again.
+func (r *RemoteUserRepository) send(method, path string, body []byte, out any) (bool, error) {
+	req, err := http.NewRequest(method, r.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if r.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.Token)
+	}
+
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return method == http.MethodGet, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300 && out == nil:
+		return false, nil
+	case resp.StatusCode < 300:
+		return false, json.NewDecoder(resp.Body).Decode(out)
+	case resp.StatusCode == http.StatusNotFound:
+		return false, ErrUserNotFound
+	case resp.StatusCode == http.StatusConflict:
+		return false, ErrUserExists
+	}
+
+	remoteErr := readError(resp)
+	switch {
+	case remoteErr.Rule != "":
+		return false, remoteErr
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, ErrUnauthorized
+	case remoteErr.readOnly():
+		// It won't take writes until an admin switches it back, so don't
+		// wait on it
+		return false, remoteErr
+	}
+
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable ||
+		(method == http.MethodGet && resp.StatusCode >= 500)
+	return retry, remoteErr
+}
+
+// readError reads the RemoteError out of an error response, whose body the
+// api package writes as {"error": ..., "rule": ...}.
+func readError(resp *http.Response) *RemoteError {
+	var payload struct {
+		Error string `json:"error"`
+		Rule  string `json:"rule"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &payload) == nil && payload.Error != "" {
+		return &RemoteError{StatusCode: resp.StatusCode, Message: payload.Error, Rule: payload.Rule}
+	}
+	return &RemoteError{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+}
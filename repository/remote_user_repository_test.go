@@ -0,0 +1,250 @@
+package repository_test
+
+import (
+	"gorepository/api"
+	"gorepository/repository"
+	"gorepository/service"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newRemote serves a memory-backed API and returns a RemoteUserRepository
+// pointed at it.
+func newRemote(t *testing.T, token string) *repository.RemoteUserRepository {
+	users := &service.UserService{Repo: repository.NewMemoryUserRepository()}
+	server := httptest.NewServer(api.NewServer(users, "secret").Handler())
+	t.Cleanup(server.Close)
+
+	return repository.NewRemoteUserRepository(server.URL, token)
+}
+
+func TestRemoteUserRepository(t *testing.T) {
+	remote := newRemote(t, "secret")
+
+	// Save through the API and read back
+	user := &repository.User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, remote.SaveUser(user))
+	assert.Equal(t, 1, user.ID)
+
+	found, err := remote.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+
+	// Not found comes back as the same error a local repository returns
+	_, err = remote.FindUserByID(99)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	users := []*repository.User{{Name: "A"}, {Name: "B"}}
+	assert.NoError(t, remote.SaveUsers(users))
+	assert.Equal(t, 2, users[0].ID)
+	assert.Equal(t, 3, users[1].ID)
+
+	byID, err := remote.FindUsersByIDs([]int{1, 3, 99})
+	assert.NoError(t, err)
+	assert.Len(t, byID, 2)
+	assert.Equal(t, "B", byID[3].Name)
+
+	assert.NoError(t, remote.AnonymizeUser(user.ID))
+	_, err = remote.FindUserByEmail("jane.doe@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+func TestRemoteUserRepositorySetUserStatus(t *testing.T) {
+	users := &service.UserService{Repo: repository.NewMemoryUserRepository()}
+	server := api.NewServer(users, "secret")
+	server.AdminToken = "secret"
+	httpServer := httptest.NewServer(server.Handler())
+	t.Cleanup(httpServer.Close)
+	remote := repository.NewRemoteUserRepository(httpServer.URL, "secret")
+
+	user := &repository.User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, remote.SaveUser(user))
+
+	// Each status has its own route
+	assert.NoError(t, remote.SetUserStatus(user.ID, repository.StatusActive, repository.StatusSuspended))
+	found, err := remote.FindUserByID(user.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, repository.StatusSuspended, found.Status)
+	assert.NoError(t, remote.SetUserStatus(user.ID, repository.StatusSuspended, repository.StatusActive))
+
+	// A change from a status the user no longer has isn't made
+	err = remote.SetUserStatus(user.ID, repository.StatusSuspended, repository.StatusDeactivated)
+	assert.ErrorIs(t, err, repository.ErrStatusChanged)
+
+	assert.NoError(t, remote.SetUserStatus(user.ID, repository.StatusActive, repository.StatusDeactivated))
+
+	// Nor is one the remote API's rules refuse
+	err = remote.SetUserStatus(user.ID, repository.StatusDeactivated, repository.StatusActive)
+	assert.ErrorIs(t, err, repository.ErrStatusChanged)
+
+	err = remote.SetUserStatus(user.ID, repository.StatusDeactivated, repository.StatusPending)
+	assert.ErrorIs(t, err, repository.ErrNotSupported)
+}
+
+func TestRemoteUserRepositoryHistory(t *testing.T) {
+	remote := newRemote(t, "secret")
+
+	user := &repository.User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, remote.SaveUser(user))
+	original := time.Now()
+	assert.NoError(t, remote.UpdateUser(&repository.User{ID: user.ID, Name: "Jane Smith", Email: "jane.doe@example.com"}))
+
+	versions, err := remote.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, "Jane Doe", versions[0].Name)
+
+	found, err := remote.FindUserAsOf(user.ID, original)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+
+	assert.ErrorIs(t, remote.UpdateUser(&repository.User{ID: 99}), repository.ErrUserNotFound)
+}
+
+func TestRemoteUserRepositoryFields(t *testing.T) {
+	remote := newRemote(t, "secret")
+
+	user := &repository.User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, remote.SaveUser(user))
+
+	found, err := remote.FindUserByID(user.ID, repository.Fields("name"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+	assert.Empty(t, found.Email)
+}
+
+func TestRemoteUserRepositorySearch(t *testing.T) {
+	remote := newRemote(t, "secret")
+	assert.NoError(t, remote.SaveUsers([]*repository.User{{Name: "John Doe"}, {Name: "Joan Smith"}, {Name: "Mary Major"}}))
+
+	found, err := remote.FindUsersByNamePrefix("jo", repository.Limit(1))
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, "Joan Smith", found[0].Name)
+
+	suggested, err := remote.SuggestUsers("jhon")
+	assert.NoError(t, err)
+	assert.Len(t, suggested, 1)
+	assert.Equal(t, "John Doe", suggested[0].Name)
+}
+
+func TestRemoteUserRepositoryMetadata(t *testing.T) {
+	remote := newRemote(t, "secret")
+	assert.NoError(t, remote.SaveUsers([]*repository.User{
+		{Name: "Jane Doe", Metadata: repository.Metadata{"plan": "pro", "seats": 5}},
+		{Name: "John Doe", Metadata: repository.Metadata{"plan": "free"}},
+	}))
+
+	found, err := remote.FindUsersByMetadata("seats", 5)
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, "Jane Doe", found[0].Name)
+	assert.Equal(t, "pro", found[0].Metadata["plan"])
+}
+
+func TestRemoteUserRepositoryUnauthorized(t *testing.T) {
+	remote := newRemote(t, "wrong")
+
+	_, err := remote.FindUserByID(1)
+	assert.ErrorIs(t, err, repository.ErrUnauthorized)
+}
+
+func TestRemoteUserRepositoryRetries(t *testing.T) {
+	// Fail twice, then succeed
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id": 1, "name": "John Doe"}`))
+	}))
+	defer server.Close()
+
+	remote := repository.NewRemoteUserRepository(server.URL, "")
+	remote.Backoff = time.Millisecond
+
+	user, err := remote.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "John Doe", user.Name)
+	assert.Equal(t, int32(3), attempts.Load())
+}
+
+func TestRemoteUserRepositoryUnavailable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	remote := repository.NewRemoteUserRepository(server.URL, "")
+	remote.Backoff = time.Millisecond
+
+	// Once retries run out, callers see the same error as a local outage
+	_, err := remote.FindUserByID(1)
+	assert.ErrorIs(t, err, repository.ErrUnavailable)
+}
+
+func TestRemoteUserRepositoryDoesNotRetryFailedWrites(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	remote := repository.NewRemoteUserRepository(server.URL, "")
+	remote.Backoff = time.Millisecond
+
+	// The server may have saved the user before failing, so don't try again
+	err := remote.SaveUser(&repository.User{Name: "Jane Doe"})
+	var remoteErr *repository.RemoteError
+	assert.ErrorAs(t, err, &remoteErr)
+	assert.Equal(t, int32(1), attempts.Load())
+}
+
+func TestRemoteUserRepositoryPolicyViolation(t *testing.T) {
+	users := &service.UserService{
+		Repo:     repository.NewMemoryUserRepository(),
+		Policies: service.UserPolicies{BlockedDomains: []string{"spam.example"}, ReservedDomains: []string{"corp.example"}},
+	}
+	server := httptest.NewServer(api.NewServer(users, "secret").Handler())
+	defer server.Close()
+	remote := repository.NewRemoteUserRepository(server.URL, "secret")
+
+	// Refusals come back as policy violations naming the rule, whether
+	// the API answered 422 or 403, rather than as a rejected token
+	for email, rule := range map[string]service.Rule{"a@spam.example": service.RuleBlockedDomain, "a@corp.example": service.RuleReservedDomain} {
+		err := remote.SaveUser(&repository.User{Name: "Ann", Email: email})
+		assert.ErrorIs(t, err, service.ErrPolicyViolation, email)
+		assert.NotErrorIs(t, err, repository.ErrUnauthorized, email)
+		var remoteErr *repository.RemoteError
+		assert.ErrorAs(t, err, &remoteErr)
+		assert.Equal(t, string(rule), remoteErr.Rule)
+	}
+}
+
+func TestRemoteUserRepositoryReadOnly(t *testing.T) {
+	users := &service.UserService{Repo: repository.NewMemoryUserRepository()}
+	server := api.NewServer(users, "secret")
+	server.ReadOnly = repository.NewReadOnlyUserRepository(users.Repo, true)
+	var attempts atomic.Int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		server.Handler().ServeHTTP(w, r)
+	}))
+	defer httpServer.Close()
+	remote := repository.NewRemoteUserRepository(httpServer.URL, "secret")
+	remote.Backoff = time.Millisecond
+
+	// A write refused while read-only isn't retried, nor mistaken for an
+	// outage
+	err := remote.SaveUser(&repository.User{Name: "Ann"})
+	assert.ErrorIs(t, err, repository.ErrReadOnly)
+	assert.NotErrorIs(t, err, repository.ErrUnavailable)
+	assert.Equal(t, int32(1), attempts.Load())
+}
@@ -0,0 +1,510 @@
+// Package repositorytest checks that a repository.UserRepository keeps the
+// interface's contract, so a new backend can prove it behaves like the
+// others by calling one function from its tests:
+//
+//	func TestSQLiteUserRepository(t *testing.T) {
+//		repositorytest.RunUserRepositoryTests(t, func(t *testing.T) repository.UserRepository {
+//			return newEmptySQLiteRepository(t)
+//		})
+//	}
+//
+// The suite covers every method, the errors each documents, and safety
+// under concurrent use. It is meant for complete backends; one that
+// returns repository.ErrNotSupported for some methods, such as
+// RemoteUserRepository, will fail those tests.
+package repositorytest
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gorepository/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory returns an empty repository for one test. Use t.Cleanup to
+// release anything it holds.
+type Factory func(t *testing.T) repository.UserRepository
+
+// RunUserRepositoryTests runs the suite against repositories from
+// factory, each test as a subtest with a repository of its own.
+func RunUserRepositoryTests(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, repo repository.UserRepository)
+	}{
+		{"SaveAndFind", testSaveAndFind},
+		{"NotFound", testNotFound},
+		{"SaveUsers", testSaveUsers},
+		{"InsertUsers", testInsertUsers},
+		{"Fields", testFields},
+		{"FindUsersWhere", testFindUsersWhere},
+		{"Search", testSearch},
+		{"Metadata", testMetadata},
+		{"UpdateAndHistory", testUpdateAndHistory},
+		{"UpdateUsers", testUpdateUsers},
+		{"RecordLogin", testRecordLogin},
+		{"Status", testStatus},
+		{"Anonymize", testAnonymize},
+		{"DeleteRestorePurge", testDeleteRestorePurge},
+		{"DeleteUsersWhere", testDeleteUsersWhere},
+		{"Isolation", testIsolation},
+		{"Concurrency", testConcurrency},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory(t))
+		})
+	}
+}
+
+// save saves a user with the given name and an email made from it.
+func save(t *testing.T, repo repository.UserRepository, name string) *repository.User {
+	t.Helper()
+	user := &repository.User{Name: name, Email: fmt.Sprintf("%s@example.com", name)}
+	require.NoError(t, repo.SaveUser(user))
+	return user
+}
+
+func names(users []*repository.User) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Name
+	}
+	return names
+}
+
+func testSaveAndFind(t *testing.T, repo repository.UserRepository) {
+	phone := "+447700900123"
+	user := &repository.User{Name: "Jane Doe", Email: "Jane.Doe@Example.com", Phone: &phone}
+	require.NoError(t, repo.SaveUser(user))
+	assert.NotZero(t, user.ID)
+	assert.False(t, user.CreatedAt.IsZero(), "SaveUser sets CreatedAt")
+
+	found, err := repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+	assert.Equal(t, "Jane.Doe@Example.com", found.Email)
+	assert.Equal(t, "jane.doe@example.com", found.NormalizedEmail)
+	assert.WithinDuration(t, user.CreatedAt, found.CreatedAt, time.Second)
+
+	// Emails match whatever their case
+	found, err = repo.FindUserByEmail(" JANE.DOE@example.com ")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	found, err = repo.FindUserByPhone(phone)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+}
+
+func testNotFound(t *testing.T, repo repository.UserRepository) {
+	_, err := repo.FindUserByID(999)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserByEmail("nobody@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserByPhone("+447700900999")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserHistory(999)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserAsOf(999, time.Now())
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	assert.ErrorIs(t, repo.UpdateUser(&repository.User{ID: 999, Name: "Nobody", Email: "nobody@example.com"}), repository.ErrUserNotFound)
+	assert.ErrorIs(t, repo.AnonymizeUser(999), repository.ErrUserNotFound)
+	assert.ErrorIs(t, repo.DeleteUser(999), repository.ErrUserNotFound)
+	_, err = repo.RestoreUser(999)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+func testSaveUsers(t *testing.T, repo repository.UserRepository) {
+	users := []*repository.User{
+		{Name: "Ann", Email: "ann@example.com"},
+		{Name: "Bob", Email: "bob@example.com"},
+		{Name: "Cat", Email: "cat@example.com"},
+	}
+	require.NoError(t, repo.SaveUsers(users))
+	assert.Less(t, users[0].ID, users[1].ID, "IDs are given in order")
+	assert.Less(t, users[1].ID, users[2].ID, "IDs are given in order")
+
+	// Unknown IDs are left out rather than failing the lookup
+	found, err := repo.FindUsersByIDs([]int{users[0].ID, users[2].ID, 999})
+	require.NoError(t, err)
+	assert.Len(t, found, 2)
+	assert.Equal(t, "Cat", found[users[2].ID].Name)
+
+	found, err = repo.FindUsersByIDs(nil)
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func testInsertUsers(t *testing.T, repo repository.UserRepository) {
+	ann := save(t, repo, "ann")
+	users := []*repository.User{
+		{ID: ann.ID + 10, Name: "Bob", Email: "bob@example.com"},
+		{ID: ann.ID + 5, Name: "Cat", Email: "cat@example.com"},
+	}
+	require.NoError(t, repo.InsertUsers(users))
+	bob, err := repo.FindUserByID(ann.ID + 10)
+	require.NoError(t, err)
+	assert.Equal(t, "Bob", bob.Name)
+	assert.False(t, bob.CreatedAt.IsZero())
+
+	// A taken ID fails the whole insert
+	err = repo.InsertUsers([]*repository.User{{ID: ann.ID + 20, Name: "Dan"}, {ID: ann.ID, Name: "Eve"}})
+	assert.ErrorIs(t, err, repository.ErrUserExists)
+	_, err = repo.FindUserByID(ann.ID + 20)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	// Users saved afterwards get IDs past those inserted
+	dan := save(t, repo, "dan")
+	assert.Greater(t, dan.ID, ann.ID+10)
+}
+
+func testFields(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+
+	// Only the fields asked for come back, and the ID always does
+	found, err := repo.FindUserByID(user.ID, repository.Fields("name"))
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+	assert.Equal(t, "jane", found.Name)
+	assert.Empty(t, found.Email)
+
+	_, err = repo.FindUserByID(user.ID, repository.Fields("password"))
+	assert.ErrorIs(t, err, repository.ErrUnknownField)
+}
+
+func testFindUsersWhere(t *testing.T, repo repository.UserRepository) {
+	var ids []int
+	for _, name := range []string{"ann", "bob", "cat", "dan"} {
+		ids = append(ids, save(t, repo, name).ID)
+	}
+
+	// Pages run in ID order from afterID
+	page, err := repo.FindUsersWhere(repository.And(), 0, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ann", "bob"}, names(page))
+	page, err = repo.FindUsersWhere(repository.And(), page[1].ID, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"cat", "dan"}, names(page))
+
+	// Backward reads down from afterID
+	page, err = repo.FindUsersWhere(repository.And(), ids[2], 10, repository.Backward())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob", "ann"}, names(page))
+
+	spec := repository.IDIn(ids[1], ids[3])
+	page, err = repo.FindUsersWhere(spec, 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"bob", "dan"}, names(page))
+
+	count, err := repo.CountUsersWhere(spec)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), count)
+	count, err = repo.CountUsersWhere(repository.And())
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+}
+
+func testSearch(t *testing.T, repo repository.UserRepository) {
+	for _, name := range []string{"John Smith", "Joanna Jones", "Mary Major"} {
+		require.NoError(t, repo.SaveUser(&repository.User{Name: name, Email: "user@example.com"}))
+	}
+
+	// Prefixes ignore case and come back ordered by name
+	found, err := repo.FindUsersByNamePrefix("jo")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Joanna Jones", "John Smith"}, names(found))
+
+	found, err = repo.FindUsersByNamePrefix("jo", repository.Limit(1))
+	require.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	// A misspelling still finds the closest name first
+	found, err = repo.SuggestUsers("Jon Smith")
+	require.NoError(t, err)
+	require.NotEmpty(t, found)
+	assert.Equal(t, "John Smith", found[0].Name)
+}
+
+func testMetadata(t *testing.T, repo repository.UserRepository) {
+	for i, plan := range []string{"pro", "free", "pro"} {
+		user := &repository.User{
+			Name:     fmt.Sprintf("user%d", i),
+			Email:    fmt.Sprintf("user%d@example.com", i),
+			Metadata: repository.Metadata{"plan": plan, "seats": 3},
+		}
+		require.NoError(t, repo.SaveUser(user))
+	}
+
+	found, err := repo.FindUsersByMetadata("plan", "pro")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user0", "user2"}, names(found))
+	assert.Equal(t, "pro", found[0].Metadata["plan"])
+
+	// Values compare as JSON, so 3 and 3.0 are the same
+	found, err = repo.FindUsersByMetadata("seats", 3.0, repository.Limit(1))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user0"}, names(found))
+
+	found, err = repo.FindUsersByMetadata("plan", "enterprise")
+	require.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func testUpdateAndHistory(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+
+	// A user who has never changed has no history
+	versions, err := repo.FindUserHistory(user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+
+	require.NoError(t, repo.UpdateUser(&repository.User{ID: user.ID, Name: "Jane Smith", Email: "Jane.Smith@example.com"}))
+	found, err := repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Smith", found.Name)
+	assert.Equal(t, "jane.smith@example.com", found.NormalizedEmail)
+	assert.WithinDuration(t, user.CreatedAt, found.CreatedAt, time.Second, "UpdateUser keeps CreatedAt")
+
+	// The lookup by email follows the change
+	_, err = repo.FindUserByEmail("jane@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserByEmail("jane.smith@example.com")
+	assert.NoError(t, err)
+
+	versions, err = repo.FindUserHistory(user.ID)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, "jane", versions[0].Name)
+	assert.Equal(t, repository.OperationUpdate, versions[0].Operation)
+
+	_, err = repo.FindUserAsOf(user.ID, user.CreatedAt.Add(-time.Hour))
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+func testUpdateUsers(t *testing.T, repo repository.UserRepository) {
+	ann, bob := save(t, repo, "ann"), save(t, repo, "bob")
+
+	require.NoError(t, repo.UpdateUsers([]*repository.User{
+		{ID: ann.ID, Name: "Ann Smith", Email: "Ann.Smith@example.com", Metadata: repository.Metadata{"plan": "pro"}},
+		{ID: bob.ID, Name: "Bob Jones", Email: "bob@example.com"},
+	}))
+	found, err := repo.FindUserByEmail("ann.smith@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "Ann Smith", found.Name)
+	assert.Equal(t, "pro", found.Metadata["plan"])
+	versions, err := repo.FindUserHistory(bob.ID)
+	require.NoError(t, err)
+	assert.Len(t, versions, 1)
+
+	// A missing user fails the whole update
+	err = repo.UpdateUsers([]*repository.User{{ID: ann.ID, Name: "Ann", Email: "ann@example.com"}, {ID: bob.ID + 100, Name: "Nobody"}})
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	found, err = repo.FindUserByID(ann.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Ann Smith", found.Name)
+}
+
+func testRecordLogin(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+	assert.Nil(t, user.LastLoginAt)
+
+	// Concurrent logins are all counted
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, repo.RecordLogin(user.ID))
+		}()
+	}
+	wg.Wait()
+
+	found, err := repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10, found.LoginCount)
+	require.NotNil(t, found.LastLoginAt)
+	assert.WithinDuration(t, time.Now(), *found.LastLoginAt, time.Minute)
+
+	// Logins aren't versions, and updates don't reset them
+	versions, err := repo.FindUserHistory(user.ID)
+	require.NoError(t, err)
+	assert.Empty(t, versions)
+	require.NoError(t, repo.UpdateUser(&repository.User{ID: user.ID, Name: "Jane Smith", Email: "jane@example.com"}))
+	found, err = repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10, found.LoginCount)
+
+	assert.ErrorIs(t, repo.RecordLogin(999), repository.ErrUserNotFound)
+}
+
+func testStatus(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+	assert.Equal(t, repository.StatusActive, user.Status, "users are saved active")
+	pending := &repository.User{Name: "joe", Email: "joe@example.com", Status: repository.StatusPending}
+	require.NoError(t, repo.SaveUser(pending))
+
+	require.NoError(t, repo.SetUserStatus(user.ID, repository.StatusActive, repository.StatusSuspended))
+	found, err := repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, repository.StatusSuspended, found.Status)
+
+	// The change is a version, and updates don't undo it
+	versions, err := repo.FindUserHistory(user.ID)
+	require.NoError(t, err)
+	require.Len(t, versions, 1)
+	assert.Equal(t, repository.StatusActive, versions[0].Status)
+	require.NoError(t, repo.UpdateUser(&repository.User{ID: user.ID, Name: "Jane Smith", Email: "jane@example.com"}))
+	found, err = repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, repository.StatusSuspended, found.Status)
+
+	// A change from a status the user no longer has is refused
+	err = repo.SetUserStatus(user.ID, repository.StatusActive, repository.StatusDeactivated)
+	assert.ErrorIs(t, err, repository.ErrStatusChanged)
+	assert.ErrorIs(t, repo.SetUserStatus(999, repository.StatusActive, repository.StatusSuspended), repository.ErrUserNotFound)
+
+	matched, err := repo.FindUsersWhere(repository.HasStatus(repository.StatusPending, repository.StatusSuspended), 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Jane Smith", "joe"}, names(matched))
+}
+
+func testAnonymize(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+	require.NoError(t, repo.UpdateUser(&repository.User{ID: user.ID, Name: "Jane Smith", Email: "jane@example.com"}))
+	require.NoError(t, repo.AnonymizeUser(user.ID))
+
+	found, err := repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "Anonymized User", found.Name)
+	assert.NotContains(t, found.Email, "jane")
+
+	// No version still holds personal data
+	versions, err := repo.FindUserHistory(user.ID)
+	require.NoError(t, err)
+	for _, version := range versions {
+		assert.NotContains(t, version.Name, "Jane")
+		assert.NotContains(t, version.Email, "jane")
+	}
+}
+
+func testDeleteRestorePurge(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+
+	// Only deleted users can be restored
+	_, err := repo.RestoreUser(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserExists)
+
+	require.NoError(t, repo.DeleteUser(user.ID))
+	_, err = repo.FindUserByID(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserByEmail("jane@example.com")
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+	restored, err := repo.RestoreUser(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, restored.ID)
+	assert.Equal(t, "jane", restored.Name)
+	found, err := repo.FindUserByEmail("jane@example.com")
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// Once purged, nothing is left to restore
+	require.NoError(t, repo.PurgeUser(user.ID))
+	_, err = repo.FindUserByID(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.RestoreUser(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserHistory(user.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+func testDeleteUsersWhere(t *testing.T, repo repository.UserRepository) {
+	ann, bob := save(t, repo, "ann"), save(t, repo, "bob")
+
+	// An empty specification would delete everyone
+	_, err := repo.DeleteUsersWhere(repository.And())
+	assert.ErrorIs(t, err, repository.ErrEmptySpecification)
+
+	deleted, err := repo.DeleteUsersWhere(repository.IDIn(ann.ID))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	_, err = repo.FindUserByID(ann.ID)
+	assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	_, err = repo.FindUserByID(bob.ID)
+	assert.NoError(t, err)
+
+	// The IDs returned are those of the users this call deleted
+	_, err = repo.DeleteUsersWhereReturningIDs(repository.And())
+	assert.ErrorIs(t, err, repository.ErrEmptySpecification)
+	ids, err := repo.DeleteUsersWhereReturningIDs(repository.IDIn(ann.ID, bob.ID))
+	require.NoError(t, err)
+	assert.Equal(t, []int{bob.ID}, ids)
+}
+
+func testIsolation(t *testing.T, repo repository.UserRepository) {
+	user := save(t, repo, "jane")
+
+	// Changing a user the caller holds doesn't change the stored one
+	user.Name = "Changed"
+	found, err := repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "jane", found.Name)
+
+	found.Name = "Changed Again"
+	found, err = repo.FindUserByID(user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "jane", found.Name)
+}
+
+func testConcurrency(t *testing.T, repo repository.UserRepository) {
+	const workers = 20
+	users := make([]*repository.User, workers)
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			users[i] = &repository.User{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i)}
+			assert.NoError(t, repo.SaveUser(users[i]))
+		}()
+	}
+	wg.Wait()
+
+	// Every concurrent save got an ID of its own
+	seen := map[int]bool{}
+	for _, user := range users {
+		assert.False(t, seen[user.ID], "ID %d given twice", user.ID)
+		seen[user.ID] = true
+	}
+
+	// Reads and writes of the same users can interleave
+	for i, user := range users {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			update := &repository.User{ID: user.ID, Name: fmt.Sprintf("renamed%d", i), Email: user.Email}
+			assert.NoError(t, repo.UpdateUser(update))
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := repo.FindUserByID(user.ID)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	count, err := repo.CountUsersWhere(repository.And())
+	require.NoError(t, err)
+	assert.Equal(t, int64(workers), count)
+	for i, user := range users {
+		found, err := repo.FindUserByID(user.ID)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("renamed%d", i), found.Name)
+	}
+}
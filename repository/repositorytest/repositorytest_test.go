@@ -0,0 +1,111 @@
+package repositorytest
+
+import (
+	"bytes"
+	"database/sql"
+	"gorepository/migrations"
+	"gorepository/repository"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryUserRepository(t *testing.T) {
+	RunUserRepositoryTests(t, func(t *testing.T) repository.UserRepository {
+		return repository.NewMemoryUserRepository()
+	})
+}
+
+func TestMockUserRepository(t *testing.T) {
+	RunUserRepositoryTests(t, func(t *testing.T) repository.UserRepository {
+		return &repository.MockUserRepository{}
+	})
+}
+
+func TestDecoratedUserRepository(t *testing.T) {
+	// The decorators keep the contract of the backend they wrap
+	RunUserRepositoryTests(t, func(t *testing.T) repository.UserRepository {
+		keys := &repository.Keyring{
+			Primary:  "2024",
+			Keys:     map[string][]byte{"2024": bytes.Repeat([]byte{1}, 32)},
+			IndexKey: bytes.Repeat([]byte{9}, 32),
+		}
+		var repo repository.UserRepository = repository.NewMemoryUserRepository()
+		repo = repository.NewEncryptedUserRepository(repo, keys, repository.NewMemoryBlindIndex())
+		repo = repository.NewCachingUserRepository(repo, time.Minute, 0)
+		repo = repository.NewLoggingUserRepository(repo, log.New(io.Discard, "", 0))
+		return repository.NewMetricsUserRepository(repo)
+	})
+}
+
+// TestPostgresUserRepository runs against the database at
+// $TEST_DATABASE_URL, emptying its users first. It is skipped without one.
+func TestPostgresUserRepository(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := migrations.Up(db); err != nil {
+		t.Fatal(err)
+	}
+
+	RunUserRepositoryTests(t, func(t *testing.T) repository.UserRepository {
+		if _, err := db.Exec("TRUNCATE users, users_history, user_email_index RESTART IDENTITY CASCADE"); err != nil {
+			t.Fatal(err)
+		}
+		return repository.NewPostgresUserRepository(db)
+	})
+}
+
+// TestPostgresQueryHooks checks what finds cost in queries, against the
+// database at $TEST_DATABASE_URL. It is skipped without one.
+func TestPostgresQueryHooks(t *testing.T) {
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := migrations.Up(db); err != nil {
+		t.Fatal(err)
+	}
+
+	counter := &repository.QueryCounter{}
+	repo := repository.NewPostgresUserRepository(db)
+	repo.Hooks = []repository.QueryHook{counter}
+
+	user := &repository.User{Name: "Jane Doe", Email: "jane.doe.hooks@example.com"}
+	if err := repo.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	defer repo.PurgeUser(user.ID)
+
+	counter.Reset()
+	if _, err := repo.FindUsersByIDs([]int{user.ID, user.ID + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := counter.Count(); n != 1 {
+		t.Errorf("FindUsersByIDs ran %d queries, want 1: %q", n, counter.Queries())
+	}
+}
+
+func TestSQLiteUserRepository(t *testing.T) {
+	RunUserRepositoryTests(t, func(t *testing.T) repository.UserRepository {
+		db, err := repository.OpenSQLite(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return repository.NewSQLiteUserRepository(db)
+	})
+}
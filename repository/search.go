@@ -0,0 +1,140 @@
+package repository
+
+import (
+	"slices"
+	"strings"
+)
+
+// DefaultSearchLimit is how many users FindUsersByNamePrefix and
+// SuggestUsers return when no Limit is given.
+const DefaultSearchLimit = 20
+
+// searchLimit resolves the Limit option for a search.
+func searchLimit(opts []FindOption) int {
+	if n := resolve(opts).limit; n > 0 {
+		return n
+	}
+	return DefaultSearchLimit
+}
+
+// hasNamePrefix reports whether name starts with prefix, ignoring case.
+func hasNamePrefix(name, prefix string) bool {
+	return strings.HasPrefix(strings.ToLower(name), strings.ToLower(prefix))
+}
+
+// suggestionDistance scores how closely name matches a typed query q, as
+// the smallest edit distance between q and either the whole name, any word
+// in it, or the start of it; lower is closer. ok is false when name is too
+// far from q to be worth suggesting.
+//
+// This is the fallback for backends without pg_trgm, so it aims to be
+// predictable rather than to rank exactly as Postgres would.
+func suggestionDistance(name, q string) (distance int, ok bool) {
+	name, q = strings.ToLower(name), strings.ToLower(strings.TrimSpace(q))
+	if q == "" {
+		return 0, false
+	}
+
+	candidates := append(strings.Fields(name), name)
+	if runes := []rune(name); len(runes) > len([]rune(q)) {
+		candidates = append(candidates, string(runes[:len([]rune(q))]))
+	}
+	distance = -1
+	for _, candidate := range candidates {
+		if d := editDistance(candidate, q); distance < 0 || d < distance {
+			distance = d
+		}
+	}
+	return distance, distance <= max(1, len([]rune(q))/3)
+}
+
+// editDistance returns the number of single-rune insertions, deletions,
+// substitutions and swaps of adjacent runes needed to turn a into b: the
+// Levenshtein distance, but counting a transposed pair, the commonest
+// typing slip, as one edit rather than two.
+func editDistance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	// d[i][j] is the distance between s[:i] and t[:j].
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// prefixUsers implements FindUsersByNamePrefix over a map of users,
+// returning copies with only the fields selected, ordered by name.
+func prefixUsers(users map[int]*User, prefix string, limit int, fields projection) []*User {
+	var matched []*User
+	for _, user := range users {
+		if hasNamePrefix(user.Name, prefix) {
+			matched = append(matched, user)
+		}
+	}
+	slices.SortFunc(matched, func(a, b *User) int {
+		if c := strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name)); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+	return projectUsers(matched[:min(len(matched), limit)], fields)
+}
+
+// suggestUsers implements SuggestUsers over a map of users, returning
+// copies with only the fields selected, closest first.
+func suggestUsers(users map[int]*User, q string, limit int, fields projection) []*User {
+	type scored struct {
+		user     *User
+		distance int
+	}
+	var matched []scored
+	for _, user := range users {
+		if d, ok := suggestionDistance(user.Name, q); ok {
+			matched = append(matched, scored{user, d})
+		}
+	}
+	slices.SortFunc(matched, func(a, b scored) int {
+		if a.distance != b.distance {
+			return a.distance - b.distance
+		}
+		return a.user.ID - b.user.ID
+	})
+
+	suggested := make([]*User, 0, min(len(matched), limit))
+	for _, m := range matched[:min(len(matched), limit)] {
+		suggested = append(suggested, m.user)
+	}
+	return projectUsers(suggested, fields)
+}
+
+// projectUsers copies users with only the fields selected.
+func projectUsers(users []*User, fields projection) []*User {
+	projected := make([]*User, len(users))
+	for i, user := range users {
+		projected[i] = fields.apply(copyUser(user))
+	}
+	return projected
+}
+
+// likePrefix escapes prefix for use as a LIKE pattern matching anything
+// that starts with it.
+func likePrefix(prefix string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(prefix))
+	return escaped + "%"
+}
@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("john", "john"))
+	assert.Equal(t, 1, editDistance("john", "jon"))
+	assert.Equal(t, 1, editDistance("john", "jhon"))
+	assert.Equal(t, 3, editDistance("kitten", "sitting"))
+	assert.Equal(t, 4, editDistance("", "josé"))
+}
+
+func TestMemoryUserRepositoryFindUsersByNamePrefix(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	assert.NoError(t, repo.SaveUsers([]*User{{Name: "john Doe"}, {Name: "Joan Smith"}, {Name: "Mary Major"}, {Name: "Jo_Anne"}}))
+
+	// Ordered by name, ignoring case
+	found, err := repo.FindUsersByNamePrefix("JO")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Jo_Anne", "Joan Smith", "john Doe"}, names(found))
+
+	found, err = repo.FindUsersByNamePrefix("jo", Limit(1), Fields("id"))
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.Equal(t, 4, found[0].ID)
+	assert.Empty(t, found[0].Name)
+
+	found, err = repo.FindUsersByNamePrefix("x")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func TestMemoryUserRepositorySuggestUsers(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	assert.NoError(t, repo.SaveUsers([]*User{{Name: "John Doe"}, {Name: "Joan Smith"}, {Name: "Mary Major"}}))
+
+	// A typo in the first name still finds them
+	found, err := repo.SuggestUsers("jhon")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"John Doe"}, names(found))
+
+	// Closest first, whichever word matches
+	found, err = repo.SuggestUsers("smith")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Joan Smith"}, names(found))
+	found, err = repo.SuggestUsers("jon")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"John Doe", "Joan Smith"}, names(found))
+
+	found, err = repo.SuggestUsers("  ")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func names(users []*User) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Name
+	}
+	return names
+}
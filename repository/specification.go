@@ -0,0 +1,234 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ErrEmptySpecification is returned by operations that refuse to run
+// against every user, when given a specification with no criteria.
+var ErrEmptySpecification = errors.New("specification has no criteria")
+
+// Specification selects users. Every backend must be able to evaluate one,
+// either against a User in memory or as a SQL condition.
+//
+// Specifications see users as they are stored, so they can't match on
+// fields EncryptedUserRepository encrypts; it refuses those that try with
+// ErrNotSupported.
+type Specification interface {
+	IsSatisfiedBy(user *User) bool
+	// SQL returns a condition for a WHERE clause over the users table. Its
+	// arguments are appended to args and its placeholders numbered to
+	// follow whatever is already there.
+	SQL(args *[]any) string
+}
+
+type createdBefore time.Time
+
+// CreatedBefore matches users created before t.
+func CreatedBefore(t time.Time) Specification {
+	return createdBefore(t)
+}
+
+func (s createdBefore) IsSatisfiedBy(user *User) bool {
+	return user.CreatedAt.Before(time.Time(s))
+}
+
+func (s createdBefore) SQL(args *[]any) string {
+	return "created_at < " + placeholder(args, time.Time(s))
+}
+
+type inactiveSince time.Time
+
+// InactiveSince matches users who haven't logged in since t, counting
+// users who have never logged in as last active when they were created.
+func InactiveSince(t time.Time) Specification {
+	return inactiveSince(t)
+}
+
+func (s inactiveSince) IsSatisfiedBy(user *User) bool {
+	lastActive := user.CreatedAt
+	if user.LastLoginAt != nil {
+		lastActive = *user.LastLoginAt
+	}
+	return lastActive.Before(time.Time(s))
+}
+
+func (s inactiveSince) SQL(args *[]any) string {
+	return "COALESCE(last_login_at, created_at) < " + placeholder(args, time.Time(s))
+}
+
+type unverified struct{}
+
+// Unverified matches users who have not verified their email.
+func Unverified() Specification {
+	return unverified{}
+}
+
+func (unverified) IsSatisfiedBy(user *User) bool {
+	return user.VerifiedAt == nil
+}
+
+func (unverified) SQL(args *[]any) string {
+	return "verified_at IS NULL"
+}
+
+type idIn []int
+
+// IDIn matches users with any of the given IDs.
+func IDIn(ids ...int) Specification {
+	return idIn(ids)
+}
+
+func (s idIn) IsSatisfiedBy(user *User) bool {
+	return slices.Contains(s, user.ID)
+}
+
+func (s idIn) SQL(args *[]any) string {
+	return "id = ANY(" + placeholder(args, pq.Array([]int(s))) + ")"
+}
+
+type hasStatus []Status
+
+// HasStatus matches users with any of the given statuses.
+func HasStatus(statuses ...Status) Specification {
+	return hasStatus(statuses)
+}
+
+func (s hasStatus) IsSatisfiedBy(user *User) bool {
+	return slices.Contains(s, user.Status.orDefault())
+}
+
+func (s hasStatus) SQL(args *[]any) string {
+	statuses := make([]string, len(s))
+	for i, status := range s {
+		statuses[i] = string(status)
+	}
+	return "status = ANY(" + placeholder(args, pq.Array(statuses)) + ")"
+}
+
+type emailDomain string
+
+// EmailDomain matches users whose email address is at domain, ignoring
+// case.
+func EmailDomain(domain string) Specification {
+	return emailDomain(strings.ToLower(domain))
+}
+
+func (s emailDomain) IsSatisfiedBy(user *User) bool {
+	_, domain, ok := strings.Cut(user.Email, "@")
+	return ok && strings.ToLower(domain) == string(s)
+}
+
+func (s emailDomain) SQL(args *[]any) string {
+	return "lower(split_part(email, '@', 2)) = " + placeholder(args, string(s))
+}
+
+type anonymized struct{}
+
+// Anonymized matches users who have been anonymized, by the tombstone
+// email User.Anonymize gives them. That email is stored as it is, even by
+// EncryptedUserRepository, so this matches beneath one too.
+func Anonymized() Specification {
+	return anonymized{}
+}
+
+func (anonymized) IsSatisfiedBy(user *User) bool {
+	tombstone := User{ID: user.ID}
+	tombstone.Anonymize()
+	return user.Email == tombstone.Email
+}
+
+func (anonymized) SQL(args *[]any) string {
+	return "email = 'anonymized-' || id || '@invalid'"
+}
+
+type not struct{ spec Specification }
+
+// Not matches users who don't satisfy spec.
+func Not(spec Specification) Specification {
+	return not{spec}
+}
+
+func (s not) IsSatisfiedBy(user *User) bool {
+	return !s.spec.IsSatisfiedBy(user)
+}
+
+func (s not) SQL(args *[]any) string {
+	return "NOT (" + s.spec.SQL(args) + ")"
+}
+
+type and []Specification
+
+// And matches users satisfying every one of specs. With no specs it
+// matches every user.
+func And(specs ...Specification) Specification {
+	return and(specs)
+}
+
+func (s and) IsSatisfiedBy(user *User) bool {
+	for _, spec := range s {
+		if !spec.IsSatisfiedBy(user) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s and) SQL(args *[]any) string {
+	if len(s) == 0 {
+		return "TRUE"
+	}
+	conditions := make([]string, len(s))
+	for i, spec := range s {
+		conditions[i] = "(" + spec.SQL(args) + ")"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// IsEmpty reports whether spec has no criteria, and so would match every
+// user.
+func IsEmpty(spec Specification) bool {
+	if spec == nil {
+		return true
+	}
+	if specs, ok := spec.(and); ok {
+		for _, s := range specs {
+			if !IsEmpty(s) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// matchesEncrypted reports whether spec matches on a field that
+// EncryptedUserRepository encrypts, which it would only ever see as
+// ciphertext.
+func matchesEncrypted(spec Specification) bool {
+	switch s := spec.(type) {
+	case emailDomain:
+		return true
+	case not:
+		return matchesEncrypted(s.spec)
+	case and:
+		for _, spec := range s {
+			if matchesEncrypted(spec) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// placeholder appends value to args and returns its $n placeholder.
+func placeholder(args *[]any, value any) string {
+	*args = append(*args, value)
+	return fmt.Sprintf("$%d", len(*args))
+}
@@ -0,0 +1,93 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpecificationSQL(t *testing.T) {
+	var args []any
+	sql := And(EmailDomain("Example.TEST"), Unverified()).SQL(&args)
+	assert.Equal(t, "(lower(split_part(email, '@', 2)) = $1) AND (verified_at IS NULL)", sql)
+	assert.Equal(t, []any{"example.test"}, args)
+}
+
+func TestEmailDomain(t *testing.T) {
+	spec := EmailDomain("example.test")
+	assert.True(t, spec.IsSatisfiedBy(&User{Email: "jane@EXAMPLE.test"}))
+	assert.False(t, spec.IsSatisfiedBy(&User{Email: "jane@example.test.com"}))
+	assert.False(t, spec.IsSatisfiedBy(&User{Email: "example.test"}))
+}
+
+func TestInactiveSince(t *testing.T) {
+	cutoff := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	recent, old := cutoff.AddDate(0, 0, 1), cutoff.AddDate(0, -1, 0)
+	spec := InactiveSince(cutoff)
+
+	// Users who never logged in count from when they were created
+	assert.True(t, spec.IsSatisfiedBy(&User{CreatedAt: old}))
+	assert.False(t, spec.IsSatisfiedBy(&User{CreatedAt: recent}))
+	assert.True(t, spec.IsSatisfiedBy(&User{CreatedAt: old, LastLoginAt: &old}))
+	assert.False(t, spec.IsSatisfiedBy(&User{CreatedAt: old, LastLoginAt: &recent}))
+
+	var args []any
+	assert.Equal(t, "COALESCE(last_login_at, created_at) < $1", spec.SQL(&args))
+	assert.Equal(t, []any{cutoff}, args)
+}
+
+func TestHasStatus(t *testing.T) {
+	spec := HasStatus(StatusSuspended, StatusDeactivated)
+	assert.True(t, spec.IsSatisfiedBy(&User{Status: StatusSuspended}))
+	assert.False(t, spec.IsSatisfiedBy(&User{Status: StatusActive}))
+	// Users without a status are active
+	assert.True(t, HasStatus(StatusActive).IsSatisfiedBy(&User{}))
+
+	var args []any
+	assert.Equal(t, "status = ANY($1)", spec.SQL(&args))
+	assert.Len(t, args, 1)
+}
+
+func TestAnonymized(t *testing.T) {
+	user := &User{ID: 7, Name: "Jane Doe", Email: "jane@example.test"}
+	assert.False(t, Anonymized().IsSatisfiedBy(user))
+	assert.True(t, Not(Anonymized()).IsSatisfiedBy(user))
+
+	user.Anonymize()
+	assert.True(t, Anonymized().IsSatisfiedBy(user))
+	// Another user's tombstone doesn't count
+	assert.False(t, Anonymized().IsSatisfiedBy(&User{ID: 8, Email: user.Email}))
+
+	var args []any
+	assert.Equal(t, "NOT (email = 'anonymized-' || id || '@invalid')", Not(Anonymized()).SQL(&args))
+	assert.Empty(t, args)
+}
+
+func TestIsEmpty(t *testing.T) {
+	assert.True(t, IsEmpty(nil))
+	assert.True(t, IsEmpty(And()))
+	assert.True(t, IsEmpty(And(And())))
+	assert.False(t, IsEmpty(And(Unverified())))
+	assert.False(t, IsEmpty(IDIn()))
+}
+
+func TestDeleteUsersWhere(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	assert.NoError(t, repo.SaveUsers([]*User{
+		{Name: "A", Email: "a@example.test"},
+		{Name: "B", Email: "b@example.com"},
+		{Name: "C", Email: "c@example.test"},
+	}))
+
+	// An empty specification would delete everyone, so it is refused
+	_, err := repo.DeleteUsersWhere(And())
+	assert.ErrorIs(t, err, ErrEmptySpecification)
+
+	n, err := repo.DeleteUsersWhere(EmailDomain("example.test"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	_, err = repo.FindUserByID(2)
+	assert.NoError(t, err)
+}
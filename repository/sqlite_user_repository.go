@@ -0,0 +1,864 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the tables SQLiteUserRepository needs, if they don't
+// exist. It mirrors the Postgres schema the migrations build, with
+// triggers keeping users_history in the same way.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	name             TEXT NOT NULL,
+	email            TEXT NOT NULL,
+	created_at       TIMESTAMP NOT NULL,
+	verified_at      TIMESTAMP,
+	normalized_email TEXT NOT NULL,
+	phone            TEXT,
+	metadata         TEXT NOT NULL DEFAULT '{}',
+	last_login_at    TIMESTAMP,
+	login_count      INTEGER NOT NULL DEFAULT 0,
+	status           TEXT NOT NULL DEFAULT 'active'
+		CHECK (status IN ('pending', 'active', 'suspended', 'deactivated'))
+);
+
+CREATE INDEX IF NOT EXISTS users_normalized_email_idx ON users (normalized_email);
+CREATE INDEX IF NOT EXISTS users_phone_idx ON users (phone);
+CREATE INDEX IF NOT EXISTS users_lower_name_idx ON users (lower(name));
+
+CREATE TABLE IF NOT EXISTS users_history (
+	history_id    INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id       INTEGER NOT NULL,
+	name          TEXT NOT NULL,
+	email         TEXT NOT NULL,
+	created_at    TIMESTAMP NOT NULL,
+	verified_at   TIMESTAMP,
+	phone         TEXT,
+	metadata      TEXT NOT NULL DEFAULT '{}',
+	last_login_at TIMESTAMP,
+	login_count   INTEGER NOT NULL DEFAULT 0,
+	status        TEXT NOT NULL DEFAULT 'active',
+	changed_at    TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+	operation     TEXT NOT NULL CHECK (operation IN ('update', 'delete'))
+);
+
+CREATE INDEX IF NOT EXISTS users_history_user_id_idx ON users_history (user_id, changed_at);
+
+CREATE TRIGGER IF NOT EXISTS users_history_update AFTER UPDATE ON users
+FOR EACH ROW WHEN OLD.name IS NOT NEW.name OR OLD.email IS NOT NEW.email
+	OR OLD.normalized_email IS NOT NEW.normalized_email OR OLD.created_at IS NOT NEW.created_at
+	OR OLD.verified_at IS NOT NEW.verified_at OR OLD.phone IS NOT NEW.phone
+	OR OLD.metadata IS NOT NEW.metadata OR OLD.status IS NOT NEW.status
+BEGIN
+	INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, operation)
+	VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, OLD.metadata, OLD.last_login_at, OLD.login_count, OLD.status, 'update');
+END;
+
+CREATE TRIGGER IF NOT EXISTS users_history_delete AFTER DELETE ON users
+FOR EACH ROW
+BEGIN
+	INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, operation)
+	VALUES (OLD.id, OLD.name, OLD.email, OLD.created_at, OLD.verified_at, OLD.phone, OLD.metadata, OLD.last_login_at, OLD.login_count, OLD.status, 'delete');
+END;
+`
+
+// sqliteBatchSize caps how many IDs go into one IN list, well under
+// SQLite's limit on bound parameters.
+const sqliteBatchSize = 500
+
+// OpenSQLite opens the SQLite database at dsn, a file name or ":memory:",
+// and creates the tables SQLiteUserRepository needs if they aren't there.
+// SQLite writes one transaction at a time, so the pool holds a single
+// connection, which also keeps an in-memory database alive for as long as
+// the pool is open.
+func OpenSQLite(dsn string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("repository: creating the sqlite schema: %w", err)
+	}
+	return db, nil
+}
+
+// SQLiteUserRepository implements UserRepository over a SQLite database
+// opened with OpenSQLite, for small deployments and local development
+// without a Postgres server.
+//
+// SQLite doesn't speak the Postgres SQL that specifications produce, and
+// has neither JSONB nor pg_trgm, so specifications, metadata finds and
+// suggestions are checked in Go, as the memory backend checks them, over
+// the users read a row at a time in ID order. Name prefixes ignore case
+// in ASCII letters only, as SQLite's lower() does, and the triggers
+// timestamp versions to the millisecond, the finest SQLite's clock gives.
+type SQLiteUserRepository struct {
+	DB *sql.DB
+	// StatementTimeout, when greater than zero, bounds every statement
+	// the repository runs, and every transaction as a whole. Finds can
+	// override it with the Timeout option.
+	StatementTimeout time.Duration
+	// Emails normalizes addresses into the normalized_email column, which
+	// FindUserByEmail looks them up by.
+	Emails EmailNormalizer
+	// Hooks are told about every statement the repository runs; see
+	// QueryHook. Set them before the repository is used.
+	Hooks []QueryHook
+}
+
+var (
+	_ UserRepository  = (*SQLiteUserRepository)(nil)
+	_ HistoryArchiver = (*SQLiteUserRepository)(nil)
+)
+
+func NewSQLiteUserRepository(db *sql.DB) *SQLiteUserRepository {
+	return &SQLiteUserRepository{DB: db}
+}
+
+func (r *SQLiteUserRepository) FindUserByID(id int, opts ...FindOption) (*User, error) {
+	return r.findOne(opts, "id = ?", id)
+}
+
+func (r *SQLiteUserRepository) FindUserByEmail(email string, opts ...FindOption) (*User, error) {
+	return r.findOne(opts, "normalized_email = ?", r.Emails.Normalize(email))
+}
+
+func (r *SQLiteUserRepository) FindUserByPhone(phone string, opts ...FindOption) (*User, error) {
+	return r.findOne(opts, "phone = ?", phone)
+}
+
+// findOne returns the user with the lowest ID matching where.
+func (r *SQLiteUserRepository) findOne(opts []FindOption, where string, args ...any) (*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT " + fields.columns() + " FROM users WHERE " + where + " ORDER BY id LIMIT 1"
+
+	var user *User
+	err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+		user, err = fields.scan(q.QueryRowContext(ctx, query, args...))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	return user, err
+}
+
+// FindUsersByIDs looks the users up a batch of IDs at a time.
+func (r *SQLiteUserRepository) FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[int]*User, len(ids))
+
+	err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+		for start := 0; start < len(ids); start += sqliteBatchSize {
+			batch := ids[start:min(start+sqliteBatchSize, len(ids))]
+			query := "SELECT " + fields.columns() + " FROM users WHERE id IN (" + sqlitePlaceholders(len(batch)) + ")"
+			err := eachRow(ctx, q, query, sqliteArgs(batch), func(rows *sql.Rows) error {
+				user, err := fields.scan(rows)
+				if err != nil {
+					return err
+				}
+				users[user.ID] = user
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (r *SQLiteUserRepository) FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT " + allFields.columns() + " FROM users WHERE id > ?1 ORDER BY id"
+	if resolve(opts).backward {
+		query = "SELECT " + allFields.columns() + " FROM users WHERE (?1 = 0 OR id < ?1) ORDER BY id DESC"
+	}
+
+	var users []*User
+	err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+		users = nil
+		return r.eachUser(ctx, q, query, []any{afterID}, func(user *User) bool {
+			if len(users) >= limit {
+				return false
+			}
+			if spec.IsSatisfiedBy(user) {
+				users = append(users, fields.apply(user))
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (r *SQLiteUserRepository) CountUsersWhere(spec Specification) (int64, error) {
+	var count int64
+	err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+		count = 0
+		if IsEmpty(spec) {
+			return q.QueryRowContext(ctx, "SELECT count(*) FROM users").Scan(&count)
+		}
+		return r.eachUser(ctx, q, "SELECT "+allFields.columns()+" FROM users", nil, func(user *User) bool {
+			if spec.IsSatisfiedBy(user) {
+				count++
+			}
+			return true
+		})
+	})
+	return count, err
+}
+
+// FindUsersByNamePrefix uses the index on lower(name), ordering as the
+// Postgres backend does.
+func (r *SQLiteUserRepository) FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT " + fields.columns() + ` FROM users WHERE lower(name) LIKE ? ESCAPE '\' ORDER BY lower(name), id LIMIT ?`
+
+	var users []*User
+	err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+		users = nil
+		return eachRow(ctx, q, query, []any{likePrefix(prefix), searchLimit(opts)}, func(rows *sql.Rows) error {
+			user, err := fields.scan(rows)
+			if err != nil {
+				return err
+			}
+			users = append(users, user)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// SuggestUsers ranks every user's name against q as the memory backend
+// does.
+func (r *SQLiteUserRepository) SuggestUsers(q string, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	users := map[int]*User{}
+	err = r.run(r.timeout(opts), func(ctx context.Context, querier querier) error {
+		clear(users)
+		return r.eachUser(ctx, querier, "SELECT "+allFields.columns()+" FROM users", nil, func(user *User) bool {
+			users[user.ID] = user
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return suggestUsers(users, q, searchLimit(opts), fields), nil
+}
+
+func (r *SQLiteUserRepository) FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error) {
+	fields, err := projectionOf(opts)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := metadataSpec(key, value)
+	if err != nil {
+		return nil, err
+	}
+	limit := metadataLimit(opts)
+
+	var users []*User
+	err = r.run(r.timeout(opts), func(ctx context.Context, q querier) error {
+		users = nil
+		return r.eachUser(ctx, q, "SELECT "+allFields.columns()+" FROM users ORDER BY id", nil, func(user *User) bool {
+			if len(users) >= limit {
+				return false
+			}
+			if spec.IsSatisfiedBy(user) {
+				users = append(users, fields.apply(user))
+			}
+			return true
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// FindUserHistory reads users_history, which triggers keep up to date.
+func (r *SQLiteUserRepository) FindUserHistory(id int) ([]UserVersion, error) {
+	query := `
+	SELECT history_id, user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation
+	FROM users_history WHERE user_id = ? ORDER BY changed_at, history_id`
+
+	var versions []UserVersion
+	err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+		versions = []UserVersion{}
+		return eachRow(ctx, q, query, []any{id}, func(rows *sql.Rows) error {
+			v, _, err := r.scanVersion(rows)
+			versions = append(versions, v)
+			return err
+		})
+	})
+	if err != nil || len(versions) > 0 {
+		return versions, err
+	}
+
+	// No history is fine as long as the user exists
+	if _, err := r.FindUserByID(id, Fields("id")); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// FindUserAsOf picks the first version still valid at the given time: the
+// earliest history row changed after it, or failing that the current row.
+func (r *SQLiteUserRepository) FindUserAsOf(id int, at time.Time) (*User, error) {
+	query := `
+	SELECT history_id, user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation
+	FROM users_history WHERE user_id = ? AND changed_at > ? ORDER BY changed_at, history_id LIMIT 1`
+
+	var user *User
+	err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+		user = nil
+		err := eachRow(ctx, q, query, []any{id, at.UTC()}, func(rows *sql.Rows) error {
+			v, _, err := r.scanVersion(rows)
+			user = &v.User
+			return err
+		})
+		if err != nil || user != nil {
+			return err
+		}
+		user, err = allFields.scan(q.QueryRowContext(ctx, "SELECT "+allFields.columns()+" FROM users WHERE id = ?", id))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	user.NormalizedEmail = r.Emails.Normalize(user.Email)
+	return existedAt(user, at)
+}
+
+func (r *SQLiteUserRepository) SaveUser(user *User) error {
+	return r.SaveUsers([]*User{user})
+}
+
+// SaveUsers inserts the users one statement at a time in a single
+// transaction. The generated IDs are written back to the users they belong
+// to once the transaction commits.
+func (r *SQLiteUserRepository) SaveUsers(users []*User) error {
+	return r.insertUsers(users, false)
+}
+
+// InsertUsers inserts the users with their own IDs in one transaction, as
+// SaveUsers does. IDs come from an AUTOINCREMENT sequence, which SQLite
+// moves past every ID inserted and never moves back, so the IDs of deleted
+// users are never handed out again.
+func (r *SQLiteUserRepository) InsertUsers(users []*User) error {
+	return r.insertUsers(users, true)
+}
+
+// insertUsers implements SaveUsers, and InsertUsers with keepIDs.
+func (r *SQLiteUserRepository) insertUsers(users []*User, keepIDs bool) error {
+	query := `
+	INSERT INTO users (id, name, email, created_at, verified_at, normalized_email, phone, metadata, last_login_at, login_count, status)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	ids := make([]int, len(users))
+	createdAts := make([]time.Time, len(users))
+	err := r.withinTx(func(ctx context.Context, q querier) error {
+		if keepIDs {
+			if err := r.checkIDsFree(ctx, q, users); err != nil {
+				return err
+			}
+		}
+		for i, user := range users {
+			metadata, err := sqliteMetadata(user.Metadata)
+			if err != nil {
+				return err
+			}
+			var id any
+			if keepIDs {
+				id = user.ID
+			}
+			createdAts[i] = user.CreatedAt
+			if createdAts[i].IsZero() {
+				createdAts[i] = time.Now()
+			}
+			result, err := q.ExecContext(ctx, query, id, user.Name, user.Email, createdAts[i].UTC(), sqliteTime(user.VerifiedAt),
+				r.Emails.Normalize(user.Email), user.Phone, metadata, sqliteTime(user.LastLoginAt), user.LoginCount, user.Status.orDefault())
+			if err != nil {
+				return err
+			}
+			last, err := result.LastInsertId()
+			if err != nil {
+				return err
+			}
+			ids[i] = int(last)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, user := range users {
+		user.ID, user.CreatedAt = ids[i], createdAts[i]
+		user.NormalizedEmail = r.Emails.Normalize(user.Email)
+		user.Status = user.Status.orDefault()
+	}
+	return nil
+}
+
+func (r *SQLiteUserRepository) UpdateUser(user *User) error {
+	return r.UpdateUsers([]*User{user})
+}
+
+// UpdateUsers updates the users one statement at a time in a single
+// transaction, rolling back at the first that matches no row.
+func (r *SQLiteUserRepository) UpdateUsers(users []*User) error {
+	query := "UPDATE users SET name = ?, email = ?, verified_at = ?, normalized_email = ?, phone = ?, metadata = ? WHERE id = ?"
+
+	normalized := make([]string, len(users))
+	err := r.withinTx(func(ctx context.Context, q querier) error {
+		for i, user := range users {
+			metadata, err := sqliteMetadata(user.Metadata)
+			if err != nil {
+				return err
+			}
+			normalized[i] = r.Emails.Normalize(user.Email)
+			result, err := q.ExecContext(ctx, query, user.Name, user.Email, sqliteTime(user.VerifiedAt), normalized[i], user.Phone, metadata, user.ID)
+			if err != nil {
+				return err
+			}
+			if err := expectOneRow(result); err != nil {
+				return fmt.Errorf("%w: user %d", err, user.ID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, user := range users {
+		user.NormalizedEmail = normalized[i]
+	}
+	return nil
+}
+
+// RecordLogin updates both fields in one statement, so concurrent logins
+// can't overwrite each other's count. The history trigger ignores changes
+// to them alone.
+func (r *SQLiteUserRepository) RecordLogin(id int) error {
+	query := "UPDATE users SET last_login_at = ?, login_count = login_count + 1 WHERE id = ?"
+	return r.exec(query, time.Now().UTC(), id)
+}
+
+// SetUserStatus only updates the row while it still has the from status.
+// When it doesn't, a second lookup tells a missing user from a changed one.
+func (r *SQLiteUserRepository) SetUserStatus(id int, from, to Status) error {
+	if _, err := ParseStatus(string(to)); err != nil {
+		return err
+	}
+	err := r.exec("UPDATE users SET status = ? WHERE id = ? AND status = ?", to, id, from)
+	if !errors.Is(err, ErrUserNotFound) {
+		return err
+	}
+	user, err := r.FindUserByID(id, Fields("status"))
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: user %d is %s, not %s", ErrStatusChanged, id, user.Status, from)
+}
+
+// AnonymizeUser scrubs the user and their history in one transaction, so
+// the history never holds personal data the user no longer does.
+func (r *SQLiteUserRepository) AnonymizeUser(id int) error {
+	tombstone := &User{ID: id}
+	tombstone.Anonymize()
+
+	return r.withinTx(func(ctx context.Context, q querier) error {
+		result, err := q.ExecContext(ctx, "UPDATE users SET name = ?, email = ?, normalized_email = ?, phone = NULL, metadata = '{}' WHERE id = ?", tombstone.Name, tombstone.Email, tombstone.NormalizedEmail, id)
+		if err != nil {
+			return err
+		}
+		if err := expectOneRow(result); err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, "UPDATE users_history SET name = ?, email = ?, phone = NULL, metadata = '{}' WHERE user_id = ?", tombstone.Name, tombstone.Email, id)
+		return err
+	})
+}
+
+func (r *SQLiteUserRepository) DeleteUser(id int) error {
+	return r.exec("DELETE FROM users WHERE id = ?", id)
+}
+
+// RestoreUser re-inserts the version of the user kept in users_history by
+// their most recent delete. History doesn't keep normalized emails, so the
+// restored one is normalized afresh.
+func (r *SQLiteUserRepository) RestoreUser(id int) (*User, error) {
+	query := `
+	SELECT history_id, user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation
+	FROM users_history WHERE user_id = ? AND operation = 'delete'
+	ORDER BY changed_at DESC, history_id DESC LIMIT 1`
+	insert := `
+	INSERT INTO users (id, name, email, created_at, verified_at, normalized_email, phone, metadata, last_login_at, login_count, status)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	var user *User
+	err := r.withinTx(func(ctx context.Context, q querier) error {
+		var exists bool
+		if err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM users WHERE id = ?)", id).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			return ErrUserExists
+		}
+		user = nil
+		err := eachRow(ctx, q, query, []any{id}, func(rows *sql.Rows) error {
+			v, _, err := r.scanVersion(rows)
+			user = &v.User
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return ErrUserNotFound
+		}
+		metadata, err := sqliteMetadata(user.Metadata)
+		if err != nil {
+			return err
+		}
+		_, err = q.ExecContext(ctx, insert, user.ID, user.Name, user.Email, user.CreatedAt.UTC(), sqliteTime(user.VerifiedAt),
+			user.NormalizedEmail, user.Phone, metadata, sqliteTime(user.LastLoginAt), user.LoginCount, user.Status)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// PurgeUser deletes the user and then their history, which includes the
+// version the delete itself just recorded.
+func (r *SQLiteUserRepository) PurgeUser(id int) error {
+	return r.withinTx(func(ctx context.Context, q querier) error {
+		var purged int64
+		for _, query := range []string{
+			"DELETE FROM users WHERE id = ?",
+			"DELETE FROM users_history WHERE user_id = ?",
+		} {
+			result, err := q.ExecContext(ctx, query, id)
+			if err != nil {
+				return err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			purged += n
+		}
+		if purged == 0 {
+			return ErrUserNotFound
+		}
+		return nil
+	})
+}
+
+func (r *SQLiteUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	ids, err := r.DeleteUsersWhereReturningIDs(spec)
+	return int64(len(ids)), err
+}
+
+// DeleteUsersWhereReturningIDs finds the matching users and deletes them
+// by ID in one transaction, which no other write can interleave with.
+func (r *SQLiteUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	if IsEmpty(spec) {
+		return nil, ErrEmptySpecification
+	}
+
+	var ids []int
+	err := r.withinTx(func(ctx context.Context, q querier) error {
+		ids = nil
+		err := r.eachUser(ctx, q, "SELECT "+allFields.columns()+" FROM users ORDER BY id", nil, func(user *User) bool {
+			if spec.IsSatisfiedBy(user) {
+				ids = append(ids, user.ID)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(ids); start += sqliteBatchSize {
+			batch := ids[start:min(start+sqliteBatchSize, len(ids))]
+			if _, err := q.ExecContext(ctx, "DELETE FROM users WHERE id IN ("+sqlitePlaceholders(len(batch))+")", sqliteArgs(batch)...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// EachUserVersion reads users_history a page at a time in the order it was
+// written, which is each user's oldest first, so the whole table is never
+// held at once. Each page is read under StatementTimeout.
+func (r *SQLiteUserRepository) EachUserVersion(fn func(UserVersion) error) error {
+	query := `
+	SELECT history_id, user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation
+	FROM users_history WHERE history_id > ? ORDER BY history_id LIMIT ?`
+
+	var after int64
+	for {
+		var versions []UserVersion
+		err := r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+			versions = nil
+			return eachRow(ctx, q, query, []any{after, historyPageSize}, func(rows *sql.Rows) error {
+				v, historyID, err := r.scanVersion(rows)
+				versions, after = append(versions, v), historyID
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			if err := fn(version); err != nil {
+				return err
+			}
+		}
+		if len(versions) < historyPageSize {
+			return nil
+		}
+	}
+}
+
+// InsertUserVersions inserts the versions into users_history in one
+// transaction, then moves the users' AUTOINCREMENT sequence past their
+// users, so a deleted user's ID isn't handed out again.
+func (r *SQLiteUserRepository) InsertUserVersions(versions []UserVersion) error {
+	query := `
+	INSERT INTO users_history (user_id, name, email, created_at, verified_at, phone, metadata, last_login_at, login_count, status, changed_at, operation)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	if len(versions) == 0 {
+		return nil
+	}
+	return r.withinTx(func(ctx context.Context, q querier) error {
+		highest := 0
+		for _, v := range versions {
+			metadata, err := sqliteMetadata(v.Metadata)
+			if err != nil {
+				return err
+			}
+			_, err = q.ExecContext(ctx, query, v.ID, v.Name, v.Email, v.CreatedAt.UTC(), sqliteTime(v.VerifiedAt), v.Phone, metadata,
+				sqliteTime(v.LastLoginAt), v.LoginCount, v.Status.orDefault(), v.ChangedAt.UTC(), v.Operation)
+			if err != nil {
+				return err
+			}
+			highest = max(highest, v.ID)
+		}
+
+		result, err := q.ExecContext(ctx, "UPDATE sqlite_sequence SET seq = max(seq, ?) WHERE name = 'users'", highest)
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		_, err = q.ExecContext(ctx, "INSERT INTO sqlite_sequence (name, seq) VALUES ('users', ?)", highest)
+		return err
+	})
+}
+
+// scanVersion reads a users_history row selected with every column, in
+// table order, returning its history_id alongside.
+func (r *SQLiteUserRepository) scanVersion(rows *sql.Rows) (UserVersion, int64, error) {
+	var v UserVersion
+	var historyID int64
+	err := rows.Scan(&historyID, &v.ID, &v.Name, &v.Email, &v.CreatedAt, &v.VerifiedAt, &v.Phone, &v.Metadata, &v.LastLoginAt, &v.LoginCount, &v.Status, &v.ChangedAt, &v.Operation)
+	v.NormalizedEmail = r.Emails.Normalize(v.Email)
+	return v, historyID, err
+}
+
+// eachUser calls fn with every user query selects, with every field,
+// until fn returns false.
+func (r *SQLiteUserRepository) eachUser(ctx context.Context, q querier, query string, args []any, fn func(*User) bool) error {
+	errStop := errors.New("stop")
+	err := eachRow(ctx, q, query, args, func(rows *sql.Rows) error {
+		user, err := allFields.scan(rows)
+		if err != nil {
+			return err
+		}
+		if !fn(user) {
+			return errStop
+		}
+		return nil
+	})
+	if errors.Is(err, errStop) {
+		return nil
+	}
+	return err
+}
+
+// eachRow runs query and calls fn with each row it returns, stopping at
+// the first error.
+func eachRow(ctx context.Context, q querier, query string, args []any, fn func(*sql.Rows) error) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// timeout returns the timeout for a find: its Timeout option if given,
+// otherwise StatementTimeout.
+func (r *SQLiteUserRepository) timeout(opts []FindOption) time.Duration {
+	if o := resolve(opts); o.timeout > 0 {
+		return o.timeout
+	}
+	return r.StatementTimeout
+}
+
+// run calls fn to run statements against the database, under a context
+// deadline when there is a timeout, marking errors with ErrQueryTimeout
+// where they apply.
+func (r *SQLiteUserRepository) run(timeout time.Duration, fn func(ctx context.Context, q querier) error) error {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return timeoutError(fn(ctx, withHooks(r.DB, r.Hooks)))
+}
+
+// withinTx runs fn in a transaction under StatementTimeout, committing if
+// it returns nil and rolling back otherwise.
+func (r *SQLiteUserRepository) withinTx(fn func(ctx context.Context, q querier) error) error {
+	return r.run(r.StatementTimeout, func(ctx context.Context, _ querier) error {
+		tx, err := r.DB.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(ctx, withHooks(tx, r.Hooks)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// exec runs a single-row update under StatementTimeout.
+func (r *SQLiteUserRepository) exec(query string, args ...any) error {
+	return r.run(r.StatementTimeout, func(ctx context.Context, q querier) error {
+		result, err := q.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		return expectOneRow(result)
+	})
+}
+
+// checkIDsFree returns ErrUserExists if any of the users' IDs is taken.
+func (r *SQLiteUserRepository) checkIDsFree(ctx context.Context, q querier, users []*User) error {
+	for start := 0; start < len(users); start += sqliteBatchSize {
+		batch := users[start:min(start+sqliteBatchSize, len(users))]
+		ids := make([]int, len(batch))
+		for i, user := range batch {
+			ids[i] = user.ID
+		}
+		var id int
+		err := q.QueryRowContext(ctx, "SELECT id FROM users WHERE id IN ("+sqlitePlaceholders(len(ids))+") LIMIT 1", sqliteArgs(ids)...).Scan(&id)
+		if err == nil {
+			return fmt.Errorf("%w: user %d", ErrUserExists, id)
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteMetadata encodes m as JSON text. Metadata's own Value is bytes,
+// which SQLite would store as a BLOB that never compares equal to the
+// TEXT '{}' the schema and AnonymizeUser write.
+func sqliteMetadata(m Metadata) (string, error) {
+	encoded, err := m.Value()
+	if err != nil {
+		return "", err
+	}
+	return string(encoded.([]byte)), nil
+}
+
+// sqliteTime maps a nil time to NULL, and stores others in UTC, so that
+// they compare as text in time order.
+func sqliteTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UTC()
+}
+
+// sqlitePlaceholders returns n comma-separated placeholders.
+func sqlitePlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// sqliteArgs returns ids as query arguments.
+func sqliteArgs(ids []int) []any {
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
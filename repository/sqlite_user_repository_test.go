@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSQLite(t *testing.T) *SQLiteUserRepository {
+	db, err := OpenSQLite(":memory:")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewSQLiteUserRepository(db)
+}
+
+func TestSQLiteUserRepositoryHistory(t *testing.T) {
+	repo := newSQLite(t)
+	user := &User{Name: "Jane Doe", Email: "jane.doe@example.com"}
+	assert.NoError(t, repo.SaveUser(user))
+
+	// The triggers timestamp versions to the millisecond, so leave a gap
+	// either side of each change
+	time.Sleep(2 * time.Millisecond)
+	original := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	assert.NoError(t, repo.UpdateUser(&User{ID: user.ID, Name: "Jane Smith", Email: "jane.smith@example.com"}))
+	time.Sleep(2 * time.Millisecond)
+	renamed := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	assert.NoError(t, repo.DeleteUser(user.ID))
+
+	versions, err := repo.FindUserHistory(user.ID)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, OperationDelete, versions[1].Operation)
+	assert.Equal(t, "jane.smith@example.com", versions[1].NormalizedEmail)
+
+	found, err := repo.FindUserAsOf(user.ID, original)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", found.Name)
+	found, err = repo.FindUserAsOf(user.ID, renamed)
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Smith", found.Name)
+	_, err = repo.FindUserAsOf(user.ID, time.Now())
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestSQLiteUserRepositoryArchive(t *testing.T) {
+	repo := newSQLite(t)
+	users := []*User{{Name: "Ann", Email: "ann@example.com"}, {Name: "Bob", Email: "bob@example.com"}}
+	assert.NoError(t, repo.SaveUsers(users))
+	assert.NoError(t, repo.UpdateUser(&User{ID: users[0].ID, Name: "Ann Smith", Email: "ann@example.com"}))
+	assert.NoError(t, repo.DeleteUser(users[1].ID))
+
+	var versions []UserVersion
+	assert.NoError(t, repo.EachUserVersion(func(v UserVersion) error {
+		versions = append(versions, v)
+		return nil
+	}))
+	assert.Len(t, versions, 2)
+
+	// Restoring the history elsewhere keeps the deleted user's ID from
+	// being handed out again
+	copied := newSQLite(t)
+	assert.NoError(t, copied.InsertUserVersions(versions))
+	restored, err := copied.RestoreUser(users[1].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", restored.Name)
+	history, err := copied.FindUserHistory(users[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "Ann", history[0].Name)
+
+	cat := &User{Name: "Cat", Email: "cat@example.com"}
+	assert.NoError(t, copied.SaveUser(cat))
+	assert.Greater(t, cat.ID, users[1].ID)
+}
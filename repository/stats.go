@@ -0,0 +1,208 @@
+package repository
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultTopDomains is how many domains AggregateUsers reports when
+// StatsQuery.TopDomains isn't set.
+const DefaultTopDomains = 10
+
+// statsBatchSize is how many users AggregateUsers reads at a time when it
+// has to count them itself.
+const statsBatchSize = 1000
+
+// StatsQuery says what AggregateUsers reports on.
+type StatsQuery struct {
+	// SignupsSince is the first day signups are counted for.
+	SignupsSince time.Time
+	// ActiveSince counts users who have logged in since then as active.
+	ActiveSince time.Time
+	// TopDomains is how many email domains to report, most users first.
+	TopDomains int
+}
+
+// DayCount is how many users signed up on a day, in UTC.
+type DayCount struct {
+	Day   string `json:"day"`
+	Users int64  `json:"users"`
+}
+
+// DomainCount is how many users have an email address at a domain.
+type DomainCount struct {
+	Domain string `json:"domain"`
+	Users  int64  `json:"users"`
+}
+
+// UserStats are aggregates over every user, for reporting.
+type UserStats struct {
+	Total  int64 `json:"total"`
+	Active int64 `json:"active"`
+	// SignupsPerDay lists the days since StatsQuery.SignupsSince with any
+	// signups, in order.
+	SignupsPerDay []DayCount `json:"signups_per_day"`
+	// TopDomains lists the email domains with the most users, most first,
+	// ties by name.
+	TopDomains []DomainCount `json:"top_domains"`
+}
+
+// Aggregator is implemented by backends that can compute UserStats
+// themselves, such as with GROUP BY queries, rather than have every user
+// read to count them.
+type Aggregator interface {
+	AggregateUsers(q StatsQuery) (*UserStats, error)
+}
+
+// AggregateUsers computes UserStats for repo. If repo, or a repository it
+// wraps, is an Aggregator the backend computes them; otherwise every user
+// is read, a batch at a time, and counted here. Encrypted emails can't be
+// grouped by the backend, so beneath an EncryptedUserRepository users are
+// always read.
+func AggregateUsers(repo UserRepository, q StatsQuery) (*UserStats, error) {
+	if q.TopDomains <= 0 {
+		q.TopDomains = DefaultTopDomains
+	}
+	if aggregator := findAggregator(repo); aggregator != nil {
+		return aggregator.AggregateUsers(q)
+	}
+
+	c := newCounter(q)
+	err := EachUser(repo, And(), 0, statsBatchSize, func(user *User) error {
+		c.add(user)
+		return nil
+	}, Fields("id", "email", "created_at", "last_login_at"))
+	if err != nil {
+		return nil, err
+	}
+	return c.result(), nil
+}
+
+func findAggregator(repo UserRepository) Aggregator {
+	for repo != nil {
+		if _, ok := repo.(*EncryptedUserRepository); ok {
+			return nil
+		}
+		if aggregator, ok := repo.(Aggregator); ok {
+			return aggregator
+		}
+		wrapper, ok := repo.(interface{ Unwrap() UserRepository })
+		if !ok {
+			return nil
+		}
+		repo = wrapper.Unwrap()
+	}
+	return nil
+}
+
+// counter counts users in Go, as the backends' queries would.
+type counter struct {
+	q             StatsQuery
+	since         time.Time
+	total, active int64
+	days, domains map[string]int64
+}
+
+func newCounter(q StatsQuery) *counter {
+	return &counter{
+		q:       q,
+		since:   q.SignupsSince.UTC().Truncate(24 * time.Hour),
+		days:    map[string]int64{},
+		domains: map[string]int64{},
+	}
+}
+
+func (c *counter) add(user *User) {
+	c.total++
+	if user.LastLoginAt != nil && !user.LastLoginAt.Before(c.q.ActiveSince) {
+		c.active++
+	}
+	if !user.CreatedAt.Before(c.since) {
+		c.days[user.CreatedAt.UTC().Format(time.DateOnly)]++
+	}
+	if _, domain, ok := strings.Cut(user.Email, "@"); ok {
+		c.domains[strings.ToLower(domain)]++
+	}
+}
+
+func (c *counter) result() *UserStats {
+	stats := &UserStats{Total: c.total, Active: c.active, SignupsPerDay: []DayCount{}, TopDomains: []DomainCount{}}
+	for day, n := range c.days {
+		stats.SignupsPerDay = append(stats.SignupsPerDay, DayCount{Day: day, Users: n})
+	}
+	slices.SortFunc(stats.SignupsPerDay, func(a, b DayCount) int { return cmp.Compare(a.Day, b.Day) })
+	for domain, n := range c.domains {
+		stats.TopDomains = append(stats.TopDomains, DomainCount{Domain: domain, Users: n})
+	}
+	slices.SortFunc(stats.TopDomains, func(a, b DomainCount) int {
+		return cmp.Or(cmp.Compare(b.Users, a.Users), cmp.Compare(a.Domain, b.Domain))
+	})
+	if len(stats.TopDomains) > c.q.TopDomains {
+		stats.TopDomains = stats.TopDomains[:c.q.TopDomains]
+	}
+	return stats
+}
+
+// AggregateUsers counts with a GROUP BY query per aggregate. Recent
+// signups are found through the created_at index, and domains are
+// extracted as the EmailDomain specification extracts them.
+func (r *PostgresUserRepository) AggregateUsers(q StatsQuery) (*UserStats, error) {
+	if q.TopDomains <= 0 {
+		q.TopDomains = DefaultTopDomains
+	}
+	stats := &UserStats{SignupsPerDay: []DayCount{}, TopDomains: []DomainCount{}}
+	since := q.SignupsSince.UTC().Truncate(24 * time.Hour)
+	err := r.run(r.StatementTimeout, func(ctx context.Context, db querier) error {
+		err := db.QueryRowContext(ctx,
+			"SELECT count(*), count(*) FILTER (WHERE last_login_at >= $1) FROM users",
+			q.ActiveSince,
+		).Scan(&stats.Total, &stats.Active)
+		if err != nil {
+			return err
+		}
+
+		rows, err := db.QueryContext(ctx,
+			"SELECT (created_at AT TIME ZONE 'UTC')::date, count(*) FROM users WHERE created_at >= $1 GROUP BY 1 ORDER BY 1",
+			since,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var day time.Time
+			var n int64
+			if err := rows.Scan(&day, &n); err != nil {
+				return err
+			}
+			stats.SignupsPerDay = append(stats.SignupsPerDay, DayCount{Day: day.Format(time.DateOnly), Users: n})
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = db.QueryContext(ctx,
+			"SELECT lower(split_part(email, '@', 2)) AS domain, count(*) FROM users WHERE email LIKE '%@%' GROUP BY 1 ORDER BY 2 DESC, 1 LIMIT $1",
+			q.TopDomains,
+		)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var domain DomainCount
+			if err := rows.Scan(&domain.Domain, &domain.Users); err != nil {
+				return err
+			}
+			stats.TopDomains = append(stats.TopDomains, domain)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
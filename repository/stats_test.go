@@ -0,0 +1,59 @@
+package repository
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAggregator is a backend that computes its own stats.
+type fakeAggregator struct {
+	*MemoryUserRepository
+	queries []StatsQuery
+}
+
+func (r *fakeAggregator) AggregateUsers(q StatsQuery) (*UserStats, error) {
+	r.queries = append(r.queries, q)
+	return &UserStats{Total: 42}, nil
+}
+
+func TestAggregateUsers(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	day := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	for i, email := range []string{"a@acme.com", "b@ACME.com", "c@globex.com", "d@initech.com"} {
+		require.NoError(t, repo.SaveUser(&User{Name: email, Email: email, CreatedAt: day.Add(time.Duration(i) * 12 * time.Hour)}))
+	}
+	require.NoError(t, repo.RecordLogin(1))
+
+	// Read through a decorator, as the server would
+	stats, err := AggregateUsers(NewLoggingUserRepository(repo, log.New(io.Discard, "", 0)), StatsQuery{
+		SignupsSince: day.Add(6 * time.Hour),
+		ActiveSince:  time.Now().Add(-time.Hour),
+		TopDomains:   2,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &UserStats{
+		Total:  4,
+		Active: 1,
+		// Counted from the start of the day SignupsSince falls on
+		SignupsPerDay: []DayCount{{"2024-05-01", 2}, {"2024-05-02", 2}},
+		TopDomains:    []DomainCount{{"acme.com", 2}, {"globex.com", 1}},
+	}, stats)
+}
+
+func TestAggregateUsersBackend(t *testing.T) {
+	backend := &fakeAggregator{MemoryUserRepository: NewMemoryUserRepository()}
+
+	stats, err := AggregateUsers(NewCachingUserRepository(backend, time.Minute, 0), StatsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), stats.Total)
+	assert.Equal(t, []StatsQuery{{TopDomains: DefaultTopDomains}}, backend.queries)
+
+	// Encrypted emails are counted here instead
+	encrypted := &EncryptedUserRepository{UserRepository: backend}
+	assert.Nil(t, findAggregator(encrypted))
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrStatusChanged is returned by SetUserStatus when the user's status
+// isn't the one the change was made from, usually because someone else
+// changed it first.
+var ErrStatusChanged = errors.New("user status changed")
+
+// ErrInvalidStatus is returned for a Status that isn't one of the four.
+var ErrInvalidStatus = errors.New("invalid user status")
+
+// Status is where a user's account is in its lifecycle. The service layer
+// decides which changes between them are allowed.
+type Status string
+
+const (
+	// StatusPending accounts have been created but not yet activated.
+	StatusPending Status = "pending"
+	// StatusActive accounts are in normal use. Users saved without a
+	// status are active.
+	StatusActive Status = "active"
+	// StatusSuspended accounts have been blocked, usually by an admin,
+	// until they are activated again.
+	StatusSuspended Status = "suspended"
+	// StatusDeactivated accounts have been closed.
+	StatusDeactivated Status = "deactivated"
+)
+
+// Statuses lists every Status.
+var Statuses = []Status{StatusPending, StatusActive, StatusSuspended, StatusDeactivated}
+
+// ParseStatus returns s as a Status, or ErrInvalidStatus if it isn't one.
+func ParseStatus(s string) (Status, error) {
+	for _, status := range Statuses {
+		if string(status) == s {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidStatus, s)
+}
+
+// orDefault returns s, or StatusActive if it isn't set.
+func (s Status) orDefault() Status {
+	if s == "" {
+		return StatusActive
+	}
+	return s
+}
+
+// setUserStatus implements SetUserStatus over a map of users.
+func setUserStatus(users map[int]*User, history userHistory, id int, from, to Status) error {
+	if _, err := ParseStatus(string(to)); err != nil {
+		return err
+	}
+	user, exists := users[id]
+	if !exists {
+		return ErrUserNotFound
+	}
+	// Users put straight into a mock's map may have no status yet
+	if user.Status.orDefault() != from.orDefault() {
+		return fmt.Errorf("%w: user %d is %s, not %s", ErrStatusChanged, id, user.Status, from)
+	}
+	history.record(user, OperationUpdate)
+	user.Status = to
+	return nil
+}
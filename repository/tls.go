@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ErrInvalidTLSConfig is returned for TLS settings that can't work.
+var ErrInvalidTLSConfig = errors.New("invalid database TLS config")
+
+// sslModes are the sslmode values Postgres clients accept, weakest first.
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// TLSConfig secures the connection to Postgres. Settings left empty keep
+// whatever the DSN says; settings given override it.
+type TLSConfig struct {
+	// Mode is the sslmode: disable, allow, prefer, require, verify-ca or
+	// verify-full. Use verify-full in production, which checks both the
+	// certificate and that it belongs to the host connected to.
+	Mode string
+	// RootCert is a PEM bundle of CAs to verify the server against.
+	RootCert string
+	// Cert and Key are a PEM client certificate and its private key, for
+	// servers that authenticate clients by certificate.
+	Cert string
+	Key  string
+}
+
+// Validate checks the settings make sense together and that the files
+// they name can be read, so problems show up at startup with a clear
+// message rather than as a failed handshake on first use.
+func (t TLSConfig) Validate() error {
+	if t.Mode != "" && !slices.Contains(sslModes, t.Mode) {
+		return fmt.Errorf("%w: unknown sslmode %q (want one of %s)", ErrInvalidTLSConfig, t.Mode, strings.Join(sslModes, ", "))
+	}
+	if t.Mode == "disable" && (t.RootCert != "" || t.Cert != "" || t.Key != "") {
+		return fmt.Errorf("%w: certificates are given but sslmode is disable", ErrInvalidTLSConfig)
+	}
+	if (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("%w: a client certificate and key must be given together", ErrInvalidTLSConfig)
+	}
+
+	for _, file := range []struct{ what, path string }{
+		{"CA bundle", t.RootCert},
+		{"client certificate", t.Cert},
+		{"client key", t.Key},
+	} {
+		if file.path == "" {
+			continue
+		}
+		info, err := os.Stat(file.path)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %w", ErrInvalidTLSConfig, file.what, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%w: %s %s is a directory", ErrInvalidTLSConfig, file.what, file.path)
+		}
+	}
+
+	// lib/pq refuses keys others can read, with a less obvious error.
+	if t.Key != "" {
+		info, _ := os.Stat(t.Key)
+		if info.Mode().Perm()&0o077 != 0 {
+			return fmt.Errorf("%w: client key %s must not be readable by group or others (chmod 600)", ErrInvalidTLSConfig, t.Key)
+		}
+	}
+	return nil
+}
+
+// Apply validates t and returns dsn with its settings added. dsn may be a
+// postgres:// URL or a list of key=value settings.
+func (t TLSConfig) Apply(dsn string) (string, error) {
+	if err := t.Validate(); err != nil {
+		return "", err
+	}
+
+	return withDSNSettings(dsn, []dsnSetting{
+		{"sslmode", t.Mode},
+		{"sslrootcert", t.RootCert},
+		{"sslcert", t.Cert},
+		{"sslkey", t.Key},
+	})
+}
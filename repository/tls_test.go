@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, perm os.FileMode) string {
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte("-----BEGIN-----"), perm))
+	return path
+}
+
+func TestTLSConfigApply(t *testing.T) {
+	ca := writeFile(t, "root ca.pem", 0o644)
+	tls := TLSConfig{Mode: "verify-full", RootCert: ca}
+
+	// Key=value DSNs have the settings appended, quoted, so they win
+	dsn, err := tls.Apply("user=app dbname=app sslmode=disable")
+	assert.NoError(t, err)
+	assert.Equal(t, "user=app dbname=app sslmode=disable sslmode='verify-full' sslrootcert='"+ca+"'", dsn)
+
+	// URLs have them set in the query
+	dsn, err = tls.Apply("postgres://app@db.example.com/app?sslmode=disable")
+	assert.NoError(t, err)
+	assert.Contains(t, dsn, "sslmode=verify-full")
+	assert.NotContains(t, dsn, "sslmode=disable")
+
+	// Nothing set leaves the DSN alone
+	dsn, err = TLSConfig{}.Apply("user=app")
+	assert.NoError(t, err)
+	assert.Equal(t, "user=app", dsn)
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	cert := writeFile(t, "client.crt", 0o644)
+	key := writeFile(t, "client.key", 0o600)
+	openKey := writeFile(t, "open.key", 0o644)
+
+	assert.NoError(t, TLSConfig{Mode: "require", Cert: cert, Key: key}.Validate())
+
+	for name, tls := range map[string]TLSConfig{
+		"unknown mode":     {Mode: "on"},
+		"certs but no TLS": {Mode: "disable", RootCert: cert},
+		"cert without key": {Mode: "require", Cert: cert},
+		"missing file":     {Mode: "verify-ca", RootCert: filepath.Join(t.TempDir(), "nope.pem")},
+		"readable key":     {Mode: "require", Cert: cert, Key: openKey},
+	} {
+		assert.ErrorIs(t, tls.Validate(), ErrInvalidTLSConfig, name)
+	}
+}
@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Postgres error codes that mean a transaction lost a race with another and
+// can safely be run again from the start.
+const (
+	serializationFailure = "40001"
+	deadlockDetected     = "40P01"
+)
+
+// TxManager runs units of work in Postgres transactions. At SERIALIZABLE
+// and REPEATABLE READ Postgres aborts transactions that conflict, and at
+// any level it may abort one to break a deadlock; TxManager runs the unit of
+// work again when that happens, backing off between attempts.
+//
+// Every retry is counted in Metrics as "Transaction.retries".
+type TxManager struct {
+	DB        *sql.DB
+	Isolation sql.IsolationLevel
+
+	MaxRetries int
+	Backoff    time.Duration
+
+	sleep func(time.Duration)
+}
+
+func NewTxManager(db *sql.DB, isolation sql.IsolationLevel) *TxManager {
+	return &TxManager{
+		DB:         db,
+		Isolation:  isolation,
+		MaxRetries: 3,
+		Backoff:    10 * time.Millisecond,
+		sleep:      time.Sleep,
+	}
+}
+
+// WithinTx runs fn in a transaction, committing if it returns nil and
+// rolling back otherwise. fn may be called more than once, so it must not
+// have side effects outside the transaction.
+func (m *TxManager) WithinTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	return m.retry(func() error {
+		tx, err := m.DB.BeginTx(ctx, &sql.TxOptions{Isolation: m.Isolation})
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// retry calls attempt until it succeeds, fails with an error that isn't
+// worth retrying, or has been retried MaxRetries times.
+func (m *TxManager) retry(attempt func() error) error {
+	for n := 0; ; n++ {
+		err := attempt()
+		if err == nil || !isRetryable(err) || n >= m.MaxRetries {
+			return err
+		}
+		Metrics.Add("Transaction.retries", 1)
+		m.sleep(m.Backoff << n)
+	}
+}
+
+// isRetryable reports whether err is a serialization failure or deadlock.
+func isRetryable(err error) bool {
+	code := sqlState(err)
+	return code == serializationFailure || code == deadlockDetected
+}
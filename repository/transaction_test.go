@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTxManager() (*TxManager, *[]time.Duration) {
+	var slept []time.Duration
+	m := NewTxManager(nil, 0)
+	m.sleep = func(d time.Duration) { slept = append(slept, d) }
+	return m, &slept
+}
+
+func TestTxManagerRetriesConflicts(t *testing.T) {
+	m, slept := newTestTxManager()
+	before := retries()
+
+	// Fail with a serialization failure, then a deadlock, then succeed
+	errs := []error{
+		&pq.Error{Code: serializationFailure},
+		fmt.Errorf("saving users: %w", &pq.Error{Code: deadlockDetected}),
+		nil,
+	}
+	attempts := 0
+	err := m.retry(func() error {
+		attempts++
+		return errs[attempts-1]
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, *slept)
+	assert.Equal(t, before+2, retries())
+}
+
+func TestTxManagerGivesUp(t *testing.T) {
+	m, _ := newTestTxManager()
+
+	// Conflicts are retried MaxRetries times and then returned
+	attempts := 0
+	err := m.retry(func() error {
+		attempts++
+		return &pq.Error{Code: serializationFailure}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 4, attempts)
+
+	// Other errors are never retried
+	attempts = 0
+	err = m.retry(func() error {
+		attempts++
+		return errors.New("syntax error")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func retries() int64 {
+	v, ok := Metrics.Get("Transaction.retries").(interface{ Value() int64 })
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
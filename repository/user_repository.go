@@ -1,12 +1,150 @@
 package repository
 
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUserNotFound is returned when no user matches a lookup.
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrUserExists is returned by RestoreUser for a user who hasn't been
+// deleted.
+var ErrUserExists = errors.New("user exists")
+
+// ErrNotSupported is returned by a repository for an operation its backend
+// cannot perform.
+var ErrNotSupported = errors.New("operation not supported by this repository")
+
+// ErrPolicyViolation is returned for a user refused by a policy. It is the
+// same error as service.ErrPolicyViolation, defined here so that
+// RemoteUserRepository can report the remote service's refusals with it.
+var ErrPolicyViolation = errors.New("policy violation")
+
 type User struct {
-	ID    int
-	Name  string
-	Email string
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+
+	// CreatedAt is set by the repository when the user is first saved.
+	CreatedAt time.Time `json:"created_at"`
+	// VerifiedAt is when the user confirmed their email, if they have.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+	// Phone is the user's phone number in E.164 form, or nil if they
+	// haven't given one. The service layer validates and normalizes it.
+	Phone *string `json:"phone,omitempty"`
+	// Metadata holds custom attributes; see Metadata.
+	Metadata Metadata `json:"metadata,omitempty"`
+	// NormalizedEmail is Email as the repository's EmailNormalizer puts
+	// it, which FindUserByEmail matches on. It is set whenever the user
+	// is saved or updated.
+	NormalizedEmail string `json:"normalized_email,omitempty"`
+	// LastLoginAt and LoginCount track the user's activity. Only
+	// RecordLogin changes them; updates leave them alone.
+	LastLoginAt *time.Time `json:"last_login_at,omitempty"`
+	LoginCount  int        `json:"login_count,omitempty"`
+	// Status is where the account is in its lifecycle. SaveUser and
+	// SaveUsers default it to StatusActive; after that only SetUserStatus
+	// changes it.
+	Status Status `json:"status,omitempty"`
 }
 
+// The find methods accept FindOptions such as Fields to shape what they
+// return.
 type UserRepository interface {
-	FindUserByID(id int) (*User, error)
+	FindUserByID(id int, opts ...FindOption) (*User, error)
+	// FindUserByEmail normalizes email and finds the user with the same
+	// NormalizedEmail, so case and surrounding space don't matter.
+	FindUserByEmail(email string, opts ...FindOption) (*User, error)
+	// FindUserByPhone finds a user by their phone number, which must be in
+	// E.164 form as stored. Should several users share it, the earliest
+	// saved is returned.
+	FindUserByPhone(phone string, opts ...FindOption) (*User, error)
+	// FindUsersByIDs returns the users with the given IDs, keyed by ID, in
+	// a single lookup. IDs with no user are left out of the map rather
+	// than returning ErrUserNotFound.
+	FindUsersByIDs(ids []int, opts ...FindOption) (map[int]*User, error)
+	// FindUsersWhere returns up to limit users matching spec with IDs
+	// greater than afterID, in ID order. Pass the last ID of one page as
+	// afterID to get the next, or see Paginate. With Backward it reads the
+	// other way.
+	FindUsersWhere(spec Specification, afterID, limit int, opts ...FindOption) ([]*User, error)
+	// CountUsersWhere returns how many users match spec.
+	CountUsersWhere(spec Specification) (int64, error)
+	// FindUsersByNamePrefix returns users whose name starts with prefix,
+	// ignoring case, ordered by name. Use Limit to change how many.
+	FindUsersByNamePrefix(prefix string, opts ...FindOption) ([]*User, error)
+	// SuggestUsers returns users whose name is close to q, closest first,
+	// for typeahead. Postgres ranks by trigram similarity; other backends
+	// by edit distance, so results differ a little between them.
+	SuggestUsers(q string, opts ...FindOption) ([]*User, error)
+	// FindUsersByMetadata returns users whose metadata has key set to
+	// value, as HasMetadata matches them, in ID order. Use Limit to cap
+	// how many; by default every match is returned.
+	FindUsersByMetadata(key string, value any, opts ...FindOption) ([]*User, error)
+	// FindUserHistory returns the user's past versions, oldest first. A
+	// user who has never changed has none; ErrUserNotFound means there is
+	// no such user now or in the past.
+	FindUserHistory(id int) ([]UserVersion, error)
+	// FindUserAsOf returns the user as they were at a point in time, or
+	// ErrUserNotFound if they didn't exist then.
+	FindUserAsOf(id int, at time.Time) (*User, error)
 	SaveUser(user *User) error
-}
\ No newline at end of file
+	SaveUsers(users []*User) error
+	// InsertUsers saves users under the IDs they already have, rather than
+	// giving them new ones, and moves ID generation past them. It is for
+	// copying users between stores; it returns ErrUserExists, and saves
+	// none, if any of the IDs is taken.
+	InsertUsers(users []*User) error
+	// UpdateUser replaces the name, email, verification time, phone number
+	// and metadata of the user with user.ID, keeping the old version in the
+	// user's history. A nil Phone or Metadata clears them.
+	UpdateUser(user *User) error
+	// UpdateUsers updates each of users as UpdateUser would, all or none:
+	// it returns ErrUserNotFound, and updates none, if any of them doesn't
+	// exist.
+	UpdateUsers(users []*User) error
+	// RecordLogin sets the user's LastLoginAt to now and adds one to their
+	// LoginCount, in a single atomic step, so concurrent logins are all
+	// counted. It isn't kept as a version in the user's history.
+	RecordLogin(id int) error
+	// SetUserStatus changes the user's status from one to another, keeping
+	// the old version in the user's history. It returns ErrStatusChanged,
+	// and changes nothing, if their status isn't from, so two changes
+	// racing can't both apply.
+	SetUserStatus(id int, from, to Status) error
+	// AnonymizeUser irreversibly replaces the user's personal data with
+	// tombstone values, in their history as well; see User.Anonymize.
+	AnonymizeUser(id int) error
+	// DeleteUser deletes the user, who can be brought back with
+	// RestoreUser until they are purged.
+	DeleteUser(id int) error
+	// RestoreUser brings back a deleted user, with the same ID, as they
+	// were when deleted. It returns ErrUserExists if the user hasn't been
+	// deleted, and ErrUserNotFound if there is nothing to restore.
+	RestoreUser(id int) (*User, error)
+	// PurgeUser permanently removes the user, deleted or not, and their
+	// history, so they can't be restored.
+	PurgeUser(id int) error
+	// DeleteUsersWhere deletes every user matching spec and returns how
+	// many were deleted. It returns ErrEmptySpecification rather than
+	// delete everyone.
+	DeleteUsersWhere(spec Specification) (int64, error)
+	// DeleteUsersWhereReturningIDs is DeleteUsersWhere, but returns the IDs
+	// of the users deleted, in no particular order, for callers that act
+	// on each one.
+	DeleteUsersWhereReturningIDs(spec Specification) ([]int, error)
+}
+
+// Anonymize replaces the user's personal data with tombstone values and
+// clears their metadata, which may hold personal data too. The
+// email stays unique, and the reserved .invalid domain means it can never
+// be delivered to.
+func (u *User) Anonymize() {
+	u.Name = "Anonymized User"
+	u.Email = fmt.Sprintf("anonymized-%d@invalid", u.ID)
+	u.NormalizedEmail = u.Email
+	u.Phone = nil
+	u.Metadata = nil
+}
@@ -0,0 +1,384 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultWriteBehindBatchSize is how many writes WriteBehindUserRepository
+// buffers before flushing when no batch size is given.
+const DefaultWriteBehindBatchSize = 1000
+
+// ErrWriteBehindFull is returned by WriteBehindUserRepository.UpdateUser
+// when the buffer is full and can't be flushed, such as while the database
+// is unavailable.
+var ErrWriteBehindFull = errors.New("write-behind buffer full")
+
+// WriteBehindUserRepository wraps a UserRepository and batches the writes
+// made through it, for high-volume ingest where many small writes cost more
+// than a few large ones.
+//
+// SaveUser and SaveUsers return once their users are written, so the
+// caller gets their IDs, but saves made while another batch is being
+// written wait and are written together, in one SaveUsers call, when it
+// finishes. UpdateUser only buffers the update, which is written, with
+// the others waiting, in one UpdateUsers call when BatchSize writes are
+// waiting, every interval given to FlushEvery, and whenever Flush is
+// called. That comes with trade-offs callers must accept:
+//
+//   - UpdateUser can't report ErrUserNotFound, as the user isn't looked up
+//     until the update is flushed. Several updates to one user before a
+//     flush are written as the last of them.
+//   - Finds read the wrapped repository, so don't see buffered updates.
+//   - Buffered updates are lost if the process dies before flushing them.
+//
+// Updates that fail to flush with ErrUnavailable or ErrQueryTimeout are
+// kept and retried on the next flush; any other failure, such as of a user
+// that no longer exists, is logged and the update dropped. At most
+// MaxPending updates are kept: once that many are waiting, UpdateUser
+// flushes them itself, and fails with ErrWriteBehindFull if that doesn't
+// make room. Deletes, anonymization, restores and purges flush first, so
+// they apply after any buffered updates rather than being undone by them.
+type WriteBehindUserRepository struct {
+	UserRepository
+	// BatchSize is how many buffered updates trigger a flush.
+	BatchSize int
+	// MaxPending is how many updates may be buffered, counting those being
+	// flushed; ten batches by default.
+	MaxPending int
+	// Logger, when set, logs dropped updates and flushes that fail outside
+	// a call to Flush.
+	Logger *log.Logger
+
+	// saveMu is held while writing saves, so saves made meanwhile gather
+	// into the next batch.
+	saveMu sync.Mutex
+	// flushMu is held while flushing updates, so batches reach the wrapped
+	// repository in the order they were written.
+	flushMu sync.Mutex
+
+	mu      sync.Mutex
+	saves   []*pendingSave
+	updates map[int]*User
+	// updated lists the IDs in updates in the order first updated.
+	updated []int
+	// flushing is how many updates are being flushed.
+	flushing int
+}
+
+// pendingSave is a SaveUsers call waiting for its users to be written.
+type pendingSave struct {
+	users []*User
+	done  chan error
+}
+
+var _ UserRepository = (*WriteBehindUserRepository)(nil)
+
+func NewWriteBehindUserRepository(repo UserRepository, batchSize int, logger *log.Logger) *WriteBehindUserRepository {
+	if batchSize <= 0 {
+		batchSize = DefaultWriteBehindBatchSize
+	}
+	return &WriteBehindUserRepository{
+		UserRepository: repo,
+		BatchSize:      batchSize,
+		MaxPending:     10 * batchSize,
+		Logger:         logger,
+		updates:        map[int]*User{},
+	}
+}
+
+func (r *WriteBehindUserRepository) SaveUser(user *User) error {
+	return r.SaveUsers([]*User{user})
+}
+
+// SaveUsers writes all of the users or, if any has invalid metadata, none,
+// as the wrapped repository would, together with any other saves waiting.
+// If that batch fails, each caller's users are written again on their own,
+// so one caller's bad user doesn't fail another's.
+func (r *WriteBehindUserRepository) SaveUsers(users []*User) error {
+	for _, user := range users {
+		if _, err := user.Metadata.encoded(); err != nil {
+			return err
+		}
+	}
+	save := &pendingSave{users: users, done: make(chan error, 1)}
+
+	r.mu.Lock()
+	r.saves = append(r.saves, save)
+	r.mu.Unlock()
+
+	// Either this call writes the batch, or one already writing did.
+	r.saveMu.Lock()
+	r.writeSaves()
+	r.saveMu.Unlock()
+	return <-save.done
+}
+
+func (r *WriteBehindUserRepository) UpdateUser(user *User) error {
+	if _, err := user.Metadata.encoded(); err != nil {
+		return err
+	}
+
+	if !r.buffer(user) {
+		// Make room at the caller's expense rather than let the buffer
+		// grow without bound.
+		r.flushLogged()
+		if !r.buffer(user) {
+			return fmt.Errorf("%w: %d updates waiting", ErrWriteBehindFull, r.Pending())
+		}
+	}
+	if r.Pending() >= r.BatchSize {
+		r.flushLogged()
+	}
+	return nil
+}
+
+// UpdateUsers buffers each update as UpdateUser does, so can't update them
+// all or none. If the buffer fills, the updates before the one refused
+// stay buffered.
+func (r *WriteBehindUserRepository) UpdateUsers(users []*User) error {
+	for _, user := range users {
+		if _, err := user.Metadata.encoded(); err != nil {
+			return err
+		}
+	}
+	for _, user := range users {
+		if err := r.UpdateUser(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *WriteBehindUserRepository) AnonymizeUser(id int) error {
+	if err := r.Flush(); err != nil {
+		return err
+	}
+	return r.UserRepository.AnonymizeUser(id)
+}
+
+func (r *WriteBehindUserRepository) DeleteUser(id int) error {
+	if err := r.Flush(); err != nil {
+		return err
+	}
+	return r.UserRepository.DeleteUser(id)
+}
+
+func (r *WriteBehindUserRepository) RestoreUser(id int) (*User, error) {
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.RestoreUser(id)
+}
+
+func (r *WriteBehindUserRepository) PurgeUser(id int) error {
+	if err := r.Flush(); err != nil {
+		return err
+	}
+	return r.UserRepository.PurgeUser(id)
+}
+
+func (r *WriteBehindUserRepository) DeleteUsersWhere(spec Specification) (int64, error) {
+	if err := r.Flush(); err != nil {
+		return 0, err
+	}
+	return r.UserRepository.DeleteUsersWhere(spec)
+}
+
+func (r *WriteBehindUserRepository) DeleteUsersWhereReturningIDs(spec Specification) ([]int, error) {
+	if err := r.Flush(); err != nil {
+		return nil, err
+	}
+	return r.UserRepository.DeleteUsersWhereReturningIDs(spec)
+}
+
+// Pending returns how many updates are buffered, counting those being
+// flushed.
+func (r *WriteBehindUserRepository) Pending() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pending()
+}
+
+// Flush writes any waiting saves, then each buffered update. It returns
+// every error the updates failed with; saves report theirs to their
+// callers.
+func (r *WriteBehindUserRepository) Flush() error {
+	r.saveMu.Lock()
+	r.writeSaves()
+	r.saveMu.Unlock()
+
+	retrying, dropped := r.writeUpdates()
+	return errors.Join(append(retrying, dropped...)...)
+}
+
+// FlushEvery flushes every interval until the returned function is called,
+// logging failures. Stopping flushes whatever is still buffered before
+// returning, so call it on shutdown to lose nothing.
+func (r *WriteBehindUserRepository) FlushEvery(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				r.flushLogged()
+				return
+			case <-ticker.C:
+				r.flushLogged()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+func (r *WriteBehindUserRepository) Unwrap() UserRepository {
+	return r.UserRepository
+}
+
+// buffer adds user's update to the buffer, replacing any earlier update of
+// the same user. It reports false if the buffer is full.
+func (r *WriteBehindUserRepository) buffer(user *User) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.updates[user.ID]; !ok {
+		if r.pending() >= r.MaxPending {
+			return false
+		}
+		r.updated = append(r.updated, user.ID)
+	}
+	r.updates[user.ID] = copyUser(user)
+	return true
+}
+
+// writeSaves writes every waiting save in one batch and tells each caller
+// how theirs went. Callers must hold r.saveMu.
+func (r *WriteBehindUserRepository) writeSaves() {
+	r.mu.Lock()
+	saves := r.saves
+	r.saves = nil
+	r.mu.Unlock()
+
+	if len(saves) == 0 {
+		return
+	}
+	var batch []*User
+	for _, save := range saves {
+		batch = append(batch, save.users...)
+	}
+	err := r.UserRepository.SaveUsers(batch)
+	if err != nil && len(saves) > 1 {
+		for _, save := range saves {
+			save.done <- r.UserRepository.SaveUsers(save.users)
+		}
+		return
+	}
+	for _, save := range saves {
+		save.done <- err
+	}
+}
+
+// writeUpdates writes the buffered updates in one UpdateUsers call,
+// returning the errors of those kept to retry and of those dropped. If
+// that fails for any reason but one to retry, such as one of the users
+// no longer existing, each is written again on its own, so only the
+// updates at fault are dropped.
+func (r *WriteBehindUserRepository) writeUpdates() (retrying, dropped []error) {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	r.mu.Lock()
+	updated, updates := r.updated, r.updates
+	r.updated, r.updates = nil, map[int]*User{}
+	r.flushing = len(updated)
+	r.mu.Unlock()
+
+	if len(updated) == 0 {
+		r.requeue(nil)
+		return nil, nil
+	}
+	batch := make([]*User, len(updated))
+	for i, id := range updated {
+		batch[i] = updates[id]
+	}
+	err := r.UserRepository.UpdateUsers(batch)
+	switch {
+	case err == nil:
+		r.requeue(nil)
+		return nil, nil
+	case errors.Is(err, ErrUnavailable), errors.Is(err, ErrQueryTimeout):
+		r.requeue(batch)
+		return []error{err}, nil
+	}
+
+	var failed []*User
+	for _, id := range updated {
+		err := r.UserRepository.UpdateUser(updates[id])
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrUnavailable), errors.Is(err, ErrQueryTimeout):
+			retrying = append(retrying, err)
+			failed = append(failed, updates[id])
+		default:
+			dropped = append(dropped, err)
+			r.logf("repository: write-behind dropped update of user %d: %v", id, err)
+		}
+	}
+	r.requeue(failed)
+	return retrying, dropped
+}
+
+// requeue puts updates that failed to flush back in front of any buffered
+// since, unless a user has been updated again in the meantime.
+func (r *WriteBehindUserRepository) requeue(updates []*User) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.flushing = 0
+	var updated []int
+	for _, user := range updates {
+		if _, newer := r.updates[user.ID]; !newer {
+			r.updates[user.ID] = user
+			updated = append(updated, user.ID)
+		}
+	}
+	r.updated = append(updated, r.updated...)
+}
+
+// flushLogged flushes, logging rather than returning any failure to be
+// retried, for flushes no caller asked for. Dropped updates are logged as
+// they are dropped.
+func (r *WriteBehindUserRepository) flushLogged() {
+	r.saveMu.Lock()
+	r.writeSaves()
+	r.saveMu.Unlock()
+
+	if retrying, _ := r.writeUpdates(); len(retrying) > 0 {
+		r.logf("repository: write-behind flush, retrying %d updates: %v", len(retrying), errors.Join(retrying...))
+	}
+}
+
+func (r *WriteBehindUserRepository) logf(format string, args ...any) {
+	if r.Logger != nil {
+		r.Logger.Printf(format, args...)
+	}
+}
+
+// pending returns how many updates are buffered or being flushed. Callers
+// must hold r.mu.
+func (r *WriteBehindUserRepository) pending() int {
+	return len(r.updates) + r.flushing
+}
@@ -0,0 +1,201 @@
+package repository
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// gatedRepository holds every SaveUsers call until gate is closed,
+// telling entered as each arrives.
+type gatedRepository struct {
+	UserRepository
+	entered chan struct{}
+	gate    chan struct{}
+}
+
+func (r *gatedRepository) SaveUsers(users []*User) error {
+	r.entered <- struct{}{}
+	<-r.gate
+	return r.UserRepository.SaveUsers(users)
+}
+
+func TestWriteBehindUserRepository(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1, Name: "John Doe", Email: "john@example.com"}},
+	}
+	repo := NewWriteBehindUserRepository(mockRepo, 10, nil)
+
+	// Saves are written straight away, so the caller gets the ID
+	ann := &User{Name: "Ann", Email: "ann@example.com"}
+	assert.NoError(t, repo.SaveUser(ann))
+	assert.Equal(t, 2, ann.ID)
+	assert.Equal(t, 0, repo.Pending())
+
+	// Updates wait in the buffer, and later ones replace earlier ones
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Johnny", Email: "john@example.com"}))
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Jon", Email: "john@example.com"}))
+	assert.Equal(t, 1, repo.Pending())
+	assert.Equal(t, 0, mockRepo.CallCount("UpdateUser"))
+
+	// A flush writes each user's last update
+	assert.NoError(t, repo.Flush())
+	assert.Equal(t, 0, repo.Pending())
+	assert.Equal(t, 1, mockRepo.CallCount("UpdateUsers"))
+	assert.Equal(t, 0, mockRepo.CallCount("UpdateUser"))
+	assert.Equal(t, "Jon", mockRepo.Users[1].Name)
+
+	// Invalid metadata is refused straight away rather than at the flush
+	err := repo.UpdateUser(&User{ID: 1, Name: "Jon", Metadata: Metadata{"bad": make(chan int)}})
+	assert.ErrorIs(t, err, ErrInvalidMetadata)
+	assert.Equal(t, 0, repo.Pending())
+}
+
+func TestWriteBehindUserRepositoryBatchesSaves(t *testing.T) {
+	mockRepo := &MockUserRepository{}
+	mockRepo.FailWhen("SaveUsers", func(call Call, _ int) bool {
+		for _, user := range call.Args[0].([]*User) {
+			if user.Name == "Bad" {
+				return true
+			}
+		}
+		return false
+	}, ErrUserExists)
+	gated := &gatedRepository{UserRepository: mockRepo, entered: make(chan struct{}, 10), gate: make(chan struct{})}
+	repo := NewWriteBehindUserRepository(gated, 10, nil)
+
+	users := []*User{{Name: "Ann"}, {Name: "Bob"}, {Name: "Bad"}}
+	errs := make(chan error, len(users))
+	save := func(user *User) { errs <- repo.SaveUser(user) }
+
+	// Saves made while Ann's is being written wait to go together
+	go save(users[0])
+	<-gated.entered
+	go save(users[1])
+	go save(users[2])
+	assert.Eventually(t, func() bool {
+		repo.mu.Lock()
+		defer repo.mu.Unlock()
+		return len(repo.saves) == 2
+	}, time.Second, time.Millisecond)
+	close(gated.gate)
+
+	var failed []error
+	for range users {
+		if err := <-errs; err != nil {
+			failed = append(failed, err)
+		}
+	}
+
+	// The second batch failed, so each was written again on its own, and
+	// only Bad's save failed
+	assert.Len(t, failed, 1)
+	assert.ErrorIs(t, failed[0], ErrUserExists)
+	assert.Equal(t, 4, mockRepo.CallCount("SaveUsers"))
+	assert.NotZero(t, users[0].ID)
+	assert.NotZero(t, users[1].ID)
+	assert.Zero(t, users[2].ID)
+}
+
+func TestWriteBehindUserRepositoryBatchSize(t *testing.T) {
+	mockRepo := &MockUserRepository{
+		Users: map[int]*User{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}, 4: {ID: 4}},
+	}
+	repo := NewWriteBehindUserRepository(mockRepo, 3, nil)
+
+	for id := 1; id <= 4; id++ {
+		assert.NoError(t, repo.UpdateUser(&User{ID: id, Name: "Updated"}))
+	}
+
+	// The third update filled the batch, so it was flushed in one call
+	assert.Equal(t, 1, mockRepo.CallCount("UpdateUsers"))
+	assert.Len(t, mockRepo.Calls()[0].Args[0], 3)
+	assert.Equal(t, 1, repo.Pending())
+}
+
+func TestWriteBehindUserRepositoryRetries(t *testing.T) {
+	var logs bytes.Buffer
+	mockRepo := &MockUserRepository{
+		Users:      map[int]*User{1: {ID: 1, Name: "John Doe"}},
+		MethodErrs: map[string]error{"UpdateUsers": ErrUnavailable, "UpdateUser": ErrUnavailable},
+	}
+	repo := NewWriteBehindUserRepository(mockRepo, 10, log.New(&logs, "", 0))
+
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Johnny"}))
+	assert.NoError(t, repo.UpdateUser(&User{ID: 99, Name: "Nobody"}))
+
+	// Updates that fail while the database is unavailable are kept
+	assert.ErrorIs(t, repo.Flush(), ErrUnavailable)
+	assert.Equal(t, 2, repo.Pending())
+	assert.Equal(t, 0, mockRepo.CallCount("UpdateUser"))
+
+	// Once it is back they go through, except the update of a user who
+	// doesn't exist, which fails the batch and then, on its own, is
+	// logged and dropped
+	mockRepo.MethodErrs = nil
+	assert.ErrorIs(t, repo.Flush(), ErrUserNotFound)
+	assert.Equal(t, 0, repo.Pending())
+	assert.Equal(t, "Johnny", mockRepo.Users[1].Name)
+	assert.Equal(t, 2, mockRepo.CallCount("UpdateUser"))
+	assert.Contains(t, logs.String(), "dropped update of user 99")
+
+	// Nor is any other failure retried
+	mockRepo.MethodErrs = map[string]error{"UpdateUsers": errors.New("bad request"), "UpdateUser": errors.New("bad request")}
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Jon"}))
+	assert.Error(t, repo.Flush())
+	assert.Equal(t, 0, repo.Pending())
+}
+
+func TestWriteBehindUserRepositoryFull(t *testing.T) {
+	mockRepo := &MockUserRepository{MethodErrs: map[string]error{"UpdateUsers": ErrUnavailable, "UpdateUser": ErrUnavailable}}
+	repo := NewWriteBehindUserRepository(mockRepo, 10, nil)
+	repo.MaxPending = 2
+
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Ann"}))
+	assert.NoError(t, repo.UpdateUser(&User{ID: 2, Name: "Bob"}))
+	// Another update of a buffered user takes no more room
+	assert.NoError(t, repo.UpdateUser(&User{ID: 2, Name: "Bobby"}))
+
+	// A new one tries to flush to make room, and is refused when it can't
+	assert.ErrorIs(t, repo.UpdateUser(&User{ID: 3, Name: "Cat"}), ErrWriteBehindFull)
+	assert.Equal(t, 2, repo.Pending())
+
+	mockRepo.MethodErrs = nil
+	mockRepo.Users = map[int]*User{1: {ID: 1}, 2: {ID: 2}, 3: {ID: 3}}
+	assert.NoError(t, repo.UpdateUser(&User{ID: 3, Name: "Cat"}))
+	assert.Equal(t, 1, repo.Pending())
+	assert.Equal(t, "Bobby", mockRepo.Users[2].Name)
+}
+
+func TestWriteBehindUserRepositoryFlushesBeforeDelete(t *testing.T) {
+	memory := NewMemoryUserRepository()
+	assert.NoError(t, memory.SaveUser(&User{Name: "John Doe", Email: "john@example.com"}))
+	repo := NewWriteBehindUserRepository(memory, 10, nil)
+
+	// The buffered update lands before the anonymization, not after it
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Johnny", Email: "john@example.com"}))
+	assert.NoError(t, repo.AnonymizeUser(1))
+	user, err := memory.FindUserByID(1)
+	assert.NoError(t, err)
+	assert.Equal(t, "Anonymized User", user.Name)
+	assert.Equal(t, 0, repo.Pending())
+}
+
+func TestWriteBehindUserRepositoryFlushEvery(t *testing.T) {
+	mockRepo := &MockUserRepository{Users: map[int]*User{1: {ID: 1}, 2: {ID: 2}}}
+	repo := NewWriteBehindUserRepository(mockRepo, 10, nil)
+	stop := repo.FlushEvery(10 * time.Millisecond)
+
+	assert.NoError(t, repo.UpdateUser(&User{ID: 1, Name: "Ann"}))
+	assert.Eventually(t, func() bool { return repo.Pending() == 0 }, time.Second, 5*time.Millisecond)
+
+	// Stopping drains whatever is left
+	assert.NoError(t, repo.UpdateUser(&User{ID: 2, Name: "Bob"}))
+	stop()
+	assert.Equal(t, 0, repo.Pending())
+	assert.Equal(t, "Bob", mockRepo.Users[2].Name)
+}
@@ -0,0 +1,215 @@
+// Package retention deletes or anonymizes users once they have been kept
+// for longer than policy allows.
+package retention
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorepository/repository"
+	"gorepository/service"
+)
+
+// DefaultBatchSize is how many users are read per query when Engine.BatchSize
+// is not set.
+const DefaultBatchSize = 500
+
+// Action is what a Rule does to the users it matches.
+type Action string
+
+const (
+	Delete    Action = "delete"
+	Anonymize Action = "anonymize"
+)
+
+// Rule is a single retention policy.
+type Rule struct {
+	Name   string
+	Action Action
+	// Match returns the users the rule applies to as of now.
+	Match func(now time.Time) repository.Specification
+}
+
+// DeleteUnverifiedAfter deletes users who still haven't verified their email
+// once age has passed since they signed up.
+func DeleteUnverifiedAfter(age time.Duration) Rule {
+	return Rule{
+		Name:   fmt.Sprintf("delete unverified after %s", age),
+		Action: Delete,
+		Match: func(now time.Time) repository.Specification {
+			return repository.And(repository.Unverified(), repository.CreatedBefore(now.Add(-age)))
+		},
+	}
+}
+
+// AnonymizeInactiveAfter anonymizes users who haven't logged in for age,
+// or, if they never have, were created that long ago. Anonymizing rather
+// than deleting keeps their ID for whatever still refers to it. Users
+// already anonymized stay inactive, so they are left out rather than
+// anonymized again on every run.
+func AnonymizeInactiveAfter(age time.Duration) Rule {
+	return Rule{
+		Name:   fmt.Sprintf("anonymize inactive after %s", age),
+		Action: Anonymize,
+		Match: func(now time.Time) repository.Specification {
+			return repository.And(repository.InactiveSince(now.Add(-age)), repository.Not(repository.Anonymized()))
+		},
+	}
+}
+
+// Rules returns the configured rules: DeleteUnverifiedAfter and
+// AnonymizeInactiveAfter, each only if its age is greater than zero. An age
+// of zero turns a rule off rather than matching every user.
+func Rules(unverifiedAfter, inactiveAfter time.Duration) []Rule {
+	var rules []Rule
+	if unverifiedAfter > 0 {
+		rules = append(rules, DeleteUnverifiedAfter(unverifiedAfter))
+	}
+	if inactiveAfter > 0 {
+		rules = append(rules, AnonymizeInactiveAfter(inactiveAfter))
+	}
+	return rules
+}
+
+// Result is the outcome of one Rule.
+type Result struct {
+	Rule   string
+	Action Action
+	// UserIDs are the users the rule matched. Unless the run was a dry run
+	// they have all been acted on, up to the first error.
+	UserIDs []int
+	Err     error
+}
+
+// Report is the outcome of one run of an Engine.
+type Report struct {
+	At      time.Time
+	DryRun  bool
+	Results []Result
+}
+
+// String summarises the report, one line per rule.
+func (r Report) String() string {
+	var b strings.Builder
+	verb := "applied"
+	if r.DryRun {
+		verb = "would apply"
+	}
+	for _, result := range r.Results {
+		fmt.Fprintf(&b, "%s: %s %s to %d users", result.Rule, verb, result.Action, len(result.UserIDs))
+		if result.Err != nil {
+			fmt.Fprintf(&b, " (failed: %v)", result.Err)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Engine evaluates retention rules against the repository and carries them
+// out through the user service, so every deletion and anonymization is
+// audited and published like any other.
+type Engine struct {
+	Users *service.UserService
+	Rules []Rule
+	// BatchSize is how many users are read per query.
+	BatchSize int
+	// DryRun reports what would be done without changing anything.
+	DryRun bool
+
+	now func() time.Time
+}
+
+// Run applies every rule once. A failing rule is recorded in its Result and
+// doesn't stop the rules after it; the first failure is also returned.
+func (e *Engine) Run() (Report, error) {
+	now := time.Now()
+	if e.now != nil {
+		now = e.now()
+	}
+
+	report := Report{At: now, DryRun: e.DryRun}
+	var firstErr error
+	for _, rule := range e.Rules {
+		result := e.apply(rule, now)
+		if result.Err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("retention rule %q: %w", rule.Name, result.Err)
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, firstErr
+}
+
+func (e *Engine) apply(rule Rule, now time.Time) Result {
+	result := Result{Rule: rule.Name, Action: rule.Action}
+
+	batchSize := e.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	spec := rule.Match(now)
+	for afterID := 0; ; {
+		users, err := e.Users.Repo.FindUsersWhere(spec, afterID, batchSize, repository.Fields("id"))
+		if err != nil {
+			result.Err = err
+			return result
+		}
+
+		for _, user := range users {
+			if !e.DryRun {
+				if err := e.act(rule.Action, user.ID); err != nil {
+					result.Err = err
+					return result
+				}
+			}
+			result.UserIDs = append(result.UserIDs, user.ID)
+		}
+
+		if len(users) < batchSize {
+			return result
+		}
+		afterID = users[len(users)-1].ID
+	}
+}
+
+func (e *Engine) act(action Action, id int) error {
+	switch action {
+	case Delete:
+		return e.Users.DeleteUser(id)
+	case Anonymize:
+		return e.Users.AnonymizeUser(id)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+}
+
+// Schedule runs the engine every interval until the returned function is
+// called, logging each report.
+func (e *Engine) Schedule(interval time.Duration, logger *log.Logger) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				report, err := e.Run()
+				if err != nil {
+					logger.Printf("retention: %v", err)
+				}
+				for _, line := range strings.Split(strings.TrimSpace(report.String()), "\n") {
+					if line != "" {
+						logger.Printf("retention: %s", line)
+					}
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,155 @@
+package retention
+
+import (
+	"errors"
+	"gorepository/audit"
+	"gorepository/repository"
+	"gorepository/service"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func newTestEngine(repo repository.UserRepository, dryRun bool) (*Engine, *audit.MemoryRecorder) {
+	recorder := &audit.MemoryRecorder{}
+	return &Engine{
+		Users:     &service.UserService{Repo: repo, Audit: recorder},
+		Rules:     []Rule{DeleteUnverifiedAfter(30 * 24 * time.Hour)},
+		BatchSize: 2,
+		DryRun:    dryRun,
+		now:       func() time.Time { return now },
+	}, recorder
+}
+
+func seedUsers(t *testing.T, repo repository.UserRepository) {
+	verified := now.AddDate(0, -2, 0)
+	users := []*repository.User{
+		{Name: "Old Unverified 1", CreatedAt: now.AddDate(0, -2, 0)},
+		{Name: "Old Verified", CreatedAt: now.AddDate(0, -2, 0), VerifiedAt: &verified},
+		{Name: "Old Unverified 2", CreatedAt: now.AddDate(0, -3, 0)},
+		{Name: "New Unverified", CreatedAt: now.AddDate(0, 0, -1)},
+		{Name: "Old Unverified 3", CreatedAt: now.AddDate(-1, 0, 0)},
+	}
+	assert.NoError(t, repo.SaveUsers(users))
+}
+
+func TestRunDeletesUnverifiedUsers(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	seedUsers(t, repo)
+	engine, recorder := newTestEngine(repo, false)
+
+	report, err := engine.Run()
+	assert.NoError(t, err)
+	assert.Len(t, report.Results, 1)
+	assert.Equal(t, []int{1, 3, 5}, report.Results[0].UserIDs)
+
+	// Only the verified and recent users are left
+	for _, id := range []int{1, 3, 5} {
+		_, err := repo.FindUserByID(id)
+		assert.ErrorIs(t, err, repository.ErrUserNotFound)
+	}
+	for _, id := range []int{2, 4} {
+		_, err := repo.FindUserByID(id)
+		assert.NoError(t, err)
+	}
+
+	// Each deletion went through the service and was audited
+	assert.Len(t, recorder.Entries(), 3)
+}
+
+func TestRunDryRun(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	seedUsers(t, repo)
+	engine, recorder := newTestEngine(repo, true)
+
+	report, err := engine.Run()
+	assert.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []int{1, 3, 5}, report.Results[0].UserIDs)
+	assert.Contains(t, report.String(), "would apply delete to 3 users")
+
+	// Nothing was touched
+	for id := 1; id <= 5; id++ {
+		_, err := repo.FindUserByID(id)
+		assert.NoError(t, err)
+	}
+	assert.Empty(t, recorder.Entries())
+}
+
+func TestRunReportsFailures(t *testing.T) {
+	// Setup mock repository
+	mockRepo := &repository.MockUserRepository{
+		Users: map[int]*repository.User{},
+	}
+	seedUsers(t, mockRepo)
+	mockRepo.FailWhen("DeleteUser", repository.OnCall(2), errors.New("database is down"))
+
+	engine, _ := newTestEngine(mockRepo, false)
+
+	report, err := engine.Run()
+	assert.Error(t, err)
+	assert.Equal(t, []int{1}, report.Results[0].UserIDs)
+	assert.ErrorContains(t, report.Results[0].Err, "database is down")
+}
+
+func TestRunAnonymizesInactiveUsers(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	lastYear, lastWeek := now.AddDate(-1, 0, 0), now.AddDate(0, 0, -7)
+	assert.NoError(t, repo.SaveUsers([]*repository.User{
+		{Name: "Never Logged In", Email: "never@example.com", CreatedAt: lastYear},
+		{Name: "Lapsed", Email: "lapsed@example.com", CreatedAt: lastYear, LastLoginAt: &lastYear, LoginCount: 3},
+		{Name: "Active", Email: "active@example.com", CreatedAt: lastYear, LastLoginAt: &lastWeek, LoginCount: 9},
+		{Name: "New", Email: "new@example.com", CreatedAt: lastWeek},
+	}))
+	engine, _ := newTestEngine(repo, false)
+	engine.Rules = []Rule{AnonymizeInactiveAfter(180 * 24 * time.Hour)}
+
+	report, err := engine.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, report.Results[0].UserIDs)
+
+	// Anonymized users keep their ID and activity, but not their name
+	user, err := repo.FindUserByID(2)
+	assert.NoError(t, err)
+	assert.Equal(t, "Anonymized User", user.Name)
+	assert.Equal(t, 3, user.LoginCount)
+	user, err = repo.FindUserByID(3)
+	assert.NoError(t, err)
+	assert.Equal(t, "Active", user.Name)
+}
+
+func TestRunSkipsAnonymizedUsers(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	lastYear := now.AddDate(-1, 0, 0)
+	assert.NoError(t, repo.SaveUsers([]*repository.User{
+		{Name: "Lapsed", Email: "lapsed@example.com", CreatedAt: lastYear, LastLoginAt: &lastYear},
+		{Name: "Never Logged In", Email: "never@example.com", CreatedAt: lastYear},
+	}))
+	engine, recorder := newTestEngine(repo, false)
+	engine.Rules = []Rule{AnonymizeInactiveAfter(180 * 24 * time.Hour)}
+
+	report, err := engine.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, report.Results[0].UserIDs)
+
+	// The users are still inactive, but aren't anonymized a second time
+	report, err = engine.Run()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Results[0].UserIDs)
+	assert.Len(t, recorder.Entries(), 2)
+}
+
+func TestRules(t *testing.T) {
+	// Each rule is off unless given an age, so zero can't delete every
+	// unverified user
+	assert.Len(t, Rules(time.Hour, 0), 1)
+	assert.Len(t, Rules(time.Hour, time.Hour), 2)
+	assert.Empty(t, Rules(0, 0))
+	assert.Empty(t, Rules(-time.Hour, 0))
+	rules := Rules(0, time.Hour)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, Anonymize, rules[0].Action)
+}
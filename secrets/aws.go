@@ -0,0 +1,163 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// AWSSecretsManager reads secrets from AWS Secrets Manager. A reference is
+// the secret's name or ARN, optionally with "#field" to read one field of
+// a secret stored as JSON.
+//
+// Requests are signed with the given static credentials, so no SDK is
+// needed; take them from the usual AWS_* environment variables.
+type AWSSecretsManager struct {
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is needed with temporary credentials.
+	SessionToken string
+	// Endpoint overrides the regional endpoint, for testing or VPC
+	// endpoints.
+	Endpoint string
+	Client   *http.Client
+
+	now func() time.Time
+}
+
+func NewAWSSecretsManager(region, accessKeyID, secretAccessKey, sessionToken string) *AWSSecretsManager {
+	return &AWSSecretsManager{
+		Region:          region,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		SessionToken:    sessionToken,
+		Client:          &http.Client{Timeout: 5 * time.Second},
+		now:             time.Now,
+	}
+}
+
+func (a *AWSSecretsManager) Get(ctx context.Context, ref string) (string, error) {
+	id, field := splitRef(ref)
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := a.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + a.Region + ".amazonaws.com/"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if a.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.SessionToken)
+	}
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	signV4(req, body, a.Region, "secretsmanager", a.AccessKeyID, a.SecretAccessKey, now())
+
+	resp, err := a.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		SecretString string
+		Type         string `json:"__type"`
+		Message      string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("aws secret %s: %s: %w", id, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if strings.HasSuffix(out.Type, "ResourceNotFoundException") {
+			return "", fmt.Errorf("%w: aws %s", ErrNotFound, id)
+		}
+		return "", fmt.Errorf("aws secret %s: %s: %s %s", id, resp.Status, out.Type, out.Message)
+	}
+	return pickField(ref, out.SecretString, field)
+}
+
+// signV4 adds AWS Signature Version 4 headers to req, signing it and every
+// header already set.
+func signV4(req *http.Request, body []byte, region, service, accessKeyID, secretAccessKey string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	names := []string{"host"}
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.Host
+		if name != "host" {
+			value = req.Header.Get(name)
+		} else if value == "" {
+			value = req.URL.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
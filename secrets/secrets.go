@@ -0,0 +1,152 @@
+// Package secrets resolves credentials, such as the database password,
+// from wherever they are kept: the environment, files mounted by the
+// platform, HashiCorp Vault or AWS Secrets Manager.
+//
+// Secrets are named by a reference whose meaning depends on the provider.
+// For Vault and AWS a reference may end in "#field" to pick one field out
+// of a secret holding several, e.g. "app/db#password".
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned when a provider has no secret by that name.
+var ErrNotFound = errors.New("secret not found")
+
+// Provider looks up secrets by reference.
+type Provider interface {
+	Get(ctx context.Context, ref string) (string, error)
+}
+
+// Env reads secrets from environment variables named by the reference.
+type Env struct{}
+
+func (Env) Get(ctx context.Context, ref string) (string, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("%w: $%s", ErrNotFound, ref)
+	}
+	return value, nil
+}
+
+// File reads secrets from files in Dir, named by the reference, as mounted
+// by Docker and Kubernetes secrets. A trailing newline is dropped.
+type File struct {
+	Dir string
+}
+
+func (f File) Get(ctx context.Context, ref string) (string, error) {
+	if ref == "" || ref != filepath.Base(ref) || ref == ".." {
+		return "", fmt.Errorf("secret file name %q must not contain a path", ref)
+	}
+	data, err := os.ReadFile(filepath.Join(f.Dir, ref))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, filepath.Join(f.Dir, ref))
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+}
+
+// splitRef splits "name#field" into its parts. field is empty if there is
+// no "#".
+func splitRef(ref string) (name, field string) {
+	name, field, _ = strings.Cut(ref, "#")
+	return name, field
+}
+
+// pickField returns field from a secret stored as a JSON object, or the
+// whole secret if no field is asked for.
+func pickField(ref, secret, field string) (string, error) {
+	if field == "" {
+		return secret, nil
+	}
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object, so has no field %q", ref, field)
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, ref)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("secret %s is not a string", ref)
+	}
+	return s, nil
+}
+
+// Value is a resolved secret that can be refreshed, so that rotated
+// credentials are picked up without a restart.
+type Value struct {
+	Provider Provider
+	Ref      string
+
+	mu      sync.RWMutex
+	current string
+}
+
+// Resolve looks up ref with p.
+func Resolve(ctx context.Context, p Provider, ref string) (*Value, error) {
+	v := &Value{Provider: p, Ref: ref}
+	if err := v.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Get returns the secret as of the last successful refresh.
+func (v *Value) Get() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.current
+}
+
+// Refresh looks the secret up again. On failure the previous value is
+// kept.
+func (v *Value) Refresh(ctx context.Context) error {
+	current, err := v.Provider.Get(ctx, v.Ref)
+	if err != nil {
+		return fmt.Errorf("secret %s: %w", v.Ref, err)
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.current = current
+	return nil
+}
+
+// RefreshEvery refreshes the secret every interval until the returned
+// function is called. Failures are logged and the old value kept.
+func (v *Value) RefreshEvery(interval time.Duration, logger *log.Logger) (stop func()) {
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if err := v.Refresh(ctx); err != nil {
+					logger.Printf("secrets: %v", err)
+				}
+				cancel()
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
@@ -0,0 +1,124 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnv(t *testing.T) {
+	t.Setenv("TEST_DB_PASSWORD", "hunter2")
+
+	value, err := Env{}.Get(context.Background(), "TEST_DB_PASSWORD")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = Env{}.Get(context.Background(), "TEST_NOT_SET")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "db_password"), []byte("hunter2\n"), 0o600))
+	files := File{Dir: dir}
+
+	// Mounted secrets usually end in a newline, which isn't part of them
+	value, err := files.Get(context.Background(), "db_password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = files.Get(context.Background(), "api_token")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// References can't climb out of the directory
+	_, err = files.Get(context.Background(), "../db_password")
+	assert.Error(t, err)
+}
+
+func TestVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.URL.Path != "/v1/secret/data/app/db" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"password": "hunter2"}}}`))
+	}))
+	defer server.Close()
+
+	vault := NewVault(server.URL, "root")
+
+	value, err := vault.Get(context.Background(), "app/db#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = vault.Get(context.Background(), "app/db#user")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = vault.Get(context.Background(), "app/cache#password")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestAWSSecretsManager(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", r.Header.Get("X-Amz-Target"))
+		assert.Contains(t, r.Header.Get("Authorization"), "Credential=AKID/20240501/eu-west-2/secretsmanager/aws4_request")
+
+		var in struct{ SecretId string }
+		json.NewDecoder(r.Body).Decode(&in)
+		if in.SecretId != "prod/db" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"__type": "ResourceNotFoundException", "Message": "not found"}`))
+			return
+		}
+		w.Write([]byte(`{"SecretString": "{\"username\": \"app\", \"password\": \"hunter2\"}"}`))
+	}))
+	defer server.Close()
+
+	aws := NewAWSSecretsManager("eu-west-2", "AKID", "secret", "")
+	aws.Endpoint = server.URL
+	aws.now = func() time.Time { return time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC) }
+
+	value, err := aws.Get(context.Background(), "prod/db#password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = aws.Get(context.Background(), "prod/cache")
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla case from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	signV4(req, nil, "us-east-1", "service", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
+
+func TestValueRefresh(t *testing.T) {
+	t.Setenv("TEST_API_TOKEN", "one")
+
+	value, err := Resolve(context.Background(), Env{}, "TEST_API_TOKEN")
+	assert.NoError(t, err)
+	assert.Equal(t, "one", value.Get())
+
+	// A rotated secret is picked up on refresh
+	t.Setenv("TEST_API_TOKEN", "two")
+	assert.NoError(t, value.Refresh(context.Background()))
+	assert.Equal(t, "two", value.Get())
+
+	// A failed refresh keeps the last good value
+	os.Unsetenv("TEST_API_TOKEN")
+	assert.Error(t, value.Refresh(context.Background()))
+	assert.Equal(t, "two", value.Get())
+}
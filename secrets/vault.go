@@ -0,0 +1,82 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Vault reads secrets from a HashiCorp Vault KV version 2 engine over its
+// HTTP API. A reference is the secret's path within the engine and the
+// field to read, "app/db#password"; the field defaults to "value".
+type Vault struct {
+	// Addr is Vault's base URL, such as https://vault.example.com:8200.
+	Addr  string
+	Token string
+	// Mount is where the KV engine is mounted; the default is "secret".
+	Mount  string
+	Client *http.Client
+}
+
+func NewVault(addr, token string) *Vault {
+	return &Vault{
+		Addr:   strings.TrimSuffix(addr, "/"),
+		Token:  token,
+		Mount:  "secret",
+		Client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (v *Vault) Get(ctx context.Context, ref string) (string, error) {
+	path, field := splitRef(ref)
+	if field == "" {
+		field = "value"
+	}
+
+	endpoint := v.Addr + "/v1/" + url.PathEscape(v.Mount) + "/data/" + escapePath(path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "", fmt.Errorf("%w: vault %s", ErrNotFound, path)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Data map[string]any `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("vault %s: %w", path, err)
+	}
+	value, ok := body.Data.Data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: vault %s has no string field %q", ErrNotFound, path, field)
+	}
+	return value, nil
+}
+
+// escapePath escapes each segment of a slash-separated path.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
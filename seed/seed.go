@@ -0,0 +1,99 @@
+// Package seed generates fake users for load testing and demo environments.
+package seed
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"gorepository/repository"
+)
+
+// DefaultBatchSize is the number of users handed to the repository per
+// bulk insert when Seeder.BatchSize is not set.
+const DefaultBatchSize = 1000
+
+var firstNames = []string{
+	"Alice", "Amir", "Ava", "Ben", "Chloe", "Daniel", "Ella", "Emeka", "Fatima", "Finn",
+	"Grace", "Hana", "Harry", "Isla", "Jack", "James", "Jia", "Leo", "Lily", "Lucas",
+	"Maya", "Mei", "Mohammed", "Noah", "Olivia", "Oscar", "Priya", "Rosa", "Ruby", "Sam",
+	"Sofia", "Tariq", "Theo", "Yusuf", "Zara", "Zoe",
+}
+
+var lastNames = []string{
+	"Adams", "Ahmed", "Brown", "Chen", "Clarke", "Davies", "Evans", "Garcia", "Green", "Hall",
+	"Hughes", "Iqbal", "Jones", "Khan", "Kowalski", "Lewis", "Martin", "Nguyen", "Novak", "Okafor",
+	"Patel", "Roberts", "Robinson", "Singh", "Smith", "Taylor", "Thomas", "Walker", "White", "Wilson",
+	"Wright", "Young",
+}
+
+var domains = []string{"example.com", "example.net", "example.org"}
+
+// Generator produces fake users with realistic names and unique emails.
+type Generator struct {
+	rand  *rand.Rand
+	taken map[string]int
+}
+
+// NewGenerator returns a Generator. The same seed always yields the same users.
+func NewGenerator(seed int64) *Generator {
+	return &Generator{
+		rand:  rand.New(rand.NewSource(seed)),
+		taken: map[string]int{},
+	}
+}
+
+// User returns a new fake user. Emails are unique across everything this
+// Generator has produced.
+func (g *Generator) User() *repository.User {
+	first := firstNames[g.rand.Intn(len(firstNames))]
+	last := lastNames[g.rand.Intn(len(lastNames))]
+	domain := domains[g.rand.Intn(len(domains))]
+
+	local := strings.ToLower(first + "." + last)
+	key := local + "@" + domain
+	n := g.taken[key]
+	g.taken[key] = n + 1
+
+	email := key
+	if n > 0 {
+		email = fmt.Sprintf("%s%d@%s", local, n, domain)
+	}
+
+	return &repository.User{Name: first + " " + last, Email: email}
+}
+
+// Users returns n new fake users.
+func (g *Generator) Users(n int) []*repository.User {
+	users := make([]*repository.User, n)
+	for i := range users {
+		users[i] = g.User()
+	}
+	return users
+}
+
+// Seeder loads generated users into a repository through its bulk-insert path.
+type Seeder struct {
+	Repo      repository.UserRepository
+	Generator *Generator
+	BatchSize int
+}
+
+// Seed generates count users and saves them in batches, returning how many
+// were saved before any error.
+func (s *Seeder) Seed(count int) (int, error) {
+	batchSize := s.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	saved := 0
+	for saved < count {
+		batch := s.Generator.Users(min(batchSize, count-saved))
+		if err := s.Repo.SaveUsers(batch); err != nil {
+			return saved, err
+		}
+		saved += len(batch)
+	}
+	return saved, nil
+}
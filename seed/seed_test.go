@@ -0,0 +1,51 @@
+package seed
+
+import (
+	"errors"
+	"gorepository/repository"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneratorEmailsAreUnique(t *testing.T) {
+	gen := NewGenerator(1)
+
+	// Far more users than name combinations, so collisions must be resolved
+	users := gen.Users(10000)
+
+	seen := map[string]bool{}
+	for _, user := range users {
+		assert.NotEmpty(t, user.Name)
+		assert.False(t, seen[user.Email], "duplicate email %s", user.Email)
+		seen[user.Email] = true
+	}
+}
+
+func TestSeed(t *testing.T) {
+	// Setup mock repository
+	mockRepo := &repository.MockUserRepository{
+		Users: map[int]*repository.User{},
+	}
+
+	seeder := &Seeder{Repo: mockRepo, Generator: NewGenerator(1), BatchSize: 30}
+
+	// Test seeding a count that doesn't divide evenly into batches
+	saved, err := seeder.Seed(100)
+	assert.NoError(t, err)
+	assert.Equal(t, 100, saved)
+	assert.Len(t, mockRepo.Users, 100)
+}
+
+func TestSeedStopsOnError(t *testing.T) {
+	mockRepo := &repository.MockUserRepository{
+		Users: map[int]*repository.User{},
+		Err:   errors.New("database is down"),
+	}
+
+	seeder := &Seeder{Repo: mockRepo, Generator: NewGenerator(1)}
+
+	saved, err := seeder.Seed(10)
+	assert.Error(t, err)
+	assert.Equal(t, 0, saved)
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"gorepository/repository"
+	"strings"
+)
+
+// ErrInvalidPhone is returned for a phone number that can't be put into
+// E.164 form.
+var ErrInvalidPhone = errors.New("invalid phone number")
+
+// NormalizePhone puts a phone number into E.164 form: a + followed by the
+// country calling code and subscriber number, 8 to 15 digits in all, such
+// as +447700900123. Spaces, dashes, dots and brackets are ignored, and an
+// international 00 prefix is read as +.
+//
+// A number without a country code is taken to be in the country whose
+// calling code is countryCode, dropping its leading trunk 0, so
+// "07700 900123" with countryCode "44" becomes +447700900123. If
+// countryCode is empty, such numbers are rejected.
+//
+// Only the shape of the number is checked, not whether it is allocated.
+func NormalizePhone(phone, countryCode string) (string, error) {
+	digits := strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '.', '(', ')':
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(phone))
+
+	switch {
+	case strings.HasPrefix(digits, "+"):
+		digits = digits[1:]
+	case strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case countryCode != "":
+		digits = countryCode + strings.TrimPrefix(digits, "0")
+	default:
+		return "", fmt.Errorf("%w: %q has no country code", ErrInvalidPhone, phone)
+	}
+
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' || strings.Trim(digits, "0123456789") != "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPhone, phone)
+	}
+	return "+" + digits, nil
+}
+
+// normalizePhone puts user's phone number, if they have one, into E.164
+// form in place. An empty number is treated as none.
+func (s *UserService) normalizePhone(user *repository.User) error {
+	if user.Phone == nil {
+		return nil
+	}
+	if *user.Phone == "" {
+		user.Phone = nil
+		return nil
+	}
+	phone, err := NormalizePhone(*user.Phone, s.PhoneCountryCode)
+	if err != nil {
+		return err
+	}
+	user.Phone = &phone
+	return nil
+}
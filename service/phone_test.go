@@ -0,0 +1,75 @@
+package service
+
+import (
+	"gorepository/repository"
+	"gorepository/repository/mocks"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePhone(t *testing.T) {
+	valid := map[string]string{
+		"+44 7700 900123":   "+447700900123",
+		"0044 7700-900-123": "+447700900123",
+		"07700 900123":      "+447700900123",
+		"+1 (202) 555.0143": "+12025550143",
+	}
+	for phone, want := range valid {
+		got, err := NormalizePhone(phone, "44")
+		assert.NoError(t, err, phone)
+		assert.Equal(t, want, got)
+	}
+
+	invalid := []string{"", "+44 77", "+0 7700 900123", "+44 7700 900123 ext 4", "+1234567890123456"}
+	for _, phone := range invalid {
+		_, err := NormalizePhone(phone, "44")
+		assert.ErrorIs(t, err, ErrInvalidPhone, phone)
+	}
+
+	// Without a default country code the number must carry its own
+	_, err := NormalizePhone("07700 900123", "")
+	assert.ErrorIs(t, err, ErrInvalidPhone)
+}
+
+func TestCreateUserNormalizesPhone(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().Build()
+	service := &UserService{Repo: mockRepo, PhoneCountryCode: "44"}
+
+	// Stored in E.164 form, and found however it is typed
+	phone := "07700 900123"
+	user := &repository.User{Name: "Jane Doe", Phone: &phone}
+	assert.NoError(t, service.CreateUser(user))
+	assert.Equal(t, "+447700900123", *user.Phone)
+
+	found, err := service.GetUserByPhone("+44 7700 900123")
+	assert.NoError(t, err)
+	assert.Equal(t, user.ID, found.ID)
+
+	// An invalid number is rejected before anything is saved
+	bad := "12"
+	assert.ErrorIs(t, service.CreateUser(&repository.User{Name: "John Doe", Phone: &bad}), ErrInvalidPhone)
+	assert.Equal(t, 1, mockRepo.CallCount("SaveUser"))
+
+	// An empty number means none
+	empty := ""
+	none := &repository.User{Name: "John Doe", Phone: &empty}
+	assert.NoError(t, service.CreateUser(none))
+	assert.Nil(t, none.Phone)
+}
+
+func TestValidateUser(t *testing.T) {
+	mockRepo := mocks.NewUserRepo().Build()
+	service := &UserService{Repo: mockRepo, PhoneCountryCode: "44"}
+
+	// Normalized as CreateUser would, without being saved
+	phone := "07700 900123"
+	user := &repository.User{Name: "Jane Doe", Phone: &phone}
+	assert.NoError(t, service.ValidateUser(user))
+	assert.Equal(t, "+447700900123", *user.Phone)
+
+	bad := "12"
+	assert.ErrorIs(t, service.ValidateUser(&repository.User{Phone: &bad}), ErrInvalidPhone)
+	assert.ErrorIs(t, service.ValidateUser(&repository.User{Metadata: repository.Metadata{"f": func() {}}}), repository.ErrInvalidMetadata)
+	assert.Empty(t, mockRepo.Calls())
+}
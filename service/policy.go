@@ -0,0 +1,269 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gorepository/repository"
+)
+
+// DefaultTenantKey is the metadata key naming a user's tenant when
+// UserPolicies.TenantKey isn't set.
+const DefaultTenantKey = "tenant"
+
+// ErrPolicyViolation is wrapped by every PolicyViolation, for callers that
+// only need to know a user was refused by a policy. It is
+// repository.ErrPolicyViolation, so a refusal from a remote instance
+// matches it too.
+var ErrPolicyViolation = repository.ErrPolicyViolation
+
+// Rule names a policy a user can be refused by.
+type Rule string
+
+const (
+	// RuleTenantQuota refuses users beyond their tenant's quota.
+	RuleTenantQuota Rule = "tenant_quota"
+	// RuleReservedDomain refuses email addresses at reserved domains,
+	// such as the organization's own, which only staff tooling may use.
+	RuleReservedDomain Rule = "reserved_domain"
+	// RuleBlockedDomain refuses email addresses at blocked domains, such
+	// as disposable email services.
+	RuleBlockedDomain Rule = "blocked_domain"
+	// RuleUniqueEmail refuses an email address another user already has.
+	RuleUniqueEmail Rule = "unique_email"
+)
+
+// PolicyViolation is returned for a user refused by one of the service's
+// UserPolicies. It wraps ErrPolicyViolation.
+type PolicyViolation struct {
+	Rule Rule
+	// Detail says what about the user broke the rule.
+	Detail string
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("%s: %s: %s", ErrPolicyViolation, v.Rule, v.Detail)
+}
+
+func (v *PolicyViolation) Unwrap() error {
+	return ErrPolicyViolation
+}
+
+// DisposableDomains are the disposable email services block_disposable
+// blocks. The list is not exhaustive; add others with blocked_domain.
+var DisposableDomains = []string{
+	"10minutemail.com", "dispostable.com", "guerrillamail.com", "mailinator.com",
+	"maildrop.cc", "sharklasers.com", "temp-mail.org", "trashmail.com", "yopmail.com",
+}
+
+// UserPolicies are the rules new users are held to beyond being valid.
+// The zero value has none. Domains match their subdomains too, ignoring
+// case.
+type UserPolicies struct {
+	// TenantKey is the metadata key naming a user's tenant; it defaults
+	// to DefaultTenantKey. Users without a string there belong to no
+	// tenant, and no quota applies to them.
+	TenantKey string
+	// MaxUsersPerTenant caps how many users each tenant may have, when
+	// greater than zero. TenantQuotas overrides it for single tenants.
+	MaxUsersPerTenant int
+	TenantQuotas      map[string]int
+	ReservedDomains   []string
+	BlockedDomains    []string
+	// UniqueEmails refuses a user whose email, once normalized, another
+	// user already has.
+	UniqueEmails bool
+}
+
+// ParseUserPolicies reads UserPolicies written as comma-separated rules,
+// as in
+//
+//	max_users=100,max_users:acme=500,reserved_domain=example.com,block_disposable,unique_email
+//
+// where max_users sets MaxUsersPerTenant, or a tenant's quota when followed
+// by :tenant, reserved_domain and blocked_domain add a domain each,
+// block_disposable blocks DisposableDomains, unique_email sets
+// UniqueEmails and tenant_key sets TenantKey. An empty string has no
+// rules.
+func ParseUserPolicies(s string) (UserPolicies, error) {
+	var p UserPolicies
+	for _, rule := range strings.Split(s, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(rule, "=")
+		key, tenant, _ := strings.Cut(key, ":")
+		key, tenant, value = strings.TrimSpace(key), strings.TrimSpace(tenant), strings.TrimSpace(value)
+		if tenant != "" && key != "max_users" {
+			return UserPolicies{}, fmt.Errorf("service: user policy %q: only max_users takes a tenant", rule)
+		}
+
+		switch key {
+		case "max_users":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return UserPolicies{}, fmt.Errorf("service: user policy %q: want a number of users", rule)
+			}
+			if tenant == "" {
+				p.MaxUsersPerTenant = n
+				continue
+			}
+			if p.TenantQuotas == nil {
+				p.TenantQuotas = map[string]int{}
+			}
+			p.TenantQuotas[tenant] = n
+		case "reserved_domain", "blocked_domain":
+			if value == "" {
+				return UserPolicies{}, fmt.Errorf("service: user policy %q: want a domain", rule)
+			}
+			if key == "reserved_domain" {
+				p.ReservedDomains = append(p.ReservedDomains, value)
+			} else {
+				p.BlockedDomains = append(p.BlockedDomains, value)
+			}
+		case "block_disposable":
+			p.BlockedDomains = append(p.BlockedDomains, DisposableDomains...)
+		case "unique_email":
+			p.UniqueEmails = true
+		case "tenant_key":
+			if value == "" {
+				return UserPolicies{}, fmt.Errorf("service: user policy %q: want a metadata key", rule)
+			}
+			p.TenantKey = value
+		default:
+			return UserPolicies{}, fmt.Errorf("service: unknown user policy %q", key)
+		}
+	}
+	return p, nil
+}
+
+// Tenant returns the tenant user belongs to, or "" if none.
+func (p UserPolicies) Tenant(user *repository.User) string {
+	tenant, _ := user.Metadata[p.tenantKey()].(string)
+	return tenant
+}
+
+// Quota returns how many users tenant may have, or 0 for no limit.
+func (p UserPolicies) Quota(tenant string) int {
+	if n, ok := p.TenantQuotas[tenant]; ok {
+		return n
+	}
+	return p.MaxUsersPerTenant
+}
+
+// checkEmail refuses an email address at a reserved or blocked domain.
+func (p UserPolicies) checkEmail(email string) error {
+	_, domain, _ := strings.Cut(strings.ToLower(strings.TrimSpace(email)), "@")
+	if domainIn(domain, p.ReservedDomains) {
+		return &PolicyViolation{Rule: RuleReservedDomain, Detail: fmt.Sprintf("%s is a reserved domain", domain)}
+	}
+	if domainIn(domain, p.BlockedDomains) {
+		return &PolicyViolation{Rule: RuleBlockedDomain, Detail: fmt.Sprintf("%s is not accepted", domain)}
+	}
+	return nil
+}
+
+// domainIn reports whether domain is one of domains or a subdomain of one.
+func domainIn(domain string, domains []string) bool {
+	return domain != "" && slices.ContainsFunc(domains, func(d string) bool {
+		d = strings.ToLower(d)
+		return domain == d || strings.HasSuffix(domain, "."+d)
+	})
+}
+
+// enforcePolicies checks new users against the quotas and uniqueness the
+// service's Policies ask for, as a batch: a user repeated in users, or
+// taking their tenant past its quota with those before them, is refused.
+//
+// Quotas are soft. Users are counted before they are saved, with nothing
+// held in between, so concurrent creations can take a tenant a little
+// past its quota.
+func (s *UserService) enforcePolicies(users []*repository.User) error {
+	if s.Policies.UniqueEmails {
+		seen := map[string]bool{}
+		for _, user := range users {
+			email := strings.ToLower(strings.TrimSpace(user.Email))
+			if seen[email] {
+				return &PolicyViolation{Rule: RuleUniqueEmail, Detail: fmt.Sprintf("%s is given more than once", user.Email)}
+			}
+			seen[email] = true
+			if err := s.checkEmailTaken(user); err != nil {
+				return err
+			}
+		}
+	}
+
+	adding := map[string]int{}
+	for _, user := range users {
+		if tenant := s.Policies.Tenant(user); tenant != "" && s.Policies.Quota(tenant) > 0 {
+			adding[tenant]++
+		}
+	}
+	for tenant, n := range adding {
+		quota := s.Policies.Quota(tenant)
+		count, err := s.Repo.CountUsersWhere(repository.HasMetadata(s.Policies.tenantKey(), tenant))
+		if err != nil {
+			return err
+		}
+		if count+int64(n) > int64(quota) {
+			return &PolicyViolation{Rule: RuleTenantQuota, Detail: fmt.Sprintf("tenant %s has %d of its %d users", tenant, count, quota)}
+		}
+	}
+	return nil
+}
+
+// checkUpdate holds an update of user to the service's Policies, as far as
+// it changes their email or tenant. It reads the user as they are only if
+// there is a policy to check.
+func (s *UserService) checkUpdate(user *repository.User) error {
+	p := s.Policies
+	if len(p.ReservedDomains) == 0 && len(p.BlockedDomains) == 0 && !p.UniqueEmails && p.MaxUsersPerTenant == 0 && len(p.TenantQuotas) == 0 {
+		return nil
+	}
+	current, err := s.Repo.FindUserByID(user.ID, repository.Fields("id", "email", "metadata"))
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(current.Email), strings.TrimSpace(user.Email)) {
+		if err := p.checkEmail(user.Email); err != nil {
+			return err
+		}
+		if p.UniqueEmails {
+			if err := s.checkEmailTaken(user); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Tenant(user) != p.Tenant(current) {
+		return s.enforcePolicies([]*repository.User{user})
+	}
+	return nil
+}
+
+// checkEmailTaken refuses user's email if a different user has it. Only
+// the ID of a match is read, so the lookup is served by the email index
+// alone.
+func (s *UserService) checkEmailTaken(user *repository.User) error {
+	existing, err := s.Repo.FindUserByEmail(user.Email, repository.Fields("id"))
+	switch {
+	case errors.Is(err, repository.ErrUserNotFound):
+		return nil
+	case err != nil:
+		return err
+	case existing.ID != user.ID:
+		return &PolicyViolation{Rule: RuleUniqueEmail, Detail: fmt.Sprintf("%s is already taken", user.Email)}
+	}
+	return nil
+}
+
+func (p UserPolicies) tenantKey() string {
+	if p.TenantKey == "" {
+		return DefaultTenantKey
+	}
+	return p.TenantKey
+}
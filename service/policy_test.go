@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"gorepository/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tenantUser(name, tenant string) *repository.User {
+	return &repository.User{Name: name, Email: name + "@example.com", Metadata: repository.Metadata{"tenant": tenant}}
+}
+
+func TestParseUserPolicies(t *testing.T) {
+	p, err := ParseUserPolicies("max_users=100, max_users:acme=500,reserved_domain=acme.com,blocked_domain=spam.example,unique_email,tenant_key=org")
+	require.NoError(t, err)
+	assert.Equal(t, UserPolicies{
+		TenantKey:         "org",
+		MaxUsersPerTenant: 100,
+		TenantQuotas:      map[string]int{"acme": 500},
+		ReservedDomains:   []string{"acme.com"},
+		BlockedDomains:    []string{"spam.example"},
+		UniqueEmails:      true,
+	}, p)
+	assert.Equal(t, 500, p.Quota("acme"))
+	assert.Equal(t, 100, p.Quota("globex"))
+
+	p, err = ParseUserPolicies("block_disposable")
+	require.NoError(t, err)
+	assert.Equal(t, DisposableDomains, p.BlockedDomains)
+
+	for _, bad := range []string{"max_users=lots", "reserved_domain", "unique_email:acme", "quota=1"} {
+		_, err := ParseUserPolicies(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	service := &UserService{Repo: repo, Policies: UserPolicies{MaxUsersPerTenant: 2, TenantQuotas: map[string]int{"globex": 1}}}
+
+	require.NoError(t, service.CreateUser(tenantUser("a", "acme")))
+	require.NoError(t, service.CreateUser(tenantUser("b", "globex")))
+	// Users without a tenant aren't counted against anyone
+	require.NoError(t, service.CreateUser(&repository.User{Name: "c", Email: "c@example.com"}))
+
+	err := service.CreateUser(tenantUser("d", "globex"))
+	var violation *PolicyViolation
+	require.True(t, errors.As(err, &violation))
+	assert.Equal(t, RuleTenantQuota, violation.Rule)
+	assert.ErrorIs(t, err, ErrPolicyViolation)
+
+	// A batch is counted as a whole, and refused as a whole
+	err = service.CreateUsers([]*repository.User{tenantUser("e", "acme"), tenantUser("f", "acme")})
+	assert.ErrorIs(t, err, ErrPolicyViolation)
+	count, err := repo.CountUsersWhere(repository.And())
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.NoError(t, service.CreateUsers([]*repository.User{tenantUser("e", "acme")}))
+
+	// Moving to a full tenant is refused, but staying in one isn't
+	c, err := repo.FindUserByID(3)
+	require.NoError(t, err)
+	c.Metadata = repository.Metadata{"tenant": "globex"}
+	assert.ErrorIs(t, service.UpdateUser(c), ErrPolicyViolation)
+	b, err := repo.FindUserByID(2)
+	require.NoError(t, err)
+	b.Name = "Bee"
+	assert.NoError(t, service.UpdateUser(b))
+}
+
+func TestEmailPolicies(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	service := &UserService{Repo: repo, Policies: UserPolicies{
+		ReservedDomains: []string{"acme.com"},
+		BlockedDomains:  []string{"mailinator.com"},
+		UniqueEmails:    true,
+	}}
+
+	cases := []struct {
+		email string
+		want  Rule
+	}{
+		{"jane@acme.com", RuleReservedDomain},
+		{"jane@EU.Acme.com", RuleReservedDomain},
+		{"jane@mailinator.com", RuleBlockedDomain},
+		{"jane@notmailinator.com", ""},
+		{"jane.doe@example.com", ""},
+		{" Jane.Doe@Example.com ", RuleUniqueEmail},
+	}
+	for _, c := range cases {
+		err := service.CreateUser(&repository.User{Name: "Jane Doe", Email: c.email})
+		if c.want == "" {
+			assert.NoError(t, err, c.email)
+			continue
+		}
+		var violation *PolicyViolation
+		if assert.True(t, errors.As(err, &violation), c.email) {
+			assert.Equal(t, c.want, violation.Rule, c.email)
+		}
+	}
+
+	// Nor can a user take another's email, or a blocked one, by updating
+	john := &repository.User{Name: "John Doe", Email: "john.doe@example.com"}
+	require.NoError(t, service.CreateUser(john))
+	for _, email := range []string{"jane.doe@example.com", "john@mailinator.com"} {
+		john.Email = email
+		assert.ErrorIs(t, service.UpdateUser(john), ErrPolicyViolation, email)
+	}
+	john.Email = "john.doe@example.com"
+	assert.NoError(t, service.UpdateUser(john), "keeping their own")
+
+	// A user saved at a domain before it was reserved can still be renamed
+	staff := &repository.User{Name: "Staff", Email: "staff@acme.com"}
+	require.NoError(t, repo.SaveUser(staff))
+	staff.Name = "Staff Member"
+	assert.NoError(t, service.UpdateUser(staff))
+
+	err := service.CreateUsers([]*repository.User{
+		{Name: "A", Email: "same@example.org"},
+		{Name: "B", Email: "SAME@example.org"},
+	})
+	assert.ErrorIs(t, err, ErrPolicyViolation)
+}
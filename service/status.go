@@ -0,0 +1,80 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+
+	"gorepository/audit"
+	"gorepository/events"
+	"gorepository/repository"
+)
+
+// ErrInvalidTransition is returned when a user's status can't be changed
+// to the one asked for from the one they have, such as suspending a
+// deactivated account.
+var ErrInvalidTransition = errors.New("invalid status transition")
+
+// transitions lists the statuses each status can be changed from.
+// Deactivation is final, so nothing leaves StatusDeactivated.
+var transitions = map[repository.Status][]repository.Status{
+	repository.StatusActive:      {repository.StatusPending, repository.StatusSuspended},
+	repository.StatusSuspended:   {repository.StatusPending, repository.StatusActive},
+	repository.StatusDeactivated: {repository.StatusPending, repository.StatusActive, repository.StatusSuspended},
+}
+
+// CanTransition reports whether a user's status may be changed from one
+// status to another.
+func CanTransition(from, to repository.Status) bool {
+	for _, allowed := range transitions[to] {
+		if allowed == from {
+			return true
+		}
+	}
+	return false
+}
+
+// ActivateUser activates a pending or suspended user. The action is
+// audited and a UserActivated event is emitted.
+func (s *UserService) ActivateUser(id int) error {
+	return s.transition(id, repository.StatusActive, audit.ActionActivate, events.UserActivated)
+}
+
+// SuspendUser suspends a pending or active user until they are activated
+// again. The action is audited and a UserSuspended event is emitted.
+func (s *UserService) SuspendUser(id int) error {
+	return s.transition(id, repository.StatusSuspended, audit.ActionSuspend, events.UserSuspended)
+}
+
+// DeactivateUser closes a user's account for good; it can't be activated
+// again. The action is audited and a UserDeactivated event is emitted.
+func (s *UserService) DeactivateUser(id int) error {
+	return s.transition(id, repository.StatusDeactivated, audit.ActionDeactivate, events.UserDeactivated)
+}
+
+// GetUsersByStatus retrieves a page of the users with the given status, in
+// ID order.
+func (s *UserService) GetUsersByStatus(status repository.Status, cursor string, size int, opts ...repository.FindOption) (repository.Page[*repository.User], error) {
+	return repository.Paginate(s.Repo, repository.HasStatus(status), cursor, size, opts...)
+}
+
+// transition changes a user's status to to, if the rules allow it from
+// the status they have now. The change is made from that status, so a
+// concurrent change makes it fail with repository.ErrStatusChanged rather
+// than skip the rules.
+func (s *UserService) transition(id int, to repository.Status, action, eventType string) error {
+	user, err := s.Repo.FindUserByID(id, repository.Fields("status"))
+	if err != nil {
+		return err
+	}
+	from := user.Status
+	if from == "" {
+		from = repository.StatusActive
+	}
+	if !CanTransition(from, to) {
+		return fmt.Errorf("%w: user %d is %s, so can't become %s", ErrInvalidTransition, id, from, to)
+	}
+	if err := s.Repo.SetUserStatus(id, from, to); err != nil {
+		return err
+	}
+	return s.audited(id, action, eventType)
+}
@@ -1,18 +1,341 @@
 package service
 
-import "gorepository/repository"
+import (
+    "context"
+    "fmt"
+    "gorepository/audit"
+    "gorepository/events"
+    "gorepository/features"
+    "gorepository/repository"
+    "slices"
+    "time"
+)
+
+// deleteBatchSize is how many users DeleteUsersWhere deletes at a time when
+// it has to audit them.
+const deleteBatchSize = 500
+
+// exportBatchSize is how many users ExportUsers reads at a time.
+const exportBatchSize = 1000
 
 // UserService handles user-related operations.
 type UserService struct {
     Repo repository.UserRepository
+
+    // Events, when set, receives an event for each change made.
+    Events events.Publisher
+    // Audit, when set, records sensitive actions such as anonymization.
+    Audit audit.Recorder
+    // PhoneCountryCode is the calling code, such as "44", assumed for
+    // phone numbers given without one. See NormalizePhone.
+    PhoneCountryCode string
+    // Policies are the quotas and email rules new users are held to; see
+    // UserPolicies.
+    Policies UserPolicies
+
+    // Flags, when set, switches on behaviours still being rolled out; see
+    // the features package.
+    Flags features.Provider
+}
+
+// WithContext returns the service to use while handling the request ctx
+// belongs to. If ctx carries a repository.IdentityMap, the copy it returns
+// finds users by ID through it, so each user is read at most once per
+// request; otherwise it returns s.
+func (s *UserService) WithContext(ctx context.Context) *UserService {
+    m := repository.IdentityMapFrom(ctx)
+    if m == nil {
+        return s
+    }
+    scoped := *s
+    scoped.Repo = repository.NewIdentityMapUserRepository(s.Repo, m)
+    return &scoped
 }
 
 // GetUser retrieves a user by ID.
-func (s *UserService) GetUser(id int) (*repository.User, error) {
-    return s.Repo.FindUserByID(id)
+func (s *UserService) GetUser(id int, opts ...repository.FindOption) (*repository.User, error) {
+    return s.Repo.FindUserByID(id, opts...)
+}
+
+// GetUserByEmail retrieves a user by email address.
+func (s *UserService) GetUserByEmail(email string, opts ...repository.FindOption) (*repository.User, error) {
+    return s.Repo.FindUserByEmail(email, opts...)
+}
+
+// GetUserByPhone retrieves a user by phone number, given in any form
+// NormalizePhone accepts.
+func (s *UserService) GetUserByPhone(phone string, opts ...repository.FindOption) (*repository.User, error) {
+    normalized, err := NormalizePhone(phone, s.PhoneCountryCode)
+    if err != nil {
+        return nil, err
+    }
+    return s.Repo.FindUserByPhone(normalized, opts...)
+}
+
+// ListUsers retrieves a page of users in ID order, starting from cursor, or
+// from the first user if cursor is empty.
+func (s *UserService) ListUsers(cursor string, size int, opts ...repository.FindOption) (repository.Page[*repository.User], error) {
+    return repository.Paginate(s.Repo, repository.And(), cursor, size, opts...)
+}
+
+// GetUsersByMetadata retrieves a page of the users whose metadata has key
+// set to value, in ID order.
+func (s *UserService) GetUsersByMetadata(key string, value any, cursor string, size int, opts ...repository.FindOption) (repository.Page[*repository.User], error) {
+    return repository.Paginate(s.Repo, repository.HasMetadata(key, value), cursor, size, opts...)
+}
+
+// GetUsers retrieves many users by ID in one lookup, keyed by ID. Unknown
+// IDs are left out.
+func (s *UserService) GetUsers(ids []int, opts ...repository.FindOption) (map[int]*repository.User, error) {
+    return s.Repo.FindUsersByIDs(ids, opts...)
+}
+
+// ExportUsers calls fn with every user after cursor, or every user if it is
+// empty, in ID order. They are read a batch at a time, so any number can be
+// exported. To resume an export that was cut short, pass
+// repository.CursorAfter the last user fn was given.
+func (s *UserService) ExportUsers(cursor string, fn func(*repository.User) error, opts ...repository.FindOption) error {
+    afterID, err := repository.ParseCursorAfter(cursor)
+    if err != nil {
+        return err
+    }
+    return repository.EachUser(s.Repo, repository.And(), afterID, exportBatchSize, fn, opts...)
+}
+
+// SearchUsers retrieves users whose name starts with prefix, ordered by
+// name. Only the best matches are returned, as a single page. With the
+// features.FuzzySearch flag on, it searches as SuggestUsers does instead,
+// so a prefix with a typo still finds them.
+func (s *UserService) SearchUsers(prefix string, opts ...repository.FindOption) (repository.Page[*repository.User], error) {
+    if features.Enabled(s.Flags, features.FuzzySearch) {
+        return s.SuggestUsers(prefix, opts...)
+    }
+    users, err := s.Repo.FindUsersByNamePrefix(prefix, opts...)
+    return repository.NewPage(users), err
+}
+
+// SuggestUsers retrieves users whose name is close to q, closest first, as
+// a single page.
+func (s *UserService) SuggestUsers(q string, opts ...repository.FindOption) (repository.Page[*repository.User], error) {
+    users, err := s.Repo.SuggestUsers(q, opts...)
+    return repository.NewPage(users), err
+}
+
+// GetUserHistory retrieves a user's past versions, oldest first, as a
+// single page.
+func (s *UserService) GetUserHistory(id int) (repository.Page[repository.UserVersion], error) {
+    versions, err := s.Repo.FindUserHistory(id)
+    return repository.NewPage(versions), err
+}
+
+// GetUserAsOf retrieves a user as they were at a point in time.
+func (s *UserService) GetUserAsOf(id int, at time.Time) (*repository.User, error) {
+    return s.Repo.FindUserAsOf(id, at)
 }
 
-// CreateUser saves a new user to the repository.
+// ValidateUser checks a new user against the rules CreateUser applies,
+// without saving them, and normalizes them as it would: their phone
+// number, if any, is put in E.164 form. It returns ErrInvalidPhone,
+// repository.ErrInvalidMetadata or a PolicyViolation for an email domain
+// the service's Policies refuse. Quotas and uniqueness depend on the
+// users saved with them, so only CreateUser and CreateUsers check those.
+func (s *UserService) ValidateUser(user *repository.User) error {
+    if err := s.normalizePhone(user); err != nil {
+        return err
+    }
+    if err := s.Policies.checkEmail(user.Email); err != nil {
+        return err
+    }
+    _, err := user.Metadata.Value()
+    return err
+}
+
+// CreateUser saves a new user to the repository, with their phone number,
+// if any, in E.164 form, and emits a UserCreated event. It returns a
+// PolicyViolation for a user the service's Policies refuse.
 func (s *UserService) CreateUser(user *repository.User) error {
-    return s.Repo.SaveUser(user)
+    if err := s.ValidateUser(user); err != nil {
+        return err
+    }
+    if err := s.enforcePolicies([]*repository.User{user}); err != nil {
+        return err
+    }
+    if err := s.Repo.SaveUser(user); err != nil {
+        return err
+    }
+    s.publish(events.Event{Type: events.UserCreated, UserID: user.ID, At: time.Now()})
+    return nil
+}
+
+// CreateUsers saves many new users to the repository in one go, and emits
+// a UserCreated event for each. If any is invalid, or refused by the
+// service's Policies, none of them are saved.
+func (s *UserService) CreateUsers(users []*repository.User) error {
+    for _, user := range users {
+        if err := s.ValidateUser(user); err != nil {
+            return err
+        }
+    }
+    if err := s.enforcePolicies(users); err != nil {
+        return err
+    }
+    if err := s.Repo.SaveUsers(users); err != nil {
+        return err
+    }
+    now := time.Now()
+    for _, user := range users {
+        s.publish(events.Event{Type: events.UserCreated, UserID: user.ID, At: now})
+    }
+    return nil
+}
+
+// UpdateUser saves changes to an existing user and emits a UserUpdated
+// event. The previous version is kept in the user's history. The service's
+// Policies only apply to what changed: a new email is held to them as a
+// new user's would be, so a user whose domain has since been reserved can
+// still change their name, and a user moving to another tenant counts
+// against its quota.
+func (s *UserService) UpdateUser(user *repository.User) error {
+    if err := s.normalizePhone(user); err != nil {
+        return err
+    }
+    if err := s.checkUpdate(user); err != nil {
+        return err
+    }
+    if err := s.Repo.UpdateUser(user); err != nil {
+        return err
+    }
+    s.publish(events.Event{Type: events.UserUpdated, UserID: user.ID, At: time.Now()})
+    return nil
+}
+
+// RecordLogin notes that a user has just logged in, for activity tracking,
+// and emits a UserLoggedIn event. It isn't audited, being routine.
+func (s *UserService) RecordLogin(id int) error {
+    if err := s.Repo.RecordLogin(id); err != nil {
+        return err
+    }
+    s.publish(events.Event{Type: events.UserLoggedIn, UserID: id, At: time.Now()})
+    return nil
+}
+
+// RollbackUser puts a user back the way they were at a point in time,
+// undoing every change since, and returns the restored user. The rollback
+// is itself an update, so it can be undone in turn; it is audited and
+// emits a UserUpdated event. Deleted users can't be rolled back, and
+// anonymization can't be undone since it scrubs the history too.
+func (s *UserService) RollbackUser(id int, at time.Time) (*repository.User, error) {
+    version, err := s.Repo.FindUserAsOf(id, at)
+    if err != nil {
+        return nil, err
+    }
+    if err := s.Repo.UpdateUser(version); err != nil {
+        return nil, err
+    }
+    return version, s.audited(id, audit.ActionRollback, events.UserUpdated)
+}
+
+// AnonymizeUser irreversibly scrubs a user's personal data, for requests to
+// be forgotten. The user's ID survives so that anything referring to it
+// still resolves. The action is audited and a UserAnonymized event is
+// emitted once the data is gone.
+func (s *UserService) AnonymizeUser(id int) error {
+    if err := s.Repo.AnonymizeUser(id); err != nil {
+        return err
+    }
+    return s.audited(id, audit.ActionAnonymize, events.UserAnonymized)
+}
+
+// DeleteUser removes a user, who can be brought back with RestoreUser
+// until they are purged. The action is audited and a UserDeleted event is
+// emitted.
+func (s *UserService) DeleteUser(id int) error {
+    if err := s.Repo.DeleteUser(id); err != nil {
+        return err
+    }
+    return s.audited(id, audit.ActionDelete, events.UserDeleted)
+}
+
+// RestoreUser brings back a deleted user, with the same ID, and returns
+// them. The action is audited and a UserRestored event is emitted.
+func (s *UserService) RestoreUser(id int) (*repository.User, error) {
+    user, err := s.Repo.RestoreUser(id)
+    if err != nil {
+        return nil, err
+    }
+    return user, s.audited(id, audit.ActionRestore, events.UserRestored)
+}
+
+// PurgeUser permanently removes a user, deleted or not, along with their
+// history, so nothing about them can be restored. The action is audited
+// and a UserPurged event is emitted.
+func (s *UserService) PurgeUser(id int) error {
+    if err := s.Repo.PurgeUser(id); err != nil {
+        return err
+    }
+    return s.audited(id, audit.ActionPurge, events.UserPurged)
+}
+
+// DeleteUsersWhere deletes every user matching spec and returns how many
+// were deleted. A spec with no criteria is refused with
+// repository.ErrEmptySpecification.
+//
+// When audit or events are configured, the matching IDs are read first and
+// deleted in batches, and each user a batch actually deleted is audited and
+// announced individually.
+func (s *UserService) DeleteUsersWhere(spec repository.Specification) (int64, error) {
+    if repository.IsEmpty(spec) {
+        return 0, repository.ErrEmptySpecification
+    }
+    if s.Audit == nil && s.Events == nil {
+        return s.Repo.DeleteUsersWhere(spec)
+    }
+
+    var deleted int64
+    for afterID := 0; ; {
+        page, err := s.Repo.FindUsersWhere(spec, afterID, deleteBatchSize, repository.Fields("id"))
+        if err != nil || len(page) == 0 {
+            return deleted, err
+        }
+        ids := make([]int, len(page))
+        for i, user := range page {
+            ids[i] = user.ID
+        }
+        afterID = ids[len(ids)-1]
+
+        // Re-check spec in case a user changed since the page was read, and
+        // audit only the users this delete removed
+        removed, err := s.Repo.DeleteUsersWhereReturningIDs(repository.And(repository.IDIn(ids...), spec))
+        deleted += int64(len(removed))
+        if err != nil {
+            return deleted, err
+        }
+        slices.Sort(removed)
+        for _, id := range removed {
+            if err := s.audited(id, audit.ActionDelete, events.UserDeleted); err != nil {
+                return deleted, err
+            }
+        }
+    }
+}
+
+// audited records an action that has already been carried out on a user,
+// then announces it. The action can't be undone, so a failure to audit is
+// reported but doesn't stop the event.
+func (s *UserService) audited(id int, action, eventType string) error {
+    now := time.Now()
+    var err error
+    if s.Audit != nil {
+        if auditErr := s.Audit.Record(audit.Entry{At: now, Action: action, UserID: id}); auditErr != nil {
+            err = fmt.Errorf("user %d: %s done but not audited: %w", id, action, auditErr)
+        }
+    }
+    s.publish(events.Event{Type: eventType, UserID: id, At: now})
+    return err
+}
+
+func (s *UserService) publish(event events.Event) {
+    if s.Events != nil {
+        s.Events.Publish(event)
+    }
 }
@@ -1,8 +1,14 @@
 package service
 
 import (
+	"context"
+	"errors"
+	"gorepository/audit"
+	"gorepository/events"
 	"gorepository/repository" // Adjust the import path as needed
+	"gorepository/repository/mocks"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -48,3 +54,287 @@ func TestCreateUser(t *testing.T) {
     assert.NotNil(t, savedUser)
     assert.Equal(t, "Jane Doe", savedUser.Name)
 }
+
+func TestRepositoryCalls(t *testing.T) {
+    // Setup mock repository
+    mockRepo := &repository.MockUserRepository{
+        Users: map[int]*repository.User{
+            1: {ID: 1, Name: "John Doe", Email: "john.doe@example.com"},
+        },
+    }
+
+    service := &UserService{Repo: mockRepo}
+
+    // Verify that each lookup went to the repository
+    service.GetUser(1)
+    service.GetUser(2)
+    assert.Equal(t, 2, mockRepo.CallCount("FindUserByID"))
+    mockRepo.AssertCalled(t, "FindUserByID", 2)
+
+    // Verify that a new user is handed to the repository as given
+    err := service.CreateUser(&repository.User{ID: 2, Name: "Jane Doe", Email: "jane.doe@example.com"})
+    assert.NoError(t, err)
+    mockRepo.AssertCalled(t, "SaveUser", &repository.User{ID: 2, Name: "Jane Doe", Email: "jane.doe@example.com"})
+}
+
+func TestCreateUserError(t *testing.T) {
+    // Setup mock repository that fails to save
+    mockRepo := mocks.NewUserRepo().
+        FailingOn("SaveUser", errors.New("database is down")).
+        Build()
+
+    service := &UserService{Repo: mockRepo}
+
+    // Test that the repository error is returned
+    err := service.CreateUser(&repository.User{Name: "Jane Doe", Email: "jane.doe@example.com"})
+    assert.Error(t, err)
+}
+
+func TestAnonymizeUser(t *testing.T) {
+    // Setup mock repository, audit log and event bus
+    mockRepo := mocks.NewUserRepo().
+        WithUser(&repository.User{ID: 1, Name: "John Doe", Email: "john.doe@example.com"}).
+        Build()
+    recorder := &audit.MemoryRecorder{}
+    bus := events.NewBus()
+    var published []events.Event
+    bus.Subscribe(func(e events.Event) { published = append(published, e) })
+
+    service := &UserService{Repo: mockRepo, Audit: recorder, Events: bus}
+
+    // Test anonymizing an existing user
+    err := service.AnonymizeUser(1)
+    assert.NoError(t, err)
+
+    user, err := service.GetUser(1)
+    assert.NoError(t, err)
+    assert.Equal(t, "Anonymized User", user.Name)
+    assert.Equal(t, "anonymized-1@invalid", user.Email)
+
+    // Verify the action was audited and announced
+    assert.Len(t, recorder.Entries(), 1)
+    assert.Equal(t, audit.ActionAnonymize, recorder.Entries()[0].Action)
+    assert.Len(t, published, 1)
+    assert.Equal(t, events.UserAnonymized, published[0].Type)
+
+    // Test anonymizing a non-existing user does neither
+    err = service.AnonymizeUser(2)
+    assert.ErrorIs(t, err, repository.ErrUserNotFound)
+    assert.Len(t, recorder.Entries(), 1)
+    assert.Len(t, published, 1)
+}
+
+func TestDeleteUser(t *testing.T) {
+    // Setup mock repository and audit log
+    mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1, Name: "John Doe"}).Build()
+    recorder := &audit.MemoryRecorder{}
+
+    service := &UserService{Repo: mockRepo, Audit: recorder}
+
+    // Test deleting an existing user
+    err := service.DeleteUser(1)
+    assert.NoError(t, err)
+
+    _, err = service.GetUser(1)
+    assert.ErrorIs(t, err, repository.ErrUserNotFound)
+    assert.Len(t, recorder.Entries(), 1)
+    assert.Equal(t, audit.ActionDelete, recorder.Entries()[0].Action)
+}
+
+func TestRollbackUser(t *testing.T) {
+    // Setup mock repository, audit log and event bus
+    mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1, Name: "John Doe", Email: "john.doe@example.com"}).Build()
+    recorder := &audit.MemoryRecorder{}
+    bus := events.NewBus()
+    var published []events.Event
+    bus.Subscribe(func(e events.Event) { published = append(published, e) })
+
+    service := &UserService{Repo: mockRepo, Audit: recorder, Events: bus}
+
+    // Test undoing an update
+    before := time.Now()
+    err := service.UpdateUser(&repository.User{ID: 1, Name: "John Smith", Email: "john.smith@example.com"})
+    assert.NoError(t, err)
+
+    restored, err := service.RollbackUser(1, before)
+    assert.NoError(t, err)
+    assert.Equal(t, "John Doe", restored.Name)
+
+    user, err := service.GetUser(1)
+    assert.NoError(t, err)
+    assert.Equal(t, "john.doe@example.com", user.Email)
+    assert.Len(t, recorder.Entries(), 1)
+    assert.Equal(t, audit.ActionRollback, recorder.Entries()[0].Action)
+    assert.Len(t, published, 2)
+
+    // Both changes are in the history
+    history, err := service.GetUserHistory(1)
+    assert.NoError(t, err)
+    assert.Len(t, history.Items, 2)
+    assert.Equal(t, int64(2), history.Total)
+
+    // Test rolling back to before the user existed
+    _, err = service.RollbackUser(2, before)
+    assert.ErrorIs(t, err, repository.ErrUserNotFound)
+}
+
+func TestRestoreAndPurgeUser(t *testing.T) {
+    // Setup mock repository, audit log and event bus
+    mockRepo := mocks.NewUserRepo().WithUser(&repository.User{ID: 1, Name: "John Doe"}).Build()
+    recorder := &audit.MemoryRecorder{}
+    bus := events.NewBus()
+    var published []string
+    bus.Subscribe(func(e events.Event) { published = append(published, e.Type) })
+
+    service := &UserService{Repo: mockRepo, Audit: recorder, Events: bus}
+
+    // Test restoring a deleted user
+    assert.NoError(t, service.DeleteUser(1))
+    restored, err := service.RestoreUser(1)
+    assert.NoError(t, err)
+    assert.Equal(t, "John Doe", restored.Name)
+
+    // Test purging them for good
+    assert.NoError(t, service.PurgeUser(1))
+    _, err = service.RestoreUser(1)
+    assert.ErrorIs(t, err, repository.ErrUserNotFound)
+
+    assert.Equal(t, []string{events.UserDeleted, events.UserRestored, events.UserPurged}, published)
+    assert.Len(t, recorder.Entries(), 3)
+    assert.Equal(t, audit.ActionPurge, recorder.Entries()[2].Action)
+}
+
+func TestGetUsers(t *testing.T) {
+    // Setup mock repository
+    mockRepo := mocks.NewUserRepo().
+        WithUser(&repository.User{ID: 1, Name: "John Doe"}).
+        WithUser(&repository.User{ID: 2, Name: "Jane Doe"}).
+        Build()
+
+    service := &UserService{Repo: mockRepo}
+
+    // Test resolving many users in a single lookup
+    users, err := service.GetUsers([]int{1, 2, 3})
+    assert.NoError(t, err)
+    assert.Len(t, users, 2)
+    assert.Equal(t, "Jane Doe", users[2].Name)
+    assert.Equal(t, 1, mockRepo.CallCount("FindUsersByIDs"))
+}
+
+func TestDeleteUsersWhere(t *testing.T) {
+    // Setup mock repository and audit log
+    mockRepo := mocks.NewUserRepo().
+        WithUser(&repository.User{ID: 1, Email: "a@example.test"}).
+        WithUser(&repository.User{ID: 2, Email: "b@example.com"}).
+        WithUser(&repository.User{ID: 3, Email: "c@example.test"}).
+        Build()
+    recorder := &audit.MemoryRecorder{}
+
+    service := &UserService{Repo: mockRepo, Audit: recorder}
+
+    // Test that an empty specification is refused
+    _, err := service.DeleteUsersWhere(repository.And())
+    assert.ErrorIs(t, err, repository.ErrEmptySpecification)
+    assert.False(t, mockRepo.Called("DeleteUsersWhere"))
+
+    // Test deleting by domain audits each deleted user
+    deleted, err := service.DeleteUsersWhere(repository.EmailDomain("example.test"))
+    assert.NoError(t, err)
+    assert.Equal(t, int64(2), deleted)
+    assert.Len(t, mockRepo.Users, 1)
+    assert.Len(t, recorder.Entries(), 2)
+    assert.Equal(t, 3, recorder.Entries()[1].UserID)
+}
+
+// racingRepository deletes a user as soon as a page of users has been
+// read, as another process might between the read and the delete.
+type racingRepository struct {
+    repository.UserRepository
+    id int
+}
+
+func (r racingRepository) FindUsersWhere(spec repository.Specification, afterID, limit int, opts ...repository.FindOption) ([]*repository.User, error) {
+    users, err := r.UserRepository.FindUsersWhere(spec, afterID, limit, opts...)
+    if err == nil && len(users) > 0 {
+        _ = r.UserRepository.DeleteUser(r.id)
+    }
+    return users, err
+}
+
+func TestDeleteUsersWhereAuditsOnlyItsDeletes(t *testing.T) {
+    // Setup a repository where user 3 is deleted by someone else midway
+    repo := repository.NewMemoryUserRepository()
+    for _, email := range []string{"a@example.test", "b@example.com", "c@example.test"} {
+        assert.NoError(t, repo.SaveUser(&repository.User{Email: email}))
+    }
+    recorder := &audit.MemoryRecorder{}
+
+    service := &UserService{Repo: racingRepository{UserRepository: repo, id: 3}, Audit: recorder}
+
+    // Test that only the user this call deleted is audited
+    deleted, err := service.DeleteUsersWhere(repository.EmailDomain("example.test"))
+    assert.NoError(t, err)
+    assert.Equal(t, int64(1), deleted)
+    assert.Len(t, recorder.Entries(), 1)
+    assert.Equal(t, 1, recorder.Entries()[0].UserID)
+}
+
+func TestUserStatusLifecycle(t *testing.T) {
+    // Setup mock repository, audit log and event bus
+    mockRepo := mocks.NewUserRepo().
+        WithUser(&repository.User{ID: 1, Name: "John Doe", Status: repository.StatusPending}).
+        Build()
+    recorder := &audit.MemoryRecorder{}
+    bus := events.NewBus()
+    var published []string
+    bus.Subscribe(func(e events.Event) { published = append(published, e.Type) })
+
+    service := &UserService{Repo: mockRepo, Audit: recorder, Events: bus}
+
+    // Test moving through the lifecycle
+    assert.NoError(t, service.ActivateUser(1))
+    assert.NoError(t, service.SuspendUser(1))
+    assert.NoError(t, service.ActivateUser(1))
+    assert.NoError(t, service.DeactivateUser(1))
+
+    user, err := service.GetUser(1)
+    assert.NoError(t, err)
+    assert.Equal(t, repository.StatusDeactivated, user.Status)
+    assert.Equal(t, []string{events.UserActivated, events.UserSuspended, events.UserActivated, events.UserDeactivated}, published)
+    assert.Len(t, recorder.Entries(), 4)
+    mockRepo.AssertCalled(t, "SetUserStatus", 1, repository.StatusSuspended, repository.StatusActive)
+
+    // Test that deactivation is final, and refused changes aren't announced
+    assert.ErrorIs(t, service.ActivateUser(1), ErrInvalidTransition)
+    assert.ErrorIs(t, service.SuspendUser(1), ErrInvalidTransition)
+    assert.ErrorIs(t, service.DeactivateUser(1), ErrInvalidTransition)
+    assert.Len(t, published, 4)
+
+    assert.ErrorIs(t, service.SuspendUser(2), repository.ErrUserNotFound)
+}
+
+func TestCanTransition(t *testing.T) {
+    assert.True(t, CanTransition(repository.StatusPending, repository.StatusActive))
+    assert.True(t, CanTransition(repository.StatusActive, repository.StatusSuspended))
+    assert.False(t, CanTransition(repository.StatusActive, repository.StatusActive))
+    assert.False(t, CanTransition(repository.StatusSuspended, repository.StatusPending))
+    assert.False(t, CanTransition(repository.StatusDeactivated, repository.StatusActive))
+}
+
+func TestWithContext(t *testing.T) {
+    mockRepo := mocks.NewUserRepo().
+        WithUser(&repository.User{ID: 1, Name: "John Doe"}).
+        Build()
+    service := &UserService{Repo: mockRepo}
+
+    // Without an identity map every lookup goes to the repository
+    assert.Same(t, service, service.WithContext(context.Background()))
+
+    // With one, a request reads each user once
+    scoped := service.WithContext(repository.WithIdentityMap(context.Background()))
+    for range 3 {
+        _, err := scoped.GetUser(1)
+        assert.NoError(t, err)
+    }
+    assert.Equal(t, 1, mockRepo.CallCount("FindUserByID"))
+}
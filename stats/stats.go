@@ -0,0 +1,144 @@
+// Package stats reports aggregates over users, such as signups per day,
+// active users and users per email domain, for lightweight reporting
+// without a separate BI stack.
+//
+// The aggregates are computed by repository.AggregateUsers, with GROUP BY
+// queries where the backend supports them. A Reporter keeps the last
+// report, like a materialized view, and computes it again only once it is
+// older than MaxAge or is refreshed, so frequent requests don't each scan
+// the users table.
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"gorepository/repository"
+)
+
+// Defaults a Reporter falls back to for settings left unset.
+const (
+	DefaultDays         = 30
+	DefaultActiveWithin = 30 * 24 * time.Hour
+	DefaultMaxAge       = 5 * time.Minute
+)
+
+// Report is repository.UserStats as of ComputedAt, with the window they
+// cover.
+type Report struct {
+	repository.UserStats
+	// Days is how many days, today included, SignupsPerDay covers.
+	Days int `json:"days"`
+	// ActiveSince is when a user must have last logged in by to count as
+	// active.
+	ActiveSince time.Time `json:"active_since"`
+	ComputedAt  time.Time `json:"computed_at"`
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Users: %d\n", r.Total)
+	fmt.Fprintf(&b, "Active since %s: %d\n", r.ActiveSince.Format(time.DateOnly), r.Active)
+	fmt.Fprintf(&b, "Signups in the last %d days:\n", r.Days)
+	for _, day := range r.SignupsPerDay {
+		fmt.Fprintf(&b, "  %s  %d\n", day.Day, day.Users)
+	}
+	b.WriteString("Top email domains:\n")
+	for _, domain := range r.TopDomains {
+		fmt.Fprintf(&b, "  %-30s  %d\n", domain.Domain, domain.Users)
+	}
+	return b.String()
+}
+
+// Reporter computes Reports over Repo and keeps the latest. It is safe
+// for concurrent use; while a report is being computed, other callers
+// wait for it rather than compute their own.
+type Reporter struct {
+	Repo repository.UserRepository
+	// Days is how many days of signups to report; DefaultDays if unset.
+	Days int
+	// ActiveWithin is how recently users must have logged in to count as
+	// active; DefaultActiveWithin if unset.
+	ActiveWithin time.Duration
+	// TopDomains is how many email domains to report; see
+	// repository.DefaultTopDomains.
+	TopDomains int
+	// MaxAge is how long a report is served before it is computed again;
+	// DefaultMaxAge if unset, or never reused if negative.
+	MaxAge time.Duration
+
+	// now is time.Now, replaced in tests.
+	now func() time.Time
+
+	mu   sync.Mutex
+	last *Report
+}
+
+// NewReporter returns a Reporter over repo with the default settings.
+func NewReporter(repo repository.UserRepository) *Reporter {
+	return &Reporter{Repo: repo}
+}
+
+// Users returns the latest report, computing a new one if it is older
+// than MaxAge.
+func (r *Reporter) Users() (*Report, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last != nil && r.maxAge() >= 0 && r.clock().Sub(r.last.ComputedAt) < r.maxAge() {
+		return r.last, nil
+	}
+	return r.refresh()
+}
+
+// Refresh computes a new report, however old the latest is, and returns
+// it.
+func (r *Reporter) Refresh() (*Report, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refresh()
+}
+
+func (r *Reporter) refresh() (*Report, error) {
+	now := r.clock()
+	days := r.Days
+	if days <= 0 {
+		days = DefaultDays
+	}
+	activeWithin := r.ActiveWithin
+	if activeWithin <= 0 {
+		activeWithin = DefaultActiveWithin
+	}
+
+	report := &Report{
+		Days:        days,
+		ActiveSince: now.Add(-activeWithin),
+		ComputedAt:  now,
+	}
+	stats, err := repository.AggregateUsers(r.Repo, repository.StatsQuery{
+		SignupsSince: now.UTC().AddDate(0, 0, 1-days),
+		ActiveSince:  report.ActiveSince,
+		TopDomains:   r.TopDomains,
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.UserStats = *stats
+	r.last = report
+	return report, nil
+}
+
+func (r *Reporter) maxAge() time.Duration {
+	if r.MaxAge == 0 {
+		return DefaultMaxAge
+	}
+	return r.MaxAge
+}
+
+func (r *Reporter) clock() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
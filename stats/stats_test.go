@@ -0,0 +1,50 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"gorepository/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReporter(t *testing.T) {
+	repo := repository.NewMemoryUserRepository()
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	for i, email := range []string{"a@acme.com", "b@acme.com", "c@globex.com"} {
+		// Signed up on the 1st, the 9th and the 10th
+		createdAt := now.AddDate(0, 0, []int{-9, -1, 0}[i])
+		require.NoError(t, repo.SaveUser(&repository.User{Name: email, Email: email, CreatedAt: createdAt}))
+	}
+
+	reporter := NewReporter(repo)
+	reporter.Days = 7
+	reporter.now = func() time.Time { return now }
+
+	report, err := reporter.Users()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), report.Total)
+	assert.Equal(t, []repository.DayCount{{Day: "2024-05-09", Users: 1}, {Day: "2024-05-10", Users: 1}}, report.SignupsPerDay)
+	assert.Equal(t, []repository.DomainCount{{Domain: "acme.com", Users: 2}, {Domain: "globex.com", Users: 1}}, report.TopDomains)
+	assert.Equal(t, now.Add(-DefaultActiveWithin), report.ActiveSince)
+
+	// The report is reused until it is MaxAge old, or refreshed
+	require.NoError(t, repo.SaveUser(&repository.User{Name: "d", Email: "d@initech.com", CreatedAt: now}))
+	now = now.Add(DefaultMaxAge - time.Second)
+	report, err = reporter.Users()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), report.Total)
+
+	report, err = reporter.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), report.Total)
+	assert.Equal(t, now, report.ComputedAt)
+
+	now = now.Add(DefaultMaxAge)
+	require.NoError(t, repo.DeleteUser(4))
+	report, err = reporter.Users()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), report.Total)
+}